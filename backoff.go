@@ -0,0 +1,70 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the delays between the attempts of an operation retried
+// after a failure, like the restart of a crashed discovery (see
+// Manager.SetRestartBackoff), the reconnection of a Client (see
+// WithReconnectBackoff) or the recovery of its "events" mode (see
+// Client.SetSyncRecoveryBackoff). The implementations must be safe for concurrent
+// use, since the same Backoff may be shared by many discoveries.
+type Backoff interface {
+	// Delay returns the delay to wait before the given attempt, counted
+	// from 1.
+	Delay(attempt int) time.Duration
+}
+
+// BackoffFunc is an adapter to use a function as a Backoff.
+type BackoffFunc func(attempt int) time.Duration
+
+// Delay calls f(attempt).
+func (f BackoffFunc) Delay(attempt int) time.Duration {
+	return f(attempt)
+}
+
+// ConstantBackoff returns a Backoff waiting the same delay before each
+// attempt. A zero delay retries immediately, that is useful in the tests.
+func ConstantBackoff(delay time.Duration) Backoff {
+	return BackoffFunc(func(int) time.Duration { return delay })
+}
+
+// ExponentialBackoff returns a Backoff waiting the initial delay before the
+// first attempt and doubling it for each of the following, up to maxDelay.
+// The jitter, between 0 and 1, is the fraction of each delay that is
+// randomized to avoid many discoveries retrying in lockstep: with a jitter
+// of 0.5 the delay is a random value between half and the whole computed
+// delay. A jitter of 0 gives the exact delays.
+func ExponentialBackoff(initial, maxDelay time.Duration, jitter float64) Backoff {
+	jitter = min(1, jitter)
+	return BackoffFunc(func(attempt int) time.Duration {
+		delay := initial
+		for i := 1; i < attempt && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		delay = min(delay, maxDelay)
+		if jitter > 0 && delay > 0 {
+			delay -= time.Duration(jitter * rand.Float64() * float64(delay))
+		}
+		return delay
+	})
+}
@@ -0,0 +1,54 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	constant := ConstantBackoff(time.Second)
+	require.Equal(t, time.Second, constant.Delay(1))
+	require.Equal(t, time.Second, constant.Delay(10))
+	require.Zero(t, ConstantBackoff(0).Delay(3))
+
+	exponential := ExponentialBackoff(100*time.Millisecond, time.Second, 0)
+	delays := []time.Duration{}
+	for attempt := 1; attempt <= 6; attempt++ {
+		delays = append(delays, exponential.Delay(attempt))
+	}
+	require.Equal(t, []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second,
+	}, delays)
+	require.Zero(t, ExponentialBackoff(0, time.Second, 0.5).Delay(5))
+
+	// The jittered delays stay between the given fraction and the whole delay
+	jittered := ExponentialBackoff(100*time.Millisecond, time.Second, 0.5)
+	for i := 0; i < 100; i++ {
+		delay := jittered.Delay(2)
+		require.GreaterOrEqual(t, delay, 100*time.Millisecond)
+		require.LessOrEqual(t, delay, 200*time.Millisecond)
+	}
+
+	custom := BackoffFunc(func(attempt int) time.Duration { return time.Duration(attempt) * time.Minute })
+	require.Equal(t, 3*time.Minute, custom.Delay(3))
+}
@@ -18,32 +18,92 @@
 package discovery
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/arduino/go-paths-helper"
 )
 
 // Client is a tool that detects communication ports to interact
 // with the boards.
 type Client struct {
-	id                   string
-	processArgs          []string
-	process              *paths.Process
-	outgoingCommandsPipe io.Writer
-	incomingMessagesChan <-chan *discoveryMessage
-	userAgent            string
-	logger               ClientLogger
+	id                    string
+	processArgs           []string
+	address               string
+	dialer                func() (io.ReadWriteCloser, error)
+	authToken             string
+	optionsErr            error
+	reconnectAttempts     int
+	reconnectDelay        time.Duration
+	reconnectBackoff      Backoff
+	processAttributes     ProcessAttributes
+	process               *discoveryProcess
+	userAgent             string
+	locale                string
+	clock                 Clock
+	logger                ClientLogger
+	tracer                ClientTracer
+	traceCtx              context.Context
+	metrics               Metrics
+	snapshotQuietPeriod   time.Duration
+	snapshotMaxWait       time.Duration
+	journal               *Journal
+	redactor              *Redactor
+	decodeRecovery        bool
+	unknownMessageHandler func(json.RawMessage)
+	violationHandler      func(Violation)
+	rawEventHandler       func(json.RawMessage)
+	stallTimeout          time.Duration
+	eventGuard            *eventGuard
+	strictState           bool
+	msgpackFraming        bool
+	pollingFallback       time.Duration
+	syncRecoveryAttempts  int
+	syncRecoveryDelay     time.Duration
+	syncRecoveryBackoff   Backoff
+	stats                 clientStats
+	listCache             listCache
+
+	// commandMutex serializes the commands sent to the discovery, see
+	// instrumentCommand.
+	commandMutex sync.Mutex
+
+	// sharedMutex serializes the acquisition and the release of the
+	// shared "events" mode, see AcquireSync.
+	sharedMutex sync.Mutex
+	shared      *sharedSync
 
 	// All the following fields are guarded by statusMutex
 	statusMutex           sync.Mutex
+	outgoingCommandsPipe  io.Writer
+	incomingMessagesChan  <-chan *message
+	conn                  io.ReadWriteCloser
+	reconnecting          bool
+	closing               bool
 	incomingMessagesError error
 	eventChan             chan<- *Event
+	dispatcher            *eventDispatcher
+	eventSeq              uint64
+	snapshot              *snapshotCollector
+	capabilities          []string
+	propertySchema        PropertySchema
+	enricher              *portEnricher
+	stallTimer            ClockTimer
+	stallDetected         bool
+	session               uint64
+	sessionDone           chan struct{}
+	processState          *os.ProcessState
+	recentMessages        messageTail
+	lastError             error
+	closed                bool
+	syncActive            bool
+	pollStop              chan struct{}
+	resyncing             bool
 }
 
 // ClientLogger is the interface that must be implemented by a logger
@@ -58,30 +118,16 @@ type nullClientLogger struct{}
 func (l *nullClientLogger) Debugf(format string, args ...interface{}) {}
 func (l *nullClientLogger) Errorf(format string, args ...interface{}) {}
 
-type discoveryMessage struct {
-	EventType       string  `json:"eventType"`
-	Message         string  `json:"message"`
-	Error           bool    `json:"error"`
-	ProtocolVersion int     `json:"protocolVersion"` // Used in HELLO command
-	Ports           []*Port `json:"ports"`           // Used in LIST command
-	Port            *Port   `json:"port"`            // Used in add and remove events
+func newCommandError(command string, msg *message) *CommandError {
+	return &CommandError{Command: command, Code: ErrorCode(msg.Code), Message: msg.Message}
 }
 
-func (msg discoveryMessage) String() string {
-	s := fmt.Sprintf("type: %s", msg.EventType)
-	if msg.Message != "" {
-		s += fmt.Sprintf(", message: %s", msg.Message)
-	}
-	if msg.ProtocolVersion != 0 {
-		s += fmt.Sprintf(", protocol version: %d", msg.ProtocolVersion)
-	}
-	if len(msg.Ports) > 0 {
-		s += fmt.Sprintf(", ports: %s", msg.Ports)
-	}
-	if msg.Port != nil {
-		s += fmt.Sprintf(", port: %s", msg.Port)
-	}
-	return s
+// redactMessage returns a copy of the message with the ports masked by the
+// Redactor of the Client, to be used in log messages.
+func (disc *Client) redactMessage(msg message) message {
+	msg.Port = disc.redactor.Redact(msg.Port)
+	msg.Ports = disc.redactor.RedactAll(msg.Ports)
+	return msg
 }
 
 // Event is a pluggable discovery event
@@ -89,6 +135,57 @@ type Event struct {
 	Type        string
 	Port        *Port
 	DiscoveryID string
+
+	// Ports is the list of ports reported by a "snapshot" event.
+	Ports []*Port
+
+	// Alternates are the ports of the same board reported by other
+	// discoveries, set by a Manager with deduplication enabled.
+	Alternates []*Port
+
+	// OldPort is the previous port of a board that changed address,
+	// reported by the "moved" events of a Manager with move tracking
+	// enabled (see Manager.SetMoveTracking).
+	OldPort *Port
+
+	// Error is the error that terminated the "events" mode, reported by
+	// the last "stop" event if the event channel has not been closed by
+	// Stop or Quit (for example the discovery crashed).
+	Error string
+
+	// Seq is a sequence number assigned by the Client to each event, it's
+	// monotonically increasing for the whole lifetime of the Client and
+	// can be used to detect gaps or to order events.
+	Seq uint64
+	// Timestamp is the time when the event has been received by the Client.
+	Timestamp time.Time
+
+	// Extensions are the fields of the "add" and "remove" messages unknown
+	// to this version of the library, as a JSON object (see also
+	// Port.Extensions). They are not kept by the "snapshot" events.
+	Extensions json.RawMessage
+}
+
+// emit records the event in the journal, if any, and sends it in the
+// event channel. statusMutex must be held by the caller.
+func (disc *Client) emit(ev *Event) {
+	if disc.journal != nil {
+		disc.journal.Record(ev)
+	}
+	disc.dispatcher.push(ev)
+}
+
+// newEvent creates a new Event with the next sequence number.
+// statusMutex must be held by the caller.
+func (disc *Client) newEvent(eventType string, port *Port) *Event {
+	disc.eventSeq++
+	return &Event{
+		Type:        eventType,
+		Port:        port,
+		DiscoveryID: disc.GetID(),
+		Seq:         disc.eventSeq,
+		Timestamp:   disc.clock.Now(),
+	}
 }
 
 // NewClient create a new pluggable discovery client
@@ -96,14 +193,44 @@ func NewClient(id string, args ...string) *Client {
 	return &Client{
 		id:          id,
 		processArgs: args,
-		userAgent:   "pluggable-discovery-protocol-handler",
+		userAgent:   defaultUserAgent,
+		clock:       systemClock{},
 		logger:      &nullClientLogger{},
+		tracer:      &nullClientTracer{},
+		traceCtx:    context.Background(),
+		metrics:     &nullMetrics{},
 	}
 }
 
-// SetUserAgent sets the user agent to be used in the discovery
+// SetJournal sets a Journal where all the events delivered by the Client
+// are recorded.
+func (disc *Client) SetJournal(journal *Journal) {
+	disc.journal = journal
+}
+
+// SetRedactor sets the Redactor used to mask the sensitive data of the ports
+// in the log messages of the discovery.
+func (disc *Client) SetRedactor(redactor *Redactor) {
+	disc.redactor = redactor
+}
+
+// SetUserAgent sets the user agent to be used in the discovery, it's sent in
+// the HELLO command prefixed by "arduino-cli ". The quotes and the control
+// characters, that would corrupt the HELLO command, are replaced by spaces.
+// See SetUserAgentProduct to send a structured user agent.
 func (disc *Client) SetUserAgent(userAgent string) {
-	disc.userAgent = userAgent
+	disc.userAgent = "arduino-cli " + userAgentText(userAgent)
+}
+
+// SetUserAgentProduct sets the user agent sent to the discovery in the
+// HELLO command, as "product/version" followed by the extra tokens (for
+// example comments like "(linux; amd64)"), see ParseUserAgent. The
+// characters not allowed in the product and in the version, like spaces
+// and slashes, are replaced by "-", the quotes and the control characters
+// of the extra tokens are replaced too: the HELLO command is always well
+// formed. If the product is empty the default user agent is used.
+func (disc *Client) SetUserAgentProduct(product, version string, extra ...string) {
+	disc.userAgent = formatUserAgent(product, version, extra)
 }
 
 // SetLogger sets the logger to be used in the discovery
@@ -111,6 +238,76 @@ func (disc *Client) SetLogger(logger ClientLogger) {
 	disc.logger = logger
 }
 
+// SetInitialSnapshotQuietPeriod enables the delivery of the initial burst of
+// "add" events, generated by the discovery after StartSync, as a single
+// "snapshot" event. The initial burst is considered completed when no events
+// are received for the given quiet period, or when maxWait is elapsed since
+// the StartSync, whichever comes first: this ensures that the snapshot is
+// delivered even if the discovery keeps sending events. A zero maxWait means
+// no upper bound. A zero quietPeriod (the default) disables the feature.
+func (disc *Client) SetInitialSnapshotQuietPeriod(quietPeriod, maxWait time.Duration) {
+	disc.snapshotQuietPeriod = quietPeriod
+	disc.snapshotMaxWait = maxWait
+}
+
+// SetDecodeRecovery enables the recovery from the malformed messages sent by
+// the discovery: instead of terminating the communication, the bad message is
+// logged and skipped, and the decoding is resumed from the next '{'. The
+// number of skipped messages is reported in Stats.
+func (disc *Client) SetDecodeRecovery(enabled bool) {
+	disc.decodeRecovery = enabled
+}
+
+// SetMsgpackFraming makes the Client request the MessagePack framing of the
+// messages to the discoveries advertising it (see CapabilityMsgpackFraming),
+// right after the HELLO handshake. The discoveries not supporting it keep
+// using JSON. This method must be called before Run.
+func (disc *Client) SetMsgpackFraming(enabled bool) {
+	disc.msgpackFraming = enabled
+}
+
+// knownMessageTypes are the event types of the messages defined by the
+// pluggable discovery protocol.
+var knownMessageTypes = map[string]bool{
+	"hello":         true,
+	"start":         true,
+	"stop":          true,
+	"list":          true,
+	"start_sync":    true,
+	"quit":          true,
+	"framing":       true,
+	"configure":     true,
+	"selftest":      true,
+	"command_error": true,
+	"add":           true,
+	"remove":        true,
+}
+
+// SetUnknownMessageHandler sets a handler for the messages with an event
+// type not defined by the protocol, like vendor extensions or messages from
+// future protocol versions. The handler receives the raw JSON message and
+// is called from the goroutine decoding the messages, so it must not block.
+// If no handler is set the unknown messages are treated as responses to the
+// commands.
+func (disc *Client) SetUnknownMessageHandler(handler func(json.RawMessage)) {
+	disc.unknownMessageHandler = handler
+}
+
+// SetRawEventHandler sets a handler receiving the "add" and "remove" events
+// as raw JSON messages, before (and instead of) their decoding: it allows
+// the proxies and the recorders that just re-emit the events to avoid the
+// cost of decoding and encoding them again. The events handled this way are
+// not delivered to the channel returned by StartSync and are missed by all
+// the features processing the ports (journal, enricher, initial snapshot,
+// sequence numbers...), the events mode must still be started with
+// StartSync to receive them. The handler is called from the goroutine
+// decoding the messages, so it must not block, and the raw message is
+// valid only during the call: it must be copied to be retained. With the
+// MessagePack framing the raw message is converted to JSON.
+func (disc *Client) SetRawEventHandler(handler func(json.RawMessage)) {
+	disc.rawEventHandler = handler
+}
+
 // GetID returns the identifier for this discovery
 func (disc *Client) GetID() string {
 	return disc.id
@@ -120,13 +317,46 @@ func (disc *Client) String() string {
 	return disc.id
 }
 
-func (disc *Client) jsonDecodeLoop(in io.Reader, outChan chan<- *discoveryMessage) {
-	decoder := json.NewDecoder(in)
+func (disc *Client) jsonDecodeLoop(in io.Reader, outChan chan<- *message, session uint64) {
+	dec := jsonCodec{}.NewDecoder(in)
+	disc.statusMutex.Lock()
+	var done <-chan struct{}
+	if disc.session == session {
+		done = disc.sessionDone
+	}
+	disc.statusMutex.Unlock()
 	closeAndReportError := func(err error) {
 		disc.statusMutex.Lock()
-		disc.incomingMessagesError = err
-		disc.stopSync()
-		disc.killProcess()
+		reconnect := false
+		// Do not touch the status if the discovery has already been
+		// restarted: it belongs to a newer session.
+		if disc.session == session {
+			// Reconnect only if the connection has been lost (and not closed by us)
+			reconnect = !disc.reconnecting && !disc.closing && disc.conn != nil && disc.reconnectAttempts > 0
+			if disc.stallDetected {
+				disc.stallDetected = false
+				err = ErrStalled
+			}
+			// The "stop" event reports the plain error, the CrashReport is
+			// returned by the commands and by LastError
+			stopErr := err
+			if process := disc.process; process != nil && err != nil && err != ErrStalled && !disc.closing {
+				// The process terminated unexpectedly: the exit status and
+				// the standard error are available after killProcess
+				disc.killProcess()
+				err = disc.newCrashReport(err, process)
+			}
+			disc.incomingMessagesError = err
+			if err != nil && !disc.closing {
+				disc.lastError = err
+			}
+			if reconnect {
+				disc.reconnecting = true
+			} else if !disc.reconnecting {
+				disc.stopSyncWithError(stopErr)
+			}
+			disc.killProcess()
+		}
 		disc.statusMutex.Unlock()
 		close(outChan)
 		if err != nil {
@@ -134,51 +364,247 @@ func (disc *Client) jsonDecodeLoop(in io.Reader, outChan chan<- *discoveryMessag
 		} else {
 			disc.logger.Debugf("Stopped decode loop")
 		}
+		if reconnect {
+			go disc.reconnect()
+		}
+	}
+
+	// Formatting the received messages is expensive, with high event rates,
+	// skip it if nobody is going to read the log
+	_, nullLogger := disc.logger.(*nullClientLogger)
+	debugLog := !nullLogger
+
+	skipMalformed := func(err error) bool {
+		if !disc.decodeRecovery {
+			return false
+		}
+		disc.stats.messageSkipped()
+		disc.logger.Errorf("Skipped malformed message: %v", err)
+		return true
+	}
+
+	var strict *stateTracker
+	if disc.strictState {
+		strict = &stateTracker{}
 	}
+	// The events following the QUIT response are dropped, see
+	// CapabilityQuitDrain
+	quitReceived := false
 
+	rawEventHandler := disc.rawEventHandler
 	for {
-		var msg discoveryMessage
-		if err := decoder.Decode(&msg); err != nil {
+		var m *message
+		var err error
+		if rawEventHandler != nil {
+			var eventType string
+			if eventType, err = dec.Peek(); err == nil && (eventType == "add" || eventType == "remove") {
+				disc.resetStallTimer()
+				disc.stats.eventReceived(eventType, disc.clock.Now())
+				disc.tracer.Event(disc.id, eventType)
+				disc.metrics.EventReceived(disc.id, eventType)
+				rawEventHandler(dec.Raw())
+				continue
+			}
+		}
+		if err == nil {
+			m, err = dec.Decode()
+		}
+		if err != nil {
+			if errors.Is(err, errMalformed) {
+				disc.stats.decodeError()
+				disc.reportViolation(ViolationMalformedMessage, "", "", nil, err)
+				if skipMalformed(err) {
+					skipped, err := dec.Resync()
+					if skipped != "" {
+						disc.logger.Debugf("Skipped data: %q", skipped)
+					}
+					if err != nil {
+						closeAndReportError(err)
+						return
+					}
+					continue
+				}
+			}
 			closeAndReportError(err)
 			return
 		}
-		disc.logger.Debugf("Received message %s", msg)
-		if msg.EventType == "add" {
-			if msg.Port == nil {
-				closeAndReportError(errors.New("invalid 'add' message: missing port"))
+		disc.resetStallTimer()
+		if _, ok := dec.(*jsonDecoder); ok || (m.EventType != "add" && m.EventType != "remove") {
+			// The JSON form of the MessagePack frames is computed only for
+			// the responses, the events are too many
+			disc.recentMessages.record(false, dec.Raw())
+		}
+		if debugLog {
+			disc.logger.Debugf("Received message %s", disc.redactMessage(*m))
+		}
+		if m.EventType == "add" || m.EventType == "remove" {
+			if m.Port == nil {
+				err := fmt.Errorf("invalid '%s' message: missing port", m.EventType)
+				disc.reportViolation(ViolationMissingPort, "", m.EventType, dec.Raw(), err)
+				if skipMalformed(err) {
+					continue
+				}
+				closeAndReportError(err)
 				return
 			}
-			disc.statusMutex.Lock()
-			if disc.eventChan != nil {
-				disc.eventChan <- &Event{"add", msg.Port, disc.GetID()}
+			if quitReceived {
+				if strict != nil && disc.HasCapability(CapabilityQuitDrain) {
+					disc.invalidState(stateQuit, m.EventType, dec.Raw(), fmt.Errorf("'%s' event received after the QUIT response", m.EventType))
+				} else {
+					disc.logger.Debugf("Ignored '%s' event received after the QUIT response", m.EventType)
+				}
+				releasePort(m.Port)
+				continue
 			}
-			disc.statusMutex.Unlock()
-		} else if msg.EventType == "remove" {
-			if msg.Port == nil {
-				closeAndReportError(errors.New("invalid 'remove' message: missing port"))
-				return
+			if strict != nil {
+				if err := strict.event(m.EventType); err != nil {
+					disc.invalidState(strict.state, m.EventType, dec.Raw(), err)
+					releasePort(m.Port)
+					continue
+				}
 			}
-			disc.statusMutex.Lock()
-			if disc.eventChan != nil {
-				disc.eventChan <- &Event{"remove", msg.Port, disc.GetID()}
+			disc.listCache.invalidate()
+			if !disc.sendPortEvent(m.EventType, m.Port, m.Extensions) {
+				releasePort(m.Port)
 			}
-			disc.statusMutex.Unlock()
+			continue
+		}
+		if disc.violationHandler != nil {
+			if m.EventType == "" {
+				disc.reportViolation(ViolationMissingEventType, "", "", dec.Raw(), nil)
+			} else if !knownMessageTypes[m.EventType] {
+				disc.reportViolation(ViolationUnknownMessage, "", m.EventType, dec.Raw(), nil)
+			}
+		}
+		if m.EventType == "" && disc.decodeRecovery {
+			// Probably an inner object of a malformed message
+			skipMalformed(errors.New("missing eventType"))
+		} else if handler := disc.unknownMessageHandler; handler != nil && !knownMessageTypes[m.EventType] {
+			// The raw message is overwritten by the next Decode
+			handler(append(json.RawMessage(nil), dec.Raw()...))
 		} else {
-			outChan <- &msg
+			// The decoded message is reused by the decoder, the responses
+			// are copied since they are retained by the receiver
+			msg := *m
+			if disc.violationHandler != nil {
+				msg.raw = append(json.RawMessage(nil), dec.Raw()...)
+			}
+			if msg.EventType == "list" {
+				msg.Ports = dropNilPorts(msg.Ports)
+			}
+			if strict != nil {
+				state := strict.state
+				if err := strict.response(&msg); err != nil {
+					disc.invalidState(state, msg.EventType, dec.Raw(), err)
+				}
+			}
+			if msg.EventType == "quit" && !msg.Error {
+				quitReceived = true
+			}
+			if msg.EventType == "start_sync" && disc.syncEventReceived(&msg) {
+				// Error reported by the discovery in events mode
+				continue
+			}
+			if _, ok := dec.(*jsonDecoder); ok && msg.EventType == "framing" && !msg.Error {
+				// The following messages are sent in MessagePack frames
+				dec = msgpackCodec{}.NewDecoder(dec.Buffered())
+			}
+			disc.stats.responseReceived()
+			select {
+			case outChan <- &msg:
+			case <-done:
+			}
 		}
 	}
 }
 
+// dropNilPorts removes the null entries, sent by a misbehaving discovery,
+// from the list of ports.
+func dropNilPorts(ports []*Port) []*Port {
+	res := ports[:0]
+	for _, port := range ports {
+		if port != nil {
+			res = append(res, port)
+		}
+	}
+	return res
+}
+
+// sendPortEvent delivers a port event received from the discovery, it
+// returns false if the event has been dropped and the port is not
+// referenced anymore.
+func (disc *Client) sendPortEvent(eventType string, port *Port, extensions json.RawMessage) bool {
+	disc.stats.eventReceived(eventType, disc.clock.Now())
+	disc.tracer.Event(disc.id, eventType)
+	disc.metrics.EventReceived(disc.id, eventType)
+	if disc.eventGuard != nil && !disc.eventGuard.accept(eventType, port) {
+		disc.stats.eventSuppressed()
+		disc.logger.Debugf("Suppressed duplicate '%s' event of port %s", eventType, port)
+		return false
+	}
+	disc.statusMutex.Lock()
+	enricher := disc.enricher
+	disc.statusMutex.Unlock()
+	if enricher != nil {
+		enricher.enqueue(port, func(port *Port) { disc.deliverPortEvent(eventType, port, extensions) })
+		return true
+	}
+	return disc.deliverPortEvent(eventType, port, extensions)
+}
+
+// deliverPortEvent queues the port event in the event channel, it returns
+// false if the events mode is not active and the event has been dropped.
+func (disc *Client) deliverPortEvent(eventType string, port *Port, extensions json.RawMessage) bool {
+	disc.statusMutex.Lock()
+	dispatcher := disc.dispatcher
+	disc.statusMutex.Unlock()
+	if dispatcher == nil {
+		return false
+	}
+	dispatcher.waitRoom()
+
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.dispatcher != dispatcher {
+		return false
+	}
+	if disc.snapshot != nil {
+		disc.snapshot.collect(eventType, port, disc.snapshotQuietPeriod)
+		return true
+	}
+	ev := disc.newEvent(eventType, port)
+	ev.Extensions = extensions
+	disc.emit(ev)
+	disc.metrics.EventsBacklog(disc.id, disc.dispatcher.backlog())
+	return true
+}
+
 // Alive returns true if the discovery is running and false otherwise.
 func (disc *Client) Alive() bool {
 	disc.statusMutex.Lock()
 	defer disc.statusMutex.Unlock()
-	return disc.process != nil
+	return disc.process != nil || disc.conn != nil
+}
+
+// LastError returns the last error reported by the discovery: the error
+// responses to the commands, the errors reported asynchronously while in
+// "events" mode and the unexpected termination of the discovery (or loss
+// of the connection). It returns nil if no error has been reported. It's
+// meant for status UIs, to show why a discovery doesn't report any port.
+func (disc *Client) LastError() error {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.lastError
 }
 
-func (disc *Client) waitMessage(timeout time.Duration) (*discoveryMessage, error) {
+func (disc *Client) waitMessage(timeout time.Duration) (*message, error) {
+	disc.statusMutex.Lock()
+	incomingMessagesChan := disc.incomingMessagesChan
+	disc.statusMutex.Unlock()
+	timer := disc.clock.NewTimer(timeout)
+	defer timer.Stop()
 	select {
-	case msg := <-disc.incomingMessagesChan:
+	case msg := <-incomingMessagesChan:
 		if msg == nil {
 			disc.statusMutex.Lock()
 			err := disc.incomingMessagesError
@@ -186,16 +612,28 @@ func (disc *Client) waitMessage(timeout time.Duration) (*discoveryMessage, error
 			return nil, err
 		}
 		return msg, nil
-	case <-time.After(timeout):
+	case <-timer.C():
 		return nil, fmt.Errorf("timeout waiting for message from %s", disc)
 	}
 }
 
 func (disc *Client) sendCommand(command string) error {
-	disc.logger.Debugf("Sending command %s", strings.TrimSpace(command))
+	logged := strings.TrimSpace(command)
+	if disc.authToken != "" {
+		logged = strings.ReplaceAll(logged, disc.authToken, MaskAll(disc.authToken))
+	}
+	disc.logger.Debugf("Sending command %s", logged)
+	disc.recentMessages.record(true, []byte(logged))
+	disc.stats.commandSent()
+	disc.statusMutex.Lock()
+	outgoingCommandsPipe := disc.outgoingCommandsPipe
+	disc.statusMutex.Unlock()
+	if outgoingCommandsPipe == nil {
+		return errors.New("discovery not running")
+	}
 	data := []byte(command)
 	for {
-		n, err := disc.outgoingCommandsPipe.Write(data)
+		n, err := outgoingCommandsPipe.Write(data)
 		if err != nil {
 			return err
 		}
@@ -207,37 +645,56 @@ func (disc *Client) sendCommand(command string) error {
 }
 
 func (disc *Client) runProcess() error {
-	disc.logger.Debugf("Starting discovery process")
-	proc, err := paths.NewProcess(nil, disc.processArgs...)
-	if err != nil {
-		return err
+	if disc.dialer != nil {
+		return disc.dial()
 	}
-	stdout, err := proc.StdoutPipe()
+	disc.logger.Debugf("Starting discovery process")
+	proc, stdin, stdout, err := newDiscoveryProcess(disc.processArgs, disc.processAttributes)
 	if err != nil {
 		return err
 	}
-	stdin, err := proc.StdinPipe()
-	if err != nil {
-		return err
-	}
-	disc.outgoingCommandsPipe = stdin
-
-	messageChan := make(chan *discoveryMessage)
-	disc.incomingMessagesChan = messageChan
-	go disc.jsonDecodeLoop(stdout, messageChan)
-
-	if err := proc.Start(); err != nil {
+	if warning, err := proc.start(disc.processAttributes); err != nil {
+		// The decode loop is not started yet, nothing else to release
+		_ = stdin.Close()
+		_ = stdout.Close()
 		return err
+	} else if warning != nil {
+		disc.logger.Errorf("Setting discovery process attributes: %v", warning)
 	}
 
 	disc.statusMutex.Lock()
 	defer disc.statusMutex.Unlock()
+	disc.recentMessages.reset()
+	messageChan := make(chan *message)
+	disc.outgoingCommandsPipe = stdin
+	disc.incomingMessagesChan = messageChan
+	disc.sessionDone = make(chan struct{})
+	disc.session++
+	disc.listCache.invalidate()
+	go disc.jsonDecodeLoop(stdout, messageChan, disc.session)
 	disc.process = proc
+	if disc.stats.processStarted() {
+		disc.metrics.ProcessRestarted(disc.id)
+	}
 	disc.logger.Debugf("Discovery process started")
 	return nil
 }
 
 func (disc *Client) killProcess() {
+	if disc.sessionDone != nil {
+		// Release the decode loop, if it's waiting to deliver a response
+		// that nobody is going to read
+		close(disc.sessionDone)
+		disc.sessionDone = nil
+	}
+	if conn := disc.conn; conn != nil {
+		disc.conn = nil
+		disc.logger.Debugf("Closing connection to %s", disc.remote())
+		if err := conn.Close(); err != nil {
+			disc.logger.Errorf("Closing connection: %v", err)
+		}
+		return
+	}
 	disc.logger.Debugf("Killing discovery process")
 	if process := disc.process; process != nil {
 		disc.process = nil
@@ -247,14 +704,38 @@ func (disc *Client) killProcess() {
 		if err := process.Wait(); err != nil {
 			disc.logger.Errorf("Waiting discovery process termination: %v", err)
 		}
+		disc.processState = process.cmd.ProcessState
 	}
 	disc.logger.Debugf("Discovery process killed")
 }
 
-// Run starts the discovery executable process and sends the HELLO command to the discovery to agree on the
+// Run starts the discovery executable process (or connects to the remote discovery if the Client has been
+// created with NewTCPClient) and sends the HELLO command to the discovery to agree on the
 // pluggable discovery protocol. This must be the first command to run in the communication with the discovery.
 // If the process is started but the HELLO command fails the process is killed.
 func (disc *Client) Run() (err error) {
+	endCommand := disc.instrumentCommand("HELLO")
+	defer func() { endCommand(err) }()
+
+	disc.statusMutex.Lock()
+	reconnecting := disc.reconnecting
+	closed := disc.closed
+	disc.closing = false
+	disc.statusMutex.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+	if reconnecting {
+		return ErrReconnecting
+	}
+	if disc.optionsErr != nil {
+		return disc.optionsErr
+	}
+	return disc.run()
+}
+
+// run starts the discovery and performs the HELLO handshake.
+func (disc *Client) run() (err error) {
 	if err = disc.runProcess(); err != nil {
 		return err
 	}
@@ -271,37 +752,101 @@ func (disc *Client) Run() (err error) {
 		disc.statusMutex.Unlock()
 	}()
 
-	if err = disc.sendCommand("HELLO 1 \"arduino-cli " + disc.userAgent + "\"\n"); err != nil {
-		return err
+	msg, err := disc.hello(disc.locale)
+	if err == nil && msg.EventType == "hello" && msg.Error && disc.locale != "" && (msg.Code == "" || msg.Code == string(ErrorCodeInvalidCommand)) {
+		// The discoveries not supporting the locale reject the HELLO
+		// command: retry without it
+		msg, err = disc.hello("")
 	}
-	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
-		return fmt.Errorf("calling HELLO: %w", err)
+	if err != nil {
+		return err
 	} else if msg.EventType != "hello" {
-		return fmt.Errorf("event out of sync, expected 'hello', received '%s'", msg.EventType)
+		return disc.outOfSync("hello", msg)
 	} else if msg.Error {
-		return fmt.Errorf("command failed: %s", msg.Message)
+		return newCommandError("HELLO", msg)
 	} else if strings.ToUpper(msg.Message) != "OK" {
-		return fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+		return disc.notOK(msg)
 	} else if msg.ProtocolVersion > 1 {
 		return fmt.Errorf("protocol version not supported: requested 1, got %d", msg.ProtocolVersion)
+	} else {
+		disc.statusMutex.Lock()
+		disc.capabilities = msg.Capabilities
+		disc.propertySchema = msg.PropertySchema
+		disc.statusMutex.Unlock()
+	}
+	if disc.msgpackFraming && disc.HasCapability(CapabilityMsgpackFraming) {
+		if err = disc.sendCommand("FRAMING MSGPACK\n"); err != nil {
+			return err
+		}
+		if msg, err := disc.waitMessage(time.Second * 10); err != nil {
+			return fmt.Errorf("calling FRAMING: %w", err)
+		} else if msg.EventType != "framing" {
+			return disc.outOfSync("framing", msg)
+		} else if msg.Error {
+			return newCommandError("FRAMING", msg)
+		}
 	}
 	return nil
 }
 
+// hello sends the HELLO command, with the given locale if not empty, and
+// waits for the response.
+func (disc *Client) hello(locale string) (*message, error) {
+	hello := "HELLO 1 \"" + disc.userAgent + "\""
+	if disc.authToken != "" {
+		hello += " \"" + disc.authToken + "\""
+	}
+	if locale != "" {
+		hello += " locale=" + locale
+	}
+	if err := disc.sendCommand(hello + "\n"); err != nil {
+		return nil, err
+	}
+	msg, err := disc.waitMessage(time.Second * 10)
+	if err != nil {
+		return nil, fmt.Errorf("calling HELLO: %w", err)
+	}
+	return msg, nil
+}
+
+// HasCapability returns true if the given protocol capability has been
+// advertised by the discovery in the HELLO response.
+func (disc *Client) HasCapability(capability string) bool {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	for _, c := range disc.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
 // Start initializes and start the discovery internal subroutines. This command must be
 // called before List.
-func (disc *Client) Start() error {
+func (disc *Client) Start() (err error) {
+	endCommand := disc.instrumentCommand("START")
+	defer func() { endCommand(err) }()
+
+	if err := disc.checkNotReconnecting(); err != nil {
+		return err
+	}
+	return disc.start()
+}
+
+// start sends the START command and checks the response.
+func (disc *Client) start() error {
 	if err := disc.sendCommand("START\n"); err != nil {
 		return err
 	}
 	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
 		return fmt.Errorf("calling START: %w", err)
 	} else if msg.EventType != "start" {
-		return fmt.Errorf("event out of sync, expected 'start', received '%s'", msg.EventType)
+		return disc.outOfSync("start", msg)
 	} else if msg.Error {
-		return fmt.Errorf("command failed: %s", msg.Message)
+		return newCommandError("START", msg)
 	} else if strings.ToUpper(msg.Message) != "OK" {
-		return fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+		return disc.notOK(msg)
 	}
 	return nil
 }
@@ -309,60 +854,181 @@ func (disc *Client) Start() error {
 // Stop stops the discovery internal subroutines and possibly free the internally
 // used resources. This command should be called if the client wants to pause the
 // discovery for a while.
-func (disc *Client) Stop() error {
+func (disc *Client) Stop() (err error) {
+	endCommand := disc.instrumentCommand("STOP")
+	defer func() { endCommand(err) }()
+
+	if err := disc.checkNotReconnecting(); err != nil {
+		return err
+	}
+	if err := disc.stop(); err != nil {
+		return err
+	}
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	disc.stopSync()
+	return nil
+}
+
+// stop sends the STOP command and checks the response.
+func (disc *Client) stop() error {
 	if err := disc.sendCommand("STOP\n"); err != nil {
 		return err
 	}
 	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
 		return fmt.Errorf("calling STOP: %w", err)
 	} else if msg.EventType != "stop" {
-		return fmt.Errorf("event out of sync, expected 'stop', received '%s'", msg.EventType)
+		return disc.outOfSync("stop", msg)
+	} else if msg.Error && msg.Message == msgAlreadyStopped && disc.HasCapability(CapabilityIdempotentStop) {
+		// the discovery is already stopped: treat as success
 	} else if msg.Error {
-		return fmt.Errorf("command failed: %s", msg.Message)
+		return newCommandError("STOP", msg)
 	} else if strings.ToUpper(msg.Message) != "OK" {
-		return fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+		return disc.notOK(msg)
 	}
-	disc.statusMutex.Lock()
-	defer disc.statusMutex.Unlock()
-	disc.stopSync()
 	return nil
 }
 
 func (disc *Client) stopSync() {
+	disc.stopSyncWithError(nil)
+}
+
+// stopSyncWithError terminates the "events" mode, reporting err in the
+// final "stop" event. statusMutex must be held by the caller.
+func (disc *Client) stopSyncWithError(err error) {
+	disc.syncActive = false
+	if disc.pollStop != nil {
+		close(disc.pollStop)
+		disc.pollStop = nil
+	}
+	disc.resyncing = false
+	disc.stopStallDetection()
+	if disc.snapshot != nil {
+		disc.flushSnapshot()
+	}
 	if disc.eventChan != nil {
-		disc.eventChan <- &Event{"stop", nil, disc.GetID()}
-		close(disc.eventChan)
-		disc.eventChan = nil
+		ev := disc.newEvent("stop", nil)
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		disc.emit(ev)
+		disc.closeEventChan()
 	}
 }
 
 // Quit terminates the discovery. No more commands can be accepted by the discovery.
 func (disc *Client) Quit() {
-	_ = disc.sendCommand("QUIT\n")
-	if _, err := disc.waitMessage(time.Second * 5); err != nil {
+	endCommand := disc.instrumentCommand("QUIT")
+	// The discovery is going to close the connection: it must not be
+	// treated as a connection loss.
+	disc.statusMutex.Lock()
+	disc.closing = true
+	disc.statusMutex.Unlock()
+	// If the command can't be sent the discovery is not running, there is
+	// no need to wait for the response.
+	err := disc.sendCommand("QUIT\n")
+	if err == nil {
+		err = disc.waitQuitResponse(time.Second * 5)
+	}
+	if err != nil {
 		disc.logger.Errorf("Quitting discovery: %s", err)
 	}
+	endCommand(err)
 	disc.statusMutex.Lock()
 	disc.stopSync()
 	disc.killProcess()
 	disc.statusMutex.Unlock()
 }
 
+// ErrClientClosed is returned by Run if the Client has been closed.
+var ErrClientClosed = errors.New("discovery client closed")
+
+// Close terminates the discovery and releases all the resources of the
+// Client: the QUIT command is sent, if the discovery is running, and then
+// the process is killed (or the connection closed), the event channel is
+// closed and the internal goroutines are terminated. The Client can't be
+// used anymore after Close. It's safe to call Close more than once, it
+// always returns nil.
+func (disc *Client) Close() error {
+	disc.statusMutex.Lock()
+	if disc.closed {
+		disc.statusMutex.Unlock()
+		return nil
+	}
+	disc.closed = true
+	alive := disc.process != nil || disc.conn != nil
+	disc.closing = true
+	incomingMessagesChan := disc.incomingMessagesChan
+	disc.statusMutex.Unlock()
+
+	if alive {
+		disc.Quit()
+	} else {
+		disc.statusMutex.Lock()
+		disc.stopSync()
+		disc.killProcess()
+		disc.statusMutex.Unlock()
+	}
+
+	// Wait for the termination of the decode loop, if any
+	if incomingMessagesChan != nil {
+		timeout := disc.clock.NewTimer(5 * time.Second)
+		defer timeout.Stop()
+	drain:
+		for {
+			select {
+			case msg := <-incomingMessagesChan:
+				if msg == nil {
+					break drain
+				}
+			case <-timeout.C():
+				disc.logger.Errorf("Timeout waiting for the decode loop termination")
+				break drain
+			}
+		}
+	}
+	return nil
+}
+
 // List executes an enumeration of the ports and returns a list of the available
 // ports at the moment of the call.
-func (disc *Client) List() ([]*Port, error) {
-	if err := disc.sendCommand("LIST\n"); err != nil {
+func (disc *Client) List() (ports []*Port, err error) {
+	endCommand := disc.instrumentCommand("LIST")
+	defer func() { endCommand(err) }()
+
+	if err := disc.checkNotReconnecting(); err != nil {
 		return nil, err
 	}
-	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
-		return nil, fmt.Errorf("calling LIST: %w", err)
-	} else if msg.EventType != "list" {
-		return nil, fmt.Errorf("event out of sync, expected 'list', received '%s'", msg.EventType)
-	} else if msg.Error {
-		return nil, fmt.Errorf("command failed: %s", msg.Message)
-	} else {
-		return msg.Ports, nil
+	// The chunks of a chunked response are reassembled transparently
+	command := "LIST\n"
+	if disc.HasCapability(CapabilityChunkedList) {
+		command = "LIST CHUNKED\n"
+	}
+	if err := disc.sendCommand(command); err != nil {
+		return nil, err
+	}
+	ports = []*Port{}
+	for {
+		if msg, err := disc.waitMessage(time.Second * 10); err != nil {
+			return nil, fmt.Errorf("calling LIST: %w", err)
+		} else if msg.EventType != "list" {
+			return nil, disc.outOfSync("list", msg)
+		} else if msg.Error {
+			return nil, newCommandError("LIST", msg)
+		} else {
+			ports = append(ports, msg.Ports...)
+			if !msg.More {
+				break
+			}
+		}
+	}
+	disc.statusMutex.Lock()
+	enricher := disc.enricher
+	disc.statusMutex.Unlock()
+	if enricher != nil {
+		return enricher.applyAll(ports), nil
 	}
+	return ports, nil
 }
 
 // StartSync puts the discovery in "events" mode: the discovery will send "add"
@@ -372,26 +1038,62 @@ func (disc *Client) List() ([]*Port, error) {
 // It also creates a channel used to receive events from the pluggable discovery.
 // The event channel must be consumed as quickly as possible since it may block the
 // discovery if it becomes full. The channel size is configurable.
-func (disc *Client) StartSync(size int) (<-chan *Event, error) {
-	if err := disc.sendCommand("START_SYNC\n"); err != nil {
+func (disc *Client) StartSync(size int) (events <-chan *Event, err error) {
+	endCommand := disc.instrumentCommand("START_SYNC")
+	defer func() { endCommand(err) }()
+
+	if err := disc.checkNotReconnecting(); err != nil {
 		return nil, err
 	}
+	// The events channel is created before sending the command, the
+	// events sent by the discovery right after the response would be
+	// lost otherwise.
+	// In case there is already an existing event channel in use we close it before creating a new one.
+	disc.statusMutex.Lock()
+	disc.stopSync()
+	c := disc.openEventChan(size)
+	if disc.snapshotQuietPeriod > 0 {
+		disc.startSnapshot()
+	}
+	disc.startStallDetection()
+	disc.statusMutex.Unlock()
+
+	if err := disc.startSync(); err != nil {
+		if disc.pollingFallback > 0 && disc.startPollingFallback(c, err) {
+			return c, nil
+		}
+		disc.statusMutex.Lock()
+		if disc.eventChan == c {
+			disc.stopStallDetection()
+			if disc.snapshot != nil {
+				disc.snapshot.stop()
+				disc.snapshot = nil
+			}
+			disc.closeEventChan()
+		}
+		disc.statusMutex.Unlock()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startSync sends the START_SYNC command and checks the response.
+func (disc *Client) startSync() error {
+	if disc.eventGuard != nil {
+		disc.eventGuard.reset()
+	}
+	if err := disc.sendCommand("START_SYNC\n"); err != nil {
+		return err
+	}
 
 	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
-		return nil, fmt.Errorf("calling START_SYNC: %w", err)
+		return fmt.Errorf("calling START_SYNC: %w", err)
 	} else if msg.EventType != "start_sync" {
-		return nil, fmt.Errorf("evemt out of sync, expected 'start_sync', received '%s'", msg.EventType)
+		return disc.outOfSync("start_sync", msg)
 	} else if msg.Error {
-		return nil, fmt.Errorf("command failed: %s", msg.Message)
+		return newCommandError("START_SYNC", msg)
 	} else if strings.ToUpper(msg.Message) != "OK" {
-		return nil, fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+		return disc.notOK(msg)
 	}
-
-	// In case there is already an existing event channel in use we close it before creating a new one.
-	disc.statusMutex.Lock()
-	defer disc.statusMutex.Unlock()
-	disc.stopSync()
-	c := make(chan *Event, size)
-	disc.eventChan = c
-	return c, nil
+	return nil
 }
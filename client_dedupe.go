@@ -0,0 +1,70 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "sync"
+
+// SetEventDeduplication enables the idempotency guard on the port events
+// sent by the discovery, for the discoveries that misbehave: an "add" event
+// identical to the last one of the same port is dropped, as well as the
+// "remove" events of the ports never added (or already removed). An "add"
+// of a known port with different data is delivered, as an update. The
+// suppressed events are logged and counted in Stats. The known ports are
+// forgotten at each START_SYNC. This method must be called before Run.
+func (disc *Client) SetEventDeduplication(enabled bool) {
+	if !enabled {
+		disc.eventGuard = nil
+		return
+	}
+	disc.eventGuard = &eventGuard{ports: map[string]*Port{}}
+}
+
+// eventGuard tracks the ports added by the discovery to suppress the
+// duplicate events, see SetEventDeduplication.
+type eventGuard struct {
+	mutex sync.Mutex
+	ports map[string]*Port
+}
+
+// accept returns false if the given event must be suppressed.
+func (g *eventGuard) accept(eventType string, port *Port) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	key := eventPortKey("", port)
+	previous, known := g.ports[key]
+	switch eventType {
+	case "add":
+		if known && samePortData(previous, port) {
+			return false
+		}
+		g.ports[key] = port.Clone()
+	case "remove":
+		if !known {
+			return false
+		}
+		delete(g.ports, key)
+	}
+	return true
+}
+
+// reset forgets the known ports.
+func (g *eventGuard) reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	clear(g.ports)
+}
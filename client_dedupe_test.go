@@ -0,0 +1,71 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// duplicatingDiscovery sends duplicate and inconsistent events.
+type duplicatingDiscovery struct {
+	testDiscovery
+}
+
+func (d *duplicatingDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	eventCB("add", &Port{Address: "1", Protocol: "test"})
+	eventCB("add", &Port{Address: "1", Protocol: "test"})
+	eventCB("add", &Port{Address: "1", Protocol: "test", AddressLabel: "updated"})
+	eventCB("remove", &Port{Address: "2", Protocol: "test"})
+	eventCB("remove", &Port{Address: "1", Protocol: "test"})
+	eventCB("remove", &Port{Address: "1", Protocol: "test"})
+	eventCB("add", &Port{Address: "3", Protocol: "test"})
+	return nil
+}
+
+func TestClientEventDeduplication(t *testing.T) {
+	run := func(dedupe bool) []string {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			_ = NewServer(&duplicatingDiscovery{}).Run(serverConn, serverConn)
+		}()
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		cl.SetEventDeduplication(dedupe)
+		require.NoError(t, cl.Run())
+		defer cl.Quit()
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		res := []string{}
+		for ev := range events {
+			res = append(res, ev.Type+" "+ev.Port.Address+" "+ev.Port.AddressLabel)
+			if ev.Port.Address == "3" {
+				break
+			}
+		}
+		if dedupe {
+			require.Equal(t, uint64(3), cl.Stats().SuppressedEvents)
+		}
+		return res
+	}
+	require.Equal(t, []string{"add 1 ", "add 1 updated", "remove 1 ", "add 3 "}, run(true))
+	require.Len(t, run(false), 7)
+}
@@ -0,0 +1,186 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+)
+
+// eventDispatcher owns the event channel of a Client: it's the only
+// goroutine sending the events in the channel and closing it. The Client
+// queues the events while holding the statusMutex and never blocks on a
+// slow consumer; the producers of the port events apply the backpressure
+// waiting for room in the queue (see waitRoom) without holding any lock.
+type eventDispatcher struct {
+	out  chan<- *Event
+	size int
+	wake chan struct{}
+	room chan struct{}
+
+	mutex   sync.Mutex
+	queue   []*Event
+	sending bool
+	closed  bool
+}
+
+// newEventDispatcher starts a dispatcher for the channel out, queueing up
+// to size events (at least one) before applying the backpressure.
+func newEventDispatcher(out chan<- *Event, size int) *eventDispatcher {
+	d := &eventDispatcher{
+		out:  out,
+		size: max(size, 1),
+		wake: make(chan struct{}, 1),
+		room: make(chan struct{}, 1),
+	}
+	go d.run()
+	return d
+}
+
+// push queues an event. It never blocks.
+func (d *eventDispatcher) push(ev *Event) {
+	d.mutex.Lock()
+	if !d.closed {
+		d.queue = append(d.queue, ev)
+	}
+	d.mutex.Unlock()
+	notify(d.wake)
+}
+
+// close closes the event channel after the delivery of the queued events.
+func (d *eventDispatcher) close() {
+	d.mutex.Lock()
+	d.closed = true
+	d.mutex.Unlock()
+	notify(d.wake)
+	notify(d.room)
+}
+
+// waitRoom waits until there is room in the queue for a new event, or the
+// dispatcher is closed.
+func (d *eventDispatcher) waitRoom() {
+	for {
+		d.mutex.Lock()
+		ok := d.closed || len(d.queue) < d.size
+		d.mutex.Unlock()
+		if ok {
+			return
+		}
+		<-d.room
+	}
+}
+
+// backlog returns the number of events not yet consumed.
+func (d *eventDispatcher) backlog() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	res := len(d.queue) + len(d.out)
+	if d.sending {
+		res++
+	}
+	return res
+}
+
+func (d *eventDispatcher) run() {
+	for {
+		d.mutex.Lock()
+		if len(d.queue) > 0 {
+			ev := d.queue[0]
+			d.queue[0] = nil
+			d.queue = d.queue[1:]
+			d.sending = true
+			d.mutex.Unlock()
+			notify(d.room)
+			d.out <- ev
+			d.mutex.Lock()
+			d.sending = false
+			d.mutex.Unlock()
+			continue
+		}
+		if d.closed {
+			d.mutex.Unlock()
+			close(d.out)
+			notify(d.room)
+			return
+		}
+		d.mutex.Unlock()
+		<-d.wake
+	}
+}
+
+// notify notifies the channel c, with a buffer of one element, without
+// blocking.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// openEventChan creates a new event channel of the given size, with its
+// dispatcher. statusMutex must be held by the caller.
+func (disc *Client) openEventChan(size int) chan *Event {
+	c := make(chan *Event, size)
+	disc.eventChan = c
+	disc.dispatcher = newEventDispatcher(c, size)
+	disc.stats.setDispatcher(disc.dispatcher)
+	return c
+}
+
+// closeEventChan closes the current event channel, after the delivery of
+// the queued events. statusMutex must be held by the caller.
+func (disc *Client) closeEventChan() {
+	disc.dispatcher.close()
+	disc.eventChan = nil
+	disc.dispatcher = nil
+	disc.stats.setDispatcher(nil)
+}
+
+// ReceiveEvents waits for an event from the channel returned by StartSync
+// and appends it to dst, together with the events already waiting in the
+// channel, up to the capacity of dst (at least one event is appended). It
+// allows to consume high event rates in batches, reusing the same slice:
+//
+//	batch := make([]*Event, 0, 256)
+//	for {
+//		var ok bool
+//		if batch, ok = ReceiveEvents(events, batch[:0]); !ok {
+//			break
+//		}
+//		...
+//	}
+//
+// It returns false if the channel has been closed and no event is appended.
+func ReceiveEvents(events <-chan *Event, dst []*Event) ([]*Event, bool) {
+	ev, ok := <-events
+	if !ok {
+		return dst, false
+	}
+	dst = append(dst, ev)
+	for len(dst) < cap(dst) {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return dst, true
+			}
+			dst = append(dst, ev)
+		default:
+			return dst, true
+		}
+	}
+	return dst, true
+}
@@ -0,0 +1,116 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+)
+
+// maxEnricherConcurrency is the maximum number of ports enriched at the
+// same time by a Client.
+const maxEnricherConcurrency = 4
+
+// portEnricher runs the enrichment of the ports off the decode goroutine,
+// with a bounded concurrency, delivering the results in order.
+type portEnricher struct {
+	enrich    func(*Port) *Port
+	semaphore chan struct{}
+
+	mutex sync.Mutex
+	last  chan struct{} // closed when the last queued port is delivered
+}
+
+func newPortEnricher(enrich func(*Port) *Port) *portEnricher {
+	return &portEnricher{
+		enrich:    enrich,
+		semaphore: make(chan struct{}, maxEnricherConcurrency),
+	}
+}
+
+// apply returns the enriched port, or the given port if the enricher
+// returns nil.
+func (e *portEnricher) apply(port *Port) *Port {
+	e.semaphore <- struct{}{}
+	defer func() { <-e.semaphore }()
+	if res := e.enrich(port); res != nil {
+		return res
+	}
+	return port
+}
+
+// enqueue enriches the port in background and then calls deliver, after the
+// ports previously enqueued have been delivered.
+func (e *portEnricher) enqueue(port *Port, deliver func(*Port)) {
+	e.mutex.Lock()
+	prev := e.last
+	done := make(chan struct{})
+	e.last = done
+	e.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		res := e.apply(port)
+		if prev != nil {
+			<-prev
+		}
+		deliver(res)
+	}()
+}
+
+// applyAll enriches the given ports concurrently.
+func (e *portEnricher) applyAll(ports []*Port) []*Port {
+	res := make([]*Port, len(ports))
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i int, port *Port) {
+			defer wg.Done()
+			res[i] = e.apply(port)
+		}(i, port)
+	}
+	wg.Wait()
+	return res
+}
+
+// SetPortEnricher sets a function called for every port listed or reported
+// in an event, for example to look up the board name from the VID/PID or to
+// localize the labels. The function must return the enriched port, without
+// modifying the given one (see Port.Clone), or nil to leave it unchanged.
+// The function is executed off the goroutine decoding the messages of the
+// discovery, with a bounded concurrency, so that slow lookups don't stall
+// the communication; the events are still delivered in order.
+func (disc *Client) SetPortEnricher(enrich func(*Port) *Port) {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if enrich == nil {
+		disc.enricher = nil
+		return
+	}
+	disc.enricher = newPortEnricher(enrich)
+}
+
+// SetPortEnricher sets the port enricher to be used in all the discoveries
+// of the Manager, including the ones added later (see Client.SetPortEnricher).
+func (dm *Manager) SetPortEnricher(enrich func(*Port) *Port) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.enrich = enrich
+	for _, disc := range dm.discoveries {
+		disc.SetPortEnricher(enrich)
+	}
+}
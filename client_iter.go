@@ -0,0 +1,94 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build go1.23
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"iter"
+)
+
+// eventsIteratorSize is the size of the event channels used by the
+// iterators returned by Client.Events and Manager.Events.
+const eventsIteratorSize = 10
+
+// Events returns an iterator over the events of the discovery. The
+// discovery is run (if needed) and put in "events" mode when the iteration
+// starts. When the loop exits, or ctx is done, the "events" mode is stopped
+// and, if the discovery has been run by the iterator, the discovery is
+// terminated.
+//
+// The final "stop" event is yielded only if it reports an error, together
+// with the error. The failures to start the "events" mode and the ctx
+// error are yielded with a nil event. The iteration ends after an error.
+func (disc *Client) Events(ctx context.Context) iter.Seq2[*Event, error] {
+	return func(yield func(*Event, error) bool) {
+		owned := !disc.Alive()
+		if owned {
+			if err := disc.Run(); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+		ch, err := disc.StartSync(eventsIteratorSize)
+		if err != nil {
+			if owned {
+				disc.Quit()
+			}
+			yield(nil, err)
+			return
+		}
+		defer func() {
+			if owned || disc.Stop() != nil {
+				disc.Quit()
+			}
+			for range ch {
+				// Drain the events until the channel is closed
+			}
+		}()
+		for {
+			// The events may be already buffered: ctx is checked first
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			select {
+			case <-ctx.Done():
+			case ev, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := eventError(ev); err != nil || ev.Type != "stop" {
+					if !yield(ev, err) || err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// eventError returns the error reported by the given "stop" event, if any.
+func eventError(ev *Event) error {
+	if ev.Type != "stop" || ev.Error == "" {
+		return nil
+	}
+	return fmt.Errorf("discovery %s: %s", ev.DiscoveryID, ev.Error)
+}
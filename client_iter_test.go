@@ -0,0 +1,126 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build go1.23
+
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventsIterator(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	t.Run("Client", func(t *testing.T) {
+		disc := NewClient("a", "dummy-discovery/dummy-discovery")
+		addresses := []string{}
+		for ev, err := range disc.Events(context.Background()) {
+			require.NoError(t, err)
+			require.Equal(t, "add", ev.Type)
+			if addresses = append(addresses, ev.Port.Address); len(addresses) == 2 {
+				break
+			}
+		}
+		require.Equal(t, []string{"1", "2"}, addresses)
+		// The discovery has been run by the iterator
+		require.False(t, disc.Alive())
+
+		// A running discovery is only stopped
+		require.NoError(t, disc.Run())
+		for ev, err := range disc.Events(context.Background()) {
+			require.NoError(t, err)
+			require.Equal(t, "add", ev.Type)
+			break
+		}
+		require.True(t, disc.Alive())
+		ch, err := disc.StartSync(10)
+		require.NoError(t, err)
+		require.Equal(t, "add", (<-ch).Type)
+		disc.Quit()
+	})
+
+	t.Run("ClientContext", func(t *testing.T) {
+		disc := NewClient("a", "dummy-discovery/dummy-discovery")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		count := 0
+		var lastErr error
+		for ev, err := range disc.Events(ctx) {
+			if err != nil {
+				require.Nil(t, ev)
+				lastErr = err
+				continue
+			}
+			count++
+			cancel()
+		}
+		require.Equal(t, 1, count)
+		require.ErrorIs(t, lastErr, context.Canceled)
+		require.False(t, disc.Alive())
+	})
+
+	t.Run("ClientErrors", func(t *testing.T) {
+		disc := NewClient("a", "dummy-discovery/not-existent")
+		for ev, err := range disc.Events(context.Background()) {
+			require.Nil(t, ev)
+			require.ErrorContains(t, err, "not-existent")
+		}
+
+		disc = NewClient("a", "dummy-discovery/dummy-discovery", "-k")
+		events := []*Event{}
+		var lastErr error
+		for ev, err := range disc.Events(context.Background()) {
+			events = append(events, ev)
+			lastErr = err
+		}
+		require.Len(t, events, 3)
+		require.Equal(t, "stop", events[2].Type)
+		require.ErrorContains(t, lastErr, "discovery a: ")
+	})
+
+	t.Run("Manager", func(t *testing.T) {
+		dm := NewManager()
+		require.NoError(t, dm.Add(NewClient("a", "dummy-discovery/dummy-discovery")))
+		require.NoError(t, dm.Add(NewClient("b", "dummy-discovery/not-existent")))
+		var errs []error
+		count := 0
+		for ev, err := range dm.Events(context.Background()) {
+			if err != nil {
+				require.Nil(t, ev)
+				errs = append(errs, err)
+				continue
+			}
+			require.Equal(t, "a", ev.DiscoveryID)
+			if count++; count == 2 {
+				break
+			}
+		}
+		require.Len(t, errs, 1)
+		require.ErrorContains(t, errs[0], "discovery b")
+		// The discoveries are stopped, not terminated
+		require.True(t, dm.Discoveries()[0].Alive())
+		dm.Quit()
+	})
+}
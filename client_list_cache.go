@@ -0,0 +1,129 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// listCache is the result of the last LIST, see ListCached.
+type listCache struct {
+	mutex   sync.Mutex
+	ports   []*Port
+	fetched time.Time
+	valid   bool
+	// generation is incremented at each invalidation, the results of the
+	// LIST sent before the invalidation are not cached.
+	generation uint64
+	refreshing bool
+}
+
+// lookup returns a copy of the cached ports if they are not older than
+// maxAge. refresh is true if the cache should be refreshed in background,
+// when more than half of maxAge is elapsed.
+func (c *listCache) lookup(now time.Time, maxAge time.Duration) (ports []*Port, ok, refresh bool, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	age := now.Sub(c.fetched)
+	if !c.valid || age > maxAge {
+		return nil, false, false, c.generation
+	}
+	if age > maxAge/2 && !c.refreshing {
+		c.refreshing = true
+		refresh = true
+	}
+	return clonePorts(c.ports), true, refresh, c.generation
+}
+
+// store caches a copy of the ports returned by a LIST sent at the given
+// time, unless the cache has been invalidated in the meantime.
+func (c *listCache) store(generation uint64, sent time.Time, ports []*Port) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation || (c.valid && sent.Before(c.fetched)) {
+		return
+	}
+	c.ports = clonePorts(ports)
+	c.fetched = sent
+	c.valid = true
+}
+
+// refreshed marks the end of a background refresh.
+func (c *listCache) refreshed() {
+	c.mutex.Lock()
+	c.refreshing = false
+	c.mutex.Unlock()
+}
+
+// invalidate discards the cached ports.
+func (c *listCache) invalidate() {
+	c.mutex.Lock()
+	c.ports = nil
+	c.valid = false
+	c.generation++
+	c.mutex.Unlock()
+}
+
+// clonePorts returns a deep copy of the ports.
+func clonePorts(ports []*Port) []*Port {
+	res := make([]*Port, len(ports))
+	for i, port := range ports {
+		res[i] = port.Clone()
+	}
+	return res
+}
+
+// ListCached is like List, but it returns the result of a previous call if
+// it's not older than maxAge, to avoid repeated scans of the discoveries
+// that are expensive to LIST (like a UI refreshing the list of the ports
+// frequently). When more than half of maxAge is elapsed the cache is
+// refreshed in background, so that the following calls are served from the
+// cache too. The cache is invalidated as soon as an "add" or "remove" event
+// is received, while in "events" mode, and when the discovery is restarted.
+// A maxAge of zero, or negative, always calls List. The ports returned are
+// copies and may be modified by the caller.
+func (disc *Client) ListCached(maxAge time.Duration) ([]*Port, error) {
+	if maxAge <= 0 {
+		return disc.List()
+	}
+	ports, ok, refresh, generation := disc.listCache.lookup(disc.clock.Now(), maxAge)
+	if refresh {
+		go func() {
+			defer disc.listCache.refreshed()
+			if _, err := disc.cachedList(generation); err != nil {
+				disc.logger.Debugf("Refreshing the cached list of ports: %v", err)
+			}
+		}()
+	}
+	if ok {
+		return ports, nil
+	}
+	return disc.cachedList(generation)
+}
+
+// cachedList sends a LIST and caches the result.
+func (disc *Client) cachedList(generation uint64) ([]*Port, error) {
+	sent := disc.clock.Now()
+	ports, err := disc.List()
+	if err != nil {
+		return nil, err
+	}
+	disc.listCache.store(generation, sent, ports)
+	return ports, nil
+}
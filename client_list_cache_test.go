@@ -0,0 +1,121 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientListCached(t *testing.T) {
+	var lists atomic.Int32
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		server := NewServer(&testDiscovery{})
+		server.Use(func(cmd string, next func()) {
+			if strings.HasPrefix(cmd, "LIST") {
+				lists.Add(1)
+			}
+			next()
+		})
+		_ = server.Run(serverConn, serverConn)
+	}()
+	clock := NewManualClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	cl.SetClock(clock)
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+	require.NoError(t, cl.Start())
+
+	ports, err := cl.ListCached(10 * time.Second)
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	require.Equal(t, int32(1), lists.Load())
+
+	// A recent result is served from the cache, the ports are copies
+	ports[0].Address = "changed"
+	clock.Advance(time.Second)
+	ports, err = cl.ListCached(10 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "1", ports[0].Address)
+	require.Equal(t, int32(1), lists.Load())
+
+	// After half of the max age the cache is refreshed in background
+	clock.Advance(5 * time.Second)
+	ports, err = cl.ListCached(10 * time.Second)
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	require.Eventually(t, func() bool { return lists.Load() == 2 }, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		cl.listCache.mutex.Lock()
+		defer cl.listCache.mutex.Unlock()
+		return !cl.listCache.refreshing
+	}, time.Second, time.Millisecond)
+	clock.Advance(4 * time.Second)
+	_, err = cl.ListCached(10 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), lists.Load())
+
+	// An expired result is not served
+	clock.Advance(time.Minute)
+	_, err = cl.ListCached(10 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), lists.Load())
+
+	// The events invalidate the cache
+	require.NoError(t, cl.Stop())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "add", (<-events).Type)
+	require.NoError(t, cl.Stop())
+	require.NoError(t, cl.Start())
+	_, err = cl.ListCached(10 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, int32(4), lists.Load())
+
+	// No cache with a zero max age
+	_, err = cl.ListCached(0)
+	require.NoError(t, err)
+	require.Equal(t, int32(5), lists.Load())
+}
+
+func TestListCacheInvalidation(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cache := &listCache{}
+	_, ok, _, generation := cache.lookup(now, time.Second)
+	require.False(t, ok)
+
+	// The result of a LIST sent before the invalidation is discarded
+	cache.invalidate()
+	cache.store(generation, now, []*Port{{Address: "1", Protocol: "test"}})
+	_, ok, _, generation = cache.lookup(now, time.Second)
+	require.False(t, ok)
+
+	cache.store(generation, now, []*Port{{Address: "1", Protocol: "test"}})
+	ports, ok, refresh, _ := cache.lookup(now, time.Second)
+	require.True(t, ok)
+	require.False(t, refresh)
+	require.Equal(t, "1", ports[0].Address)
+}
@@ -0,0 +1,215 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrReconnecting is returned by the Client commands while the Client is
+// reconnecting to a remote discovery.
+var ErrReconnecting = errors.New("reconnecting to the discovery")
+
+// ClientOption is an option for a Client created with NewTCPClient or
+// NewConnClient.
+type ClientOption func(*Client)
+
+// WithReconnect enables the automatic reconnection of the Client: if the
+// connection is lost, the Client tries to connect again for the given number
+// of attempts, waiting the given delay before each attempt. While
+// reconnecting all the commands fail with ErrReconnecting.
+// After reconnecting the HELLO handshake is repeated and, if the Client was
+// in "events" mode, a "reconnected" event is sent in the event channel and
+// the START_SYNC command is sent again: the ports reported before the
+// "reconnected" event must be considered stale, since the discovery will
+// report again all the available ports (as a "snapshot" event if the
+// initial snapshot mode is enabled). If all the attempts fail the event
+// channel is closed as usual.
+func WithReconnect(attempts int, delay time.Duration) ClientOption {
+	return func(disc *Client) {
+		disc.reconnectAttempts = attempts
+		disc.reconnectDelay = delay
+	}
+}
+
+// WithReconnectBackoff sets the Backoff computing the delays before the
+// reconnection attempts, in place of the constant delay given to
+// WithReconnect, that still enables the reconnection and sets the number of
+// attempts.
+func WithReconnectBackoff(backoff Backoff) ClientOption {
+	return func(disc *Client) {
+		disc.reconnectBackoff = backoff
+	}
+}
+
+// ErrInvalidAuthToken is returned by Client.Run if the token given to
+// WithAuthToken contains double quotes, spaces or control characters, that
+// would corrupt the HELLO command.
+var ErrInvalidAuthToken = errors.New("invalid authentication token")
+
+// WithAuthToken sets the token sent in the HELLO command to authenticate
+// to a Server protected with Server.SetAuthToken. The token must not
+// contain double quotes, spaces or control characters, otherwise Run fails
+// with ErrInvalidAuthToken without contacting the discovery.
+func WithAuthToken(token string) ClientOption {
+	return func(disc *Client) {
+		if strings.ContainsFunc(token, func(r rune) bool { return r == '"' || r <= ' ' || r == 0x7f }) {
+			disc.optionsErr = ErrInvalidAuthToken
+			return
+		}
+		disc.authToken = token
+	}
+}
+
+// NewConnClient create a new pluggable discovery client that speaks the
+// protocol over the connection returned by dial, instead of spawning a
+// discovery process. dial is called again on each reconnection attempt.
+// This allows to use other transports, for example an SSH session.
+func NewConnClient(id string, dial func() (io.ReadWriteCloser, error), opts ...ClientOption) *Client {
+	disc := NewClient(id)
+	disc.dialer = dial
+	for _, opt := range opts {
+		opt(disc)
+	}
+	return disc
+}
+
+// remote returns a description of the remote discovery for logging purposes.
+func (disc *Client) remote() string {
+	if disc.address != "" {
+		return disc.address
+	}
+	return disc.id
+}
+
+func (disc *Client) checkNotReconnecting() error {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.reconnecting {
+		return ErrReconnecting
+	}
+	return nil
+}
+
+func (disc *Client) dial() error {
+	disc.logger.Debugf("Connecting to %s", disc.remote())
+	conn, err := disc.dialer()
+	if err != nil {
+		return err
+	}
+
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	messageChan := make(chan *message)
+	disc.conn = conn
+	disc.outgoingCommandsPipe = conn
+	disc.incomingMessagesChan = messageChan
+	disc.sessionDone = make(chan struct{})
+	disc.session++
+	disc.listCache.invalidate()
+	go disc.jsonDecodeLoop(conn, messageChan, disc.session)
+	if disc.stats.processStarted() {
+		disc.metrics.ProcessRestarted(disc.id)
+	}
+	disc.logger.Debugf("Connected to %s", disc.remote())
+	return nil
+}
+
+func (disc *Client) reconnect() {
+	disc.statusMutex.Lock()
+	syncing := disc.eventChan != nil
+	polling := disc.pollStop != nil
+	disc.statusMutex.Unlock()
+
+	// isClosing checks if Quit has been called, in that case the
+	// reconnection is aborted and the connection (if any) closed.
+	isClosing := func() bool {
+		disc.statusMutex.Lock()
+		defer disc.statusMutex.Unlock()
+		if disc.closing {
+			disc.killProcess()
+		}
+		return disc.closing
+	}
+	done := func() {
+		disc.statusMutex.Lock()
+		disc.reconnecting = false
+		disc.statusMutex.Unlock()
+	}
+
+	backoff := disc.reconnectBackoff
+	if backoff == nil {
+		backoff = ConstantBackoff(disc.reconnectDelay)
+	}
+	var lastErr error
+	for attempt := 1; attempt <= disc.reconnectAttempts; attempt++ {
+		sleep(disc.clock, backoff.Delay(attempt))
+		if isClosing() {
+			done()
+			return
+		}
+		disc.logger.Debugf("Reconnecting to %s (attempt %d of %d)", disc.remote(), attempt, disc.reconnectAttempts)
+		if err := disc.run(); err != nil {
+			disc.logger.Errorf("Reconnecting to %s: %v", disc.remote(), err)
+			lastErr = err
+			continue
+		}
+		if isClosing() {
+			done()
+			return
+		}
+		if syncing {
+			disc.statusMutex.Lock()
+			if disc.eventChan != nil {
+				disc.emit(disc.newEvent("reconnected", nil))
+			}
+			if disc.snapshotQuietPeriod > 0 {
+				if disc.snapshot != nil {
+					disc.snapshot.stop()
+				}
+				disc.startSnapshot()
+			}
+			disc.statusMutex.Unlock()
+			resume := disc.startSync
+			if polling {
+				// The polling goroutine keeps running
+				resume = disc.start
+			}
+			if err := resume(); err != nil {
+				disc.logger.Errorf("Restarting sync on %s: %v", disc.remote(), err)
+				lastErr = err
+				disc.statusMutex.Lock()
+				disc.killProcess()
+				disc.statusMutex.Unlock()
+				continue
+			}
+		}
+		disc.logger.Debugf("Reconnected to %s", disc.remote())
+		done()
+		return
+	}
+
+	disc.statusMutex.Lock()
+	disc.reconnecting = false
+	disc.lastError = lastErr
+	disc.stopSyncWithError(lastErr)
+	disc.statusMutex.Unlock()
+}
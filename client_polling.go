@@ -0,0 +1,282 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// SetPollingFallback enables the fallback to the "polling" mode (see
+// StartPolling) for the discoveries that can't stay in "events" mode: if
+// the START_SYNC command is rejected by the discovery, or the discovery
+// reports an error while in "events" mode (and the sync recovery is
+// disabled or failed, see SetSyncRecovery), the Client starts the discovery
+// with the START command and polls the ports every interval, transparently
+// delivering the "add" and "remove" events in the same event channel. The
+// degradation is logged as an error. Since the Client doesn't know the
+// ports already reported in "events" mode, they are reported again with
+// new "add" events when falling back after an error. A zero interval (the
+// default) disables the fallback.
+func (disc *Client) SetPollingFallback(interval time.Duration) {
+	disc.pollingFallback = interval
+}
+
+// StartPolling puts the discovery in "polling" mode: the discovery is started
+// with the START command and a LIST is executed every interval, the result is
+// compared with the previous one and the differences are reported as "add"
+// and "remove" events in the returned channel, the same way StartSync does.
+// A port whose properties or hardware ID changed is reported as removed and
+// added again. It's meant as a fallback for the discoveries that don't
+// support (or fail) the START_SYNC command, the events are delayed up to
+// the polling interval. The polling is terminated by Stop or Quit, or by a
+// new StartSync or StartPolling, and the channel is closed.
+func (disc *Client) StartPolling(interval time.Duration, size int) (<-chan *Event, error) {
+	if err := disc.Start(); err != nil {
+		return nil, err
+	}
+
+	// In case there is already an existing event channel in use we close it before creating a new one.
+	disc.statusMutex.Lock()
+	disc.stopSync()
+	c := disc.openEventChan(size)
+	disc.startPollLoop(c, interval)
+	disc.statusMutex.Unlock()
+	return c, nil
+}
+
+// startPollingFallback starts polling the ports, in the event channel c,
+// after the START_SYNC command failed with the error err. It returns
+// false if the fallback is not possible. It must be called by StartSync.
+func (disc *Client) startPollingFallback(c chan<- *Event, err error) bool {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		// The discovery is not responding properly
+		return false
+	}
+	disc.logger.Errorf("Falling back to polling every %s: %s", disc.pollingFallback, err)
+	if err := disc.start(); err != nil {
+		disc.logger.Errorf("Falling back to polling: %s", err)
+		return false
+	}
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.eventChan != c {
+		return false
+	}
+	disc.stopStallDetection()
+	disc.startPollLoop(c, disc.pollingFallback)
+	return true
+}
+
+// syncEventReceived checks a "start_sync" message received by the decode
+// loop. An error received while in "events" mode is reported by the
+// discovery asynchronously, not in response to a command: it's recorded as
+// the last error, handled by the sync recovery or the polling fallback if
+// enabled, and true is returned. False is returned for the responses to
+// the START_SYNC command.
+func (disc *Client) syncEventReceived(msg *message) bool {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if !msg.Error {
+		disc.syncActive = disc.eventChan != nil
+		if disc.resyncing && disc.eventChan != nil {
+			// Sent before the events of the restarted sync
+			disc.emit(disc.newEvent("resynced", nil))
+		}
+		disc.resyncing = false
+		return false
+	}
+	if !disc.syncActive {
+		return false
+	}
+	disc.lastError = newCommandError("START_SYNC", msg)
+	if disc.syncRecoveryAttempts > 0 {
+		disc.syncActive = false
+		go disc.recoverSync(disc.eventChan, msg.Message)
+		return true
+	}
+	if disc.pollingFallback > 0 {
+		disc.syncActive = false
+		go disc.fallbackToPolling(disc.eventChan, msg.Message)
+		return true
+	}
+	disc.logger.Errorf("Discovery error: %s", msg.Message)
+	return true
+}
+
+// fallbackToPolling restarts the discovery in "polling" mode, delivering
+// the events in the event channel c, after the error errMsg has been
+// reported in "events" mode.
+func (disc *Client) fallbackToPolling(c chan<- *Event, errMsg string) {
+	disc.logger.Errorf("Discovery error: %s, falling back to polling every %s", errMsg, disc.pollingFallback)
+	if !disc.isEventChan(c) {
+		return
+	}
+	if err := disc.runCommand("STOP", disc.stop); err != nil {
+		disc.logger.Errorf("Falling back to polling: %s", err)
+		disc.abortSync(c, err)
+		return
+	}
+	disc.pollAfterStop(c)
+}
+
+// pollAfterStop starts the stopped discovery in "polling" mode, delivering
+// the events in the event channel c.
+func (disc *Client) pollAfterStop(c chan<- *Event) {
+	err := disc.runCommand("START", disc.start)
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.eventChan != c {
+		return
+	}
+	if err != nil {
+		disc.logger.Errorf("Falling back to polling: %s", err)
+		disc.stopSyncWithError(err)
+		return
+	}
+	disc.stopStallDetection()
+	disc.startPollLoop(c, disc.pollingFallback)
+}
+
+// runCommand runs a command, sent by the Client on its own initiative,
+// with the same instrumentation and serialization of the public methods.
+func (disc *Client) runCommand(command string, f func() error) (err error) {
+	endCommand := disc.instrumentCommand(command)
+	defer func() { endCommand(err) }()
+	if err := disc.checkNotReconnecting(); err != nil {
+		return err
+	}
+	return f()
+}
+
+// abortSync terminates the "events" mode, because of the error err, if c
+// is still the event channel.
+func (disc *Client) abortSync(c chan<- *Event, err error) {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.eventChan == c {
+		disc.stopSyncWithError(err)
+	}
+}
+
+// startPollLoop starts polling the ports in the event channel c.
+// statusMutex must be held by the caller.
+func (disc *Client) startPollLoop(c chan<- *Event, interval time.Duration) {
+	stop := make(chan struct{})
+	disc.pollStop = stop
+	go disc.pollLoop(c, interval, stop)
+}
+
+// pollLoop runs LIST every interval until the event channel c is replaced
+// or closed, or stop is closed.
+func (disc *Client) pollLoop(c chan<- *Event, interval time.Duration, stop <-chan struct{}) {
+	previous := []*Port{}
+	for {
+		if !disc.isEventChan(c) {
+			return
+		}
+		// The interval is measured from the beginning of the LIST
+		tick := disc.clock.NewTimer(interval)
+		ports, err := disc.List()
+		if err != nil {
+			disc.logger.Errorf("Polling ports: %s", err)
+		} else {
+			for _, ev := range diffPorts(previous, ports) {
+				if !disc.deliverPolledEvent(c, ev.Type, ev.Port) {
+					tick.Stop()
+					return
+				}
+			}
+			previous = ports
+		}
+		select {
+		case <-tick.C():
+		case <-stop:
+			tick.Stop()
+			return
+		}
+	}
+}
+
+// isEventChan returns true if c is the current event channel.
+func (disc *Client) isEventChan(c chan<- *Event) bool {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.eventChan == c
+}
+
+// deliverPolledEvent sends an event, detected by polling, in the event
+// channel c. It returns false if c is no more the current event channel.
+func (disc *Client) deliverPolledEvent(c chan<- *Event, eventType string, port *Port) bool {
+	disc.stats.eventReceived(eventType, disc.clock.Now())
+	disc.tracer.Event(disc.id, eventType)
+	disc.metrics.EventReceived(disc.id, eventType)
+	disc.statusMutex.Lock()
+	dispatcher := disc.dispatcher
+	current := disc.eventChan == c
+	disc.statusMutex.Unlock()
+	if !current {
+		return false
+	}
+	dispatcher.waitRoom()
+
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.eventChan != c {
+		return false
+	}
+	disc.emit(disc.newEvent(eventType, port))
+	disc.metrics.EventsBacklog(disc.id, disc.dispatcher.backlog())
+	return true
+}
+
+// diffPorts returns the "remove" and "add" events that turn the list of ports
+// previous into current. The events are returned as Event with only the Type
+// and Port fields set.
+func diffPorts(previous, current []*Port) []*Event {
+	type key struct{ protocol, address string }
+	currentPorts := map[key]*Port{}
+	for _, port := range current {
+		currentPorts[key{port.Protocol, port.Address}] = port
+	}
+	previousPorts := map[key]*Port{}
+	events := []*Event{}
+	for _, port := range previous {
+		k := key{port.Protocol, port.Address}
+		previousPorts[k] = port
+		if curr, ok := currentPorts[k]; !ok || !samePortData(port, curr) {
+			events = append(events, &Event{Type: "remove", Port: &Port{Address: port.Address, Protocol: port.Protocol}})
+		}
+	}
+	for _, port := range current {
+		if prev, ok := previousPorts[key{port.Protocol, port.Address}]; !ok || !samePortData(prev, port) {
+			events = append(events, &Event{Type: "add", Port: port})
+		}
+	}
+	return events
+}
+
+// samePortData returns true if the two ports have the same JSON encoding.
+func samePortData(a, b *Port) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
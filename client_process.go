@@ -0,0 +1,188 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// ProcessAttributes are the platform-specific attributes of the discovery
+// process spawned by a Client. They have no effect on the remote discoveries
+// and on the platforms that don't support them.
+type ProcessAttributes struct {
+	// HideConsole prevents the discovery process from opening a console
+	// window, on Windows, when the Client runs in a GUI application without
+	// a console (CREATE_NO_WINDOW).
+	HideConsole bool
+	// KillOnParentExit makes the discovery process (and the processes it
+	// starts) terminate when the process running the Client exits, even if
+	// killed abruptly. On Windows the discovery is assigned to a job object
+	// with the JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE flag.
+	KillOnParentExit bool
+	// NewProcessGroup starts the discovery process in a new process group,
+	// on Unix, so that the processes started by the discovery are killed
+	// along with it. On Windows see KillOnParentExit.
+	NewProcessGroup bool
+
+	// Niceness lowers (if positive) or raises (if negative, usually
+	// requiring elevated privileges) the scheduling priority of the
+	// discovery process, like the Unix nice command, from -20 to 19. On
+	// Windows it's mapped to a priority class: IDLE from 10, BELOW_NORMAL
+	// from 1, ABOVE_NORMAL from -1 and HIGH from -10. On Unix it's applied
+	// right after the process start.
+	Niceness int
+	// CPUAffinity is the list of the CPUs (counted from 0) the discovery
+	// process is allowed to run on, on Linux and Windows. An empty list
+	// allows all the CPUs. On Windows the discovery is assigned to a job
+	// object and only the first 64 CPUs can be used.
+	CPUAffinity []int
+	// MemoryLimit is the maximum memory, in bytes, that the discovery
+	// process can use, on Linux and Windows. A zero value means no limit.
+	// On Windows the discovery is assigned to a job object with the
+	// JOB_OBJECT_LIMIT_PROCESS_MEMORY flag. On Linux the discovery is moved
+	// to a new cgroup v2 created inside Cgroup, with the memory.max limit;
+	// the cgroup is removed when the process exits.
+	MemoryLimit uint64
+	// Cgroup is the path of the cgroup v2 directory where the cgroups of
+	// the discoveries with a MemoryLimit are created, on Linux. It must be
+	// writable by the user running the Client and have the memory
+	// controller available, for example a cgroup delegated by systemd.
+	// If empty the MemoryLimit is not applied on Linux.
+	Cgroup string
+
+	// RunAs launches the discovery process as a different user, on Unix,
+	// usually to drop the privileges of a Client running as root (see
+	// LookupProcessUser). Unlike the other attributes, the discovery is not
+	// started if the user cannot be set, or on the platforms that don't
+	// support it.
+	RunAs *ProcessUser
+	// RestrictedToken launches the discovery process, on Windows, with a
+	// restricted version of the token of the current process: all the
+	// privileges but SeChangeNotifyPrivilege are removed and, if the
+	// current user is an administrator, the token is filtered as by UAC
+	// (LUA token). As for RunAs, the discovery is not started if the token
+	// cannot be created, or on the other platforms.
+	RestrictedToken bool
+}
+
+// ProcessUser is the user and the groups of a discovery process, see
+// ProcessAttributes.RunAs.
+type ProcessUser struct {
+	UID uint32
+	GID uint32
+	// Groups are the supplementary groups, if empty the process has no
+	// supplementary groups.
+	Groups []uint32
+}
+
+// SetProcessAttributes sets the attributes of the discovery process, they
+// are applied the next time the process is started. The attributes that
+// cannot be applied are logged as errors and don't prevent the discovery
+// from running.
+func (disc *Client) SetProcessAttributes(attrs ProcessAttributes) {
+	disc.processAttributes = attrs
+}
+
+// ProcessState returns the state of the last discovery process that
+// exited, with the CPU time and the resources used by the process, or nil
+// if no process has exited yet (or the Client has been created with
+// NewTCPClient).
+func (disc *Client) ProcessState() *os.ProcessState {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.processState
+}
+
+// discoveryProcess is a running discovery process.
+type discoveryProcess struct {
+	cmd   *exec.Cmd
+	group bool
+	// stderr keeps the last lines of the standard error of the process.
+	stderr *lineTail
+	// release frees the platform-specific resources allocated for the
+	// process, it may be nil.
+	release func()
+	// started frees the resources needed only to start the process, it may
+	// be nil.
+	started func()
+}
+
+// newDiscoveryProcess prepares the discovery process with the given args
+// and attributes, returning the pipes to communicate with it.
+func newDiscoveryProcess(args []string, attrs ProcessAttributes) (*discoveryProcess, io.WriteCloser, io.ReadCloser, error) {
+	if len(args) == 0 {
+		return nil, nil, nil, errors.New("no executable specified")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	started, err := setProcessAttributes(cmd, attrs)
+	if err != nil {
+		_ = stdin.Close()
+		_ = stdout.Close()
+		return nil, nil, nil, err
+	}
+	if attrs.NewProcessGroup {
+		setProcessGroup(cmd)
+	}
+	stderr := newLineTail(crashReportStderrLines)
+	cmd.Stderr = stderr
+	return &discoveryProcess{cmd: cmd, group: attrs.NewProcessGroup, stderr: stderr, started: started}, stdin, stdout, nil
+}
+
+// start starts the process and applies the attributes that require a
+// running process. A failure applying the attributes is returned as warning
+// and doesn't prevent the process from running.
+func (p *discoveryProcess) start(attrs ProcessAttributes) (warning error, err error) {
+	err = p.cmd.Start()
+	if p.started != nil {
+		p.started()
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.release, warning = applyProcessAttributes(p.cmd.Process, attrs)
+	return warning, nil
+}
+
+// Kill causes the process, and its process group if any, to exit
+// immediately.
+func (p *discoveryProcess) Kill() error {
+	if p.group {
+		return killProcessGroup(p.cmd.Process)
+	}
+	return p.cmd.Process.Kill()
+}
+
+// Wait waits for the process to exit and frees the resources allocated for it.
+func (p *discoveryProcess) Wait() error {
+	err := p.cmd.Wait()
+	if p.release != nil {
+		p.release()
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// applyProcessLimits applies the niceness and the CPU affinity to all the
+// threads of the discovery process, and moves it to a new cgroup if a memory
+// limit is set.
+func applyProcessLimits(process *os.Process, attrs ProcessAttributes) (func(), error) {
+	var errs []error
+	if attrs.Niceness != 0 || len(attrs.CPUAffinity) > 0 {
+		for _, tid := range processThreads(process.Pid) {
+			if attrs.Niceness != 0 {
+				if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, attrs.Niceness); err != nil {
+					errs = append(errs, fmt.Errorf("setting niceness: %w", err))
+				}
+			}
+			if len(attrs.CPUAffinity) > 0 {
+				if err := setCPUAffinity(tid, attrs.CPUAffinity); err != nil {
+					errs = append(errs, fmt.Errorf("setting CPU affinity: %w", err))
+				}
+			}
+			if len(errs) > 0 {
+				break
+			}
+		}
+	}
+	var release func()
+	if attrs.MemoryLimit > 0 {
+		if attrs.Cgroup == "" {
+			errs = append(errs, errors.New("the memory limit requires a cgroup"))
+		} else if remove, err := newProcessCgroup(attrs.Cgroup, process.Pid, attrs.MemoryLimit); err != nil {
+			errs = append(errs, err)
+		} else {
+			release = remove
+		}
+	}
+	return release, errors.Join(errs...)
+}
+
+// processThreads returns the IDs of the threads of the process. The
+// niceness and the CPU affinity are per-thread attributes on Linux, the
+// threads started afterwards inherit them.
+func processThreads(pid int) []int {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return []int{pid}
+	}
+	tids := []int{}
+	for _, entry := range entries {
+		if tid, err := strconv.Atoi(entry.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids
+}
+
+// setCPUAffinity allows the thread to run only on the given CPUs.
+func setCPUAffinity(tid int, cpus []int) error {
+	mask := []uint64{}
+	for _, cpu := range cpus {
+		if cpu < 0 {
+			return fmt.Errorf("invalid CPU %d", cpu)
+		}
+		for len(mask) <= cpu/64 {
+			mask = append(mask, 0)
+		}
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// newProcessCgroup creates a cgroup for the process inside the given cgroup,
+// with the memory limit, and moves the process to it. The returned function
+// removes the cgroup once the process has exited.
+func newProcessCgroup(parent string, pid int, limit uint64) (func(), error) {
+	// Enable the memory controller for the children, if not already enabled:
+	// a failure is reported below by the missing memory.max file.
+	_ = os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory"), 0644)
+	dir := filepath.Join(parent, fmt.Sprintf("discovery-%d", pid))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating cgroup: %w", err)
+	}
+	remove := func() { _ = os.Remove(dir) }
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatUint(limit, 10)), 0644); err != nil {
+		remove()
+		return nil, fmt.Errorf("setting cgroup memory limit: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		remove()
+		return nil, fmt.Errorf("moving discovery process to cgroup: %w", err)
+	}
+	return remove, nil
+}
@@ -0,0 +1,84 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessLimits(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	cl := NewClient("1", "dummy-discovery/dummy-discovery")
+	cl.SetProcessAttributes(ProcessAttributes{Niceness: 5, CPUAffinity: []int{0}})
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+	cl.statusMutex.Lock()
+	process := cl.process.cmd.Process
+	cl.statusMutex.Unlock()
+	pid := process.Pid
+
+	for _, tid := range processThreads(pid) {
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/stat", pid, tid))
+		require.NoError(t, err)
+		// The fields after the command name, the niceness is the 19th field
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		require.Equal(t, "5", fields[16])
+		status, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%d/status", pid, tid))
+		require.NoError(t, err)
+		require.Contains(t, string(status), "Cpus_allowed_list:\t0\n")
+	}
+
+	_, err = applyProcessLimits(process, ProcessAttributes{CPUAffinity: []int{-1}})
+	require.EqualError(t, err, "setting CPU affinity: invalid CPU -1")
+	_, err = applyProcessLimits(process, ProcessAttributes{MemoryLimit: 1 << 20})
+	require.EqualError(t, err, "the memory limit requires a cgroup")
+}
+
+func TestProcessCgroup(t *testing.T) {
+	// A plain directory stands for the delegated cgroup
+	parent := paths.New(t.TempDir())
+	remove, err := newProcessCgroup(parent.String(), 1234, 64<<20)
+	require.NoError(t, err)
+	cgroup := parent.Join("discovery-1234")
+	for file, expected := range map[string]string{
+		"memory.max":   "67108864",
+		"cgroup.procs": "1234",
+	} {
+		data, err := cgroup.Join(file).ReadFile()
+		require.NoError(t, err)
+		require.Equal(t, expected, string(data))
+	}
+	data, err := parent.Join("cgroup.subtree_control").ReadFile()
+	require.NoError(t, err)
+	require.Equal(t, "+memory", string(data))
+	require.NotNil(t, remove)
+
+	// The cgroup of the same process already exists
+	_, err = newProcessCgroup(parent.String(), 1234, 64<<20)
+	require.ErrorContains(t, err, "creating cgroup")
+}
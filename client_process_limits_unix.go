@@ -0,0 +1,38 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build unix && !linux
+
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// applyProcessLimits applies the niceness of the discovery process, the
+// CPU affinity and the memory limit are not supported.
+func applyProcessLimits(process *os.Process, attrs ProcessAttributes) (func(), error) {
+	if attrs.Niceness == 0 {
+		return nil, nil
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, process.Pid, attrs.Niceness); err != nil {
+		return nil, fmt.Errorf("setting niceness: %w", err)
+	}
+	return nil, nil
+}
@@ -0,0 +1,71 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessRunAs(t *testing.T) {
+	root, err := LookupProcessUser("root")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), root.UID)
+	require.Equal(t, uint32(0), root.GID)
+	_, err = LookupProcessUser("no-such-user")
+	require.Error(t, err)
+
+	// The discovery must be reachable by the other user
+	dir := paths.New(t.TempDir())
+	for _, d := range []*paths.Path{dir.Parent(), dir} {
+		require.NoError(t, os.Chmod(d.String(), 0755))
+	}
+	builder, err := paths.NewProcess(nil, "go", "build", "-o", dir.Join("dummy-discovery").String())
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	// The Windows restricted token is refused instead of being ignored
+	cl := NewClient("restricted", dir.Join("dummy-discovery").String())
+	cl.SetProcessAttributes(ProcessAttributes{RestrictedToken: true})
+	require.EqualError(t, cl.Run(), "the restricted token is supported only on Windows")
+
+	nobody := &ProcessUser{UID: 65534, GID: 65534}
+	cl = NewClient("1", dir.Join("dummy-discovery").String())
+	cl.SetProcessAttributes(ProcessAttributes{RunAs: nobody})
+	if os.Getuid() != 0 {
+		// Only root can run a process as a different user
+		require.Error(t, cl.Run())
+		require.False(t, cl.Alive())
+		return
+	}
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+	cl.statusMutex.Lock()
+	pid := cl.process.cmd.Process.Pid
+	cl.statusMutex.Unlock()
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	require.NoError(t, err)
+	require.Contains(t, string(status), "Uid:\t65534\t65534\t65534\t65534\n")
+	require.Contains(t, string(status), "Gid:\t65534\t65534\t65534\t65534\n")
+	require.Regexp(t, `\nGroups:\s*\n`, string(status))
+}
@@ -0,0 +1,37 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !unix
+
+package discovery
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+func setProcessUser(cmd *exec.Cmd, runAs *ProcessUser) error {
+	return fmt.Errorf("running the discovery as a different user is not supported on %s", runtime.GOOS)
+}
+
+// LookupProcessUser returns the ProcessUser with the IDs of the user with
+// the given name, its primary group and its supplementary groups. It's
+// supported only on Unix.
+func LookupProcessUser(name string) (*ProcessUser, error) {
+	return nil, fmt.Errorf("running the discovery as a different user is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,189 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	createNoWindow                = 0x08000000
+	idlePriorityClass             = 0x00000040
+	highPriorityClass             = 0x00000080
+	belowNormalPriorityClass      = 0x00004000
+	aboveNormalPriorityClass      = 0x00008000
+	jobObjectLimitAffinity        = 0x00000010
+	jobObjectLimitProcessMemory   = 0x00000100
+	jobObjectLimitKillOnJobClose  = 0x00002000
+	jobObjectExtendedLimitInfoCls = 9
+	processSetQuota               = 0x0100
+	processTerminate              = 0x0001
+	disableMaxPrivilege           = 0x1
+	luaToken                      = 0x4
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	advapi32                     = syscall.NewLazyDLL("advapi32.dll")
+	procCreateRestrictedToken    = advapi32.NewProc("CreateRestrictedToken")
+)
+
+// jobObjectExtendedLimitInformation is the JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+// structure of the Windows API.
+type jobObjectExtendedLimitInformation struct {
+	BasicLimitInformation struct {
+		PerProcessUserTimeLimit int64
+		PerJobUserTimeLimit     int64
+		LimitFlags              uint32
+		MinimumWorkingSetSize   uintptr
+		MaximumWorkingSetSize   uintptr
+		ActiveProcessLimit      uint32
+		Affinity                uintptr
+		PriorityClass           uint32
+		SchedulingClass         uint32
+	}
+	IoInfo struct {
+		ReadOperationCount  uint64
+		WriteOperationCount uint64
+		OtherOperationCount uint64
+		ReadTransferCount   uint64
+		WriteTransferCount  uint64
+		OtherTransferCount  uint64
+	}
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// setProcessAttributes sets the creation flags and the token of the
+// process. The returned function closes the restricted token, if any.
+func setProcessAttributes(cmd *exec.Cmd, attrs ProcessAttributes) (func(), error) {
+	if attrs.RunAs != nil {
+		return nil, setProcessUser(cmd, attrs.RunAs)
+	}
+	// Never show the command prompt of the discovery
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	if attrs.HideConsole {
+		cmd.SysProcAttr.CreationFlags |= createNoWindow
+	}
+	cmd.SysProcAttr.CreationFlags |= priorityClass(attrs.Niceness)
+	if !attrs.RestrictedToken {
+		return nil, nil
+	}
+	token, err := newRestrictedToken()
+	if err != nil {
+		return nil, err
+	}
+	cmd.SysProcAttr.Token = token
+	return func() { _ = token.Close() }, nil
+}
+
+// newRestrictedToken creates a restricted version of the token of the
+// current process, without privileges and filtered as by UAC.
+func newRestrictedToken() (syscall.Token, error) {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, fmt.Errorf("creating restricted token: %w", err)
+	}
+	var current syscall.Token
+	if err := syscall.OpenProcessToken(process, syscall.TOKEN_DUPLICATE|syscall.TOKEN_QUERY|syscall.TOKEN_ASSIGN_PRIMARY, &current); err != nil {
+		return 0, fmt.Errorf("creating restricted token: %w", err)
+	}
+	defer current.Close()
+	var restricted syscall.Token
+	if res, _, err := procCreateRestrictedToken.Call(uintptr(current), disableMaxPrivilege|luaToken, 0, 0, 0, 0, 0, 0, uintptr(unsafe.Pointer(&restricted))); res == 0 {
+		return 0, fmt.Errorf("creating restricted token: %w", err)
+	}
+	return restricted, nil
+}
+
+// priorityClass maps the Unix niceness to the creation flag of the
+// corresponding priority class, 0 keeps the default.
+func priorityClass(niceness int) uint32 {
+	switch {
+	case niceness >= 10:
+		return idlePriorityClass
+	case niceness > 0:
+		return belowNormalPriorityClass
+	case niceness <= -10:
+		return highPriorityClass
+	case niceness < 0:
+		return aboveNormalPriorityClass
+	default:
+		return 0
+	}
+}
+
+// applyProcessAttributes assigns the process to a job object that kills it
+// when the last handle to the job is closed, that is when the parent exits,
+// and that enforces the CPU affinity and the memory limit. The returned
+// function closes the job handle.
+func applyProcessAttributes(process *os.Process, attrs ProcessAttributes) (func(), error) {
+	var info jobObjectExtendedLimitInformation
+	if attrs.KillOnParentExit {
+		info.BasicLimitInformation.LimitFlags |= jobObjectLimitKillOnJobClose
+	}
+	if len(attrs.CPUAffinity) > 0 {
+		var mask uintptr
+		for _, cpu := range attrs.CPUAffinity {
+			if cpu < 0 || cpu >= int(unsafe.Sizeof(mask)*8) {
+				return nil, fmt.Errorf("setting CPU affinity: invalid CPU %d", cpu)
+			}
+			mask |= 1 << cpu
+		}
+		info.BasicLimitInformation.LimitFlags |= jobObjectLimitAffinity
+		info.BasicLimitInformation.Affinity = mask
+	}
+	if attrs.MemoryLimit > 0 {
+		info.BasicLimitInformation.LimitFlags |= jobObjectLimitProcessMemory
+		info.ProcessMemoryLimit = uintptr(attrs.MemoryLimit)
+	}
+	if info.BasicLimitInformation.LimitFlags == 0 {
+		return nil, nil
+	}
+	job, _, err := procCreateJobObjectW.Call(0, 0)
+	if job == 0 {
+		return nil, fmt.Errorf("creating job object: %w", err)
+	}
+	closeJob := func() { _ = syscall.CloseHandle(syscall.Handle(job)) }
+
+	if res, _, err := procSetInformationJobObject.Call(job, jobObjectExtendedLimitInfoCls, uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); res == 0 {
+		closeJob()
+		return nil, fmt.Errorf("setting job object limits: %w", err)
+	}
+
+	handle, err := syscall.OpenProcess(processSetQuota|processTerminate, false, uint32(process.Pid))
+	if err != nil {
+		closeJob()
+		return nil, fmt.Errorf("opening discovery process: %w", err)
+	}
+	defer syscall.CloseHandle(handle)
+	if res, _, err := procAssignProcessToJobObject.Call(job, uintptr(handle)); res == 0 {
+		closeJob()
+		return nil, fmt.Errorf("assigning discovery process to job object: %w", err)
+	}
+	return closeJob, nil
+}
@@ -0,0 +1,111 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"time"
+)
+
+// maxSyncRecoveryDelay is the maximum delay between the attempts to
+// recover the "events" mode.
+const maxSyncRecoveryDelay = time.Minute
+
+// SetSyncRecovery enables the automatic recovery of the "events" mode: as
+// stated by the protocol, after the discovery reported an error in "events"
+// mode only a STOP + START_SYNC cycle resumes the events. The Client sends
+// the STOP command and tries to send the START_SYNC command for the given
+// number of attempts, waiting the given delay before the first attempt and
+// doubling it (up to a minute) before each of the following ones. When
+// the sync is restarted a "resynced" event is sent in the event channel:
+// the ports reported before must be considered stale, since the discovery
+// will report again all the available ports (as a "snapshot" event if the
+// initial snapshot mode is enabled). If all the attempts fail the Client
+// falls back to polling, if enabled (see SetPollingFallback), otherwise
+// the event channel is closed. Zero attempts (the default) disable the
+// recovery.
+func (disc *Client) SetSyncRecovery(attempts int, delay time.Duration) {
+	disc.syncRecoveryAttempts = attempts
+	disc.syncRecoveryDelay = delay
+}
+
+// SetSyncRecoveryBackoff sets the Backoff computing the delays before the
+// attempts to recover the "events" mode, in place of the delay doubled at
+// each attempt given to SetSyncRecovery, that still enables the recovery
+// and sets the number of attempts. A nil backoff restores the default.
+func (disc *Client) SetSyncRecoveryBackoff(backoff Backoff) {
+	disc.syncRecoveryBackoff = backoff
+}
+
+// recoverSync restarts the "events" mode, delivering the events in the
+// event channel c, after the error errMsg has been reported by the
+// discovery.
+func (disc *Client) recoverSync(c chan<- *Event, errMsg string) {
+	disc.logger.Errorf("Discovery error: %s, restarting sync", errMsg)
+	if !disc.isEventChan(c) {
+		return
+	}
+	if err := disc.runCommand("STOP", disc.stop); err != nil {
+		disc.logger.Errorf("Restarting sync: %s", err)
+		disc.abortSync(c, err)
+		return
+	}
+
+	var err error
+	backoff := disc.syncRecoveryBackoff
+	if backoff == nil {
+		backoff = ExponentialBackoff(disc.syncRecoveryDelay, maxSyncRecoveryDelay, 0)
+	}
+	for attempt := 1; attempt <= disc.syncRecoveryAttempts; attempt++ {
+		sleep(disc.clock, backoff.Delay(attempt))
+
+		disc.statusMutex.Lock()
+		if disc.eventChan != c {
+			disc.statusMutex.Unlock()
+			return
+		}
+		disc.resyncing = true
+		if disc.snapshotQuietPeriod > 0 {
+			if disc.snapshot != nil {
+				disc.snapshot.stop()
+			}
+			disc.startSnapshot()
+		}
+		disc.statusMutex.Unlock()
+
+		err = disc.runCommand("START_SYNC", disc.startSync)
+		if err == nil {
+			disc.logger.Debugf("Sync restarted")
+			return
+		}
+		disc.logger.Errorf("Restarting sync (attempt %d of %d): %s", attempt, disc.syncRecoveryAttempts, err)
+		disc.statusMutex.Lock()
+		disc.resyncing = false
+		if disc.snapshot != nil {
+			disc.snapshot.stop()
+			disc.snapshot = nil
+		}
+		disc.statusMutex.Unlock()
+	}
+
+	if disc.pollingFallback > 0 {
+		disc.logger.Errorf("Falling back to polling every %s", disc.pollingFallback)
+		disc.pollAfterStop(c)
+		return
+	}
+	disc.abortSync(c, err)
+}
@@ -0,0 +1,195 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"slices"
+	"sync"
+)
+
+// SyncHandle is a reference to the "events" mode of a Client shared by
+// many consumers, obtained with Client.AcquireSync.
+type SyncHandle struct {
+	shared *sharedSync
+	events chan *Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+// sharedSync fans out the events of a StartSync to the acquired handles.
+type sharedSync struct {
+	disc    *Client
+	mutex   sync.Mutex
+	handles map[*SyncHandle]bool
+	ports   map[sharedPortKey]*Port
+	closed  bool
+}
+
+type sharedPortKey struct{ protocol, address string }
+
+// AcquireSync returns a handle to the "events" mode of the Client, that can
+// be shared by many consumers: the first call puts the discovery in
+// "events" mode with StartSync and each handle receives a copy of the
+// events in its own channel (of the given size). A consumer acquiring the
+// handle while the discovery is already in "events" mode receives first
+// an "add" event (with a zero Seq) for each port currently available. The
+// discovery is stopped only when the last handle is released. The events
+// are shared between the handles and must not be modified. If the
+// "events" mode is terminated in another way (for example by a direct
+// call to Stop or StartSync, or because the discovery crashed) the
+// channels of all the handles are closed.
+func (disc *Client) AcquireSync(size int) (*SyncHandle, error) {
+	disc.sharedMutex.Lock()
+	defer disc.sharedMutex.Unlock()
+	s := disc.shared
+	if s == nil || s.isClosed() {
+		events, err := disc.StartSync(size)
+		if err != nil {
+			return nil, err
+		}
+		s = &sharedSync{
+			disc:    disc,
+			handles: map[*SyncHandle]bool{},
+			ports:   map[sharedPortKey]*Port{},
+		}
+		disc.shared = s
+		go s.run(events)
+	}
+	return s.acquire(size), nil
+}
+
+// Events returns the channel of the events of the handle. The channel is
+// closed when the handle is released or the "events" mode is terminated.
+func (h *SyncHandle) Events() <-chan *Event {
+	return h.events
+}
+
+// Release releases the handle and closes its event channel. If it's the
+// last handle acquired the discovery is stopped, and the result of the Stop
+// command is returned. Calling Release more than once has no effect.
+func (h *SyncHandle) Release() (err error) {
+	h.once.Do(func() { err = h.shared.release(h) })
+	return err
+}
+
+// acquire creates a new handle, replaying the currently available ports.
+func (s *sharedSync) acquire(size int) *SyncHandle {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// The channel must hold the replayed ports, the handle has not been
+	// returned to the consumer yet.
+	h := &SyncHandle{
+		shared: s,
+		events: make(chan *Event, size+len(s.ports)),
+		done:   make(chan struct{}),
+	}
+	if s.closed {
+		close(h.events)
+		return h
+	}
+	ports := make([]*Port, 0, len(s.ports))
+	for _, port := range s.ports {
+		ports = append(ports, port)
+	}
+	slices.SortFunc(ports, ComparePorts)
+	for _, port := range ports {
+		h.events <- &Event{Type: "add", Port: port, DiscoveryID: s.disc.GetID(), Timestamp: s.disc.clock.Now()}
+	}
+	s.handles[h] = true
+	return h
+}
+
+// release removes the handle h and stops the discovery if h was the last
+// handle acquired.
+func (s *sharedSync) release(h *SyncHandle) error {
+	// Unblock the fan out, if it's waiting to deliver an event to h
+	close(h.done)
+	s.mutex.Lock()
+	if s.handles[h] {
+		delete(s.handles, h)
+		close(h.events)
+	}
+	last := len(s.handles) == 0 && !s.closed
+	s.mutex.Unlock()
+	if !last {
+		return nil
+	}
+
+	disc := s.disc
+	disc.sharedMutex.Lock()
+	defer disc.sharedMutex.Unlock()
+	// A new handle may have been acquired in the meantime
+	if disc.shared != s || s.count() > 0 {
+		return nil
+	}
+	disc.shared = nil
+	return disc.Stop()
+}
+
+// run delivers the events to the handles until the event channel is closed.
+func (s *sharedSync) run(events <-chan *Event) {
+	for ev := range events {
+		s.mutex.Lock()
+		s.track(ev)
+		for h := range s.handles {
+			select {
+			case h.events <- ev:
+			case <-h.done:
+			}
+		}
+		s.mutex.Unlock()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for h := range s.handles {
+		close(h.events)
+	}
+	s.handles = nil
+}
+
+// track updates the currently available ports with the event ev.
+// s.mutex must be held by the caller.
+func (s *sharedSync) track(ev *Event) {
+	switch ev.Type {
+	case "add":
+		s.ports[sharedPortKey{ev.Port.Protocol, ev.Port.Address}] = ev.Port
+	case "remove":
+		delete(s.ports, sharedPortKey{ev.Port.Protocol, ev.Port.Address})
+	case "snapshot":
+		clear(s.ports)
+		for _, port := range ev.Ports {
+			s.ports[sharedPortKey{port.Protocol, port.Address}] = port
+		}
+	case "reconnected", "resynced":
+		// All the ports are going to be reported again
+		clear(s.ports)
+	}
+}
+
+func (s *sharedSync) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *sharedSync) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.handles)
+}
@@ -0,0 +1,85 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "time"
+
+// snapshotCollector accumulates the initial burst of port events after a
+// StartSync, to deliver them to the client as a single "snapshot" event.
+type snapshotCollector struct {
+	ports    []*Port
+	timer    ClockTimer
+	maxTimer ClockTimer
+}
+
+// startSnapshot starts collecting the initial burst of events.
+// statusMutex must be held by the caller.
+func (disc *Client) startSnapshot() {
+	c := &snapshotCollector{ports: []*Port{}}
+	flush := func() {
+		disc.statusMutex.Lock()
+		defer disc.statusMutex.Unlock()
+		// Ignore timers belonging to an already delivered snapshot
+		if disc.snapshot == c {
+			disc.flushSnapshot()
+		}
+	}
+	c.timer = disc.clock.AfterFunc(disc.snapshotQuietPeriod, flush)
+	if disc.snapshotMaxWait > 0 {
+		c.maxTimer = disc.clock.AfterFunc(disc.snapshotMaxWait, flush)
+	}
+	disc.snapshot = c
+}
+
+// flushSnapshot delivers the collected snapshot and returns to the normal
+// event streaming mode. statusMutex must be held by the caller.
+func (disc *Client) flushSnapshot() {
+	c := disc.snapshot
+	disc.snapshot = nil
+	c.stop()
+	if disc.eventChan == nil {
+		return
+	}
+	ev := disc.newEvent("snapshot", nil)
+	ev.Ports = c.ports
+	disc.emit(ev)
+	disc.metrics.EventsBacklog(disc.id, disc.dispatcher.backlog())
+}
+
+// stop stops the snapshot timers.
+func (c *snapshotCollector) stop() {
+	c.timer.Stop()
+	if c.maxTimer != nil {
+		c.maxTimer.Stop()
+	}
+}
+
+// collect adds (or removes) the port to the collected snapshot and
+// restarts the quiet period timer. statusMutex must be held by the caller.
+func (c *snapshotCollector) collect(eventType string, port *Port, quietPeriod time.Duration) {
+	for i, p := range c.ports {
+		if p.Equals(port) {
+			c.ports = append(c.ports[:i], c.ports[i+1:]...)
+			break
+		}
+	}
+	if eventType == "add" {
+		c.ports = append(c.ports, port)
+	}
+	c.timer.Reset(quietPeriod)
+}
@@ -0,0 +1,90 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStalled is the error reported by a Client that has been terminated
+// because the discovery stalled, see Client.SetStallTimeout.
+var ErrStalled = errors.New("discovery stalled")
+
+// SetStallTimeout enables the detection of stalled discoveries while in
+// "events" mode: if the discovery doesn't send any message (events or
+// responses) for the given timeout, it's considered stalled and the
+// connection is closed (or the process killed). If the Client has been
+// created WithReconnect the discovery is connected again and the sync is
+// resumed, otherwise the event channel is closed as if the discovery had
+// crashed. Since an idle discovery doesn't send any message, the timeout
+// must be much longer than the usual interval between the events. A zero
+// timeout (the default) disables the feature.
+func (disc *Client) SetStallTimeout(timeout time.Duration) {
+	disc.stallTimeout = timeout
+}
+
+// startStallDetection starts the inactivity timer, if enabled.
+// statusMutex must be held by the caller.
+func (disc *Client) startStallDetection() {
+	if disc.stallTimeout <= 0 || disc.stallTimer != nil {
+		return
+	}
+	disc.stallTimer = disc.clock.AfterFunc(disc.stallTimeout, disc.stalled)
+}
+
+// stopStallDetection stops the inactivity timer.
+// statusMutex must be held by the caller.
+func (disc *Client) stopStallDetection() {
+	if disc.stallTimer != nil {
+		disc.stallTimer.Stop()
+		disc.stallTimer = nil
+	}
+}
+
+// resetStallTimer restarts the inactivity timer after a message has been
+// received from the discovery.
+func (disc *Client) resetStallTimer() {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.stallTimer != nil {
+		disc.stallTimer.Reset(disc.stallTimeout)
+	}
+}
+
+// stalled is called when the inactivity timer expires: the communication
+// is terminated, so that the decode loop reports ErrStalled and applies the
+// reconnection policy. The timer is restarted by the first message received
+// after the reconnection.
+func (disc *Client) stalled() {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	if disc.stallTimer == nil || disc.eventChan == nil || disc.reconnecting || disc.closing {
+		return
+	}
+	disc.logger.Errorf("No messages received from %s for %s: discovery stalled", disc, disc.stallTimeout)
+	disc.stats.stallDetected()
+	disc.stallDetected = true
+	if conn := disc.conn; conn != nil {
+		// The connection is closed but not released, to make the decode
+		// loop start the reconnection
+		_ = conn.Close()
+	} else if process := disc.process; process != nil {
+		_ = process.Kill()
+	}
+}
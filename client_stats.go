@@ -0,0 +1,142 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// ClientStats is a snapshot of the counters collected by a Client.
+type ClientStats struct {
+	// CommandsSent is the number of commands sent to the discovery.
+	CommandsSent uint64
+	// ResponsesReceived is the number of command responses received.
+	ResponsesReceived uint64
+	// EventsByType is the number of port events received, by event type.
+	EventsByType map[string]uint64
+	// DecodeErrors is the number of messages that could not be decoded.
+	DecodeErrors uint64
+	// SkippedMessages is the number of malformed messages skipped, see
+	// Client.SetDecodeRecovery.
+	SkippedMessages uint64
+	// LastEventTime is the time when the last port event has been received.
+	LastEventTime time.Time
+	// ProcessRestarts is the number of times the discovery process has been
+	// started again after the first run.
+	ProcessRestarts uint64
+	// Stalls is the number of times the discovery has been detected as
+	// stalled, see Client.SetStallTimeout.
+	Stalls uint64
+	// SuppressedEvents is the number of duplicate "add" events and of
+	// "remove" events of unknown ports dropped, see
+	// Client.SetEventDeduplication.
+	SuppressedEvents uint64
+	// EventsBacklog is the number of events waiting to be consumed in the
+	// event channel returned by StartSync.
+	EventsBacklog int
+}
+
+// clientStats collects the Client counters. It has its own mutex to not
+// interfere (or deadlock) with the Client statusMutex.
+type clientStats struct {
+	mutex         sync.Mutex
+	stats         ClientStats
+	processStarts uint64
+	dispatcher    *eventDispatcher
+}
+
+func (s *clientStats) commandSent() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.CommandsSent++
+}
+
+func (s *clientStats) responseReceived() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.ResponsesReceived++
+}
+
+func (s *clientStats) eventReceived(eventType string, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stats.EventsByType == nil {
+		s.stats.EventsByType = map[string]uint64{}
+	}
+	s.stats.EventsByType[eventType]++
+	s.stats.LastEventTime = now
+}
+
+func (s *clientStats) decodeError() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.DecodeErrors++
+}
+
+func (s *clientStats) messageSkipped() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.SkippedMessages++
+}
+
+func (s *clientStats) eventSuppressed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.SuppressedEvents++
+}
+
+func (s *clientStats) stallDetected() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.Stalls++
+}
+
+// processStarted counts a new process start and returns true if it's a restart.
+func (s *clientStats) processStarted() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.processStarts++
+	if s.processStarts > 1 {
+		s.stats.ProcessRestarts++
+		return true
+	}
+	return false
+}
+
+func (s *clientStats) setDispatcher(d *eventDispatcher) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dispatcher = d
+}
+
+// Stats returns a snapshot of the counters collected by the Client.
+func (disc *Client) Stats() ClientStats {
+	s := &disc.stats
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := s.stats
+	res.EventsByType = map[string]uint64{}
+	for k, v := range s.stats.EventsByType {
+		res.EventsByType[k] = v
+	}
+	if s.dispatcher != nil {
+		res.EventsBacklog = s.dispatcher.backlog()
+	}
+	return res
+}
@@ -0,0 +1,119 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "fmt"
+
+// SetStrictStateValidation enables the tracking, in the Client, of the
+// state of the discovery, as implied by the successful responses to the
+// commands, to detect the messages not allowed in that state: the "add"
+// and "remove" events received outside the "events" mode (for example
+// before the response to START_SYNC) are dropped, the responses not
+// allowed (like a "list" while in "events" mode) are delivered anyway to
+// the commands waiting for them. All of them are reported as
+// ViolationInvalidState, to the handler set with
+// SetProtocolViolationHandler, and logged, to give the authors of the
+// discoveries precise diagnostics. This method must be called before Run.
+func (disc *Client) SetStrictStateValidation(enabled bool) {
+	disc.strictState = enabled
+}
+
+// discoveryState is the state of the discovery as seen by the Client.
+type discoveryState int
+
+const (
+	stateWaitingHello discoveryState = iota
+	stateIdle
+	stateStarted
+	stateSyncing
+	stateQuit
+)
+
+func (s discoveryState) String() string {
+	switch s {
+	case stateWaitingHello:
+		return "waiting for HELLO"
+	case stateIdle:
+		return "idle"
+	case stateStarted:
+		return "STARTed"
+	case stateSyncing:
+		return "START_SYNCed"
+	case stateQuit:
+		return "QUIT"
+	}
+	return "unknown"
+}
+
+// stateTracker follows the state machine of the discovery, see
+// SetStrictStateValidation. It's used only by the decode loop.
+type stateTracker struct {
+	state discoveryState
+}
+
+// event checks a port event, it returns an error if the event is not
+// allowed in the current state.
+func (t *stateTracker) event(eventType string) error {
+	if t.state != stateSyncing {
+		return fmt.Errorf("'%s' event received while %s, the events are allowed only after a successful START_SYNC", eventType, t.state)
+	}
+	return nil
+}
+
+// response checks a response and updates the state accordingly, it returns
+// an error if the response is not allowed in the current state. The error
+// responses are always allowed, the discovery is rejecting the command.
+func (t *stateTracker) response(msg *message) error {
+	if msg.Error {
+		return nil
+	}
+	var allowed bool
+	previous := t.state
+	switch msg.EventType {
+	case "hello":
+		allowed = previous == stateWaitingHello
+		t.state = stateIdle
+	case "start":
+		allowed = previous == stateIdle
+		t.state = stateStarted
+	case "start_sync":
+		allowed = previous == stateIdle
+		t.state = stateSyncing
+	case "stop":
+		// STOP may be idempotent, see Server.SetIdempotentStop
+		allowed = previous != stateWaitingHello && previous != stateQuit
+		t.state = stateIdle
+	case "list":
+		allowed = previous == stateStarted
+	case "quit":
+		allowed = previous != stateQuit
+		t.state = stateQuit
+	default:
+		allowed = previous != stateWaitingHello && previous != stateQuit
+	}
+	if !allowed {
+		return fmt.Errorf("'%s' response received while %s", msg.EventType, previous)
+	}
+	return nil
+}
+
+// invalidState reports a message not allowed in the current state.
+func (disc *Client) invalidState(state discoveryState, got string, raw []byte, err error) {
+	disc.logger.Errorf("Protocol violation: %v", err)
+	disc.reportViolation(ViolationInvalidState, state.String(), got, raw, err)
+}
@@ -0,0 +1,108 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientStrictStateValidation(t *testing.T) {
+	// A discovery sending the events before the START_SYNC response and
+	// answering LIST while in "events" mode
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		reader := bufio.NewReader(serverConn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd, _, _ := strings.Cut(strings.TrimSpace(line), " "); cmd {
+			case "HELLO":
+				fmt.Fprintln(serverConn, `{"eventType":"hello","message":"OK","protocolVersion":1}`)
+			case "START_SYNC":
+				fmt.Fprintln(serverConn, `{"eventType":"add","port":{"address":"early","protocol":"test"}}`)
+				fmt.Fprintln(serverConn, `{"eventType":"start_sync","message":"OK"}`)
+				fmt.Fprintln(serverConn, `{"eventType":"add","port":{"address":"1","protocol":"test"}}`)
+			case "LIST":
+				fmt.Fprintln(serverConn, `{"eventType":"list","ports":[]}`)
+			case "QUIT":
+				fmt.Fprintln(serverConn, `{"eventType":"quit","message":"OK"}`)
+				return
+			}
+		}
+	}()
+
+	var mutex sync.Mutex
+	violations := []Violation{}
+	cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	cl.SetStrictStateValidation(true)
+	cl.SetProtocolViolationHandler(func(v Violation) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		violations = append(violations, v)
+	})
+	require.NoError(t, cl.Run())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	// The early event is dropped
+	require.Equal(t, "1", (<-events).Port.Address)
+	// The response is delivered anyway
+	ports, err := cl.List()
+	require.NoError(t, err)
+	require.Empty(t, ports)
+	cl.Quit()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, violations, 2)
+	require.Equal(t, ViolationInvalidState, violations[0].Kind)
+	require.Equal(t, "idle", violations[0].Expected)
+	require.Equal(t, "add", violations[0].Got)
+	require.Contains(t, string(violations[0].Raw), "early")
+	require.EqualError(t, violations[0].Err, "'add' event received while idle, the events are allowed only after a successful START_SYNC")
+	require.Equal(t, ViolationInvalidState, violations[1].Kind)
+	require.EqualError(t, violations[1].Err, "'list' response received while START_SYNCed")
+}
+
+func TestStateTracker(t *testing.T) {
+	tracker := &stateTracker{}
+	require.Error(t, tracker.response(messageOk("start")))
+	tracker = &stateTracker{}
+	require.NoError(t, tracker.response(messageError("start", ErrorCodeNotInitialized, "First command must be HELLO")))
+	require.NoError(t, tracker.response(&message{EventType: "hello", Message: "OK"}))
+	require.Error(t, tracker.event("add"))
+	require.NoError(t, tracker.response(messageOk("start")))
+	require.NoError(t, tracker.response(&message{EventType: "list"}))
+	require.Error(t, tracker.response(messageOk("start_sync")))
+	require.NoError(t, tracker.response(messageOk("stop")))
+	require.NoError(t, tracker.response(messageOk("start_sync")))
+	require.NoError(t, tracker.event("remove"))
+	require.NoError(t, tracker.response(messageOk("stop")))
+	require.NoError(t, tracker.response(messageOk("quit")))
+	require.Error(t, tracker.response(messageOk("quit")))
+}
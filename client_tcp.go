@@ -0,0 +1,77 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package discovery
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+// WithTLS enables TLS for a Client created with NewTCPClient, using the
+// given configuration.
+func WithTLS(config *tls.Config) ClientOption {
+	return func(disc *Client) {
+		if disc.address != "" {
+			disc.dialer = tcpDialer(disc.address, config)
+		}
+	}
+}
+
+// NewTCPClient create a new pluggable discovery client that connects to a
+// remote discovery, served at the given address (for example using
+// Server.Serve), instead of spawning a discovery process.
+func NewTCPClient(id, address string, opts ...ClientOption) *Client {
+	disc := NewClient(id)
+	disc.address = address
+	disc.dialer = tcpDialer(address, nil)
+	for _, opt := range opts {
+		opt(disc)
+	}
+	return disc
+}
+
+// tcpDialer returns the function connecting to the discovery at the given
+// address, with TLS if config is not nil.
+func tcpDialer(address string, config *tls.Config) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		dialer := &net.Dialer{Timeout: time.Second * 10}
+		if config != nil {
+			return tls.DialWithDialer(dialer, "tcp", address, config)
+		}
+		return dialer.Dial("tcp", address)
+	}
+}
+
+// NewUnixClient create a new pluggable discovery client that connects to a
+// local discovery, served on the unix domain socket at the given path (for
+// example using Server.Serve with ListenUnix), instead of spawning a
+// discovery process.
+func NewUnixClient(id, path string, opts ...ClientOption) *Client {
+	disc := NewClient(id)
+	disc.dialer = func() (io.ReadWriteCloser, error) {
+		return net.DialTimeout("unix", path, time.Second*10)
+	}
+	for _, opt := range opts {
+		opt(disc)
+	}
+	return disc
+}
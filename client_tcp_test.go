@@ -0,0 +1,243 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package discovery
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.conns <- conn
+	}
+	return conn, err
+}
+
+func TestTCPClient(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := &recordingListener{Listener: tcpListener, conns: make(chan net.Conn, 10)}
+	defer listener.Close()
+	go NewServer(&testDiscovery{}).Serve(listener)
+
+	t.Run("Reconnect", func(t *testing.T) {
+		cl := NewTCPClient("tcp", listener.Addr().String(), WithReconnect(3, 300*time.Millisecond))
+		cl.SetLogger(&testLogger{})
+		require.NoError(t, cl.Run())
+		require.True(t, cl.Alive())
+		ch, err := cl.StartSync(10)
+		require.NoError(t, err)
+		ev := <-ch
+		require.Equal(t, "add", ev.Type)
+		require.Equal(t, "tcp", ev.DiscoveryID)
+
+		// Drop the connection from the server side: the client reconnects
+		// and restarts the sync on the same channel.
+		(<-listener.conns).Close()
+		require.Eventually(t, func() bool {
+			_, err := cl.List()
+			return errors.Is(err, ErrReconnecting)
+		}, time.Second, 10*time.Millisecond)
+		for _, expected := range []string{"reconnected", "add"} {
+			select {
+			case ev := <-ch:
+				require.Equal(t, expected, ev.Type)
+			case <-time.After(2 * time.Second):
+				t.Fatal("client did not reconnect")
+			}
+		}
+		require.Equal(t, uint64(1), cl.Stats().ProcessRestarts)
+
+		cl.Quit()
+		require.Equal(t, "stop", (<-ch).Type)
+		_, ok := <-ch
+		require.False(t, ok)
+		require.False(t, cl.Alive())
+		<-listener.conns
+	})
+
+	t.Run("StallDetection", func(t *testing.T) {
+		// testDiscovery sends a single event and then stays silent
+		cl := NewTCPClient("tcp", listener.Addr().String(), WithReconnect(3, 10*time.Millisecond))
+		cl.SetStallTimeout(300 * time.Millisecond)
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(10)
+		require.NoError(t, err)
+		require.Equal(t, "add", (<-ch).Type)
+		for _, expected := range []string{"reconnected", "add"} {
+			select {
+			case ev := <-ch:
+				require.Equal(t, expected, ev.Type)
+			case <-time.After(2 * time.Second):
+				t.Fatal("stalled client did not reconnect")
+			}
+		}
+		require.GreaterOrEqual(t, cl.Stats().Stalls, uint64(1))
+		require.Eventually(t, func() bool {
+			return !errors.Is(cl.Stop(), ErrReconnecting)
+		}, time.Second, 10*time.Millisecond)
+		ev := <-ch
+		require.Equal(t, "stop", ev.Type)
+		stalls := cl.Stats().Stalls
+
+		// No stall detection after STOP
+		time.Sleep(500 * time.Millisecond)
+		require.Equal(t, stalls, cl.Stats().Stalls)
+		cl.Quit()
+		for len(listener.conns) > 0 {
+			<-listener.conns
+		}
+	})
+
+	t.Run("NoReconnectAfterQuit", func(t *testing.T) {
+		// The server closes the connection right after the "quit" response
+		cl := NewTCPClient("tcp", listener.Addr().String(), WithReconnect(3, 10*time.Millisecond))
+		require.NoError(t, cl.Run())
+		<-listener.conns
+		cl.Quit()
+		require.False(t, cl.Alive())
+		time.Sleep(100 * time.Millisecond)
+		require.False(t, cl.Alive())
+		select {
+		case <-listener.conns:
+			t.Fatal("client reconnected after Quit")
+		default:
+		}
+	})
+
+	t.Run("ReconnectBackoff", func(t *testing.T) {
+		// The backoff replaces the delay given to WithReconnect
+		attempts := make(chan int, 10)
+		backoff := BackoffFunc(func(attempt int) time.Duration {
+			attempts <- attempt
+			return 0
+		})
+		cl := NewTCPClient("tcp", listener.Addr().String(), WithReconnect(3, time.Hour), WithReconnectBackoff(backoff))
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(10)
+		require.NoError(t, err)
+		require.Equal(t, "add", (<-ch).Type)
+
+		(<-listener.conns).Close()
+		select {
+		case ev := <-ch:
+			require.Equal(t, "reconnected", ev.Type)
+		case <-time.After(2 * time.Second):
+			t.Fatal("client did not reconnect")
+		}
+		require.Equal(t, "add", (<-ch).Type)
+		require.Equal(t, 1, <-attempts)
+		cl.Quit()
+		<-listener.conns
+	})
+
+	t.Run("ReconnectWithSnapshot", func(t *testing.T) {
+		cl := NewTCPClient("tcp", listener.Addr().String(), WithReconnect(3, 100*time.Millisecond))
+		cl.SetInitialSnapshotQuietPeriod(100*time.Millisecond, 0)
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(10)
+		require.NoError(t, err)
+		require.Equal(t, "snapshot", (<-ch).Type)
+
+		(<-listener.conns).Close()
+		require.Equal(t, "reconnected", (<-ch).Type)
+		ev := <-ch
+		require.Equal(t, "snapshot", ev.Type)
+		require.Len(t, ev.Ports, 1)
+		cl.Quit()
+		<-listener.conns
+	})
+}
+
+// newTestCertificate generates a self-signed certificate for 127.0.0.1.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTCPClientTLSAuth(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	server := NewServer(&testDiscovery{})
+	server.SetAuthToken("secret")
+	go server.ServeTLS(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	addr := listener.Addr().String()
+
+	// Wrong token
+	cl := NewTCPClient("tls", addr, WithTLS(&tls.Config{RootCAs: pool}), WithAuthToken("wrong"))
+	require.EqualError(t, cl.Run(), "command failed: Invalid authentication token")
+	require.False(t, cl.Alive())
+
+	// Untrusted certificate
+	cl = NewTCPClient("tls", addr, WithTLS(&tls.Config{}), WithAuthToken("secret"))
+	require.Error(t, cl.Run())
+
+	// Plain TCP connection to a TLS server
+	cl = NewTCPClient("tls", addr, WithAuthToken("secret"))
+	require.Error(t, cl.Run())
+
+	require.Eventually(t, func() bool {
+		cl = NewTCPClient("tls", addr, WithTLS(&tls.Config{RootCAs: pool}), WithAuthToken("secret"))
+		return cl.Run() == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	ch, err := cl.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "add", (<-ch).Type)
+	cl.Quit()
+	require.False(t, cl.Alive())
+}
@@ -18,14 +18,25 @@
 package discovery
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/arduino/go-paths-helper"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
 type testLogger struct{}
@@ -40,18 +51,87 @@ func (l *testLogger) Errorf(msg string, args ...any) {
 	fmt.Println()
 }
 
-func TestDiscoveryStdioHandling(t *testing.T) {
-	// Build `netcat` helper inside testdata/cat
-	builder, err := paths.NewProcess(nil, "go", "build")
+type testTraceKey struct{}
+
+type testTracer struct {
+	mutex    sync.Mutex
+	commands []string
+	events   []string
+}
+
+func (tr *testTracer) StartCommand(ctx context.Context, discoveryID, command string) func(err error) {
+	return func(err error) {
+		tr.mutex.Lock()
+		defer tr.mutex.Unlock()
+		tr.commands = append(tr.commands, fmt.Sprintf("%s %s %s %v", ctx.Value(testTraceKey{}), discoveryID, command, err))
+	}
+}
+
+func (tr *testTracer) Event(discoveryID, eventType string) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.events = append(tr.events, discoveryID+" "+eventType)
+}
+
+type testMetrics struct {
+	mutex   sync.Mutex
+	records []string
+}
+
+func (m *testMetrics) record(s string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.records = append(m.records, s)
+}
+
+// count returns the number of records starting with the given prefix.
+func (m *testMetrics) count(prefix string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n := 0
+	for _, r := range m.records {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *testMetrics) CommandLatency(discoveryID, command string, elapsed time.Duration, err error) {
+	m.record(fmt.Sprintf("%s %s latency %v", discoveryID, command, err))
+}
+func (m *testMetrics) EventReceived(discoveryID, eventType string) {
+	m.record(fmt.Sprintf("%s event %s", discoveryID, eventType))
+}
+func (m *testMetrics) EventsBacklog(discoveryID string, backlog int) {
+	m.record(fmt.Sprintf("%s backlog %d", discoveryID, backlog))
+}
+func (m *testMetrics) ProcessRestarted(discoveryID string) {
+	m.record(fmt.Sprintf("%s restarted", discoveryID))
+}
+
+// buildStdioProxy builds the stdio-proxy tool in a temporary directory and
+// returns its path. It's used to run a "discovery" bridged to a listener of
+// the test.
+func buildStdioProxy(t *testing.T) string {
+	exe := filepath.Join(t.TempDir(), "stdio-proxy")
+	if runtime.GOOS == "windows" {
+		exe += ".exe"
+	}
+	builder, err := paths.NewProcess(nil, "go", "build", "-o", exe, "./cmd/stdio-proxy")
 	require.NoError(t, err)
-	builder.SetDir("testdata/netcat")
 	require.NoError(t, builder.Run())
+	return exe
+}
 
-	// Run netcat and test if streaming json works as expected
+func TestDiscoveryStdioHandling(t *testing.T) {
+	proxy := buildStdioProxy(t)
+
+	// Run stdio-proxy and test if streaming json works as expected
 	listener, err := net.ListenTCP("tcp", nil)
 	require.NoError(t, err)
 
-	disc := NewClient("test", "testdata/netcat/netcat", listener.Addr().String())
+	disc := NewClient("test", proxy, listener.Addr().String())
 	disc.SetLogger(&testLogger{})
 	err = disc.runProcess()
 	require.NoError(t, err)
@@ -130,6 +210,7 @@ func TestClient(t *testing.T) {
 
 		time.Sleep(time.Second)
 
+		var last *Event
 	loop:
 		for {
 			select {
@@ -140,12 +221,895 @@ func TestClient(t *testing.T) {
 					break loop
 				}
 				fmt.Println("Recv: ", msg)
+				last = msg
 			case <-time.After(time.Second):
 				t.Error("Crashing client did not close event channel")
 				break loop
 			}
 		}
+		// The termination is reported in the last event
+		require.NotNil(t, last)
+		require.Equal(t, "stop", last.Type)
+		require.Equal(t, io.EOF.Error(), last.Error)
+		require.ErrorIs(t, cl.LastError(), io.EOF)
 
 		cl.Quit()
 	})
+	t.Run("EventsSequenceNumbers", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+
+		// dummy-discovery sends two "add" events right after START_SYNC
+		ev1 := <-ch
+		ev2 := <-ch
+		require.Equal(t, "add", ev1.Type)
+		require.Equal(t, "add", ev2.Type)
+		require.Equal(t, uint64(1), ev1.Seq)
+		require.Equal(t, uint64(2), ev2.Seq)
+		require.False(t, ev1.Timestamp.IsZero())
+		require.False(t, ev2.Timestamp.Before(ev1.Timestamp))
+
+		cl.Quit()
+		ev3 := <-ch
+		require.Equal(t, "stop", ev3.Type)
+		require.Equal(t, uint64(3), ev3.Seq)
+	})
+	t.Run("PortEnricher", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetPortEnricher(func(port *Port) *Port {
+			if n, _ := strconv.Atoi(port.Address); n%2 == 1 {
+				// odd ports are slower to enrich than the even ones
+				time.Sleep(200 * time.Millisecond)
+			}
+			res := port.Clone()
+			res.Properties.Set("board", "dummy"+port.Address)
+			return res
+		})
+		require.NoError(t, cl.Run())
+
+		require.NoError(t, cl.Start())
+		var ports []*Port
+		require.Eventually(t, func() bool {
+			ports, err = cl.List()
+			return err == nil && len(ports) == 2
+		}, time.Second, 10*time.Millisecond)
+		for _, port := range ports {
+			require.Equal(t, "dummy"+port.Address, port.Properties.Get("board"))
+		}
+		require.NoError(t, cl.Stop())
+
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+		ev1 := <-ch
+		ev2 := <-ch
+		require.Equal(t, "3", ev1.Port.Address)
+		require.Equal(t, "4", ev2.Port.Address)
+		require.Equal(t, "dummy3", ev1.Port.Properties.Get("board"))
+		require.Equal(t, "dummy4", ev2.Port.Properties.Get("board"))
+		require.Less(t, ev1.Seq, ev2.Seq)
+		cl.Quit()
+	})
+	t.Run("StallTimeout", func(t *testing.T) {
+		// dummy-discovery waits 2 seconds after the initial events
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetStallTimeout(500 * time.Millisecond)
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+		require.Equal(t, "add", (<-ch).Type)
+		require.Equal(t, "add", (<-ch).Type)
+		select {
+		case ev := <-ch:
+			require.Equal(t, "stop", ev.Type)
+		case <-time.After(2 * time.Second):
+			t.Fatal("stalled discovery not detected")
+		}
+		_, ok := <-ch
+		require.False(t, ok)
+		require.Equal(t, uint64(1), cl.Stats().Stalls)
+		require.False(t, cl.Alive())
+	})
+	t.Run("ProcessAttributes", func(t *testing.T) {
+		// The attributes are platform-specific, check that they don't
+		// prevent the discovery from running
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetProcessAttributes(ProcessAttributes{HideConsole: true, KillOnParentExit: true})
+		require.NoError(t, cl.Run())
+		require.True(t, cl.Alive())
+		cl.Quit()
+		require.False(t, cl.Alive())
+
+		require.EqualError(t, NewClient("2").Run(), "no executable specified")
+	})
+	t.Run("ErrorCodes", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.NoError(t, cl.Run())
+		_, err := cl.List()
+		require.EqualError(t, err, "command failed: Discovery not STARTed")
+		require.ErrorIs(t, err, ErrorCodeNotStarted)
+		var cmdErr *CommandError
+		require.ErrorAs(t, err, &cmdErr)
+		require.Equal(t, "LIST", cmdErr.Command)
+		cl.Quit()
+	})
+	t.Run("Journal", func(t *testing.T) {
+		path := paths.New(t.TempDir(), "journal.ndjson")
+		journal, err := OpenJournal(path)
+		require.NoError(t, err)
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetJournal(journal)
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+		received := []*Event{<-ch, <-ch}
+		cl.Quit()
+		received = append(received, <-ch)
+		require.NoError(t, journal.Err())
+		require.NoError(t, journal.Close())
+
+		replay, err := ReplayJournal(path)
+		require.NoError(t, err)
+		for _, expected := range received {
+			ev := <-replay
+			require.Equal(t, expected.Type, ev.Type)
+			require.Equal(t, expected.Seq, ev.Seq)
+			require.Equal(t, "1", ev.DiscoveryID)
+			require.True(t, expected.Timestamp.Equal(ev.Timestamp))
+			if expected.Port != nil {
+				require.Equal(t, expected.Port.Address, ev.Port.Address)
+			}
+		}
+		_, ok := <-replay
+		require.False(t, ok)
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+		<-ch
+		<-ch
+
+		stats := cl.Stats()
+		require.Equal(t, uint64(2), stats.CommandsSent) // HELLO and START_SYNC
+		require.Equal(t, uint64(2), stats.ResponsesReceived)
+		require.Equal(t, map[string]uint64{"add": 2}, stats.EventsByType)
+		require.Equal(t, uint64(0), stats.DecodeErrors)
+		require.Equal(t, uint64(0), stats.ProcessRestarts)
+		require.Equal(t, 0, stats.EventsBacklog)
+		require.False(t, stats.LastEventTime.IsZero())
+		cl.Quit()
+
+		// Running the discovery again counts as a process restart
+		require.NoError(t, cl.Run())
+		stats = cl.Stats()
+		require.Equal(t, uint64(1), stats.ProcessRestarts)
+		require.Equal(t, uint64(4), stats.CommandsSent) // + QUIT and HELLO
+		cl.Quit()
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		metrics := &testMetrics{}
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetMetrics(metrics)
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+		<-ch
+		<-ch
+		_, err = cl.List()
+		require.Error(t, err)
+		cl.Quit()
+		require.NoError(t, cl.Run())
+		cl.Quit()
+
+		require.Equal(t, 2, metrics.count("1 HELLO latency <nil>"))
+		require.Equal(t, 1, metrics.count("1 START_SYNC latency <nil>"))
+		require.Equal(t, 1, metrics.count("1 LIST latency command failed"))
+		require.Equal(t, 2, metrics.count("1 QUIT latency"))
+		require.Equal(t, 2, metrics.count("1 event add"))
+		require.Equal(t, 2, metrics.count("1 backlog"))
+		require.Equal(t, 1, metrics.count("1 restarted"))
+	})
+
+	t.Run("InitialSnapshot", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetInitialSnapshotQuietPeriod(500*time.Millisecond, 0)
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+
+		// The two initial "add" events are delivered as a single snapshot
+		select {
+		case ev := <-ch:
+			require.Equal(t, "snapshot", ev.Type)
+			require.Nil(t, ev.Port)
+			require.Len(t, ev.Ports, 2)
+		case <-time.After(time.Second):
+			t.Fatal("snapshot event not received")
+		}
+
+		// Subsequent events are streamed normally
+		select {
+		case ev := <-ch:
+			require.Equal(t, "add", ev.Type)
+			require.NotNil(t, ev.Port)
+		case <-time.After(3 * time.Second):
+			t.Fatal("add event not received")
+		}
+		cl.Quit()
+	})
+	t.Run("InitialSnapshotMaxWait", func(t *testing.T) {
+		// The quiet period is longer than the interval between the events
+		// sent by dummy-discovery: the snapshot is delivered after maxWait.
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetInitialSnapshotQuietPeriod(3*time.Second, 500*time.Millisecond)
+		require.NoError(t, cl.Run())
+		start := time.Now()
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+
+		select {
+		case ev := <-ch:
+			require.Equal(t, "snapshot", ev.Type)
+			require.Len(t, ev.Ports, 2)
+			require.Less(t, time.Since(start), 1500*time.Millisecond)
+		case <-time.After(2 * time.Second):
+			t.Fatal("snapshot event not received")
+		}
+		cl.Quit()
+	})
+
+	t.Run("Tracer", func(t *testing.T) {
+		tracer := &testTracer{}
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetTracer(tracer)
+		cl.SetTraceContext(context.WithValue(context.Background(), testTraceKey{}, "parent"))
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+		<-ch
+		<-ch
+		_, err = cl.List()
+		require.Error(t, err)
+		cl.Quit()
+
+		tracer.mutex.Lock()
+		defer tracer.mutex.Unlock()
+		require.Equal(t, []string{
+			"parent 1 HELLO <nil>",
+			"parent 1 START_SYNC <nil>",
+			"parent 1 LIST command failed: Discovery not STARTed",
+			"parent 1 QUIT <nil>",
+		}, tracer.commands)
+		require.Equal(t, []string{"1 add", "1 add"}, tracer.events)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/dummy-discovery")
+		cl.SetProcessAttributes(ProcessAttributes{NewProcessGroup: true})
+		require.NoError(t, cl.Run())
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+		require.NoError(t, cl.Close())
+		require.False(t, cl.Alive())
+		for range ch {
+			// Drain the channel until it's closed
+		}
+		require.NoError(t, cl.Close())
+		require.ErrorIs(t, cl.Run(), ErrClientClosed)
+		require.NotNil(t, cl.ProcessState())
+	})
+
+	t.Run("NoLeaksOnFailedRun", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+		// Failed process start
+		cl := NewClient("1", "dummy-discovery/not-existent")
+		require.Error(t, cl.Run())
+
+		// Discovery crashing during the HELLO
+		cl = NewClient("1", "dummy-discovery/dummy-discovery", "--invalid")
+		require.ErrorIs(t, cl.Run(), io.EOF)
+
+		// Unexpected HELLO response followed by another message, that the
+		// decode loop can't deliver
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			_, _ = bufio.NewReader(serverConn).ReadString('\n')
+			_, _ = serverConn.Write([]byte(`{"eventType":"list","ports":[]}` + "\n" + `{"eventType":"list","ports":[]}`))
+		}()
+		cl = NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		require.ErrorContains(t, cl.Run(), "event out of sync")
+	})
+
+	t.Run("CloseWithoutRunning", func(t *testing.T) {
+		cl := NewClient("1", "dummy-discovery/not-existent")
+		require.Error(t, cl.Run())
+		require.NoError(t, cl.Close())
+		require.False(t, cl.Alive())
+	})
+}
+
+func TestClientStatsDecodeErrors(t *testing.T) {
+	proxy := buildStdioProxy(t)
+
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+	disc := NewClient("test", proxy, listener.Addr().String())
+	require.NoError(t, disc.runProcess())
+	listener.SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte(`{ "eventType": "ev1" }{ "eventType": ]`))
+	require.NoError(t, err)
+	msg, err := disc.waitMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "ev1", msg.EventType)
+	_, err = disc.waitMessage(time.Second)
+	require.Error(t, err)
+
+	stats := disc.Stats()
+	require.Equal(t, uint64(1), stats.ResponsesReceived)
+	require.Equal(t, uint64(1), stats.DecodeErrors)
+	conn.Close()
+}
+
+func TestClientDecodeRecovery(t *testing.T) {
+	proxy := buildStdioProxy(t)
+
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+	disc := NewClient("test", proxy, listener.Addr().String())
+	disc.SetDecodeRecovery(true)
+	require.NoError(t, disc.runProcess())
+	listener.SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(`{ "eventType": "ev1" }{ "eventType": ] }garbage` +
+		`{ "eventType": "ev2", "message": 3 }{ "eventType": "add" }{ "eventType": "ev3" }`))
+	require.NoError(t, err)
+	msg, err := disc.waitMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "ev1", msg.EventType)
+	msg, err = disc.waitMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "ev3", msg.EventType)
+	require.True(t, disc.Alive())
+
+	stats := disc.Stats()
+	require.Equal(t, uint64(2), stats.ResponsesReceived)
+	require.Equal(t, uint64(2), stats.DecodeErrors)
+	require.Equal(t, uint64(3), stats.SkippedMessages)
+}
+
+func TestClientUnknownMessageHandler(t *testing.T) {
+	proxy := buildStdioProxy(t)
+
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+	disc := NewClient("test", proxy, listener.Addr().String())
+	unknown := make(chan json.RawMessage, 1)
+	disc.SetUnknownMessageHandler(func(msg json.RawMessage) { unknown <- msg })
+	require.NoError(t, disc.runProcess())
+	listener.SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(`{ "eventType": "vendor_status", "battery": 42 }{ "eventType": "stop", "message": "OK" }`))
+	require.NoError(t, err)
+	msg, err := disc.waitMessage(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "stop", msg.EventType)
+	require.JSONEq(t, `{ "eventType": "vendor_status", "battery": 42 }`, string(<-unknown))
+}
+
+func TestClientEventExtensions(t *testing.T) {
+	proxy := buildStdioProxy(t)
+
+	listener, err := net.ListenTCP("tcp", nil)
+	require.NoError(t, err)
+	disc := NewClient("test", proxy, listener.Addr().String())
+	require.NoError(t, disc.runProcess())
+	listener.SetDeadline(time.Now().Add(time.Second))
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	go func() {
+		command := make([]byte, len("START_SYNC\n"))
+		if _, err := io.ReadFull(conn, command); err != nil {
+			return
+		}
+		conn.Write([]byte(`{"eventType":"start_sync","message":"OK"}` +
+			`{"eventType":"add","port":{"address":"1","protocol":"test","future":true},"priority":[1,2]}`))
+	}()
+	events, err := disc.StartSync(10)
+	require.NoError(t, err)
+	ev := <-events
+	require.Equal(t, "add", ev.Type)
+	require.Equal(t, `{"future":true}`, string(ev.Port.Extensions))
+	require.Equal(t, `{"priority":[1,2]}`, string(ev.Extensions))
+}
+
+// recordingListener keeps track of the accepted connections so that
+// tests can close them from the server side.
+func TestClientIdempotentStop(t *testing.T) {
+	// A scripted discovery advertising the idempotent STOP but still replying
+	// with the "already STOPped" error.
+	run := func(capabilities string) *Client {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			reader := bufio.NewReader(serverConn)
+			for {
+				cmd, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				switch strings.Fields(cmd)[0] {
+				case "HELLO":
+					fmt.Fprintf(serverConn, `{"eventType":"hello","message":"OK","protocolVersion":1,"capabilities":[%s]}`, capabilities)
+				case "STOP":
+					fmt.Fprint(serverConn, `{"eventType":"stop","error":true,"message":"Discovery already STOPped"}`)
+				case "QUIT":
+					fmt.Fprint(serverConn, `{"eventType":"quit","message":"OK"}`)
+					return
+				}
+			}
+		}()
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		require.NoError(t, cl.Run())
+		return cl
+	}
+
+	cl := run(`"idempotent_stop"`)
+	require.True(t, cl.HasCapability(CapabilityIdempotentStop))
+	require.NoError(t, cl.Stop())
+	cl.Quit()
+
+	cl = run("")
+	require.False(t, cl.HasCapability(CapabilityIdempotentStop))
+	require.EqualError(t, cl.Stop(), "command failed: Discovery already STOPped")
+	cl.Quit()
+}
+
+func TestClientChunkedList(t *testing.T) {
+	for _, chunkSize := range []int{0, 3} {
+		clientConn, serverConn := net.Pipe()
+		server := NewServer(&manyPortsDiscovery{})
+		server.SetListChunkSize(chunkSize)
+		go func() {
+			defer serverConn.Close()
+			_ = server.Run(serverConn, serverConn)
+		}()
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		require.NoError(t, cl.Run())
+		require.Equal(t, chunkSize > 0, cl.HasCapability(CapabilityChunkedList))
+		require.NoError(t, cl.Start())
+		ports, err := cl.List()
+		require.NoError(t, err)
+		require.Len(t, ports, 10)
+		require.Equal(t, "other", ports[0].Protocol)
+		require.Equal(t, "5", ports[9].Address)
+		cl.Quit()
+	}
+}
+
+// callbackDiscovery hands the callbacks to the test, to emit events on
+// demand. The first failures calls to StartSync return an error.
+type callbackDiscovery struct {
+	testDiscovery
+	eventCB  chan EventCallback
+	errorCB  chan ErrorCallback
+	failures atomic.Int32
+}
+
+func newCallbackDiscovery(failures int) *callbackDiscovery {
+	d := &callbackDiscovery{
+		eventCB: make(chan EventCallback, 1),
+		errorCB: make(chan ErrorCallback, 1),
+	}
+	d.failures.Store(int32(failures))
+	return d
+}
+
+func (d *callbackDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	if d.failures.Add(-1) >= 0 {
+		return errors.New("not supported")
+	}
+	d.eventCB <- eventCB
+	d.errorCB <- errorCB
+	return nil
+}
+
+// startCallbackDiscovery runs a Server for the given discovery and
+// returns a Client connected to it.
+func startCallbackDiscovery(t *testing.T, impl *callbackDiscovery) *Client {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		_ = NewServer(impl).Run(serverConn, serverConn)
+	}()
+	cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	require.NoError(t, cl.Run())
+	t.Cleanup(cl.Quit)
+	return cl
+}
+
+// nextEvent returns the next event from the channel, failing the test
+// after a timeout.
+func nextEvent(t *testing.T, events <-chan *Event) *Event {
+	select {
+	case ev := <-events:
+		require.NotNil(t, ev, "event channel closed")
+		return ev
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timeout waiting for event")
+		return nil
+	}
+}
+
+func TestClientPolling(t *testing.T) {
+	impl := newCallbackDiscovery(0)
+	cl := startCallbackDiscovery(t, impl)
+	events, err := cl.StartPolling(10*time.Millisecond, 10)
+	require.NoError(t, err)
+	eventCB := <-impl.eventCB
+
+	eventCB("add", &Port{Address: "1", Protocol: "test"})
+	ev := nextEvent(t, events)
+	require.Equal(t, "add", ev.Type)
+	require.Equal(t, "1", ev.Port.Address)
+
+	// A changed port is removed and added again
+	eventCB("add", &Port{Address: "1", Protocol: "test", HardwareID: "abc"})
+	ev = nextEvent(t, events)
+	require.Equal(t, "remove", ev.Type)
+	require.Equal(t, "1", ev.Port.Address)
+	ev = nextEvent(t, events)
+	require.Equal(t, "add", ev.Type)
+	require.Equal(t, "abc", ev.Port.HardwareID)
+
+	eventCB("remove", &Port{Address: "1", Protocol: "test"})
+	ev = nextEvent(t, events)
+	require.Equal(t, "remove", ev.Type)
+	require.Equal(t, "1", ev.Port.Address)
+
+	require.NoError(t, cl.Stop())
+	require.Equal(t, "stop", nextEvent(t, events).Type)
+	_, ok := <-events
+	require.False(t, ok)
+}
+
+func TestClientPollingFallback(t *testing.T) {
+	t.Run("StartSyncRejected", func(t *testing.T) {
+		impl := newCallbackDiscovery(1)
+		cl := startCallbackDiscovery(t, impl)
+		cl.SetPollingFallback(10 * time.Millisecond)
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		eventCB := <-impl.eventCB
+		eventCB("add", &Port{Address: "1", Protocol: "test"})
+		ev := nextEvent(t, events)
+		require.Equal(t, "add", ev.Type)
+		require.Equal(t, "1", ev.Port.Address)
+		require.NoError(t, cl.Stop())
+		require.Equal(t, "stop", nextEvent(t, events).Type)
+	})
+
+	t.Run("StartSyncRejectedWithoutFallback", func(t *testing.T) {
+		cl := startCallbackDiscovery(t, newCallbackDiscovery(1))
+		_, err := cl.StartSync(10)
+		var cmdErr *CommandError
+		require.ErrorAs(t, err, &cmdErr)
+	})
+
+	t.Run("ErrorInEventsMode", func(t *testing.T) {
+		impl := newCallbackDiscovery(0)
+		cl := startCallbackDiscovery(t, impl)
+		cl.SetPollingFallback(10 * time.Millisecond)
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		eventCB, errorCB := <-impl.eventCB, <-impl.errorCB
+		eventCB("add", &Port{Address: "1", Protocol: "test"})
+		require.Equal(t, "add", nextEvent(t, events).Type)
+
+		errorCB("device lost")
+		// The discovery is restarted with START
+		eventCB = <-impl.eventCB
+		eventCB("add", &Port{Address: "2", Protocol: "test"})
+		ev := nextEvent(t, events)
+		require.Equal(t, "add", ev.Type)
+		require.Equal(t, "2", ev.Port.Address)
+
+		// The commands are still working in "polling" mode
+		ports, err := cl.List()
+		require.NoError(t, err)
+		require.Len(t, ports, 1)
+		require.NoError(t, cl.Stop())
+		for ev := range events {
+			if ev.Type == "stop" {
+				return
+			}
+		}
+		require.Fail(t, "missing stop event")
+	})
+}
+
+func TestDiffPorts(t *testing.T) {
+	a := &Port{Address: "a", Protocol: "test"}
+	b := &Port{Address: "b", Protocol: "test"}
+	b2 := &Port{Address: "b", Protocol: "test", HardwareID: "123"}
+	c := &Port{Address: "c", Protocol: "test"}
+	res := []string{}
+	for _, ev := range diffPorts([]*Port{a, b}, []*Port{b2, c}) {
+		res = append(res, ev.Type+" "+ev.Port.Address)
+	}
+	require.Equal(t, []string{"remove a", "remove b", "add b", "add c"}, res)
+	require.Empty(t, diffPorts([]*Port{a, b}, []*Port{a, b}))
+}
+
+func TestClientSyncRecovery(t *testing.T) {
+	t.Run("Resynced", func(t *testing.T) {
+		impl := newCallbackDiscovery(0)
+		cl := startCallbackDiscovery(t, impl)
+		cl.SetSyncRecovery(3, time.Millisecond)
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		eventCB, errorCB := <-impl.eventCB, <-impl.errorCB
+		eventCB("add", &Port{Address: "1", Protocol: "test"})
+		require.Equal(t, "add", nextEvent(t, events).Type)
+
+		errorCB("device lost")
+		eventCB = <-impl.eventCB
+		require.Equal(t, "resynced", nextEvent(t, events).Type)
+		eventCB("add", &Port{Address: "2", Protocol: "test"})
+		ev := nextEvent(t, events)
+		require.Equal(t, "add", ev.Type)
+		require.Equal(t, "2", ev.Port.Address)
+
+		// The recovery is repeated at the next error
+		errorCB = <-impl.errorCB
+		errorCB("device lost again")
+		<-impl.eventCB
+		require.Equal(t, "resynced", nextEvent(t, events).Type)
+		require.NoError(t, cl.Stop())
+		require.Equal(t, "stop", nextEvent(t, events).Type)
+	})
+
+	t.Run("AttemptsExhausted", func(t *testing.T) {
+		impl := newCallbackDiscovery(0)
+		cl := startCallbackDiscovery(t, impl)
+		cl.SetSyncRecovery(2, time.Millisecond)
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		<-impl.eventCB
+		errorCB := <-impl.errorCB
+		impl.failures.Store(2)
+		errorCB("device lost")
+		require.Equal(t, "stop", nextEvent(t, events).Type)
+		_, ok := <-events
+		require.False(t, ok)
+	})
+
+	t.Run("AttemptsExhaustedWithPollingFallback", func(t *testing.T) {
+		impl := newCallbackDiscovery(0)
+		cl := startCallbackDiscovery(t, impl)
+		cl.SetSyncRecovery(2, time.Millisecond)
+		cl.SetPollingFallback(10 * time.Millisecond)
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		<-impl.eventCB
+		errorCB := <-impl.errorCB
+		impl.failures.Store(2)
+		errorCB("device lost")
+		eventCB := <-impl.eventCB
+		eventCB("add", &Port{Address: "1", Protocol: "test"})
+		ev := nextEvent(t, events)
+		require.Equal(t, "add", ev.Type)
+		require.Equal(t, "1", ev.Port.Address)
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		impl := newCallbackDiscovery(0)
+		cl := startCallbackDiscovery(t, impl)
+		cl.SetSyncRecovery(3, time.Hour)
+		attempts := make(chan int, 3)
+		cl.SetSyncRecoveryBackoff(BackoffFunc(func(attempt int) time.Duration {
+			attempts <- attempt
+			return 0
+		}))
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		<-impl.eventCB
+		errorCB := <-impl.errorCB
+		impl.failures.Store(2)
+		errorCB("device lost")
+		<-impl.eventCB
+		require.Equal(t, "resynced", nextEvent(t, events).Type)
+		require.Equal(t, []int{1, 2, 3}, []int{<-attempts, <-attempts, <-attempts})
+	})
+}
+
+func TestClientSharedSync(t *testing.T) {
+	impl := newCallbackDiscovery(0)
+	cl := startCallbackDiscovery(t, impl)
+	h1, err := cl.AcquireSync(10)
+	require.NoError(t, err)
+	eventCB := <-impl.eventCB
+	<-impl.errorCB
+	eventCB("add", &Port{Address: "1", Protocol: "test"})
+	require.Equal(t, "1", nextEvent(t, h1.Events()).Port.Address)
+
+	// The ports already available are replayed to the new consumer
+	h2, err := cl.AcquireSync(10)
+	require.NoError(t, err)
+	ev := nextEvent(t, h2.Events())
+	require.Equal(t, "add", ev.Type)
+	require.Equal(t, "1", ev.Port.Address)
+
+	// The first release doesn't stop the discovery
+	require.NoError(t, h1.Release())
+	require.NoError(t, h1.Release())
+	_, ok := <-h1.Events()
+	require.False(t, ok)
+	eventCB("remove", &Port{Address: "1", Protocol: "test"})
+	ev = nextEvent(t, h2.Events())
+	require.Equal(t, "remove", ev.Type)
+
+	// The last release stops the discovery
+	require.NoError(t, h2.Release())
+	_, ok = <-h2.Events()
+	require.False(t, ok)
+	var cmdErr *CommandError
+	require.ErrorAs(t, cl.Stop(), &cmdErr)
+
+	// A new acquisition starts the discovery again
+	h3, err := cl.AcquireSync(10)
+	require.NoError(t, err)
+	<-impl.eventCB
+	require.NoError(t, cl.Stop())
+	require.Equal(t, "stop", nextEvent(t, h3.Events()).Type)
+	_, ok = <-h3.Events()
+	require.False(t, ok)
+	require.NoError(t, h3.Release())
+}
+
+func TestClientSlowConsumer(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		_ = NewServer(&testDiscovery{}).Run(serverConn, serverConn)
+	}()
+	cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	require.NoError(t, cl.Run())
+	events, err := cl.StartSync(0)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return cl.Stats().EventsBacklog == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The pending event doesn't block the Client
+	require.True(t, cl.Alive())
+	require.NoError(t, cl.Stop())
+	require.Equal(t, "add", nextEvent(t, events).Type)
+	require.Equal(t, "stop", nextEvent(t, events).Type)
+	_, ok := <-events
+	require.False(t, ok)
+	cl.Quit()
+}
+
+func TestClientRawEventHandler(t *testing.T) {
+	impl := newCallbackDiscovery(0)
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		_ = NewServer(impl).Run(serverConn, serverConn)
+	}()
+	cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	raw := make(chan json.RawMessage, 10)
+	cl.SetRawEventHandler(func(msg json.RawMessage) {
+		raw <- append(json.RawMessage(nil), msg...)
+	})
+	require.NoError(t, cl.Run())
+	defer cl.Quit()
+
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	eventCB := <-impl.eventCB
+	eventCB("add", &Port{Address: "1", Protocol: "test", Properties: PropertiesFromMap(map[string]string{"vid": "0x2341"})})
+	eventCB("remove", &Port{Address: "1", Protocol: "test"})
+	require.JSONEq(t, `{"eventType":"add","port":{"address":"1","protocol":"test","properties":{"vid":"0x2341"}}}`, string(<-raw))
+	require.JSONEq(t, `{"eventType":"remove","port":{"address":"1","protocol":"test"}}`, string(<-raw))
+
+	// The events are not delivered to the channel, the responses are still decoded
+	ports, err := cl.List()
+	require.Error(t, err)
+	require.Nil(t, ports)
+	require.NoError(t, cl.Stop())
+	require.Equal(t, "stop", nextEvent(t, events).Type)
+	require.Equal(t, map[string]uint64{"add": 1, "remove": 1}, cl.Stats().EventsByType)
+}
+
+func TestReceiveEvents(t *testing.T) {
+	events := make(chan *Event, 10)
+	for i := 0; i < 5; i++ {
+		events <- &Event{Type: "add", Seq: uint64(i + 1)}
+	}
+	batch := make([]*Event, 0, 3)
+	batch, ok := ReceiveEvents(events, batch[:0])
+	require.True(t, ok)
+	require.Len(t, batch, 3)
+	require.EqualValues(t, 3, batch[2].Seq)
+	// The slice is reused
+	again, ok := ReceiveEvents(events, batch[:0])
+	require.True(t, ok)
+	require.Len(t, again, 2)
+	require.Same(t, &batch[0], &again[0])
+	require.EqualValues(t, 5, again[1].Seq)
+
+	// At least one event is appended
+	events <- &Event{Type: "remove"}
+	close(events)
+	full, ok := ReceiveEvents(events, again)
+	require.True(t, ok)
+	require.Len(t, full, 3)
+	_, ok = ReceiveEvents(events, nil)
+	require.False(t, ok)
+}
+
+func TestClientLastError(t *testing.T) {
+	impl := newCallbackDiscovery(0)
+	cl := startCallbackDiscovery(t, impl)
+	require.NoError(t, cl.LastError())
+
+	// Error reported in a command response
+	require.NoError(t, cl.Start())
+	<-impl.eventCB
+	errorCB := <-impl.errorCB
+	errorCB("libusb permission denied")
+	_, err := cl.List()
+	require.Error(t, err)
+	require.Equal(t, err, cl.LastError())
+	require.Contains(t, cl.LastError().Error(), "libusb permission denied")
+	require.NoError(t, cl.Stop())
+
+	// Error reported asynchronously in "events" mode
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	<-impl.eventCB
+	errorCB = <-impl.errorCB
+	errorCB("device disconnected")
+	require.Eventually(t, func() bool {
+		return strings.Contains(cl.LastError().Error(), "device disconnected")
+	}, 5*time.Second, 10*time.Millisecond)
+	var cmdErr *CommandError
+	require.ErrorAs(t, cl.LastError(), &cmdErr)
+	require.Equal(t, "START_SYNC", cmdErr.Command)
+
+	// The error doesn't break the following commands
+	require.NoError(t, cl.Stop())
+	ev := nextEvent(t, events)
+	require.Equal(t, "stop", ev.Type)
+	require.Empty(t, ev.Error)
+}
+
+func TestClientInvalidAuthToken(t *testing.T) {
+	for _, token := range []string{`a"b`, "a b", "a\nLIST", "a\x7f"} {
+		dialed := false
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) {
+			dialed = true
+			return nil, errors.New("unexpected dial")
+		}, WithAuthToken(token))
+		require.ErrorIs(t, cl.Run(), ErrInvalidAuthToken, token)
+		require.False(t, dialed)
+		require.False(t, cl.Alive())
+	}
 }
@@ -0,0 +1,56 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "context"
+
+// ClientTracer is the interface that must be implemented by a tracer to be
+// used in the discovery client. It allows to instrument the Client with a
+// tracing system (for example OpenTelemetry) without adding a dependency on
+// it in this package. An adapter for OpenTelemetry is available in the
+// "otel" submodule.
+type ClientTracer interface {
+	// StartCommand is called when a command is sent to the discovery, ctx is
+	// the context set with SetTraceContext and may be used to parent the
+	// command span under the caller's trace. The returned function is called
+	// when the command round-trip is completed, with the resulting error (nil
+	// if the command succeeded).
+	StartCommand(ctx context.Context, discoveryID, command string) (end func(err error))
+
+	// Event is called for each port event received from the discovery.
+	Event(discoveryID, eventType string)
+}
+
+type nullClientTracer struct{}
+
+func (t *nullClientTracer) StartCommand(ctx context.Context, discoveryID, command string) func(err error) {
+	return func(err error) {}
+}
+func (t *nullClientTracer) Event(discoveryID, eventType string) {}
+
+// SetTracer sets the tracer to be used in the discovery
+func (disc *Client) SetTracer(tracer ClientTracer) {
+	disc.tracer = tracer
+}
+
+// SetTraceContext sets the context passed to the tracer for each command,
+// for example the context holding the span of the host application operation
+// that is using the discovery. By default context.Background() is used.
+func (disc *Client) SetTraceContext(ctx context.Context) {
+	disc.traceCtx = ctx
+}
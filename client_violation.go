@@ -0,0 +1,125 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ViolationKind is the kind of a protocol Violation.
+type ViolationKind string
+
+const (
+	// ViolationOutOfSync is reported when the response to a command has an
+	// unexpected event type.
+	ViolationOutOfSync ViolationKind = "out_of_sync"
+	// ViolationUnexpectedResponse is reported when a successful response
+	// to a command doesn't carry the "OK" message.
+	ViolationUnexpectedResponse ViolationKind = "unexpected_response"
+	// ViolationUnknownMessage is reported when a message has an event type
+	// not defined by the protocol.
+	ViolationUnknownMessage ViolationKind = "unknown_message"
+	// ViolationMissingEventType is reported when a message has no event
+	// type.
+	ViolationMissingEventType ViolationKind = "missing_event_type"
+	// ViolationMissingPort is reported when an "add" or "remove" event has
+	// no port.
+	ViolationMissingPort ViolationKind = "missing_port"
+	// ViolationMalformedMessage is reported when the data received is not a
+	// valid message.
+	ViolationMalformedMessage ViolationKind = "malformed_message"
+	// ViolationInvalidState is reported when a message is not allowed in
+	// the current state of the discovery, see
+	// Client.SetStrictStateValidation.
+	ViolationInvalidState ViolationKind = "invalid_state"
+)
+
+// Violation describes a message of a discovery not complying with the
+// pluggable discovery protocol, see Client.SetProtocolViolationHandler.
+type Violation struct {
+	// DiscoveryID is the ID of the Client.
+	DiscoveryID string
+	// Kind is the kind of the violation.
+	Kind ViolationKind
+	// Expected is what the Client expected, for example the event type of
+	// the response to a command, if applicable.
+	Expected string
+	// Got is what the Client received instead, for example the event type
+	// of the message.
+	Got string
+	// Raw is the raw message as JSON, if available. The MessagePack frames
+	// are converted to JSON.
+	Raw json.RawMessage
+	// Err is the error reported, if any.
+	Err error
+}
+
+func (v Violation) String() string {
+	res := fmt.Sprintf("discovery %s: %s", v.DiscoveryID, v.Kind)
+	if v.Expected != "" || v.Got != "" {
+		res += fmt.Sprintf(": expected '%s', received '%s'", v.Expected, v.Got)
+	}
+	if v.Err != nil {
+		res += fmt.Sprintf(": %v", v.Err)
+	}
+	return res
+}
+
+// SetProtocolViolationHandler sets a handler called when the discovery
+// sends a message not complying with the protocol, like a response out of
+// sync or an event without the port, so that the applications can keep
+// track of the misbehaving discoveries. The violations are reported in
+// addition to the errors returned by the commands, and regardless of the
+// decode recovery (see SetDecodeRecovery). The handler may be called from
+// the goroutine decoding the messages, so it must not block. This method
+// must be called before Run.
+func (disc *Client) SetProtocolViolationHandler(handler func(Violation)) {
+	disc.violationHandler = handler
+}
+
+// reportViolation calls the protocol violation handler, if any.
+func (disc *Client) reportViolation(kind ViolationKind, expected, got string, raw json.RawMessage, err error) {
+	if disc.violationHandler == nil {
+		return
+	}
+	disc.violationHandler(Violation{
+		DiscoveryID: disc.id,
+		Kind:        kind,
+		Expected:    expected,
+		Got:         got,
+		Raw:         append(json.RawMessage(nil), raw...),
+		Err:         err,
+	})
+}
+
+// outOfSync reports the response to a command with an unexpected event type
+// and returns the error for the command.
+func (disc *Client) outOfSync(expected string, msg *message) error {
+	err := fmt.Errorf("event out of sync, expected '%s', received '%s'", expected, msg.EventType)
+	disc.reportViolation(ViolationOutOfSync, expected, msg.EventType, msg.raw, err)
+	return err
+}
+
+// notOK reports a successful response to a command without the "OK"
+// message and returns the error for the command.
+func (disc *Client) notOK(msg *message) error {
+	err := fmt.Errorf("communication out of sync, expected 'OK', received '%s'", msg.Message)
+	disc.reportViolation(ViolationUnexpectedResponse, "OK", msg.Message, msg.raw, err)
+	return err
+}
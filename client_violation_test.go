@@ -0,0 +1,108 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientProtocolViolations(t *testing.T) {
+	// A discovery answering START with the wrong event type, START_SYNC
+	// with a wrong message and sending bad events
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		reader := bufio.NewReader(serverConn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var res string
+			switch strings.Fields(line)[0] {
+			case "HELLO":
+				res = `{"eventType": "hello", "message": "OK", "protocolVersion": 1}`
+			case "START":
+				res = `{"eventType": "list", "ports": []}`
+			case "START_SYNC":
+				res = `{"eventType": "start_sync", "message": "Maybe"}` +
+					`{"eventType": "add"}` +
+					`{"eventType": "vendor_event"}` +
+					`{"message": "no type"}` +
+					`{"eventType": "add", "port": {]}` +
+					`{"eventType": "add", "port": {"address": "1", "protocol": "test"}}`
+			case "QUIT":
+				_, _ = io.WriteString(serverConn, `{"eventType": "quit", "message": "OK"}`)
+				return
+			}
+			if _, err := io.WriteString(serverConn, res); err != nil {
+				return
+			}
+		}
+	}()
+	violations := make(chan Violation, 10)
+	disc := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	disc.SetDecodeRecovery(true)
+	disc.SetUnknownMessageHandler(func(json.RawMessage) {})
+	disc.SetProtocolViolationHandler(func(v Violation) { violations <- v })
+	require.NoError(t, disc.Run())
+
+	err := disc.Start()
+	require.EqualError(t, err, "event out of sync, expected 'start', received 'list'")
+	v := <-violations
+	require.Equal(t, "pipe", v.DiscoveryID)
+	require.Equal(t, ViolationOutOfSync, v.Kind)
+	require.Equal(t, "start", v.Expected)
+	require.Equal(t, "list", v.Got)
+	require.JSONEq(t, `{"eventType": "list", "ports": []}`, string(v.Raw))
+	require.Equal(t, "discovery pipe: out_of_sync: expected 'start', received 'list': "+err.Error(), v.String())
+
+	_, err = disc.StartSync(10)
+	require.EqualError(t, err, "communication out of sync, expected 'OK', received 'Maybe'")
+	v = <-violations
+	require.Equal(t, ViolationUnexpectedResponse, v.Kind)
+	require.Equal(t, "OK", v.Expected)
+	require.Equal(t, "Maybe", v.Got)
+
+	expected := []ViolationKind{ViolationMissingPort, ViolationUnknownMessage, ViolationMissingEventType, ViolationMalformedMessage}
+	for _, kind := range expected {
+		select {
+		case v := <-violations:
+			require.Equal(t, kind, v.Kind)
+			if kind == ViolationUnknownMessage {
+				require.Equal(t, "vendor_event", v.Got)
+				require.JSONEq(t, `{"eventType": "vendor_event"}`, string(v.Raw))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing %s violation", kind)
+		}
+	}
+	disc.Quit()
+	// The resync after the malformed message may hit more malformed data
+	for len(violations) > 0 {
+		require.Equal(t, ViolationMalformedMessage, (<-violations).Kind)
+	}
+}
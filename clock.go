@@ -0,0 +1,261 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of a Client: the timeouts of the commands,
+// the delays of the reconnections and of the sync recoveries, the polling
+// interval, the inactivity and snapshot timers and the timestamps of the
+// events are all measured with it (see Client.SetClock). A Manager has its
+// own Clock for the restart delays, the List timeout, the move tracking
+// window and the health timestamps (see Manager.SetClock). The default
+// Clock is the system clock, the tests can use a ManualClock to run the timeout
+// scenarios instantly and deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a timer sending the current time on its channel
+	// after the duration, like time.NewTimer.
+	NewTimer(d time.Duration) ClockTimer
+	// AfterFunc waits for the duration to elapse and then calls f in its
+	// own goroutine, like time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// ClockTimer is a timer created with Clock.NewTimer or Clock.AfterFunc.
+type ClockTimer interface {
+	// C returns the channel where the time is sent when the timer
+	// expires, nil for the timers created with AfterFunc.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it returns false if the timer
+	// already expired or has been stopped.
+	Stop() bool
+	// Reset changes the timer to expire after the duration, it returns
+	// true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// SetClock sets the Clock used to measure the timeouts, the delays and the
+// timestamps of the events, the default is the system clock. It's meant
+// for the tests, see ManualClock. This method must be called before Run.
+func (disc *Client) SetClock(clock Clock) {
+	disc.clock = clock
+}
+
+// SetClock sets the Clock used to measure the restart delays, the List
+// timeout, the move tracking window and the health timestamps, the default
+// is the system clock. The Clock of the discoveries is set separately with
+// Client.SetClock. It's meant for the tests, see ManualClock.
+func (dm *Manager) SetClock(clock Clock) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.clock = clock
+}
+
+func (dm *Manager) getClock() Clock {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	return dm.clock
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                      { return time.Now() }
+func (systemClock) NewTimer(d time.Duration) ClockTimer { return systemTimer{time.NewTimer(d)} }
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+// systemTimer is a ClockTimer of the time package.
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+// sleep pauses the current goroutine for the duration measured with the
+// clock. A zero duration returns immediately, without waiting for the
+// ManualClock to advance.
+func sleep(clock Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	<-timer.C()
+}
+
+// ManualClock is a Clock whose time advances only when Advance is called,
+// firing the timers expired in the meantime in order of expiration. It's
+// meant for the tests: the code under test waits on the clock and the test
+// moves the time forward as soon as the code is waiting (see
+// WaitForTimers), without sleeping.
+type ManualClock struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	pending []*manualTimer
+}
+
+// NewManualClock creates a new ManualClock set at the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	c := &ManualClock{now: now}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// manualTimer is a timer of a ManualClock.
+type manualTimer struct {
+	clock    *ManualClock
+	deadline time.Time
+	fire     func(now time.Time)
+	c        chan time.Time
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer sending the time of the clock on its channel
+// when the duration is elapsed, see Advance.
+func (c *ManualClock) NewTimer(d time.Duration) ClockTimer {
+	ch := make(chan time.Time, 1)
+	t := c.newTimer(d, func(now time.Time) {
+		// Like the timers of the time package, the time is dropped if the
+		// previous one has not been received
+		select {
+		case ch <- now:
+		default:
+		}
+	}, ch)
+	return t
+}
+
+// AfterFunc calls f in its own goroutine when the duration is elapsed, see
+// Advance.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return c.newTimer(d, func(time.Time) { go f() }, nil)
+}
+
+func (c *ManualClock) newTimer(d time.Duration, fire func(now time.Time), ch chan time.Time) *manualTimer {
+	t := &manualTimer{clock: c, fire: fire, c: ch}
+	c.mutex.Lock()
+	t.deadline = c.now.Add(d)
+	c.mutex.Unlock()
+	if d <= 0 {
+		t.fire(t.deadline)
+		return t
+	}
+	c.mutex.Lock()
+	c.schedule(t)
+	c.mutex.Unlock()
+	return t
+}
+
+// schedule adds the timer to the pending ones. mutex must be held by the
+// caller.
+func (c *ManualClock) schedule(t *manualTimer) {
+	c.pending = append(c.pending, t)
+	// The timers with the same deadline fire in order of creation
+	sort.SliceStable(c.pending, func(i, j int) bool { return c.pending[i].deadline.Before(c.pending[j].deadline) })
+	c.cond.Broadcast()
+}
+
+// unschedule removes the timer from the pending ones and returns true if
+// it was pending. mutex must be held by the caller.
+func (c *ManualClock) unschedule(t *manualTimer) bool {
+	for i, p := range c.pending {
+		if p == t {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the time of the clock forward by the duration, firing the
+// timers expired in order of expiration: when a timer fires the time of the
+// clock is its expiration time. The functions of AfterFunc run in their own
+// goroutines, they may still be running when Advance returns.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	target := c.now.Add(d)
+	for len(c.pending) > 0 && !c.pending[0].deadline.After(target) {
+		t := c.pending[0]
+		c.pending = c.pending[1:]
+		if t.deadline.After(c.now) {
+			c.now = t.deadline
+		}
+		c.mutex.Unlock()
+		t.fire(t.deadline)
+		c.mutex.Lock()
+	}
+	c.now = target
+	c.mutex.Unlock()
+}
+
+// Timers returns the number of timers waiting to fire.
+func (c *ManualClock) Timers() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending)
+}
+
+// WaitForTimers blocks until at least n timers are waiting to fire, for
+// example until the code under test is waiting for a timeout.
+func (c *ManualClock) WaitForTimers(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.pending) < n {
+		c.cond.Wait()
+	}
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.unschedule(t)
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mutex.Lock()
+	wasPending := c.unschedule(t)
+	t.deadline = c.now.Add(d)
+	if d <= 0 {
+		c.mutex.Unlock()
+		t.fire(t.deadline)
+		return wasPending
+	}
+	c.schedule(t)
+	c.mutex.Unlock()
+	return wasPending
+}
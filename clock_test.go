@@ -0,0 +1,95 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewManualClock(start)
+	require.Equal(t, start, clock.Now())
+
+	fired := make(chan string, 10)
+	late := clock.NewTimer(2 * time.Second)
+	early := clock.NewTimer(time.Second)
+	clock.AfterFunc(1500*time.Millisecond, func() { fired <- "func" })
+	stopped := clock.AfterFunc(time.Second, func() { fired <- "stopped" })
+	require.Equal(t, 4, clock.Timers())
+	require.True(t, stopped.Stop())
+	require.False(t, stopped.Stop())
+	require.Nil(t, stopped.C())
+
+	clock.Advance(999 * time.Millisecond)
+	require.Empty(t, early.C())
+	clock.Advance(time.Millisecond)
+	require.Equal(t, start.Add(time.Second), <-early.C())
+	require.False(t, early.Stop())
+	clock.Advance(5 * time.Second)
+	require.Equal(t, start.Add(2*time.Second), <-late.C())
+	require.Equal(t, "func", <-fired)
+	require.Equal(t, start.Add(6*time.Second), clock.Now())
+	require.Zero(t, clock.Timers())
+
+	// A reset timer fires again
+	require.False(t, late.Reset(time.Second))
+	require.True(t, late.Reset(2*time.Second))
+	clock.Advance(time.Second)
+	require.Empty(t, late.C())
+	clock.Advance(time.Second)
+	require.Equal(t, start.Add(8*time.Second), <-late.C())
+
+	// WaitForTimers waits for the timers created by other goroutines
+	done := make(chan time.Time)
+	go func() { done <- <-clock.NewTimer(time.Minute).C() }()
+	clock.WaitForTimers(1)
+	clock.Advance(time.Minute)
+	require.Equal(t, start.Add(8*time.Second+time.Minute), <-done)
+}
+
+func TestClientClock(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	// A discovery reading the commands without answering
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, bufio.NewReader(serverConn))
+	}()
+	disc := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	disc.SetClock(clock)
+	res := make(chan error)
+	go func() { res <- disc.Run() }()
+
+	// The HELLO timeout expires without waiting for it
+	clock.WaitForTimers(1)
+	clock.Advance(10 * time.Second)
+	select {
+	case err := <-res:
+		require.ErrorContains(t, err, "timeout waiting for message")
+	case <-time.After(time.Second):
+		t.Fatal("HELLO not timed out")
+	}
+}
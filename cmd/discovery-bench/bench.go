@@ -0,0 +1,208 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// benchConfig is the configuration of a benchmark run.
+type benchConfig struct {
+	args           []string
+	helloRuns      int
+	listCalls      int
+	eventsDuration time.Duration
+}
+
+// report is the result of a benchmark run, the durations are expressed in
+// milliseconds.
+type report struct {
+	Discovery string         `json:"discovery"`
+	Hello     *latencyReport `json:"hello,omitempty"`
+	List      *latencyReport `json:"list,omitempty"`
+	Ports     int            `json:"ports,omitempty"`
+	Events    *eventsReport  `json:"events,omitempty"`
+	Process   *processReport `json:"process,omitempty"`
+}
+
+// latencyReport summarizes the latency of repeated commands.
+type latencyReport struct {
+	Samples int     `json:"samples"`
+	Min     float64 `json:"minMs"`
+	Mean    float64 `json:"meanMs"`
+	P50     float64 `json:"p50Ms"`
+	P95     float64 `json:"p95Ms"`
+	Max     float64 `json:"maxMs"`
+}
+
+// eventsReport summarizes the events received in "events" mode.
+type eventsReport struct {
+	Duration   float64           `json:"durationMs"`
+	Count      int               `json:"count"`
+	PerSecond  float64           `json:"perSecond"`
+	ByType     map[string]uint64 `json:"byType"`
+	FirstEvent float64           `json:"firstEventMs,omitempty"`
+}
+
+// processReport is the CPU time and the memory used by the discovery
+// process, it's available only after the process exited.
+type processReport struct {
+	UserCPU   float64 `json:"userCpuMs"`
+	SystemCPU float64 `json:"systemCpuMs"`
+	// MaxRSS is the peak resident memory, in bytes, when reported by the OS.
+	MaxRSS int64 `json:"maxRssBytes,omitempty"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// newLatencyReport summarizes the given samples, it returns nil if there
+// are no samples.
+func newLatencyReport(samples []time.Duration) *latencyReport {
+	if len(samples) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, s := range sorted {
+		total += s
+	}
+	// Nearest-rank percentile
+	percentile := func(p int) time.Duration {
+		rank := (p*len(sorted) + 99) / 100
+		return sorted[rank-1]
+	}
+	return &latencyReport{
+		Samples: len(sorted),
+		Min:     milliseconds(sorted[0]),
+		Mean:    milliseconds(total / time.Duration(len(sorted))),
+		P50:     milliseconds(percentile(50)),
+		P95:     milliseconds(percentile(95)),
+		Max:     milliseconds(sorted[len(sorted)-1]),
+	}
+}
+
+// runBench runs the benchmark: the discovery is started helloRuns times
+// to measure the HELLO latency (including the startup of the process),
+// then the last run is used to measure the LIST latency and the events
+// throughput.
+func runBench(cfg *benchConfig) (*report, error) {
+	res := &report{Discovery: strings.Join(cfg.args, " ")}
+	runs := cfg.helloRuns
+	if runs < 1 {
+		runs = 1
+	}
+	var hello []time.Duration
+	var disc *discovery.Client
+	for i := 0; i < runs; i++ {
+		disc = discovery.NewClient("bench", cfg.args...)
+		start := time.Now()
+		if err := disc.Run(); err != nil {
+			return nil, fmt.Errorf("running discovery: %w", err)
+		}
+		hello = append(hello, time.Since(start))
+		if i < runs-1 {
+			_ = disc.Close()
+		}
+	}
+	if cfg.helloRuns > 0 {
+		res.Hello = newLatencyReport(hello)
+	}
+	defer disc.Close()
+
+	if cfg.listCalls > 0 {
+		if err := disc.Start(); err != nil {
+			return nil, fmt.Errorf("starting discovery: %w", err)
+		}
+		var list []time.Duration
+		for i := 0; i < cfg.listCalls; i++ {
+			start := time.Now()
+			ports, err := disc.List()
+			if err != nil {
+				return nil, fmt.Errorf("listing ports: %w", err)
+			}
+			list = append(list, time.Since(start))
+			res.Ports = len(ports)
+		}
+		res.List = newLatencyReport(list)
+		if err := disc.Stop(); err != nil {
+			return nil, fmt.Errorf("stopping discovery: %w", err)
+		}
+	}
+
+	if cfg.eventsDuration > 0 {
+		events, err := measureEvents(disc, cfg.eventsDuration)
+		if err != nil {
+			return nil, err
+		}
+		res.Events = events
+	}
+
+	_ = disc.Close()
+	if state := disc.ProcessState(); state != nil {
+		res.Process = &processReport{
+			UserCPU:   milliseconds(state.UserTime()),
+			SystemCPU: milliseconds(state.SystemTime()),
+			MaxRSS:    maxRSS(state),
+		}
+	}
+	return res, nil
+}
+
+// measureEvents collects the events received in "events" mode for the
+// given duration.
+func measureEvents(disc *discovery.Client, duration time.Duration) (*eventsReport, error) {
+	res := &eventsReport{ByType: map[string]uint64{}}
+	start := time.Now()
+	events, err := disc.StartSync(1000)
+	if err != nil {
+		return nil, fmt.Errorf("starting events mode: %w", err)
+	}
+	deadline := time.NewTimer(duration)
+	defer deadline.Stop()
+collect:
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil, fmt.Errorf("events mode terminated: %w", disc.LastError())
+			}
+			if res.Count == 0 {
+				res.FirstEvent = milliseconds(time.Since(start))
+			}
+			res.Count++
+			res.ByType[ev.Type]++
+		case <-deadline.C:
+			break collect
+		}
+	}
+	elapsed := time.Since(start)
+	res.Duration = milliseconds(elapsed)
+	res.PerSecond = float64(res.Count) / elapsed.Seconds()
+	if err := disc.Stop(); err != nil {
+		return nil, fmt.Errorf("stopping events mode: %w", err)
+	}
+	return res, nil
+}
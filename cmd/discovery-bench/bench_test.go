@@ -0,0 +1,74 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyReport(t *testing.T) {
+	require.Nil(t, newLatencyReport(nil))
+
+	samples := []time.Duration{}
+	for i := 20; i > 0; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	require.Equal(t, &latencyReport{
+		Samples: 20,
+		Min:     1,
+		Mean:    10.5,
+		P50:     10,
+		P95:     19,
+		Max:     20,
+	}, newLatencyReport(samples))
+	// The samples are not modified
+	require.Equal(t, 20*time.Millisecond, samples[0])
+
+	require.Equal(t, &latencyReport{Samples: 1, Min: 3, Mean: 3, P50: 3, P95: 3, Max: 3},
+		newLatencyReport([]time.Duration{3 * time.Millisecond}))
+}
+
+func TestBench(t *testing.T) {
+	executable := filepath.Join(t.TempDir(), "dummy-discovery")
+	builder, err := paths.NewProcess(nil, "go", "build", "-o", executable)
+	require.NoError(t, err)
+	builder.SetDir("../../dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	res, err := runBench(&benchConfig{
+		args:           []string{executable},
+		helloRuns:      2,
+		listCalls:      3,
+		eventsDuration: 500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, res.Hello.Samples)
+	require.Equal(t, 3, res.List.Samples)
+	// The dummy discovery sends the first port right away
+	require.GreaterOrEqual(t, res.Events.Count, 1)
+	require.EqualValues(t, res.Events.Count, res.Events.ByType["add"])
+	require.NotNil(t, res.Process)
+
+	_, err = runBench(&benchConfig{args: []string{executable, "--invalid"}, helloRuns: 1})
+	require.Error(t, err)
+}
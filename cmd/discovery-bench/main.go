@@ -0,0 +1,70 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// discovery-bench measures the performance of a pluggable discovery: the
+// latency of the HELLO and LIST commands, the throughput of the events in
+// "events" mode and the CPU and memory used by the discovery process. The
+// results are emitted as a JSON report, to compare the releases of a
+// discovery and spot the regressions.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func main() {
+	cfg := &benchConfig{}
+	flag.IntVar(&cfg.helloRuns, "hello", 5, "number of times the discovery is started to measure the HELLO latency")
+	flag.IntVar(&cfg.listCalls, "list", 20, "number of LIST commands to measure the LIST latency")
+	flag.DurationVar(&cfg.eventsDuration, "events", 10*time.Second, "how long the events are collected in \"events\" mode (0 to skip)")
+	output := flag.String("o", "", "write the report to this file instead of stdout")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] discovery [args...]\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	cfg.args = flag.Args()
+
+	report, err := runBench(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(*output, data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing the report: %s\n", err)
+		os.Exit(1)
+	}
+}
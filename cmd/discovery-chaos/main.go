@@ -0,0 +1,81 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// discovery-chaos stresses a pluggable discovery with the inputs a
+// well-behaved client never sends (random commands, rapid START/STOP
+// cycles, early QUIT, the input closed in the middle of a command, huge
+// user agents) and checks that the discovery never crashes, never hangs and
+// never emits malformed JSON. See discoverytest.Chaos for the Go tests.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/arduino/pluggable-discovery-protocol-handler/v2/discoverytest"
+)
+
+func main() {
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the random sequences, to reproduce a failure")
+	commands := flag.Int("commands", 200, "number of random commands to send")
+	cycles := flag.Int("cycles", 50, "number of START/STOP cycles")
+	userAgentSize := flag.Int("user-agent-size", 1<<20, "size of the huge user agent, in bytes")
+	timeout := flag.Duration("timeout", discoverytest.DefaultTimeout, "time the discovery has to respond to a command or to terminate")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] discovery [args...]\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	chaos := discoverytest.NewChaos(discoverytest.ExecutableLauncher(flag.Arg(0), flag.Args()[1:]...))
+	chaos.SetSeed(*seed)
+	chaos.SetCommands(*commands)
+	chaos.SetCycles(*cycles)
+	chaos.SetUserAgentSize(*userAgentSize)
+	chaos.SetTimeout(*timeout)
+	if !printResults(os.Stdout, chaos.Seed(), chaos.Run()) {
+		os.Exit(1)
+	}
+}
+
+// printResults prints the outcome of the scenarios and returns true if all
+// of them passed.
+func printResults(w io.Writer, seed int64, results []discoverytest.ChaosResult) bool {
+	passed := true
+	for _, res := range results {
+		if res.Passed() {
+			fmt.Fprintf(w, "PASS %s\n", res.Scenario)
+			continue
+		}
+		passed = false
+		fmt.Fprintf(w, "FAIL %s\n", res.Scenario)
+		for _, failure := range res.Failures {
+			fmt.Fprintf(w, "     %s\n", failure)
+		}
+	}
+	if !passed {
+		fmt.Fprintf(w, "\nrun with -seed %d to reproduce\n", seed)
+	}
+	return passed
+}
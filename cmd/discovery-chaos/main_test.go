@@ -0,0 +1,46 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/arduino/pluggable-discovery-protocol-handler/v2/discoverytest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintResults(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.True(t, printResults(out, 1, []discoverytest.ChaosResult{
+		{Scenario: "random-commands", Failures: []string{}},
+	}))
+	require.Equal(t, "PASS random-commands\n", out.String())
+
+	out.Reset()
+	require.False(t, printResults(out, 42, []discoverytest.ChaosResult{
+		{Scenario: "random-commands", Failures: []string{}},
+		{Scenario: "huge-user-agent", Failures: []string{"discovery crashed: panic: boom", "malformed JSON in the output"}},
+	}))
+	require.Equal(t, "PASS random-commands\n"+
+		"FAIL huge-user-agent\n"+
+		"     discovery crashed: panic: boom\n"+
+		"     malformed JSON in the output\n"+
+		"\n"+
+		"run with -seed 42 to reproduce\n", out.String())
+}
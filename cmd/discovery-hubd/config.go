@@ -0,0 +1,84 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// config is the configuration of the hub, loaded from a JSON file.
+type config struct {
+	Discoveries []discoveryConfig `json:"discoveries"`
+}
+
+// discoveryConfig describes a child discovery.
+type discoveryConfig struct {
+	ID      string   `json:"id"`
+	Command []string `json:"command"`
+}
+
+func loadConfig(file string) (*config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *config) validate() error {
+	if len(c.Discoveries) == 0 {
+		return errors.New("no discoveries configured")
+	}
+	ids := map[string]bool{}
+	for i, d := range c.Discoveries {
+		if d.ID == "" {
+			return fmt.Errorf("discovery #%d: missing id", i+1)
+		}
+		if ids[d.ID] {
+			return fmt.Errorf("discovery %s: duplicate id", d.ID)
+		}
+		ids[d.ID] = true
+		if len(d.Command) == 0 {
+			return fmt.Errorf("discovery %s: missing command", d.ID)
+		}
+	}
+	return nil
+}
+
+// children returns the clients of the configured discoveries.
+func (c *config) children() []*discovery.Client {
+	res := []*discovery.Client{}
+	for _, d := range c.Discoveries {
+		res = append(res, discovery.NewClient(d.ID, d.Command...))
+	}
+	return res
+}
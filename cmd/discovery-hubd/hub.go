@@ -0,0 +1,99 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// eventsBufferSize is the size of the event channels of the sessions.
+const eventsBufferSize = 100
+
+// hub owns the child discoveries and serves them to many clients: each
+// child runs only once, its "events" mode is shared by the sessions with
+// Client.AcquireSync.
+type hub struct {
+	children []*discovery.Client
+
+	mutex sync.Mutex
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+func newHub(children []*discovery.Client) *hub {
+	return &hub{children: children, conns: map[net.Conn]bool{}}
+}
+
+// start runs the child discoveries.
+func (h *hub) start() error {
+	for _, child := range h.children {
+		if err := child.Run(); err != nil {
+			h.quit()
+			return fmt.Errorf("starting discovery %s: %w", child.GetID(), err)
+		}
+	}
+	return nil
+}
+
+// quit terminates the child discoveries.
+func (h *hub) quit() {
+	for _, child := range h.children {
+		_ = child.Close()
+	}
+}
+
+// serve accepts the clients on the listener, each one in its own session.
+// It returns when the listener is closed, after terminating the sessions
+// in progress.
+func (h *hub) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			h.mutex.Lock()
+			for conn := range h.conns {
+				conn.Close()
+			}
+			h.mutex.Unlock()
+			h.wg.Wait()
+			return err
+		}
+		h.mutex.Lock()
+		h.conns[conn] = true
+		h.mutex.Unlock()
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.serveConn(conn)
+			h.mutex.Lock()
+			delete(h.conns, conn)
+			h.mutex.Unlock()
+		}()
+	}
+}
+
+func (h *hub) serveConn(conn net.Conn) {
+	// The QUIT command and the end of the connection terminate only the
+	// session: the handles are released by the Reset of the Server
+	_ = discovery.NewContextServer(&session{hub: h}).ServeConn(conn)
+}
@@ -0,0 +1,138 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// childDiscovery reports a single port and counts the StartSync calls.
+type childDiscovery struct {
+	startSyncs atomic.Int32
+}
+
+func (d *childDiscovery) Hello(userAgent string, protocolVersion int) error { return nil }
+
+func (d *childDiscovery) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	d.startSyncs.Add(1)
+	eventCB("add", &discovery.Port{Address: "1", Protocol: "test"})
+	return nil
+}
+
+func (d *childDiscovery) Stop() error { return nil }
+
+func (d *childDiscovery) Quit() {}
+
+// newChild returns a Client of the discovery running in-process.
+func newChild(impl discovery.Discovery) *discovery.Client {
+	return discovery.NewConnClient("child", func() (io.ReadWriteCloser, error) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			_ = discovery.NewServer(impl).Run(serverConn, serverConn)
+			serverConn.Close()
+		}()
+		return clientConn, nil
+	})
+}
+
+// dialHub returns a Client connected to the hub.
+func dialHub(t *testing.T, id, socket string) *discovery.Client {
+	cl := discovery.NewConnClient(id, func() (io.ReadWriteCloser, error) {
+		return net.Dial("unix", socket)
+	})
+	require.NoError(t, cl.Run())
+	t.Cleanup(func() { _ = cl.Close() })
+	return cl
+}
+
+func TestHub(t *testing.T) {
+	impl := &childDiscovery{}
+	h := newHub([]*discovery.Client{newChild(impl)})
+	require.NoError(t, h.start())
+	defer h.quit()
+	socket := filepath.Join(t.TempDir(), "hub.sock")
+	l, err := discovery.ListenUnix(socket, 0600)
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- h.serve(l) }()
+
+	if runtime.GOOS != "windows" {
+		// Only the owner can use the socket
+		info, err := os.Stat(socket)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	// Another hub can't serve on the same socket
+	_, err = discovery.ListenUnix(socket, 0600)
+	require.ErrorContains(t, err, "is already in use")
+
+	// The clients share the "events" mode of the child
+	a := dialHub(t, "a", socket)
+	eventsA, err := a.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "1", (<-eventsA).Port.Address)
+	b := dialHub(t, "b", socket)
+	eventsB, err := b.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "1", (<-eventsB).Port.Address)
+	require.Equal(t, int32(1), impl.startSyncs.Load())
+
+	// The LIST of a client in "polling" mode, while the others are syncing
+	c := dialHub(t, "c", socket)
+	require.NoError(t, c.Start())
+	require.Eventually(t, func() bool {
+		ports, err := c.List()
+		return err == nil && len(ports) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, c.Close())
+
+	// The child keeps running for the remaining client
+	a.Quit()
+	require.NoError(t, b.Stop())
+	// and it's started again for a new session
+	d := dialHub(t, "d", socket)
+	eventsD, err := d.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "1", (<-eventsD).Port.Address)
+	require.Equal(t, int32(2), impl.startSyncs.Load())
+
+	l.Close()
+	require.Error(t, <-served)
+}
+
+func TestConfigValidate(t *testing.T) {
+	require.EqualError(t, (&config{}).validate(), "no discoveries configured")
+	require.EqualError(t, (&config{Discoveries: []discoveryConfig{{Command: []string{"serial-discovery"}}}}).validate(), "discovery #1: missing id")
+	require.EqualError(t, (&config{Discoveries: []discoveryConfig{{ID: "serial"}}}).validate(), "discovery serial: missing command")
+	require.EqualError(t, (&config{Discoveries: []discoveryConfig{
+		{ID: "serial", Command: []string{"serial-discovery"}},
+		{ID: "serial", Command: []string{"serial-discovery"}},
+	}}).validate(), "discovery serial: duplicate id")
+}
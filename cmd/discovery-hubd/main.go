@@ -0,0 +1,96 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// discovery-hubd is a daemon that owns the pluggable discoveries and
+// serves them to many local clients over a unix socket, so that the
+// clients running at the same time (for example an IDE and the CLI) don't
+// start their own instances of a discovery fighting over the same OS event
+// source. The clients run "discovery-hubd -connect" as the discovery, that
+// bridges its standard input and output to the hub.
+//go:build !discovery_nonet
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// Tag is the current git tag
+var Tag = "snapshot"
+
+// Timestamp is the current timestamp
+var Timestamp = "unknown"
+
+func main() {
+	configFile := flag.String("config", "discovery-hubd.json", "path of the configuration file")
+	socket := flag.String("socket", defaultSocket(), "path of the unix socket of the hub")
+	connect := flag.Bool("connect", false, "connect to the hub and bridge the standard input and output to it, to be run by the clients as the discovery")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *version {
+		fmt.Printf("discovery-hubd %s (build timestamp: %s)\n", Tag, Timestamp)
+		os.Exit(0)
+	}
+
+	if *connect {
+		conn, err := net.Dial("unix", *socket)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error connecting to the hub: %s\n", err)
+			os.Exit(1)
+		}
+		if err := bridge(os.Stdin, os.Stdout, conn); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading configuration: %s\n", err)
+		os.Exit(1)
+	}
+	// The socket is checked first, to fail without starting the children
+	// if another hub is running
+	l, err := discovery.ListenUnix(*socket, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	h := newHub(config.children())
+	if err := h.start(); err != nil {
+		l.Close()
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	defer h.quit()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// Removes the socket too
+		l.Close()
+	}()
+	_ = h.serve(l)
+}
@@ -0,0 +1,119 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// session is the Discovery served to a client of the hub: in "events" mode
+// it acquires the shared "events" mode of all the children and forwards
+// their events.
+type session struct {
+	hub      *hub
+	handles  []*discovery.SyncHandle
+	stopping atomic.Bool
+	wg       sync.WaitGroup
+}
+
+// Hello does nothing, the children are already running.
+func (s *session) Hello(ctx context.Context, userAgent string, protocolVersion int) error {
+	return nil
+}
+
+// StartSync acquires the "events" mode of the children. The children that
+// fail to start are ignored, unless all of them fail.
+func (s *session) StartSync(ctx context.Context, eventCB discovery.SyncEventCallback, errorCB discovery.ErrorCallback) error {
+	s.stopping.Store(false)
+	var errs []error
+	for _, child := range s.hub.children {
+		handle, err := child.AcquireSync(eventsBufferSize)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("discovery %s: %w", child.GetID(), err))
+			continue
+		}
+		s.handles = append(s.handles, handle)
+		s.wg.Add(1)
+		go s.forward(child.GetID(), handle, eventCB, errorCB)
+	}
+	if len(s.handles) == 0 {
+		return fmt.Errorf("cannot start the discoveries: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// forward delivers the events of a child to the client. If the "events"
+// mode of the child terminates (the child crashed) its ports are removed.
+func (s *session) forward(id string, handle *discovery.SyncHandle, eventCB discovery.SyncEventCallback, errorCB discovery.ErrorCallback) {
+	defer s.wg.Done()
+	type portKey struct{ protocol, address string }
+	ports := map[portKey]*discovery.Port{}
+	delivered := true
+	for ev := range handle.Events() {
+		if ev.Type != "add" && ev.Type != "remove" {
+			continue
+		}
+		key := portKey{ev.Port.Protocol, ev.Port.Address}
+		if ev.Type == "add" {
+			ports[key] = ev.Port
+		} else {
+			delete(ports, key)
+		}
+		// The events are consumed anyway, not to block the other sessions,
+		// until the handle is released
+		if delivered && eventCB(ev.Type, ev.Port) != nil {
+			delivered = false
+		}
+	}
+	if s.stopping.Load() || !delivered {
+		return
+	}
+	for _, port := range ports {
+		_ = eventCB("remove", port)
+	}
+	errorCB(fmt.Sprintf("discovery %s terminated", id))
+}
+
+// Stop releases the "events" mode of the children, that are stopped if no
+// other session is using them.
+func (s *session) Stop(ctx context.Context) error {
+	s.stopping.Store(true)
+	var errs []error
+	for _, handle := range s.handles {
+		if err := handle.Release(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.wg.Wait()
+	s.handles = nil
+	return errors.Join(errs...)
+}
+
+// Quit releases the children, if needed. It's never called by the Server
+// running the session, see Server.RunSession.
+func (s *session) Quit(ctx context.Context) {
+	_ = s.Stop(ctx)
+}
@@ -0,0 +1,64 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// defaultSocket returns the default path of the socket of the hub, in the
+// temporary directory and specific to the user.
+func defaultSocket() string {
+	name := "discovery-hubd.sock"
+	if uid := os.Getuid(); uid >= 0 {
+		name = fmt.Sprintf("discovery-hubd-%d.sock", uid)
+	}
+	return filepath.Join(os.TempDir(), name)
+}
+
+// halfCloser is a connection whose writing side can be closed alone.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// bridge copies the input to the connection and the connection to the
+// output, until the hub closes the connection. When the input is closed
+// only the writing side of the connection is closed, so that the response
+// to the last command is delivered.
+func bridge(in io.Reader, out io.Writer, conn net.Conn) error {
+	defer conn.Close()
+	go func() {
+		if _, err := io.Copy(conn, in); err != nil {
+			return
+		}
+		if conn, ok := conn.(halfCloser); ok {
+			_ = conn.CloseWrite()
+		}
+	}()
+	if _, err := io.Copy(out, conn); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
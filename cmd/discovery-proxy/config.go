@@ -0,0 +1,140 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// config is the configuration of the proxy, loaded from a JSON file.
+type config struct {
+	Discoveries []discoveryConfig `json:"discoveries"`
+	Rules       []*rule           `json:"rules"`
+}
+
+// discoveryConfig describes a downstream discovery.
+type discoveryConfig struct {
+	ID      string   `json:"id"`
+	Command []string `json:"command"`
+}
+
+// rule is applied to the ports matching all the conditions in Match: the
+// port is dropped if Drop is true, otherwise the label is rewritten if Label
+// is not empty. The first matching rule wins.
+type rule struct {
+	Match match  `json:"match"`
+	Drop  bool   `json:"drop"`
+	Label string `json:"label"`
+}
+
+// match are the conditions of a rule, the empty fields match any port.
+type match struct {
+	Discovery  string            `json:"discovery"`
+	Protocol   string            `json:"protocol"`
+	Address    string            `json:"address"` // may be a glob pattern
+	Properties map[string]string `json:"properties"`
+}
+
+func loadConfig(file string) (*config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *config) validate() error {
+	if len(c.Discoveries) == 0 {
+		return errors.New("no discoveries configured")
+	}
+	for i, d := range c.Discoveries {
+		if d.ID == "" {
+			return fmt.Errorf("discovery #%d: missing id", i+1)
+		}
+		if len(d.Command) == 0 {
+			return fmt.Errorf("discovery %s: missing command", d.ID)
+		}
+	}
+	for i, r := range c.Rules {
+		if _, err := path.Match(r.Match.Address, ""); err != nil {
+			return fmt.Errorf("rule #%d: invalid address pattern: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the port reported by the given discovery matches
+// the conditions.
+func (m *match) matches(discoveryID string, port *discovery.Port) bool {
+	if m.Discovery != "" && m.Discovery != discoveryID {
+		return false
+	}
+	if m.Protocol != "" && m.Protocol != port.Protocol {
+		return false
+	}
+	if m.Address != "" {
+		if ok, _ := path.Match(m.Address, port.Address); !ok {
+			return false
+		}
+	}
+	for key, value := range m.Properties {
+		if port.Properties == nil || !strings.EqualFold(port.Properties.Get(key), value) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRules applies the rules to the port reported by the given discovery. It
+// returns the port to expose, that may be a relabeled copy of the given
+// port, or nil if the port must be hidden.
+func applyRules(rules []*rule, discoveryID string, port *discovery.Port) *discovery.Port {
+	for _, r := range rules {
+		if !r.Match.matches(discoveryID, port) {
+			continue
+		}
+		if r.Drop {
+			return nil
+		}
+		if r.Label != "" {
+			port = port.Clone()
+			port.AddressLabel = strings.NewReplacer(
+				"{label}", port.AddressLabel,
+				"{address}", port.Address,
+				"{protocol}", port.Protocol,
+				"{discovery}", discoveryID,
+			).Replace(r.Label)
+		}
+		return port
+	}
+	return port
+}
@@ -0,0 +1,85 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arduino/go-properties-orderedmap"
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	write := func(data string) string {
+		file := filepath.Join(t.TempDir(), "config.json")
+		require.NoError(t, os.WriteFile(file, []byte(data), 0644))
+		return file
+	}
+
+	c, err := loadConfig(write(`{
+		"discoveries": [{ "id": "serial", "command": ["serial-discovery", "-v"] }],
+		"rules": [{ "match": { "protocol": "serial" }, "label": "Lab {label}" }]
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"serial-discovery", "-v"}, c.Discoveries[0].Command)
+	require.Equal(t, "Lab {label}", c.Rules[0].Label)
+
+	_, err = loadConfig(write(`{}`))
+	require.EqualError(t, err, "no discoveries configured")
+	_, err = loadConfig(write(`{ "discoveries": [{ "id": "serial" }] }`))
+	require.EqualError(t, err, "discovery serial: missing command")
+	_, err = loadConfig(write(`{ "discoveries": [{ "command": ["a"] }] }`))
+	require.EqualError(t, err, "discovery #1: missing id")
+	_, err = loadConfig(write(`{
+		"discoveries": [{ "id": "serial", "command": ["a"] }],
+		"rules": [{ "match": { "address": "[" } }]
+	}`))
+	require.EqualError(t, err, "rule #1: invalid address pattern: syntax error in pattern")
+	_, err = loadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.Error(t, err)
+}
+
+func TestApplyRules(t *testing.T) {
+	rules := []*rule{
+		{Match: match{Properties: map[string]string{"vid": "0x1234"}}, Drop: true},
+		{Match: match{Discovery: "serial", Address: "/dev/ttyACM*"}, Label: "Lab {label} ({discovery})"},
+	}
+	newPort := func(address, vid string) *discovery.Port {
+		return &discovery.Port{
+			Address:      address,
+			AddressLabel: address,
+			Protocol:     "serial",
+			Properties:   properties.NewFromHashmap(map[string]string{"vid": vid}),
+		}
+	}
+
+	require.Nil(t, applyRules(rules, "serial", newPort("/dev/ttyACM0", "0X1234")))
+
+	port := newPort("/dev/ttyACM0", "0x2341")
+	res := applyRules(rules, "serial", port)
+	require.Equal(t, "Lab /dev/ttyACM0 (serial)", res.AddressLabel)
+	require.Equal(t, "/dev/ttyACM0", port.AddressLabel, "the original port must not be modified")
+
+	port = newPort("/dev/ttyUSB0", "0x2341")
+	require.Same(t, port, applyRules(rules, "serial", port))
+	port = newPort("/dev/ttyACM0", "0x2341")
+	require.Same(t, port, applyRules(rules, "other", port))
+}
@@ -0,0 +1,57 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// discovery-proxy is a pluggable discovery that runs one or more downstream
+// discoveries and re-exposes their ports as a single discovery, optionally
+// filtering and relabeling them with a set of rules.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// Tag is the current git tag
+var Tag = "snapshot"
+
+// Timestamp is the current timestamp
+var Timestamp = "unknown"
+
+func main() {
+	configFile := flag.String("config", "discovery-proxy.json", "path of the configuration file")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *version {
+		fmt.Printf("discovery-proxy %s (build timestamp: %s)\n", Tag, Timestamp)
+		os.Exit(0)
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading configuration: %s\n", err)
+		os.Exit(1)
+	}
+	proxy, err := newProxy(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	discovery.RunDiscovery(proxy)
+}
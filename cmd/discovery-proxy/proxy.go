@@ -0,0 +1,135 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// proxy is a Discovery that merges the ports of the downstream discoveries.
+type proxy struct {
+	manager *discovery.Manager
+	done    chan struct{}
+
+	mutex   sync.Mutex
+	syncing bool
+	ports   *discovery.PortTracker
+}
+
+func newProxy(c *config) (*proxy, error) {
+	manager := discovery.NewManager()
+	for _, d := range c.Discoveries {
+		if err := manager.Add(discovery.NewClient(d.ID, d.Command...)); err != nil {
+			return nil, err
+		}
+	}
+	// The rules are applied by the Manager, that drops also the "remove"
+	// events of the hidden ports.
+	rules := c.Rules
+	manager.Use(discovery.PortTransformerFunc(func(discoveryID string, port *discovery.Port) *discovery.Port {
+		return applyRules(rules, discoveryID, port)
+	}))
+	return &proxy{manager: manager, ports: discovery.NewPortTracker()}, nil
+}
+
+// Hello does nothing, the downstream discoveries are started by StartSync.
+func (p *proxy) Hello(userAgent string, protocol int) error {
+	return nil
+}
+
+// StartSync starts the downstream discoveries and forwards their events. The
+// discoveries that fail to start are ignored, unless all of them fail.
+func (p *proxy) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	events, errs := p.manager.StartSync(10)
+	if len(errs) == len(p.manager.Discoveries()) {
+		// The events channel is already closed
+		return fmt.Errorf("cannot start downstream discoveries: %w", errors.Join(errs...))
+	}
+
+	p.mutex.Lock()
+	p.syncing = true
+	p.mutex.Unlock()
+	done := make(chan struct{})
+	p.done = done
+	go func() {
+		defer close(done)
+		for ev := range events {
+			p.forward(ev, eventCB)
+		}
+		// Stop has not been called, all the downstream discoveries died
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if p.syncing {
+			errorCB("all downstream discoveries terminated")
+		}
+	}()
+	return nil
+}
+
+// forward sends the "add" and "remove" events upstream. When a downstream
+// discovery crashes, or is going to report again its ports after a
+// "reconnected" or "resynced" event, its ports are removed.
+func (p *proxy) forward(ev *discovery.Event, eventCB discovery.EventCallback) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch ev.Type {
+	case "add", "remove":
+		if p.syncing {
+			eventCB(ev.Type, ev.Port)
+		}
+	case "stop", "reconnected", "resynced":
+		if p.syncing {
+			for _, port := range p.ports.Ports(ev.DiscoveryID) {
+				eventCB("remove", port)
+			}
+		}
+	default:
+		return
+	}
+	p.ports.Track(ev)
+}
+
+// Stop stops the downstream discoveries and waits until all their events
+// are forwarded.
+func (p *proxy) Stop() error {
+	if p.done == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	p.syncing = false
+	p.mutex.Unlock()
+	err := errors.Join(p.manager.Stop()...)
+	<-p.done
+	p.done = nil
+	return err
+}
+
+// Quit terminates the downstream discoveries.
+func (p *proxy) Quit() {
+	p.mutex.Lock()
+	p.syncing = false
+	p.mutex.Unlock()
+	p.manager.Quit()
+	if p.done != nil {
+		<-p.done
+	}
+}
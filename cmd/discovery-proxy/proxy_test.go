@@ -0,0 +1,99 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type testDownstream struct {
+	address string
+}
+
+func (d *testDownstream) Hello(userAgent string, protocolVersion int) error { return nil }
+func (d *testDownstream) Stop() error                                       { return nil }
+func (d *testDownstream) Quit()                                             {}
+func (d *testDownstream) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	go eventCB("add", &discovery.Port{Address: d.address, Protocol: "serial"})
+	return nil
+}
+
+// newTestDownstream returns a discovery.Client connected to an in-process
+// downstream discovery, the downstream is killed by closing the returned
+// connection.
+func newTestDownstream(id, address string) (*discovery.Client, chan net.Conn) {
+	conns := make(chan net.Conn, 1)
+	cl := discovery.NewConnClient(id, func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		conns <- server
+		go func() {
+			_ = discovery.NewServer(&testDownstream{address: address}).RunSession(server, server)
+			server.Close()
+		}()
+		return client, nil
+	})
+	return cl, conns
+}
+
+func TestProxyDownstreamCrash(t *testing.T) {
+	manager := discovery.NewManager()
+	crashing, conns := newTestDownstream("crashing", "/dev/ttyACM0")
+	alive, _ := newTestDownstream("alive", "/dev/ttyACM1")
+	require.NoError(t, manager.Add(crashing))
+	require.NoError(t, manager.Add(alive))
+	p := &proxy{manager: manager, ports: discovery.NewPortTracker()}
+	defer p.Quit()
+
+	var mutex sync.Mutex
+	ports := map[string]bool{}
+	eventCB := func(event string, port *discovery.Port) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch event {
+		case "add":
+			ports[port.Address] = true
+		case "remove":
+			delete(ports, port.Address)
+		}
+	}
+	advertised := func() map[string]bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		res := map[string]bool{}
+		for address := range ports {
+			res[address] = true
+		}
+		return res
+	}
+
+	require.NoError(t, p.StartSync(eventCB, func(string) {}))
+	require.Eventually(t, func() bool { return len(advertised()) == 2 }, time.Second, 10*time.Millisecond)
+
+	// The ports of the crashed downstream are removed
+	(<-conns).Close()
+	require.Eventually(t, func() bool {
+		return len(advertised()) == 1 && advertised()["/dev/ttyACM1"]
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,243 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// responseTypes are the event types of the responses to the commands.
+var responseTypes = map[string]string{
+	"HELLO":      "hello",
+	"START":      "start",
+	"STOP":       "stop",
+	"LIST":       "list",
+	"START_SYNC": "start_sync",
+	"QUIT":       "quit",
+	"FRAMING":    "framing",
+}
+
+type portKey struct{ discovery, protocol, address string }
+
+// analyzer checks the entries of a session for protocol violations and
+// suspicious patterns, and collects the statistics.
+type analyzer struct {
+	gap      time.Duration
+	journal  bool
+	pending  []string
+	syncing  bool
+	quit     bool
+	ports    map[portKey]bool
+	seen     map[portKey]bool
+	last     time.Time
+	first    time.Time
+	maxGap   time.Duration
+	commands int
+	messages map[string]int
+	errors   int
+	issues   int
+}
+
+func newAnalyzer(gap time.Duration, journal bool) *analyzer {
+	return &analyzer{
+		gap:      gap,
+		journal:  journal,
+		ports:    map[portKey]bool{},
+		seen:     map[portKey]bool{},
+		messages: map[string]int{},
+	}
+}
+
+// delta returns the time elapsed since the previous entry with a known
+// time, or false if unknown.
+func (a *analyzer) delta(e *entry) (time.Duration, bool) {
+	if e.Time.IsZero() || a.last.IsZero() {
+		return 0, false
+	}
+	return e.Time.Sub(a.last), true
+}
+
+// check analyzes the next entry and returns the issues found.
+func (a *analyzer) check(e *entry) []string {
+	var issues []string
+	if delta, ok := a.delta(e); ok {
+		a.maxGap = max(a.maxGap, delta)
+		if a.gap > 0 && delta > a.gap {
+			issues = append(issues, fmt.Sprintf("long gap of %s", delta.Round(time.Millisecond)))
+		}
+	}
+	if !e.Time.IsZero() {
+		if a.first.IsZero() {
+			a.first = e.Time
+		}
+		a.last = e.Time
+	}
+
+	switch {
+	case e.Malformed != "":
+		issues = append(issues, "malformed message")
+	case e.Msg == nil:
+		issues = append(issues, a.checkCommand(e)...)
+	default:
+		issues = append(issues, a.checkMessage(e)...)
+	}
+	a.issues += len(issues)
+	return issues
+}
+
+func (a *analyzer) checkCommand(e *entry) []string {
+	a.commands++
+	var issues []string
+	if a.quit {
+		issues = append(issues, "command sent after QUIT")
+	}
+	if len(a.pending) > 0 {
+		issues = append(issues, fmt.Sprintf("command sent while waiting for the %q response", a.pending[0]))
+	}
+	name := strings.ToUpper(strings.Fields(e.Command + " ")[0])
+	expected, ok := responseTypes[name]
+	if !ok {
+		expected = "command_error"
+	}
+	a.pending = append(a.pending, expected)
+	return issues
+}
+
+func (a *analyzer) checkMessage(e *entry) []string {
+	msg := e.Msg
+	a.messages[msg.EventType]++
+	if msg.Error {
+		a.errors++
+	}
+	var issues []string
+	if a.quit && !a.journal {
+		issues = append(issues, "message sent after QUIT")
+	}
+	switch msg.EventType {
+	case "add", "remove":
+		if msg.Port == nil {
+			return append(issues, fmt.Sprintf("%q event without port", msg.EventType))
+		}
+		if !a.journal && !a.syncing {
+			issues = append(issues, fmt.Sprintf("%q event outside the events mode", msg.EventType))
+		}
+		key := portKey{e.DiscoveryID, msg.Port.Protocol, msg.Port.Address}
+		a.seen[key] = true
+		if msg.EventType == "add" {
+			if a.ports[key] {
+				issues = append(issues, "duplicate add of "+portString(msg.Port))
+			}
+			a.ports[key] = true
+		} else {
+			if !a.ports[key] {
+				issues = append(issues, "remove without add of "+portString(msg.Port))
+			}
+			delete(a.ports, key)
+		}
+		return issues
+	case "snapshot", "stop", "reconnected", "resynced":
+		if a.journal {
+			// The ports are reported again
+			a.clearPorts(e.DiscoveryID)
+			for _, port := range msg.Ports {
+				key := portKey{e.DiscoveryID, port.Protocol, port.Address}
+				a.ports[key] = true
+				a.seen[key] = true
+			}
+			return issues
+		}
+	case "moved":
+		if a.journal {
+			if msg.OldPort != nil {
+				delete(a.ports, portKey{e.DiscoveryID, msg.OldPort.Protocol, msg.OldPort.Address})
+			}
+			return issues
+		}
+	}
+	if a.journal {
+		return issues
+	}
+
+	// A response to a command
+	if len(a.pending) == 0 {
+		if msg.EventType == "start_sync" && msg.Error && a.syncing {
+			return append(issues, "discovery error in events mode: "+msg.Message)
+		}
+		return append(issues, fmt.Sprintf("unsolicited %q message", msg.EventType))
+	}
+	expected := a.pending[0]
+	if msg.EventType != expected {
+		return append(issues, fmt.Sprintf("unexpected %q message, expected %q", msg.EventType, expected))
+	}
+	if msg.More {
+		return issues
+	}
+	a.pending = a.pending[1:]
+	if !msg.Error {
+		switch msg.EventType {
+		case "start_sync":
+			a.syncing = true
+			a.clearPorts(e.DiscoveryID)
+		case "stop":
+			a.syncing = false
+			a.clearPorts(e.DiscoveryID)
+		case "quit":
+			a.quit = true
+		}
+	}
+	return issues
+}
+
+func (a *analyzer) clearPorts(discoveryID string) {
+	for key := range a.ports {
+		if key.discovery == discoveryID {
+			delete(a.ports, key)
+		}
+	}
+}
+
+// summary returns the statistics of the session.
+func (a *analyzer) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Commands:  %d\n", a.commands)
+	types := make([]string, 0, len(a.messages))
+	total := 0
+	for eventType, count := range a.messages {
+		types = append(types, eventType)
+		total += count
+	}
+	sort.Strings(types)
+	fmt.Fprintf(&b, "Messages:  %d\n", total)
+	for _, eventType := range types {
+		fmt.Fprintf(&b, "  %-12s %d\n", eventType, a.messages[eventType])
+	}
+	fmt.Fprintf(&b, "Errors:    %d\n", a.errors)
+	fmt.Fprintf(&b, "Ports:     %d seen, %d still available\n", len(a.seen), len(a.ports))
+	if !a.first.IsZero() {
+		fmt.Fprintf(&b, "Duration:  %s\n", a.last.Sub(a.first).Round(time.Millisecond))
+		fmt.Fprintf(&b, "Max gap:   %s\n", a.maxGap.Round(time.Millisecond))
+	}
+	if len(a.pending) > 0 && !a.journal {
+		fmt.Fprintf(&b, "Pending:   %d commands without response\n", len(a.pending))
+	}
+	fmt.Fprintf(&b, "Issues:    %d\n", a.issues+len(a.pending))
+	return b.String()
+}
@@ -0,0 +1,89 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// discovery-trace pretty-prints a recorded pluggable discovery session, a
+// journal written by discovery.Journal or a raw dialogue like the
+// transcripts of the discoverytest package, with the timing deltas. It
+// flags the protocol violations and the suspicious patterns (duplicate
+// adds, removes without add, long gaps...) and summarizes the statistics
+// of the session.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+func main() {
+	gap := flag.Duration("gap", 30*time.Second, "flag the gaps between messages longer than this duration (0 to disable)")
+	summaryOnly := flag.Bool("summary", false, "print only the issues and the summary")
+	strict := flag.Bool("strict", false, "exit with status 2 if any issue is found")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file]\n\nReads the session from stdin if file is missing or \"-\".\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	in := os.Stdin
+	if file := flag.Arg(0); file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	issues, err := run(in, os.Stdout, *gap, *summaryOnly)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	if *strict && issues > 0 {
+		os.Exit(2)
+	}
+}
+
+// run pretty-prints the session read from in, returning the number of
+// issues found.
+func run(in io.Reader, out io.Writer, gap time.Duration, summaryOnly bool) (int, error) {
+	entries, journal, err := readTrace(in)
+	if err != nil {
+		return 0, err
+	}
+	a := newAnalyzer(gap, journal)
+	for _, e := range entries {
+		delta, hasDelta := a.delta(e)
+		issues := a.check(e)
+		if !summaryOnly {
+			timing := "        -"
+			if hasDelta {
+				timing = fmt.Sprintf("%+8.3fs", delta.Seconds())
+			}
+			fmt.Fprintf(out, "%s %5d  %s\n", timing, e.Line, e)
+		}
+		for _, issue := range issues {
+			fmt.Fprintf(out, "          %5d  !! %s\n", e.Line, issue)
+		}
+	}
+	fmt.Fprintln(out)
+	fmt.Fprint(out, a.summary())
+	return a.issues + len(a.pending), nil
+}
@@ -0,0 +1,243 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// entry is a line of the dialogue between a client and a discovery: a
+// command sent by the client or a message sent by the discovery.
+type entry struct {
+	// Time is the time of the entry, it's zero if unknown.
+	Time time.Time
+	// Line is the line of the entry in the input.
+	Line int
+	// Command is the command sent by the client, empty for the messages.
+	Command string
+	// DiscoveryID is the discovery sending the message, known only for
+	// the journals recorded by a Manager.
+	DiscoveryID string
+	// Msg is the message sent by the discovery, nil for the commands.
+	Msg *traceMessage
+	// Malformed is the content that couldn't be parsed, if any.
+	Malformed string
+}
+
+// traceMessage is a message sent by a discovery, or an event recorded in a
+// journal.
+type traceMessage struct {
+	EventType       string            `json:"eventType"`
+	Message         string            `json:"message,omitempty"`
+	Error           bool              `json:"error,omitempty"`
+	Code            string            `json:"code,omitempty"`
+	ProtocolVersion int               `json:"protocolVersion,omitempty"`
+	Port            *discovery.Port   `json:"port,omitempty"`
+	Ports           []*discovery.Port `json:"ports,omitempty"`
+	OldPort         *discovery.Port   `json:"oldPort,omitempty"`
+	More            bool              `json:"more,omitempty"`
+	Capabilities    []string          `json:"capabilities,omitempty"`
+}
+
+// journalLine is a record of a journal written by discovery.Journal.
+type journalLine struct {
+	Time        time.Time `json:"time"`
+	DiscoveryID string    `json:"discoveryId"`
+	traceMessage
+	ErrorMessage string `json:"error,omitempty"`
+}
+
+// readTrace reads a recorded session, journal is true if it's a journal.
+// Two formats are supported:
+//   - the journals written by discovery.Journal, one JSON event per line;
+//   - the raw dialogue, like the transcripts of the discoverytest package,
+//     with the commands sent by the client prefixed by "> " and the JSON
+//     messages sent by the discovery, possibly spanning many lines. Each
+//     line may start with an RFC3339 timestamp.
+func readTrace(in io.Reader) (entries []*entry, journal bool, err error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	if isJournal(lines) {
+		return parseJournal(lines), true, nil
+	}
+	return parseDialogue(lines), false, nil
+}
+
+// isJournal returns true if the first non empty line is a journal record.
+func isJournal(lines []string) bool {
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return false
+		}
+		_, hasTime := record["time"]
+		_, hasType := record["eventType"]
+		return hasTime && hasType
+	}
+	return false
+}
+
+func parseJournal(lines []string) []*entry {
+	var res []*entry
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record journalLine
+		if err := json.Unmarshal([]byte(line), &record); err != nil || record.EventType == "" {
+			res = append(res, &entry{Line: i + 1, Malformed: line})
+			continue
+		}
+		msg := record.traceMessage
+		if record.ErrorMessage != "" {
+			msg.Message = record.ErrorMessage
+			msg.Error = true
+		}
+		res = append(res, &entry{Time: record.Time, Line: i + 1, DiscoveryID: record.DiscoveryID, Msg: &msg})
+	}
+	return res
+}
+
+func parseDialogue(lines []string) []*entry {
+	var res []*entry
+	var pending bytes.Buffer
+	var pendingEntry *entry
+	flush := func() {
+		if pendingEntry != nil && strings.TrimSpace(pending.String()) != "" {
+			pendingEntry.Malformed = strings.TrimSpace(pending.String())
+			res = append(res, pendingEntry)
+		}
+		pending.Reset()
+		pendingEntry = nil
+	}
+	for i, line := range lines {
+		timestamp, text := splitTimestamp(line)
+		if cmd, ok := strings.CutPrefix(text, "> "); ok {
+			flush()
+			res = append(res, &entry{Time: timestamp, Line: i + 1, Command: strings.TrimSpace(cmd)})
+			continue
+		}
+		if pendingEntry == nil {
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			pendingEntry = &entry{Time: timestamp, Line: i + 1}
+		}
+		pending.WriteString(text)
+		pending.WriteByte('\n')
+		if !strings.HasPrefix(strings.TrimSpace(pending.String()), "{") {
+			// Not a JSON message
+			flush()
+			continue
+		}
+		if !json.Valid(pending.Bytes()) {
+			continue
+		}
+		var msg traceMessage
+		if err := json.Unmarshal(pending.Bytes(), &msg); err != nil {
+			flush()
+			continue
+		}
+		pendingEntry.Msg = &msg
+		res = append(res, pendingEntry)
+		pending.Reset()
+		pendingEntry = nil
+	}
+	flush()
+	return res
+}
+
+// splitTimestamp splits the leading RFC3339 timestamp, if any, from the
+// line.
+func splitTimestamp(line string) (time.Time, string) {
+	first, rest, found := strings.Cut(line, " ")
+	if !found {
+		return time.Time{}, line
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, first)
+	if err != nil {
+		return time.Time{}, line
+	}
+	return timestamp, rest
+}
+
+// String returns the pretty-printed entry.
+func (e *entry) String() string {
+	if e.Malformed != "" {
+		return "?? " + e.Malformed
+	}
+	if e.Msg == nil {
+		return "> " + e.Command
+	}
+	s := "< "
+	if e.DiscoveryID != "" {
+		s += "[" + e.DiscoveryID + "] "
+	}
+	msg := e.Msg
+	s += msg.EventType
+	switch {
+	case msg.Error && msg.Code != "":
+		s += fmt.Sprintf(" ERROR [%s] %s", msg.Code, msg.Message)
+	case msg.Error:
+		s += " ERROR " + msg.Message
+	case msg.Message != "":
+		s += " " + msg.Message
+	}
+	if msg.Port != nil {
+		s += " " + portString(msg.Port)
+	}
+	if msg.OldPort != nil {
+		s += " (from " + portString(msg.OldPort) + ")"
+	}
+	if msg.Ports != nil {
+		s += fmt.Sprintf(" (%d ports)", len(msg.Ports))
+	}
+	if msg.More {
+		s += " (more)"
+	}
+	if len(msg.Capabilities) > 0 {
+		s += " capabilities: " + strings.Join(msg.Capabilities, ", ")
+	}
+	return s
+}
+
+func portString(port *discovery.Port) string {
+	s := port.Protocol + "://" + port.Address
+	if port.AddressLabel != "" && port.AddressLabel != port.Address {
+		s += fmt.Sprintf(" %q", port.AddressLabel)
+	}
+	return s
+}
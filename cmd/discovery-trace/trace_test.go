@@ -0,0 +1,104 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceTranscript(t *testing.T) {
+	f, err := os.Open("../../testdata/dummy-discovery.golden")
+	require.NoError(t, err)
+	defer f.Close()
+	out := &bytes.Buffer{}
+	issues, err := run(f, out, time.Second, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, issues, out.String())
+	require.Contains(t, out.String(), `        -    12  < add dummy://1 "Dummy upload port"`)
+	require.Contains(t, out.String(), "Commands:  4\n")
+}
+
+func TestTraceDialogueViolations(t *testing.T) {
+	session := `2024-01-02T03:04:05Z > HELLO 1 "test"
+2024-01-02T03:04:05.100Z {"eventType":"hello","message":"OK","protocolVersion":1}
+2024-01-02T03:04:05.200Z {"eventType":"add","port":{"address":"1","protocol":"test"}}
+2024-01-02T03:04:06Z > START_SYNC
+2024-01-02T03:04:06.500Z {"eventType":"start_sync","message":"OK"}
+2024-01-02T03:04:06.600Z {"eventType":"add","port":{"address":"1","protocol":"test"}}
+2024-01-02T03:04:06.700Z {"eventType":"add","port":{"address":"1","protocol":"test"}}
+2024-01-02T03:05:00Z {"eventType":"remove","port":{"address":"2","protocol":"test"}}
+2024-01-02T03:05:01Z {"eventType":"start_sync","error":true,"message":"device lost"}
+2024-01-02T03:05:02Z > LIST
+2024-01-02T03:05:02.001Z {"eventType":"start","message":"OK"}
+not a message
+> QUIT
+`
+	out := &bytes.Buffer{}
+	issues, err := run(strings.NewReader(session), out, 30*time.Second, false)
+	require.NoError(t, err)
+	res := out.String()
+	require.Contains(t, res, "  +0.100s     2  < hello OK\n")
+	for _, issue := range []string{
+		`    3  !! "add" event outside the events mode`,
+		`    7  !! duplicate add of test://1`,
+		`    8  !! long gap of 53.3s`,
+		`    8  !! remove without add of test://2`,
+		`    9  !! discovery error in events mode: device lost`,
+		`   11  !! unexpected "start" message, expected "list"`,
+		`   12  !! malformed message`,
+		`   13  !! command sent while waiting for the "list" response`,
+	} {
+		require.Contains(t, res, issue+"\n")
+	}
+	require.Contains(t, res, "Pending:   2 commands without response\n")
+	require.Equal(t, 10, issues)
+}
+
+func TestTraceJournal(t *testing.T) {
+	journal := `{"time":"2024-01-02T03:04:05Z","discoveryId":"serial","eventType":"add","seq":1,"port":{"address":"/dev/ttyACM0","protocol":"serial"}}
+{"time":"2024-01-02T03:04:06Z","discoveryId":"mdns","eventType":"add","seq":1,"port":{"address":"192.168.1.2","protocol":"network"}}
+{"time":"2024-01-02T03:04:07Z","discoveryId":"serial","eventType":"add","seq":2,"port":{"address":"/dev/ttyACM0","protocol":"serial"}}
+{"time":"2024-01-02T03:04:08Z","discoveryId":"serial","eventType":"stop","seq":3,"error":"EOF"}
+{"time":"2024-01-02T03:04:09Z","discoveryId":"serial","eventType":"remove","seq":4,"port":{"address":"/dev/ttyACM0","protocol":"serial"}}
+{"time":"2024-01-02T03:04:09Z","disc
+`
+	out := &bytes.Buffer{}
+	issues, err := run(strings.NewReader(journal), out, 0, false)
+	require.NoError(t, err)
+	res := out.String()
+	require.Contains(t, res, "  +1.000s     2  < [mdns] add network://192.168.1.2\n")
+	require.Contains(t, res, "    3  !! duplicate add of serial:///dev/ttyACM0\n")
+	require.Contains(t, res, "  +1.000s     4  < [serial] stop ERROR EOF\n")
+	require.Contains(t, res, "    5  !! remove without add of serial:///dev/ttyACM0\n")
+	require.Contains(t, res, "    6  !! malformed message\n")
+	require.Contains(t, res, "Ports:     2 seen, 1 still available\n")
+	require.Equal(t, 3, issues)
+
+	// Only the issues and the summary
+	out.Reset()
+	_, err = run(strings.NewReader(journal), out, 0, true)
+	require.NoError(t, err)
+	require.NotContains(t, out.String(), "[mdns]")
+	require.Contains(t, out.String(), "!! duplicate add")
+}
@@ -0,0 +1,74 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// stdio-proxy bridges its standard input and output to a TCP connection, to
+// run a pluggable discovery served over the network (for example with
+// Server.Serve) as if it were a local executable: the client spawns
+// stdio-proxy in place of the discovery.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Tag is the current git tag
+var Tag = "snapshot"
+
+// Timestamp is the current timestamp
+var Timestamp = "unknown"
+
+func main() {
+	cfg := &proxyConfig{}
+	flag.BoolVar(&cfg.tls, "tls", false, "connect with TLS")
+	flag.StringVar(&cfg.tlsCA, "tls-ca", "", "PEM file with the certificate authorities that sign the server certificate (implies -tls)")
+	flag.StringVar(&cfg.tlsServerName, "tls-server-name", "", "name of the server to verify, if different from the host of the address (implies -tls)")
+	flag.IntVar(&cfg.reconnectAttempts, "reconnect", 0, "number of further attempts to connect if the connection can't be established")
+	flag.DurationVar(&cfg.reconnectDelay, "reconnect-delay", time.Second, "delay between the connection attempts")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] host:port\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *version {
+		fmt.Printf("stdio-proxy %s (build timestamp: %s)\n", Tag, Timestamp)
+		os.Exit(0)
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	address, err := validateAddress(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(2)
+	}
+	cfg.address = address
+
+	conn, err := connect(cfg, time.Sleep)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	if err := proxy(os.Stdin, os.Stdout, conn); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
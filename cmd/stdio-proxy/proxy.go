@@ -0,0 +1,131 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// proxyConfig is the configuration of the proxy.
+type proxyConfig struct {
+	address           string
+	tls               bool
+	tlsCA             string
+	tlsServerName     string
+	reconnectAttempts int
+	reconnectDelay    time.Duration
+}
+
+// validateAddress checks that the address is a host and a numeric port, and
+// returns it normalized.
+func validateAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid address %q: missing host", address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid address %q: invalid port %q", address, port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// tlsConfig returns the TLS configuration, or nil if TLS is not enabled.
+func (cfg *proxyConfig) tlsConfig() (*tls.Config, error) {
+	if !cfg.tls && cfg.tlsCA == "" && cfg.tlsServerName == "" {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: cfg.tlsServerName}
+	if cfg.tlsCA != "" {
+		data, err := os.ReadFile(cfg.tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.tlsCA)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// connect connects to the server, trying again for the configured number
+// of attempts. Only the connection is retried: once the protocol session
+// has begun it can't be resumed on a new connection, since the state of the
+// discovery would be lost.
+func connect(cfg *proxyConfig, sleep func(time.Duration)) (net.Conn, error) {
+	config, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	for attempt := 0; ; attempt++ {
+		var conn net.Conn
+		if config != nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", cfg.address, config)
+		} else {
+			conn, err = dialer.Dial("tcp", cfg.address)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= cfg.reconnectAttempts {
+			return nil, err
+		}
+		sleep(cfg.reconnectDelay)
+	}
+}
+
+// halfCloser is a connection whose writing side can be closed alone, like a
+// *net.TCPConn or a *tls.Conn.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// proxy copies the input to the connection and the connection to the
+// output, it returns when the connection is closed by the server. When the
+// input is closed only the writing side of the connection is closed, so
+// that the responses still in flight (like the one to a QUIT) are
+// delivered.
+func proxy(in io.Reader, out io.Writer, conn net.Conn) error {
+	defer conn.Close()
+	go func() {
+		if _, err := io.Copy(conn, in); err != nil {
+			// The writing side is gone, the server will close the connection
+			return
+		}
+		if conn, ok := conn.(halfCloser); ok {
+			_ = conn.CloseWrite()
+		}
+	}()
+	if _, err := io.Copy(out, conn); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAddress(t *testing.T) {
+	addr, err := validateAddress("localhost:5000")
+	require.NoError(t, err)
+	require.Equal(t, "localhost:5000", addr)
+	addr, err = validateAddress("[::1]:80")
+	require.NoError(t, err)
+	require.Equal(t, "[::1]:80", addr)
+
+	for _, invalid := range []string{"", "localhost", ":5000", "localhost:", "localhost:http", "localhost:0", "localhost:65536"} {
+		_, err := validateAddress(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestProxyHalfClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Reply only after the whole input has been received
+		data, _ := io.ReadAll(conn)
+		_, _ = conn.Write([]byte("received " + string(data)))
+	}()
+
+	conn, err := connect(&proxyConfig{address: listener.Addr().String()}, nil)
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	require.NoError(t, proxy(strings.NewReader("QUIT\n"), out, conn))
+	require.Equal(t, "received QUIT\n", out.String())
+}
+
+func TestConnectRetries(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	sleeps := 0
+	cfg := &proxyConfig{address: address, reconnectAttempts: 2, reconnectDelay: time.Millisecond}
+	_, err = connect(cfg, func(d time.Duration) {
+		require.Equal(t, time.Millisecond, d)
+		sleeps++
+	})
+	require.Error(t, err)
+	require.Equal(t, 2, sleeps)
+
+	// The server comes up while the proxy is waiting
+	sleeps = 0
+	_, err = connect(cfg, func(time.Duration) {
+		sleeps++
+		listener, err = net.Listen("tcp", address)
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, sleeps)
+	listener.Close()
+}
+
+func TestTLSConfig(t *testing.T) {
+	config, err := (&proxyConfig{}).tlsConfig()
+	require.NoError(t, err)
+	require.Nil(t, config)
+
+	config, err = (&proxyConfig{tlsServerName: "example.com"}).tlsConfig()
+	require.NoError(t, err)
+	require.Equal(t, "example.com", config.ServerName)
+
+	_, err = (&proxyConfig{tlsCA: "missing.pem"}).tlsConfig()
+	require.Error(t, err)
+}
@@ -0,0 +1,273 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// codec is an encoding of the messages of the protocol, shared by the Server
+// (encoding) and the Client (decoding).
+type codec interface {
+	// Encode returns the encoded message, ready to be written to the stream.
+	Encode(msg *message) ([]byte, error)
+	// NewDecoder returns a decoder of the messages read from r.
+	NewDecoder(r io.Reader) decoder
+}
+
+// decoder decodes the messages read from a stream.
+type decoder interface {
+	// Decode returns the next message. If the error wraps errMalformed the
+	// malformed message may be skipped with Resync and the decoding resumed.
+	// The message may be overwritten by the next Decode, the ports it refers
+	// to are not.
+	Decode() (*message, error)
+	// Peek reads the next message and returns its event type, without
+	// decoding the rest of the message: the message is decoded by the
+	// following Decode or skipped by the following Peek. The errors are the
+	// same of Decode.
+	Peek() (string, error)
+	// Raw returns the JSON form of the message returned by the last Decode
+	// or Peek, it may be overwritten by the next Decode or Peek.
+	Raw() json.RawMessage
+	// Resync skips the malformed message after a failed Decode, it returns
+	// the data skipped (for logging), if any.
+	Resync() (string, error)
+	// Buffered returns the data read from the stream but not decoded yet,
+	// followed by the rest of the stream, to switch to another codec.
+	Buffered() io.Reader
+}
+
+// errMalformed is wrapped by the decoding errors of the malformed messages.
+var errMalformed = errors.New("malformed message")
+
+// malformedError is a decoding error of a malformed message.
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *malformedError) Unwrap() []error {
+	return []error{errMalformed, e.err}
+}
+
+// portPool recycles the ports of the events dropped by the Client (see
+// releasePort), to save an allocation for each port decoded.
+var portPool = sync.Pool{New: func() any { return &Port{} }}
+
+// acquirePort returns an empty Port, recycled if possible.
+func acquirePort() *Port {
+	return portPool.Get().(*Port)
+}
+
+// releasePort makes the port available to the decoders, it must not be
+// referenced anymore by the caller.
+func releasePort(port *Port) {
+	*port = Port{}
+	portPool.Put(port)
+}
+
+// jsonCodec is the JSON encoding, the default one of the protocol. The
+// zero value encodes the messages indented with two spaces, see
+// OutputFormat for the other formats.
+type jsonCodec struct {
+	indent    JSONIndent
+	noNewline bool
+}
+
+// Encode returns the JSON message, followed by a newline if required.
+func (c jsonCodec) Encode(msg *message) ([]byte, error) {
+	data, err := encodeJSON(msg, c.indent)
+	if err != nil {
+		return nil, err
+	}
+	if c.noNewline {
+		return data, nil
+	}
+	return append(data, '\n'), nil
+}
+
+// NewDecoder returns a decoder of a stream of JSON messages.
+func (jsonCodec) NewDecoder(r io.Reader) decoder {
+	return &jsonDecoder{src: r, decoder: json.NewDecoder(r)}
+}
+
+// jsonDecoder decodes a stream of JSON messages, with any indentation.
+// The buffers used for the decoding are reused, so the message returned by
+// Decode and the data returned by Raw are valid only until the next call to
+// Decode, except the ports they refer to.
+type jsonDecoder struct {
+	// src is the reader the decoder is reading from, it changes when the
+	// decoder is resynchronized after a malformed message
+	src     io.Reader
+	decoder *json.Decoder
+	buf     json.RawMessage
+	raw     json.RawMessage
+	msg     message
+	// spare is the Port the next "port" field is decoded into
+	spare *Port
+	// peeked is set if the message in buf has been read by Peek
+	peeked bool
+	// resync is set when the decoder must skip the malformed data
+	resync bool
+}
+
+// unsetAddress marks the spare Port of the jsonDecoder, to tell apart the
+// messages without a port: Port.UnmarshalJSON always overwrites the
+// address, so the mark is left only if the message has no "port" member.
+const unsetAddress = "\x00unset"
+
+// read reads the next message in buf.
+func (d *jsonDecoder) read() error {
+	d.raw = nil
+	// RawMessage reuses the capacity of the previous message
+	d.buf = d.buf[:0]
+	if err := d.decoder.Decode(&d.buf); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			d.resync = true
+			return &malformedError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// unmarshal decodes the message in buf into v.
+func (d *jsonDecoder) unmarshal(v any) error {
+	if err := json.Unmarshal(d.buf, v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			// The whole value has been consumed, the decoder is still in sync
+			return &malformedError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *jsonDecoder) Peek() (string, error) {
+	d.peeked = false
+	if err := d.read(); err != nil {
+		return "", err
+	}
+	var head struct {
+		EventType string `json:"eventType"`
+	}
+	if err := d.unmarshal(&head); err != nil {
+		return "", err
+	}
+	d.peeked = true
+	d.raw = d.buf
+	return head.EventType, nil
+}
+
+func (d *jsonDecoder) Decode() (*message, error) {
+	if d.peeked {
+		d.peeked = false
+	} else if err := d.read(); err != nil {
+		return nil, err
+	}
+	if d.spare == nil {
+		d.spare = acquirePort()
+	}
+	*d.spare = Port{Address: unsetAddress}
+	d.msg = message{Port: d.spare}
+	if err := d.unmarshal(&d.msg); err != nil {
+		return nil, err
+	}
+	extensions, err := unknownJSONMembers(d.buf, messageJSONKeys)
+	if err != nil {
+		return nil, &malformedError{err}
+	}
+	d.msg.Extensions = extensions
+	if port := d.msg.Port; port == d.spare {
+		if port.Address == unsetAddress {
+			// No port in the message
+			d.msg.Port = nil
+		} else {
+			d.spare = nil
+		}
+	}
+	d.raw = d.buf
+	return &d.msg, nil
+}
+
+func (d *jsonDecoder) Raw() json.RawMessage {
+	return d.raw
+}
+
+// Resync skips the malformed data at the current position of the decoder
+// up to the next '{'. The skipped data is truncated to maxSkippedDataLog.
+func (d *jsonDecoder) Resync() (string, error) {
+	if !d.resync {
+		return "", nil
+	}
+	d.resync = false
+	r := bufio.NewReader(d.Buffered())
+	skipped := []byte{}
+	// Skip the leading whitespace and the first byte of the malformed data,
+	// so that the decoding is resumed after its beginning
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return truncateSkipped(skipped), err
+		}
+		skipped = append(skipped, b)
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			break
+		}
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return truncateSkipped(skipped), err
+		}
+		if b == '{' {
+			_ = r.UnreadByte()
+			d.src = r
+			d.decoder = json.NewDecoder(r)
+			return truncateSkipped(skipped), nil
+		}
+		if len(skipped) <= maxSkippedDataLog {
+			skipped = append(skipped, b)
+		}
+	}
+}
+
+func (d *jsonDecoder) Buffered() io.Reader {
+	return io.MultiReader(d.decoder.Buffered(), d.src)
+}
+
+// maxSkippedDataLog is the maximum amount of skipped data that is logged
+// while resynchronizing the decoder.
+const maxSkippedDataLog = 256
+
+func truncateSkipped(data []byte) string {
+	if len(data) > maxSkippedDataLog {
+		data = data[:maxSkippedDataLog]
+	}
+	return string(data)
+}
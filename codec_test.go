@@ -0,0 +1,161 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONDecoderReuse(t *testing.T) {
+	stream := strings.NewReader(`
+{"eventType":"add","port":{"address":"1","protocol":"test","properties":{"vid":"0x2341"},"future":[1]}}
+{"eventType":"add","port":{"address":"2","protocol":"test"},"priority":1}
+{"eventType":"add"}
+{"eventType":"remove","port":null}
+{"eventType":"add","port":{"protocol":"test"}}
+{"eventType":"add","port":{}}
+{"eventType":"add","port":{"address":3}}
+{"eventType":"list","ports":[{"address":"4"}]}
+{"eventType":"quit","message":"OK"}
+`)
+	dec := jsonCodec{}.NewDecoder(stream)
+	first, err := dec.Decode()
+	require.NoError(t, err)
+	port1 := first.Port
+	require.Equal(t, "0x2341", port1.Properties.Get("vid"))
+
+	second, err := dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, "2", second.Port.Address)
+	require.JSONEq(t, `{"eventType":"add","port":{"address":"2","protocol":"test"},"priority":1}`, string(dec.Raw()))
+	require.Equal(t, `{"priority":1}`, string(second.Extensions))
+	// The unknown fields are sent again
+	data, err := jsonCodec{}.Encode(second)
+	require.NoError(t, err)
+	require.JSONEq(t, string(dec.Raw()), string(data))
+	// The ports are not overwritten by the following messages
+	require.Equal(t, "1", port1.Address)
+	require.Equal(t, `{"future":[1]}`, string(port1.Extensions))
+	require.NotSame(t, port1, second.Port)
+
+	// Missing and null ports
+	msg, err := dec.Decode()
+	require.NoError(t, err)
+	require.Nil(t, msg.Port)
+	msg, err = dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, "remove", msg.EventType)
+	require.Nil(t, msg.Port)
+	msg, err = dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, &Port{Protocol: "test"}, msg.Port)
+	// An empty port is not a missing port
+	msg, err = dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, &Port{}, msg.Port)
+
+	// A malformed port doesn't break the stream
+	_, err = dec.Decode()
+	require.ErrorIs(t, err, errMalformed)
+	msg, err = dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, "list", msg.EventType)
+	require.Nil(t, msg.Port)
+	require.Equal(t, "4", msg.Ports[0].Address)
+	require.Nil(t, msg.Extensions)
+	msg, err = dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, &message{EventType: "quit", Message: "OK"}, msg)
+	_, err = dec.Decode()
+	require.ErrorIs(t, err, io.EOF)
+
+	// A released port is reset before being reused
+	releasePort(port1)
+	require.Equal(t, &Port{}, port1)
+}
+
+func TestDecoderPeek(t *testing.T) {
+	messages := []*message{
+		{EventType: "add", Port: &Port{Address: "1", Protocol: "test"}},
+		{EventType: "list", Ports: []*Port{{Address: "2", Protocol: "test"}}},
+		{EventType: "quit", Message: "OK"},
+	}
+	for _, codec := range []codec{jsonCodec{}, msgpackCodec{}} {
+		stream := &bytes.Buffer{}
+		for _, msg := range messages {
+			data, err := codec.Encode(msg)
+			require.NoError(t, err)
+			stream.Write(data)
+		}
+		dec := codec.NewDecoder(stream)
+		// Peek and skip the event
+		eventType, err := dec.Peek()
+		require.NoError(t, err)
+		require.Equal(t, "add", eventType)
+		require.JSONEq(t, `{"eventType":"add","port":{"address":"1","protocol":"test"}}`, string(dec.Raw()))
+		// Peek and decode the response
+		eventType, err = dec.Peek()
+		require.NoError(t, err)
+		require.Equal(t, "list", eventType)
+		msg, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, messages[1], msg)
+		// Decode without Peek
+		msg, err = dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, messages[2], msg)
+		_, err = dec.Peek()
+		require.ErrorIs(t, err, io.EOF)
+	}
+
+	// The malformed messages are detected by Peek
+	dec := jsonCodec{}.NewDecoder(strings.NewReader(`{"eventType":1} {"eventType":"quit"}`))
+	_, err := dec.Peek()
+	require.ErrorIs(t, err, errMalformed)
+	eventType, err := dec.Peek()
+	require.NoError(t, err)
+	require.Equal(t, "quit", eventType)
+}
+
+func BenchmarkJSONDecoder(b *testing.B) {
+	data, err := jsonCodec{}.Encode(&message{EventType: "add", Port: &Port{
+		Address:    "/dev/ttyACM0",
+		Protocol:   "serial",
+		Properties: PropertiesFromMap(map[string]string{"vid": "0x2341", "pid": "0x0043", "serialNumber": "12345"}),
+		HardwareID: "12345",
+	}})
+	require.NoError(b, err)
+	stream := bytes.Repeat(data, b.N)
+	dec := jsonCodec{}.NewDecoder(bytes.NewReader(stream))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, err := dec.Decode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		// The events dropped by the Client are recycled
+		releasePort(msg.Port)
+	}
+}
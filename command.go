@@ -0,0 +1,61 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"strings"
+)
+
+// commandArg is an argument of a command, Quoted is set if the argument
+// was enclosed in double quotes.
+type commandArg struct {
+	Value  string
+	Quoted bool
+}
+
+// errInvalidQuoting is returned by parseCommandArgs for the arguments with
+// unbalanced or misplaced quotes.
+var errInvalidQuoting = errors.New("invalid quoting")
+
+// parseCommandArgs splits the arguments of a command, separated by one or
+// more spaces. An argument enclosed in double quotes may contain spaces,
+// the quotes can't be escaped, as in the protocol specification: an
+// unterminated quoted argument, a quote inside an argument or a quoted
+// argument not followed by a space are errors.
+func parseCommandArgs(args string) ([]commandArg, error) {
+	res := []commandArg{}
+	for args = strings.TrimLeft(args, " "); args != ""; args = strings.TrimLeft(args, " ") {
+		if args[0] != '"' {
+			value, rest, _ := strings.Cut(args, " ")
+			if strings.Contains(value, `"`) {
+				return nil, errInvalidQuoting
+			}
+			res = append(res, commandArg{Value: value})
+			args = rest
+			continue
+		}
+		value, rest, ok := strings.Cut(args[1:], `"`)
+		if !ok || (rest != "" && rest[0] != ' ') {
+			return nil, errInvalidQuoting
+		}
+		res = append(res, commandArg{Value: value, Quoted: true})
+		args = rest
+	}
+	return res, nil
+}
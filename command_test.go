@@ -0,0 +1,89 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommandArgs(t *testing.T) {
+	args, err := parseCommandArgs(`  1   "a b"  "" x`)
+	require.NoError(t, err)
+	require.Equal(t, []commandArg{{Value: "1"}, {Value: "a b", Quoted: true}, {Value: "", Quoted: true}, {Value: "x"}}, args)
+	args, err = parseCommandArgs("")
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	for _, malformed := range []string{`"`, `"a`, `"a"b`, `a"b"`, `"a""b"`, `1 "x`, `1 ""x"`} {
+		_, err := parseCommandArgs(malformed)
+		require.ErrorIs(t, err, errInvalidQuoting, malformed)
+	}
+}
+
+func TestParseHelloArgs(t *testing.T) {
+	valid := []struct {
+		args string
+		res  helloArgs
+	}{
+		{`1 "arduino-cli"`, helloArgs{"1", "arduino-cli", "", ""}},
+		{`1 "arduino-cli/1.0.0 (linux; amd64)" "secret"`, helloArgs{"1", "arduino-cli/1.0.0 (linux; amd64)", "secret", ""}},
+		{`1 "x" ""`, helloArgs{"1", "x", "", ""}},
+		{`01  "x"`, helloArgs{"01", "x", "", ""}},
+		{`1 "アルドゥイーノ/1.0 🤖"`, helloArgs{"1", "アルドゥイーノ/1.0 🤖", "", ""}},
+		{`99999999999999999999 "x"`, helloArgs{"99999999999999999999", "x", "", ""}},
+		{`1 "x" locale=it`, helloArgs{"1", "x", "", "it"}},
+		{`1 "x" "secret" LOCALE=pt_br`, helloArgs{"1", "x", "secret", "pt-BR"}},
+	}
+	for _, test := range valid {
+		res, ok := parseHelloArgs(test.args)
+		require.True(t, ok, test.args)
+		require.Equal(t, test.res, res, test.args)
+	}
+
+	invalid := []string{
+		// Truncated
+		``, `1`, `1 `, `1 "`, `1 "arduino`, `1 "x" "tok`,
+		// Over-quoted or misplaced quotes
+		`"1" "x"`, `1 ""x""`, `1 "x""y"`, `1 "x"y`, `1 x"y"`, `1 "x" "t" "u"`,
+		// Wrong arguments
+		`1 ""`, `1 x`, `1 "x" token`, `one "x"`, `-1 "x"`, `1.0 "x"`, `１ "x"`,
+		// Malformed or misplaced locale
+		`1 locale=it`, `1 "x" locale=`, `1 "x" locale=i`, `1 "x" lang=it`, `1 "x" locale=it "t"`, `1 "x" "t" "u" locale=it`,
+	}
+	for _, args := range invalid {
+		_, ok := parseHelloArgs(args)
+		require.False(t, ok, args)
+	}
+
+	// The malformed HELLO commands get an error response
+	for _, args := range append(invalid, "\xff\xfe") {
+		out := &bytes.Buffer{}
+		server := NewServer(&testDiscovery{})
+		require.NoError(t, server.Run(strings.NewReader("HELLO "+args+"\nQUIT\n"), out))
+		var msg message
+		require.NoError(t, json.NewDecoder(out).Decode(&msg), args)
+		require.Equal(t, "hello", msg.EventType, args)
+		require.True(t, msg.Error, args)
+		require.Equal(t, string(ErrorCodeInvalidCommand), msg.Code, args)
+	}
+}
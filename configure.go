@@ -0,0 +1,106 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CapabilityConfigure is the capability advertised in the HELLO response by
+// the servers whose implementation supports the CONFIGURE command, see
+// Configurable.
+const CapabilityConfigure = "configure"
+
+// Configurable may be implemented by a Discovery (or ContextDiscovery) to
+// receive the runtime parameters sent by the client with the CONFIGURE
+// command, like the network interfaces to scan or the duration of a BLE
+// scan, instead of reading them from ad-hoc environment variables. The
+// capability is advertised to the clients in the HELLO response.
+type Configurable interface {
+	// Configure applies the configuration sent by the client, a JSON object
+	// decoded with encoding/json (the numbers are float64). It may be
+	// called at any time after Hello, with the discovery started or not.
+	// The error returned, if any, is sent to the client; the ErrorCode
+	// ErrorCodeInvalidCommand is the one to use for the invalid parameters.
+	Configure(ctx context.Context, config map[string]any) error
+}
+
+// configurable returns the implementation as a Configurable, if it
+// implements the interface.
+func (d *Server) configurable() (Configurable, bool) {
+	configurable, ok := d.implementation().(Configurable)
+	return configurable, ok
+}
+
+func (d *Server) configure(args string) {
+	configurable, ok := d.configurable()
+	if !ok {
+		d.send(messageError("configure", ErrorCodeInvalidCommand, "Command CONFIGURE not supported"))
+		return
+	}
+	var config map[string]any
+	if err := json.Unmarshal([]byte(args), &config); err != nil || config == nil {
+		d.send(messageError("configure", ErrorCodeInvalidCommand, "Invalid CONFIGURE command: a JSON object is required"))
+		return
+	}
+	if err := configurable.Configure(d.sessionContext(), config); err != nil {
+		d.send(messageError("configure", errorCode(err), "Cannot CONFIGURE: "+err.Error()))
+		return
+	}
+	d.send(messageOk("configure"))
+}
+
+// Configure sends the given configuration to the discovery with the
+// CONFIGURE command, see Configurable. The configuration is encoded as a
+// JSON object. It returns an error if the discovery doesn't support the
+// command (the CapabilityConfigure capability is not advertised) or
+// rejects the configuration.
+func (disc *Client) Configure(config map[string]any) (err error) {
+	endCommand := disc.instrumentCommand("CONFIGURE")
+	defer func() { endCommand(err) }()
+
+	if err := disc.checkNotReconnecting(); err != nil {
+		return err
+	}
+	if !disc.HasCapability(CapabilityConfigure) {
+		return fmt.Errorf("discovery %s doesn't support CONFIGURE", disc.id)
+	}
+	if config == nil {
+		config = map[string]any{}
+	}
+	// The encoded JSON is a single line: the new lines in the strings
+	// are escaped
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("encoding configuration: %w", err)
+	}
+	if err := disc.sendCommand("CONFIGURE " + string(data) + "\n"); err != nil {
+		return err
+	}
+	if msg, err := disc.waitMessage(time.Second * 10); err != nil {
+		return fmt.Errorf("calling CONFIGURE: %w", err)
+	} else if msg.EventType != "configure" {
+		return disc.outOfSync("configure", msg)
+	} else if msg.Error {
+		return newCommandError("CONFIGURE", msg)
+	}
+	return nil
+}
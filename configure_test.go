@@ -0,0 +1,109 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// configDiscovery records the configurations received.
+type configDiscovery struct {
+	testDiscovery
+	configs []map[string]any
+}
+
+func (d *configDiscovery) Configure(ctx context.Context, config map[string]any) error {
+	if _, ok := config["interface"].(string); !ok {
+		return fmt.Errorf("%w: missing interface", ErrorCodeInvalidCommand)
+	}
+	d.configs = append(d.configs, config)
+	return nil
+}
+
+func TestServerConfigure(t *testing.T) {
+	impl := &configDiscovery{}
+	out := &bytes.Buffer{}
+	in := "HELLO 1 \"test\"\n" +
+		"CONFIGURE {\"interface\": \"eth0\", \"timeout\": 5, \"domains\": [\"local\"]}\n" +
+		"CONFIGURE {\"timeout\": 5}\n" +
+		"CONFIGURE [1, 2]\n" +
+		"CONFIGURE\n" +
+		"QUIT\n"
+	require.NoError(t, NewServer(impl).Run(strings.NewReader(in), out))
+	decoder := json.NewDecoder(out)
+	var msg message
+	require.NoError(t, decoder.Decode(&msg))
+	require.Contains(t, msg.Capabilities, CapabilityConfigure)
+	msg = message{}
+	require.NoError(t, decoder.Decode(&msg))
+	require.Equal(t, *messageOk("configure"), msg)
+	for _, expected := range []string{"Cannot CONFIGURE: invalid_command: missing interface", "Invalid CONFIGURE command: a JSON object is required", "Invalid CONFIGURE command: a JSON object is required"} {
+		msg = message{}
+		require.NoError(t, decoder.Decode(&msg))
+		require.Equal(t, *messageError("configure", ErrorCodeInvalidCommand, expected), msg)
+	}
+	require.Equal(t, []map[string]any{{"interface": "eth0", "timeout": 5.0, "domains": []any{"local"}}}, impl.configs)
+
+	// The implementations without the parameters don't support the command
+	out.Reset()
+	require.NoError(t, NewServer(&testDiscovery{}).Run(strings.NewReader("HELLO 1 \"test\"\nCONFIGURE {}\nQUIT\n"), out))
+	decoder = json.NewDecoder(out)
+	require.NoError(t, decoder.Decode(&msg))
+	require.NotContains(t, msg.Capabilities, CapabilityConfigure)
+	msg = message{}
+	require.NoError(t, decoder.Decode(&msg))
+	require.Equal(t, *messageError("configure", ErrorCodeInvalidCommand, "Command CONFIGURE not supported"), msg)
+}
+
+func TestClientConfigure(t *testing.T) {
+	run := func(impl Discovery) *Client {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			_ = NewServer(impl).Run(serverConn, serverConn)
+		}()
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		require.NoError(t, cl.Run())
+		return cl
+	}
+
+	impl := &configDiscovery{}
+	cl := run(impl)
+	require.True(t, cl.HasCapability(CapabilityConfigure))
+	require.NoError(t, cl.Configure(map[string]any{"interface": "multi\nline"}))
+	err := cl.Configure(nil)
+	var cmdErr *CommandError
+	require.ErrorAs(t, err, &cmdErr)
+	require.ErrorIs(t, err, ErrorCodeInvalidCommand)
+	require.ErrorContains(t, cl.Configure(map[string]any{"bad": func() {}}), "encoding configuration")
+	cl.Quit()
+	require.Equal(t, []map[string]any{{"interface": "multi\nline"}}, impl.configs)
+
+	cl = run(&testDiscovery{})
+	require.ErrorContains(t, cl.Configure(map[string]any{}), "doesn't support CONFIGURE")
+	cl.Quit()
+}
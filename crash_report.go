@@ -0,0 +1,237 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// crashReportStderrLines is the number of lines of the standard error of
+	// the discovery process kept for the CrashReport.
+	crashReportStderrLines = 20
+	// crashReportMessages is the number of protocol messages kept for the
+	// CrashReport.
+	crashReportMessages = 10
+	// crashReportMaxLine is the maximum length of the lines and of the
+	// messages kept for the CrashReport, the longer ones are truncated.
+	crashReportMaxLine = 1024
+)
+
+// CrashReport is the error returned by the Client when the discovery process
+// terminates unexpectedly, for example by Run or StartSync. It holds the
+// information useful to diagnose the crash, see Markdown. The error that
+// terminated the communication (like io.EOF) is wrapped: errors.Is and
+// errors.As work as before.
+type CrashReport struct {
+	// DiscoveryID is the ID of the Client.
+	DiscoveryID string
+	// Command is the command line of the discovery process.
+	Command []string
+	// Err is the error that terminated the communication.
+	Err error
+	// ExitCode is the exit code of the discovery process, or -1 if the
+	// process has been terminated by a signal.
+	ExitCode int
+	// ExitStatus describes how the discovery process terminated, like
+	// "exit status 2" or "signal: segmentation fault".
+	ExitStatus string
+	// Stderr are the last lines written by the discovery process on its
+	// standard error.
+	Stderr []string
+	// Messages are the last protocol messages exchanged with the discovery,
+	// with the redacted port data, oldest first: the commands sent are
+	// prefixed with "> ", the messages received with "< ".
+	Messages []string
+}
+
+func (r *CrashReport) Error() string {
+	return fmt.Sprintf("discovery %s terminated unexpectedly (%s): %v", r.DiscoveryID, r.ExitStatus, r.Err)
+}
+
+// Unwrap returns the error that terminated the communication.
+func (r *CrashReport) Unwrap() error {
+	return r.Err
+}
+
+// Markdown formats the report in Markdown, ready to be pasted in an issue
+// report.
+func (r *CrashReport) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Discovery crash report\n\n")
+	fmt.Fprintf(&b, "- Discovery: `%s`\n", r.DiscoveryID)
+	fmt.Fprintf(&b, "- Command: `%s`\n", strings.Join(r.Command, " "))
+	fmt.Fprintf(&b, "- Platform: `%s/%s`\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "- Exit status: `%s`\n", r.ExitStatus)
+	fmt.Fprintf(&b, "- Error: `%v`\n", r.Err)
+	section := func(title string, lines []string) {
+		fmt.Fprintf(&b, "\n#### %s\n\n", title)
+		if len(lines) == 0 {
+			fmt.Fprintf(&b, "(none)\n")
+			return
+		}
+		// The fence must be longer than the backtick runs of the content
+		fence := "```"
+		for _, line := range lines {
+			for strings.Contains(line, fence) {
+				fence += "`"
+			}
+		}
+		fmt.Fprintf(&b, "%stext\n%s\n%s\n", fence, strings.Join(lines, "\n"), fence)
+	}
+	section("Last lines of the standard error", r.Stderr)
+	section("Last protocol messages", r.Messages)
+	return b.String()
+}
+
+// lineTail is an io.Writer keeping the last lines written.
+type lineTail struct {
+	mutex   sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func newLineTail(max int) *lineTail {
+	return &lineTail{max: max}
+}
+
+func (t *lineTail) Write(data []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	n := len(data)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			t.partial = appendTruncated(t.partial, data)
+			break
+		}
+		t.partial = appendTruncated(t.partial, data[:i])
+		t.add(string(bytes.TrimSuffix(t.partial, []byte("\r"))))
+		t.partial = t.partial[:0]
+		data = data[i+1:]
+	}
+	return n, nil
+}
+
+// add appends the line, dropping the oldest one if needed. mutex must be
+// held by the caller.
+func (t *lineTail) add(line string) {
+	if len(t.lines) == t.max {
+		t.lines = append(t.lines[:0], t.lines[1:]...)
+	}
+	t.lines = append(t.lines, line)
+}
+
+// Lines returns the lines kept, followed by the last line if not
+// terminated.
+func (t *lineTail) Lines() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res := append([]string{}, t.lines...)
+	if len(t.partial) > 0 {
+		res = append(res, string(t.partial))
+		if len(res) > t.max {
+			res = res[1:]
+		}
+	}
+	return res
+}
+
+// appendTruncated appends data to buf up to crashReportMaxLine bytes.
+func appendTruncated(buf, data []byte) []byte {
+	return append(buf, data[:min(len(data), max(0, crashReportMaxLine-len(buf)))]...)
+}
+
+// messageTail keeps the last protocol messages exchanged with the
+// discovery. The slots are reused to avoid allocations for each message.
+type messageTail struct {
+	mutex sync.Mutex
+	slots [crashReportMessages]struct {
+		sent bool
+		data []byte
+	}
+	next  int
+	count int
+}
+
+// record adds a message, sent or received, to the tail.
+func (t *messageTail) record(sent bool, data []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	slot := &t.slots[t.next]
+	slot.sent = sent
+	slot.data = appendTruncated(slot.data[:0], data)
+	t.next = (t.next + 1) % len(t.slots)
+	t.count = min(t.count+1, len(t.slots))
+}
+
+// reset drops the messages recorded.
+func (t *messageTail) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.next = 0
+	t.count = 0
+}
+
+// messages returns the messages recorded, oldest first, formatted for the
+// CrashReport. The port data of the messages received is redacted.
+func (t *messageTail) messages(redact func(message) message) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res := make([]string, 0, t.count)
+	for i := 0; i < t.count; i++ {
+		slot := t.slots[(t.next-t.count+i+len(t.slots))%len(t.slots)]
+		if slot.sent {
+			res = append(res, "> "+string(slot.data))
+			continue
+		}
+		data := slot.data
+		var msg message
+		if err := json.Unmarshal(data, &msg); err == nil {
+			if redacted, err := json.Marshal(redact(msg)); err == nil {
+				data = redacted
+			}
+		}
+		res = append(res, "< "+string(data))
+	}
+	return res
+}
+
+// newCrashReport creates the CrashReport of the given terminated process.
+func (disc *Client) newCrashReport(err error, process *discoveryProcess) *CrashReport {
+	report := &CrashReport{
+		DiscoveryID: disc.id,
+		Command:     disc.processArgs,
+		Err:         err,
+		ExitCode:    -1,
+		ExitStatus:  "unknown",
+		Stderr:      process.stderr.Lines(),
+		Messages:    disc.recentMessages.messages(disc.redactMessage),
+	}
+	if state := process.cmd.ProcessState; state != nil {
+		report.ExitCode = state.ExitCode()
+		report.ExitStatus = state.String()
+	}
+	return report
+}
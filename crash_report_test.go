@@ -0,0 +1,108 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrashReportTails(t *testing.T) {
+	lines := newLineTail(3)
+	_, _ = lines.Write([]byte("one\r\ntw"))
+	require.Equal(t, []string{"one", "tw"}, lines.Lines())
+	_, _ = lines.Write([]byte("o\nthree\nfour\nfi"))
+	require.Equal(t, []string{"three", "four", "fi"}, lines.Lines())
+	_, _ = lines.Write([]byte(strings.Repeat("x", 2*crashReportMaxLine) + "\n"))
+	require.Len(t, lines.Lines()[2], crashReportMaxLine)
+
+	var messages messageTail
+	for i := 0; i < crashReportMessages+2; i++ {
+		messages.record(true, []byte(fmt.Sprint("LIST ", i)))
+	}
+	messages.record(false, []byte(`{"eventType":"add","port":{"address":"/dev/ttyACM0","properties":{"serialNumber":"1234"}}}`))
+	messages.record(false, []byte(`{"eventType":`))
+	redactor := NewRedactor().MaskProperty("serialNumber", nil)
+	res := messages.messages(func(msg message) message {
+		msg.Port = redactor.Redact(msg.Port)
+		return msg
+	})
+	require.Len(t, res, crashReportMessages)
+	require.Equal(t, "> LIST 4", res[0])
+	require.Equal(t, `< {"eventType":"add","port":{"address":"/dev/ttyACM0","properties":{"serialNumber":"****"}}}`, res[crashReportMessages-2])
+	require.Equal(t, `< {"eventType":`, res[crashReportMessages-1])
+	messages.reset()
+	require.Empty(t, messages.messages(nil))
+}
+
+func TestCrashReport(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	// The discovery fails on startup
+	cl := NewClient("dummy", "dummy-discovery/dummy-discovery", "--invalid")
+	err = cl.Run()
+	require.ErrorIs(t, err, io.EOF)
+	var report *CrashReport
+	require.ErrorAs(t, err, &report)
+	require.Equal(t, "dummy", report.DiscoveryID)
+	require.Equal(t, 1, report.ExitCode)
+	require.Equal(t, "exit status 1", report.ExitStatus)
+	require.Equal(t, []string{"invalid argument: --invalid"}, report.Stderr)
+	require.Equal(t, []string{`> HELLO 1 "arduino-cli pluggable-discovery-protocol-handler"`}, report.Messages)
+	require.Equal(t, "discovery dummy terminated unexpectedly (exit status 1): EOF", report.Error())
+	markdown := report.Markdown()
+	require.Contains(t, markdown, "- Command: `dummy-discovery/dummy-discovery --invalid`\n")
+	require.Contains(t, markdown, "```text\ninvalid argument: --invalid\n```\n")
+
+	// The discovery crashes in events mode
+	cl = NewClient("dummy", "dummy-discovery/dummy-discovery", "-k")
+	require.NoError(t, cl.Run())
+	ch, err := cl.StartSync(20)
+	require.NoError(t, err)
+	var last *Event
+	timeout := time.After(5 * time.Second)
+	for last == nil || last.Type != "stop" {
+		select {
+		case last = <-ch:
+		case <-timeout:
+			t.Fatal("missing stop event")
+		}
+	}
+	require.True(t, errors.As(cl.LastError(), &report))
+	require.Equal(t, 1, report.ExitCode)
+	require.Contains(t, report.Messages, "> START_SYNC")
+	require.Contains(t, report.Messages, `< {"eventType":"start_sync","message":"OK"}`)
+	require.Empty(t, report.Stderr)
+	require.Contains(t, report.Markdown(), "(none)")
+
+	// The discoveries terminated by the Client don't produce reports
+	cl = NewClient("dummy", "dummy-discovery/dummy-discovery")
+	require.NoError(t, cl.Run())
+	cl.Quit()
+	require.NoError(t, cl.LastError())
+}
@@ -0,0 +1,214 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"strings"
+	"time"
+)
+
+// Debounce collapses the "add" and "remove" events of the same port
+// flapping within the given window, like a board resetting or a flaky USB
+// cable, and returns the channel of the resulting events. The "add" and
+// "remove" events are delayed by the window: if the port goes back to the
+// state already delivered before the window expires (like a "remove"
+// followed by an "add" of the same port with the same data) no event is
+// delivered, otherwise only the last event of the port is delivered when
+// the window expires. The ports are identified by discovery ID, protocol
+// and address. The other events, like "stop" or "snapshot", are delivered
+// immediately, after the pending "add" and "remove" events. When the input
+// channel is closed the pending events are delivered and the returned
+// channel is closed. A window not greater than zero disables the
+// debouncing: the input channel is returned.
+func Debounce(in <-chan *Event, window time.Duration) <-chan *Event {
+	if window <= 0 {
+		return in
+	}
+	out := make(chan *Event, cap(in))
+	go func() {
+		defer close(out)
+		d := newDebouncer(window)
+		timer := time.NewTimer(window)
+		for {
+			stopTimer(timer)
+			var timeout <-chan time.Time
+			if deadline, ok := d.nextDeadline(); ok {
+				timer.Reset(time.Until(deadline))
+				timeout = timer.C
+			}
+			var events []*Event
+			select {
+			case ev, ok := <-in:
+				if !ok {
+					for _, ev := range d.flush() {
+						out <- ev
+					}
+					return
+				}
+				events = d.process(ev, time.Now())
+			case now := <-timeout:
+				events = d.expired(now)
+			}
+			for _, ev := range events {
+				out <- ev
+			}
+		}
+	}()
+	return out
+}
+
+// stopTimer stops the timer and drains its channel, so that it can be
+// safely Reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// debouncedEvent is an event waiting for the end of its window.
+type debouncedEvent struct {
+	ev       *Event
+	deadline time.Time
+}
+
+// debouncer holds the "add" and "remove" events until the end of their
+// window, tracking the ports delivered to compare them with the following
+// events.
+type debouncer struct {
+	window    time.Duration
+	delivered map[string]*Port
+	pending   map[string]*debouncedEvent
+	// order is the list of the keys of the pending events, by deadline.
+	order []string
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+	return &debouncer{
+		window:    window,
+		delivered: map[string]*Port{},
+		pending:   map[string]*debouncedEvent{},
+	}
+}
+
+// nextDeadline returns the deadline of the first pending event.
+func (d *debouncer) nextDeadline() (time.Time, bool) {
+	if len(d.order) == 0 {
+		return time.Time{}, false
+	}
+	return d.pending[d.order[0]].deadline, true
+}
+
+// process returns the events to deliver after receiving the given event.
+func (d *debouncer) process(ev *Event, now time.Time) []*Event {
+	if (ev.Type != "add" && ev.Type != "remove") || ev.Port == nil {
+		res := d.flush()
+		d.track(ev)
+		return append(res, ev)
+	}
+	key := eventPortKey(ev.DiscoveryID, ev.Port)
+	delivered, isDelivered := d.delivered[key]
+	if (ev.Type == "remove" && !isDelivered) || (ev.Type == "add" && isDelivered && samePortData(delivered, ev.Port)) {
+		// Back to the delivered state: the pending event is dropped
+		if _, ok := d.pending[key]; ok {
+			delete(d.pending, key)
+			d.removeOrder(key)
+		}
+		return nil
+	}
+	if pending, ok := d.pending[key]; ok {
+		// The deadline of the first event is kept, so that a port flapping
+		// forever is delivered anyway
+		pending.ev = ev
+		return nil
+	}
+	d.pending[key] = &debouncedEvent{ev: ev, deadline: now.Add(d.window)}
+	d.order = append(d.order, key)
+	return nil
+}
+
+// expired returns the pending events whose window is expired.
+func (d *debouncer) expired(now time.Time) []*Event {
+	var res []*Event
+	for len(d.order) > 0 {
+		key := d.order[0]
+		pending := d.pending[key]
+		if pending.deadline.After(now) {
+			break
+		}
+		d.order = d.order[1:]
+		delete(d.pending, key)
+		d.track(pending.ev)
+		res = append(res, pending.ev)
+	}
+	return res
+}
+
+// flush returns all the pending events.
+func (d *debouncer) flush() []*Event {
+	var res []*Event
+	for _, key := range d.order {
+		ev := d.pending[key].ev
+		d.track(ev)
+		res = append(res, ev)
+	}
+	d.order = nil
+	d.pending = map[string]*debouncedEvent{}
+	return res
+}
+
+func (d *debouncer) removeOrder(key string) {
+	for i, k := range d.order {
+		if k == key {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// track updates the delivered ports with the given event.
+func (d *debouncer) track(ev *Event) {
+	switch ev.Type {
+	case "add":
+		if ev.Port != nil {
+			d.delivered[eventPortKey(ev.DiscoveryID, ev.Port)] = ev.Port
+		}
+	case "remove":
+		if ev.Port != nil {
+			delete(d.delivered, eventPortKey(ev.DiscoveryID, ev.Port))
+		}
+	case "snapshot":
+		d.forget(ev.DiscoveryID)
+		for _, port := range ev.Ports {
+			d.delivered[eventPortKey(ev.DiscoveryID, port)] = port
+		}
+	case "stop", "reconnected", "resynced":
+		d.forget(ev.DiscoveryID)
+	}
+}
+
+// forget removes the delivered ports of the given discovery.
+func (d *debouncer) forget(discoveryID string) {
+	for key := range d.delivered {
+		if strings.HasPrefix(key, discoveryID+"|") {
+			delete(d.delivered, key)
+		}
+	}
+}
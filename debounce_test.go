@@ -0,0 +1,126 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// eventTypes returns the types and the addresses of the events.
+func eventTypes(events []*Event) []string {
+	res := []string{}
+	for _, ev := range events {
+		if ev.Port != nil {
+			res = append(res, ev.Type+" "+ev.Port.Address)
+		} else {
+			res = append(res, ev.Type)
+		}
+	}
+	return res
+}
+
+func TestDebouncer(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	addPort := func(port *Port) *Event {
+		return &Event{Type: "add", DiscoveryID: "serial", Port: port}
+	}
+	add := func(address string) *Event {
+		return addPort(NewPort(address, "serial"))
+	}
+	remove := func(address string) *Event {
+		return &Event{Type: "remove", DiscoveryID: "serial", Port: NewPort(address, "serial")}
+	}
+	d := newDebouncer(100 * time.Millisecond)
+
+	// A new port is delivered at the end of the window
+	require.Empty(t, d.process(add("A"), at(0)))
+	require.Empty(t, d.process(add("B"), at(10)))
+	deadline, ok := d.nextDeadline()
+	require.True(t, ok)
+	require.Equal(t, at(100), deadline)
+	require.Empty(t, d.expired(at(99)))
+	require.Equal(t, []string{"add A"}, eventTypes(d.expired(at(100))))
+	require.Equal(t, []string{"add B"}, eventTypes(d.expired(at(200))))
+	_, ok = d.nextDeadline()
+	require.False(t, ok)
+
+	// The flapping of a delivered port is collapsed
+	require.Empty(t, d.process(remove("A"), at(300)))
+	require.Empty(t, d.process(add("A"), at(310)))
+	require.Empty(t, d.process(remove("A"), at(320)))
+	require.Empty(t, d.process(add("A"), at(330)))
+	require.Empty(t, d.expired(at(500)))
+
+	// A port changing data is delivered once, with the last data
+	require.Empty(t, d.process(remove("A"), at(600)))
+	require.Empty(t, d.process(addPort(NewPort("A", "serial").WithProperty("serialNumber", "1")), at(610)))
+	require.Empty(t, d.process(addPort(NewPort("A", "serial").WithProperty("serialNumber", "2")), at(650)))
+	events := d.expired(at(700))
+	require.Equal(t, []string{"add A"}, eventTypes(events))
+	require.Equal(t, "2", events[0].Port.Properties.Get("serialNumber"))
+
+	// A port appearing and disappearing within the window is not delivered
+	require.Empty(t, d.process(add("C"), at(800)))
+	require.Empty(t, d.process(remove("C"), at(810)))
+	_, ok = d.nextDeadline()
+	require.False(t, ok)
+
+	// The port removed is delivered at the end of the window, the other
+	// events flush the pending ones
+	require.Empty(t, d.process(remove("B"), at(900)))
+	require.Empty(t, d.process(add("D"), at(910)))
+	require.Equal(t, []string{"remove B", "add D", "stop"}, eventTypes(d.process(&Event{Type: "stop", DiscoveryID: "serial"}, at(920))))
+
+	// The ports of a stopped discovery are forgotten
+	require.Empty(t, d.process(add("A"), at(1000)))
+	require.Equal(t, []string{"add A"}, eventTypes(d.flush()))
+	require.Empty(t, d.flush())
+
+	// The ports are reported again after the sync recovery
+	require.Equal(t, []string{"resynced"}, eventTypes(d.process(&Event{Type: "resynced", DiscoveryID: "serial"}, at(1100))))
+	require.Empty(t, d.process(add("A"), at(1110)))
+	require.Equal(t, []string{"add A"}, eventTypes(d.flush()))
+}
+
+func TestDebounce(t *testing.T) {
+	in := make(chan *Event, 10)
+	require.Equal(t, (<-chan *Event)(in), Debounce(in, 0))
+
+	out := Debounce(in, 50*time.Millisecond)
+	port := NewPort("/dev/ttyACM0", "serial")
+	in <- &Event{Type: "add", DiscoveryID: "serial", Port: port}
+	in <- &Event{Type: "remove", DiscoveryID: "serial", Port: port}
+	in <- &Event{Type: "add", DiscoveryID: "serial", Port: port}
+	select {
+	case ev := <-out:
+		require.Equal(t, "add", ev.Type)
+	case <-time.After(time.Second):
+		t.Fatal("missing event")
+	}
+	in <- &Event{Type: "remove", DiscoveryID: "serial", Port: port}
+	close(in)
+	events := []*Event{}
+	for ev := range out {
+		events = append(events, ev)
+	}
+	require.Equal(t, []string{"remove /dev/ttyACM0"}, eventTypes(events))
+}
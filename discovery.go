@@ -25,25 +25,52 @@
 // using this library.
 //
 // A usage example is provided in the dummy-discovery package.
+//
+// # Optional features and dependencies
+//
+// The core of the library, the stdio Client and Server, depends only on the
+// standard library, go-paths-helper and go-properties-orderedmap. The
+// optional features are provided as follows:
+//   - network and local IPC transports (NewTCPClient, WithTLS,
+//     NewUnixClient, ListenUnix, Server.Serve, Server.ServeTLS,
+//     RunActivatedServer and ActivationSocket): in this
+//     package, they can be left out of the build, along with the net and
+//     crypto/tls packages, with the discovery_nonet build tag; NewConnClient
+//     is always available to plug in another transport
+//   - metrics (Metrics) and tracing (ClientTracer): the interfaces are in
+//     this package, the Prometheus and OpenTelemetry adapters are in the
+//     prometheus and otel modules; the interfaces use only the standard
+//     library, so they are not affected by the build tags
+//   - journaling (Journal and JournalIndex) and the PortCache of the Manager:
+//     in this package, using only the standard library, they are not
+//     affected by the build tags either
+//   - SSH transport, Windows named pipes, WebSocket bridge and gRPC
+//     service: in the ssh, namedpipe, websocket and grpc modules
 package discovery
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Discovery is an interface that represents the business logic that
 // a pluggable discovery must implement. The communication protocol
-// is completely hidden and it's handled by a DiscoveryServer.
+// is completely hidden and it's handled by a Server.
+// See ContextDiscovery for a context-aware version of this interface.
 type Discovery interface {
 	// Hello is called once at startup to provide the userAgent string
-	// and the protocolVersion negotiated with the client.
+	// and the protocolVersion negotiated with the client. The parsed user
+	// agent is available with Server.UserAgent, the locale requested by the
+	// client with Server.Locale.
 	Hello(userAgent string, protocolVersion int) error
 
 	// StartSync is called to put the discovery in event mode. When the
@@ -66,6 +93,16 @@ type Discovery interface {
 // is detected.
 type EventCallback func(event string, port *Port)
 
+// SyncEventCallback is the same as EventCallback, but it returns an error
+// wrapping ErrEventNotDelivered if the event could not be delivered to the
+// client, for example because the client went away: the discovery should
+// then stop the scanning work until the next START_SYNC.
+type SyncEventCallback func(event string, port *Port) error
+
+// ErrEventNotDelivered is returned by a SyncEventCallback when the event
+// could not be delivered to the client.
+var ErrEventNotDelivered = errors.New("event not delivered to the client")
+
 // ErrorCallback is a callback function to signal unrecoverable errors to the
 // client while the discovery is in event mode. Once the discovery signal an
 // error it means that no more port-events will be delivered until the client
@@ -75,25 +112,124 @@ type ErrorCallback func(err string)
 // A Server is a pluggable discovery protocol handler,
 // it must be created using the NewServer function.
 type Server struct {
-	impl               Discovery
-	userAgent          string
+	impl               ContextDiscovery
+	userAgent          UserAgent // guarded by ctxMutex
+	locale             string    // guarded by ctxMutex
 	reqProtocolVersion int
 	initialized        bool
 	started            bool
 	syncStarted        bool
+	cacheMutex         sync.Mutex
 	cachedPorts        map[string]*Port
 	cachedErr          string
+	cacheCallback      func(event string, port *Port)
+	cacheNotifyMutex   sync.Mutex
 	output             io.Writer
 	outputMutex        sync.Mutex
+	syncAckPending     bool
+	pendingEvents      []*message
+	eventsClosed       bool // guarded by outputMutex
+	sessionOutput      bool // guarded by outputMutex
+	quitDrain          bool
+	stats              serverStats
+	statsInterval      time.Duration
+	statsCallback      func(ServerStats)
+	authToken          string
+	idempotentStop     bool
+	listChunkSize      int
+	msgpackFraming     bool
+	codec              codec // guarded by outputMutex
+	ctxMutex           sync.Mutex
+	sessionCtx         context.Context
+	cancelSession      context.CancelFunc
+	cancelSync         context.CancelFunc
+	quitOnce           sync.Once
+	limiter            *eventLimiter
+	ttl                *portTTL
+	propertySchema     PropertySchema
+	outputFormat       OutputFormat
+	batchOutput        *bufio.Writer // guarded by outputMutex
+	flushTimer         *time.Timer   // guarded by outputMutex
+	logger             ServerLogger
+	commandEcho        bool
+	middlewares        []CommandMiddleware
 }
 
+// CapabilityIdempotentStop is the capability advertised in the HELLO response
+// by the servers that reply OK to a STOP command when the discovery is
+// already stopped, see Server.SetIdempotentStop.
+const CapabilityIdempotentStop = "idempotent_stop"
+
+// CapabilityChunkedList is the capability advertised in the HELLO response
+// by the servers that split the LIST responses in chunks, if requested
+// with a "LIST CHUNKED" command, see Server.SetListChunkSize. All the chunks
+// except the last one have the "more" field set.
+const CapabilityChunkedList = "chunked_list"
+
+// msgAlreadyStopped is the error message sent in reply to a STOP when the
+// discovery is already stopped.
+const msgAlreadyStopped = "Discovery already STOPped"
+
 // NewServer creates a new discovery server backed by the
 // provided pluggable discovery implementation. To start the server
 // use the Run method.
 func NewServer(impl Discovery) *Server {
-	return &Server{
-		impl: impl,
+	return NewContextServer(&legacyDiscovery{impl: impl})
+}
+
+// SetIdempotentStop makes the STOP command idempotent: if the discovery is
+// already stopped the Server replies OK instead of an error. The capability
+// is advertised to the clients in the HELLO response. This method must be
+// called before Run.
+func (d *Server) SetIdempotentStop(idempotent bool) {
+	d.idempotentStop = idempotent
+}
+
+// SetListChunkSize enables the chunked LIST responses: the clients
+// requesting them receive the ports in "list" messages of at most size
+// ports each, instead of a single message that may be very large for the
+// discoveries reporting thousands of ports. The capability is advertised to
+// the clients in the HELLO response. A size of 0 disables the chunking (the
+// default). This method must be called before Run.
+func (d *Server) SetListChunkSize(size int) {
+	d.listChunkSize = size
+}
+
+// SetMsgpackFraming enables the MessagePack framing of the messages: the
+// clients sending a "FRAMING MSGPACK" command receive the following
+// messages encoded in MessagePack, that is much cheaper to produce and
+// parse than the indented JSON for the discoveries sending thousands of
+// events per second. The capability is advertised to the clients in the
+// HELLO response. This method must be called before Run.
+func (d *Server) SetMsgpackFraming(enabled bool) {
+	d.msgpackFraming = enabled
+}
+
+// capabilities returns the protocol capabilities enabled in the Server.
+func (d *Server) capabilities() []string {
+	var res []string
+	if d.idempotentStop {
+		res = append(res, CapabilityIdempotentStop)
+	}
+	if d.listChunkSize > 0 {
+		res = append(res, CapabilityChunkedList)
+	}
+	if d.msgpackFraming {
+		res = append(res, CapabilityMsgpackFraming)
+	}
+	if len(d.propertySchema) > 0 {
+		res = append(res, CapabilityPropertySchema)
+	}
+	if _, ok := d.configurable(); ok {
+		res = append(res, CapabilityConfigure)
 	}
+	if _, ok := d.selfTester(); ok {
+		res = append(res, CapabilitySelfTest)
+	}
+	if d.quitDrain {
+		res = append(res, CapabilityQuitDrain)
+	}
+	return res
 }
 
 // Run starts the protocol handling loop on the given input and
@@ -102,160 +238,334 @@ func NewServer(impl Discovery) *Server {
 // the input stream is closed. In case of IO error the error is
 // returned.
 func (d *Server) Run(in io.Reader, out io.Writer) error {
-	d.output = out
+	return d.runSession(in, out, true)
+}
+
+// runSession runs the protocol handling loop. If quitImpl is false the QUIT
+// command terminates only the current session: the implementation is
+// stopped (if needed) instead of being terminated.
+func (d *Server) runSession(in io.Reader, out io.Writer, quitImpl bool) error {
+	d.beginOutput(out, !quitImpl)
+	defer d.endOutput(out)
+	defer d.runStatsCallback()()
+	d.beginSession()
+	defer d.endSession()
 	reader := bufio.NewReader(in)
 	for {
+		// The responses to the previous command must be written before
+		// waiting for the next one
+		if err := d.flushOutput(); err != nil {
+			return err
+		}
 		fullCmd, err := reader.ReadString('\n')
 		if err != nil {
-			d.send(messageError("command_error", err.Error()))
+			if errors.Is(err, io.EOF) {
+				d.logger.Debugf("Input stream closed")
+			} else {
+				d.logger.Errorf("Reading command: %v", err)
+			}
+			d.send(messageError("command_error", ErrorCodeInternal, err.Error()))
 			return err
 		}
+		d.stats.commandHandled()
 		fullCmd = strings.TrimSpace(fullCmd)
-		split := strings.Split(fullCmd, " ")
-		cmd := strings.ToUpper(split[0])
-
-		if !d.initialized && cmd != "HELLO" && cmd != "QUIT" {
-			d.send(messageError("command_error", fmt.Sprintf("First command must be HELLO, but got '%s'", cmd)))
-			continue
+		d.echoCommand(fullCmd)
+		if d.runMiddlewares(fullCmd, quitImpl) {
+			return nil
 		}
+	}
+}
 
-		switch cmd {
-		case "HELLO":
-			if len(fullCmd) < 7 {
-				d.hello("")
-			} else {
-				d.hello(fullCmd[6:])
+// runCommand executes the command received, it returns true if the command
+// ends the session.
+func (d *Server) runCommand(fullCmd string, quitImpl bool) bool {
+	split := strings.Split(fullCmd, " ")
+	cmd := strings.ToUpper(split[0])
+
+	if !d.initialized && cmd != "HELLO" && cmd != "QUIT" {
+		d.send(messageError("command_error", ErrorCodeNotInitialized, fmt.Sprintf("First command must be HELLO, but got '%s'", cmd)))
+		return false
+	}
+
+	switch cmd {
+	case "HELLO":
+		_, args, _ := strings.Cut(fullCmd, " ")
+		d.hello(args)
+	case "START":
+		d.start()
+	case "LIST":
+		_, args, _ := strings.Cut(fullCmd, " ")
+		d.list(strings.EqualFold(args, "CHUNKED"))
+	case "START_SYNC":
+		d.startSync()
+	case "FRAMING":
+		_, args, _ := strings.Cut(fullCmd, " ")
+		d.framing(args)
+	case "STOP":
+		d.stop()
+	case "CONFIGURE":
+		_, args, _ := strings.Cut(fullCmd, " ")
+		d.configure(args)
+	case "SELFTEST":
+		d.selfTest()
+	case "QUIT":
+		if d.quitDrain {
+			d.drainEvents()
+		}
+		if quitImpl {
+			d.quit()
+		} else if d.started || d.syncStarted {
+			d.cancelSyncContext()
+			if err := d.impl.Stop(context.Background()); err != nil {
+				d.logger.Errorf("Stopping discovery at the end of the session: %v", err)
 			}
-		case "START":
-			d.start()
-		case "LIST":
-			d.list()
-		case "START_SYNC":
-			d.startSync()
-		case "STOP":
-			d.stop()
-		case "QUIT":
-			d.impl.Quit()
-			d.send(messageOk("quit"))
-			return nil
-		default:
-			d.send(messageError("command_error", fmt.Sprintf("Command %s not supported", cmd)))
+			d.logger.Debugf("Discovery stopped")
+			d.started = false
+			d.syncStarted = false
+			d.resetTTL()
+			d.resetLimiter()
 		}
+		d.send(messageOk("quit"))
+		return true
+	default:
+		d.send(messageError("command_error", ErrorCodeInvalidCommand, fmt.Sprintf("Command %s not supported", cmd)))
 	}
+	return false
 }
 
-func (d *Server) hello(cmd string) {
+// helloArgs are the arguments of the HELLO command.
+type helloArgs struct {
+	version   string
+	userAgent string
+	token     string
+	locale    string
+}
+
+// parseHelloArgs extracts the arguments of the HELLO command: the protocol
+// version, the quoted (not empty) user agent, the optional quoted
+// authentication token and the optional unquoted "locale=<tag>", always the
+// last one. ok is false if the arguments are malformed.
+func parseHelloArgs(cmdArgs string) (res helloArgs, ok bool) {
+	args, err := parseCommandArgs(cmdArgs)
+	if err != nil || len(args) < 2 {
+		return helloArgs{}, false
+	}
+	if last := args[len(args)-1]; len(args) > 2 && !last.Quoted {
+		key, value, _ := strings.Cut(last.Value, "=")
+		locale, valid := normalizeLocale(value)
+		if !strings.EqualFold(key, "locale") || !valid {
+			return helloArgs{}, false
+		}
+		res.locale = locale
+		args = args[:len(args)-1]
+	}
+	if len(args) > 3 {
+		return helloArgs{}, false
+	}
+	res.version = args[0].Value
+	if args[0].Quoted || res.version == "" || strings.Trim(res.version, "0123456789") != "" {
+		return helloArgs{}, false
+	}
+	if !args[1].Quoted || args[1].Value == "" {
+		return helloArgs{}, false
+	}
+	res.userAgent = args[1].Value
+	if len(args) == 3 {
+		if !args[2].Quoted {
+			return helloArgs{}, false
+		}
+		res.token = args[2].Value
+	}
+	return res, true
+}
+
+func (d *Server) hello(cmdArgs string) {
 	if d.initialized {
-		d.send(messageError("hello", "HELLO already called"))
+		d.send(messageError("hello", ErrorCodeInvalidState, "HELLO already called"))
 		return
 	}
-	re := regexp.MustCompile(`^(\d+) "([^"]+)"$`)
-	matches := re.FindStringSubmatch(cmd)
-	if len(matches) != 3 {
-		d.send(messageError("hello", "Invalid HELLO command"))
+	args, ok := parseHelloArgs(cmdArgs)
+	if !ok {
+		d.send(messageError("hello", ErrorCodeInvalidCommand, "Invalid HELLO command"))
 		return
 	}
-	d.userAgent = matches[2]
-	v, err := strconv.ParseInt(matches[1], 10, 64)
+	if d.authToken != "" && subtle.ConstantTimeCompare([]byte(args.token), []byte(d.authToken)) != 1 {
+		d.logger.Errorf("HELLO rejected: invalid authentication token")
+		d.send(messageError("hello", ErrorCodeUnauthorized, "Invalid authentication token"))
+		return
+	}
+	v, err := strconv.Atoi(args.version)
 	if err != nil {
-		d.send(messageError("hello", "Invalid protocol version: "+matches[2]))
+		d.send(messageError("hello", ErrorCodeInvalidCommand, "Invalid protocol version: "+args.version))
 		return
 	}
-	d.reqProtocolVersion = int(v)
-	if err := d.impl.Hello(d.userAgent, 1); err != nil {
-		d.send(messageError("hello", err.Error()))
+	ua := ParseUserAgent(args.userAgent)
+	d.reqProtocolVersion = v
+	d.setUserAgent(ua)
+	if err := d.impl.Hello(d.setLocale(args.locale), ua.Raw, 1); err != nil {
+		d.logger.Errorf("Hello failed: %v", err)
+		d.send(messageError("hello", errorCode(err), err.Error()))
 		return
 	}
 	d.send(&message{
 		EventType:       "hello",
 		ProtocolVersion: 1, // Protocol version 1 is the only supported for now...
 		Message:         "OK",
+		Capabilities:    d.capabilities(),
+		PropertySchema:  d.propertySchema,
 	})
 	d.initialized = true
+	d.logger.Debugf("Discovery initialized (protocol version %d, user agent %q)", v, ua.Raw)
+}
+
+// framing switches the encoding of the following messages, the response
+// is sent with the current encoding.
+func (d *Server) framing(encoding string) {
+	if !d.msgpackFraming || !strings.EqualFold(encoding, "MSGPACK") {
+		d.send(messageError("framing", ErrorCodeInvalidCommand, fmt.Sprintf("Framing %s not supported", encoding)))
+		return
+	}
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	d.mustWriteLocked(messageOk("framing"))
+	d.codec = msgpackCodec{}
 }
 
 func (d *Server) start() {
 	if d.started {
-		d.send(messageError("start", "Discovery already STARTed"))
+		d.send(messageError("start", ErrorCodeInvalidState, "Discovery already STARTed"))
 		return
 	}
 	if d.syncStarted {
-		d.send(messageError("start", "Discovery already START_SYNCed, cannot START"))
+		d.send(messageError("start", ErrorCodeInvalidState, "Discovery already START_SYNCed, cannot START"))
 		return
 	}
-	d.cachedPorts = map[string]*Port{}
-	d.cachedErr = ""
-	if err := d.impl.StartSync(d.eventCallback, d.errorCallback); err != nil {
-		d.send(messageError("start", "Cannot START: "+err.Error()))
+	d.clearCache()
+	if err := d.impl.StartSync(d.newSyncContext(), d.withTTL(d.eventCallback), d.errorCallback); err != nil {
+		d.cancelSyncContext()
+		d.logger.Errorf("StartSync failed: %v", err)
+		d.send(messageError("start", errorCode(err), "Cannot START: "+err.Error()))
 		return
 	}
 	d.started = true
+	d.logger.Debugf("Discovery started")
 	d.send(messageOk("start"))
 }
 
-func (d *Server) eventCallback(event string, port *Port) {
-	id := port.Address + "|" + port.Protocol
-	if event == "add" {
-		d.cachedPorts[id] = port
-	}
-	if event == "remove" {
-		delete(d.cachedPorts, id)
-	}
+func (d *Server) eventCallback(event string, port *Port) error {
+	d.updateCache(event, port)
+	return nil
 }
 
 func (d *Server) errorCallback(msg string) {
+	d.logger.Errorf("Discovery error: %s", msg)
+	d.cacheMutex.Lock()
+	defer d.cacheMutex.Unlock()
 	d.cachedErr = msg
 }
 
-func (d *Server) list() {
+// list sends the cached ports, split in chunks if requested by the client
+// and enabled in the Server.
+func (d *Server) list(chunked bool) {
 	if !d.started {
-		d.send(messageError("list", "Discovery not STARTed"))
+		d.send(messageError("list", ErrorCodeNotStarted, "Discovery not STARTed"))
 		return
 	}
 	if d.syncStarted {
-		d.send(messageError("list", "discovery already START_SYNCed, LIST not allowed"))
+		d.send(messageError("list", ErrorCodeInvalidState, "discovery already START_SYNCed, LIST not allowed"))
 		return
 	}
+	d.cacheMutex.Lock()
+	defer d.cacheMutex.Unlock()
 	if d.cachedErr != "" {
-		d.send(messageError("list", d.cachedErr))
+		d.send(messageError("list", ErrorCodeInternal, d.cachedErr))
 		return
 	}
 	ports := []*Port{}
 	for _, port := range d.cachedPorts {
 		ports = append(ports, port)
 	}
-	d.send(&message{
-		EventType: "list",
-		Ports:     &ports,
-	})
+	slices.SortFunc(ports, ComparePorts)
+	if !chunked || d.listChunkSize <= 0 || len(ports) <= d.listChunkSize {
+		d.send(&message{
+			EventType: "list",
+			Ports:     ports,
+		})
+		return
+	}
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	for len(ports) > 0 {
+		chunk := ports[:min(d.listChunkSize, len(ports))]
+		ports = ports[len(chunk):]
+		d.mustWriteLocked(&message{
+			EventType: "list",
+			Ports:     chunk,
+			More:      len(ports) > 0,
+		})
+	}
 }
 
 func (d *Server) startSync() {
 	if d.syncStarted {
-		d.send(messageError("start_sync", "Discovery already START_SYNCed"))
+		d.send(messageError("start_sync", ErrorCodeInvalidState, "Discovery already START_SYNCed"))
 		return
 	}
 	if d.started {
-		d.send(messageError("start_sync", "Discovery already STARTed, cannot START_SYNC"))
+		d.send(messageError("start_sync", ErrorCodeInvalidState, "Discovery already STARTed, cannot START_SYNC"))
 		return
 	}
-	if err := d.impl.StartSync(d.syncEvent, d.errorEvent); err != nil {
-		d.send(messageError("start_sync", "Cannot START_SYNC: "+err.Error()))
+	// The events emitted by the implementation before the START_SYNC
+	// response has been sent are queued, to preserve the protocol ordering.
+	d.resetLimiter()
+	d.clearCache()
+	d.outputMutex.Lock()
+	d.syncAckPending = true
+	d.outputMutex.Unlock()
+	err := d.impl.StartSync(d.newSyncContext(), d.withTTL(d.syncEvent), d.errorEvent)
+
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	pending := d.pendingEvents
+	d.pendingEvents = nil
+	d.syncAckPending = false
+	if err != nil {
+		d.cancelSyncContext()
+		d.logger.Errorf("StartSync failed: %v", err)
+		d.mustWriteLocked(messageError("start_sync", errorCode(err), "Cannot START_SYNC: "+err.Error()))
 		return
 	}
 	d.syncStarted = true
-	d.send(messageOk("start_sync"))
+	d.logger.Debugf("Discovery sync started")
+	d.mustWriteLocked(messageOk("start_sync"))
+	for _, msg := range pending {
+		d.mustWriteLocked(msg)
+	}
 }
 
 func (d *Server) stop() {
 	if !d.syncStarted && !d.started {
-		d.send(messageError("stop", "Discovery already STOPped"))
+		if d.idempotentStop {
+			d.send(messageOk("stop"))
+		} else {
+			d.send(messageError("stop", ErrorCodeNotStarted, msgAlreadyStopped))
+		}
 		return
 	}
-	if err := d.impl.Stop(); err != nil {
-		d.send(messageError("stop", "Cannot STOP: "+err.Error()))
+	d.cancelSyncContext()
+	if err := d.impl.Stop(context.Background()); err != nil {
+		d.logger.Errorf("Stop failed: %v", err)
+		d.send(messageError("stop", errorCode(err), "Cannot STOP: "+err.Error()))
 		return
 	}
+	if d.syncStarted {
+		d.logger.Debugf("Discovery sync stopped")
+	} else {
+		d.logger.Debugf("Discovery stopped")
+	}
+	d.resetTTL()
+	d.resetLimiter()
+	d.clearCache()
 	d.started = false
 	if d.syncStarted {
 		d.syncStarted = false
@@ -263,30 +573,94 @@ func (d *Server) stop() {
 	d.send(messageOk("stop"))
 }
 
-func (d *Server) syncEvent(event string, port *Port) {
-	d.send(&message{
+func (d *Server) syncEvent(event string, port *Port) error {
+	d.updateCache(event, port)
+	msg := &message{
 		EventType: event,
 		Port:      port,
-	})
+	}
+	if d.limiter != nil && (event == "add" || event == "remove") {
+		return d.limiter.submit(port.Address+"|"+port.Protocol, msg)
+	}
+	return d.emitEvent(msg)
+}
+
+func (d *Server) emitEvent(msg *message) error {
+	d.stats.eventEmitted()
+	return d.sendEvent(msg)
 }
 
 func (d *Server) errorEvent(msg string) {
-	d.send(messageError("start_sync", msg))
+	d.logger.Errorf("Discovery error: %s", msg)
+	_ = d.sendEvent(messageError("start_sync", ErrorCodeInternal, msg))
+}
+
+// sendEvent sends an event to the client, or queues it if the START_SYNC
+// response has not been sent yet. If the event can't be delivered, because
+// the output stream is broken or the client went away, the StartSync
+// context is cancelled and an ErrEventNotDelivered is returned.
+func (d *Server) sendEvent(msg *message) error {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	if d.syncAckPending {
+		d.pendingEvents = append(d.pendingEvents, msg)
+		return nil
+	}
+	if d.output == io.Discard || d.eventsClosed {
+		return ErrEventNotDelivered
+	}
+	if err := d.writeLocked(msg); err != nil {
+		d.logger.Errorf("Sending %s event: %v", msg.EventType, err)
+		err = fmt.Errorf("%w: %v", ErrEventNotDelivered, err)
+		d.output = io.Discard
+		d.cancelSyncContext()
+		return err
+	}
+	d.scheduleFlushLocked()
+	return nil
 }
 
 func (d *Server) send(msg *message) {
-	data, err := json.MarshalIndent(msg, "", "  ")
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	d.mustWriteLocked(msg)
+}
+
+// mustWriteLocked writes the message to the output and panics if the write
+// fails, outputMutex must be held by the caller. In a session started with
+// RunSession the client may go away at any time, so the output is discarded
+// instead: the session ends as soon as reading the next command fails.
+func (d *Server) mustWriteLocked(msg *message) {
+	if err := d.writeLocked(msg); err != nil {
+		d.logger.Errorf("Sending %s message: %v", msg.EventType, err)
+		if !d.sessionOutput {
+			panic("ERROR")
+		}
+		d.output = io.Discard
+		d.cancelSyncContext()
+	}
+}
+
+// writeLocked writes the message to the output, outputMutex must be held
+// by the caller.
+func (d *Server) writeLocked(msg *message) error {
+	if d.codec == nil {
+		d.codec = d.newJSONCodec()
+	}
+	data, err := d.codec.Encode(msg)
 	if err != nil {
-		// We are certain that this will be marshalled correctly
+		// We are certain that this will be encoded correctly
 		// so we don't handle the error
-		data, _ = json.MarshalIndent(messageError("command_error", err.Error()), "", "  ")
+		d.logger.Errorf("Encoding %s message: %v", msg.EventType, err)
+		msg = messageError("command_error", ErrorCodeInternal, err.Error())
+		data, _ = d.codec.Encode(msg)
 	}
-	data = append(data, '\n')
+	d.echoMessage(msg)
 
-	d.outputMutex.Lock()
-	defer d.outputMutex.Unlock()
 	n, err := d.output.Write(data)
-	if n != len(data) || err != nil {
-		panic("ERROR")
+	d.stats.bytesWritten(n)
+	if err == nil && n != len(data) {
+		err = io.ErrShortWrite
 	}
+	return err
 }
@@ -0,0 +1,155 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+)
+
+// ContextDiscovery is the context-aware version of the Discovery interface.
+// The contexts allow the implementations to know when the client goes away
+// or stops the discovery, and to abort the in-flight operations (like a
+// network scan) cleanly. A ContextDiscovery is served with NewContextServer.
+type ContextDiscovery interface {
+	// Hello is called once at startup to provide the userAgent string
+	// and the protocolVersion negotiated with the client. The context is
+	// cancelled when the session ends, after a QUIT or when the input
+	// stream is closed. The parsed user agent and the locale requested by
+	// the client are available in all the contexts of the session with
+	// UserAgentFromContext and LocaleFromContext.
+	Hello(ctx context.Context, userAgent string, protocolVersion int) error
+
+	// StartSync is called to put the discovery in event mode. When the
+	// function returns the discovery must send port events ("add" or "remove")
+	// using the eventCB function. The context is cancelled on STOP, on QUIT,
+	// when the input stream is closed or when an event can't be delivered to
+	// the client: the discovery may use it to stop its internal subroutines.
+	StartSync(ctx context.Context, eventCB SyncEventCallback, errorCB ErrorCallback) error
+
+	// Stop stops the discovery internal subroutines. If the discovery is
+	// in event mode it must stop sending events through the eventCB previously
+	// set. The context passed to StartSync is already cancelled when Stop is
+	// called, the context passed to Stop is never cancelled.
+	Stop(ctx context.Context) error
+
+	// Quit is called just before the server terminates. This function can be
+	// used by the discovery as a last chance gracefully close resources. The
+	// context is never cancelled.
+	Quit(ctx context.Context)
+}
+
+// NewContextServer creates a new discovery server backed by the provided
+// context-aware pluggable discovery implementation. To start the server use
+// the Run method.
+func NewContextServer(impl ContextDiscovery) *Server {
+	return &Server{
+		impl:   impl,
+		logger: &nullServerLogger{},
+	}
+}
+
+// legacyDiscovery adapts a Discovery to the ContextDiscovery interface,
+// the contexts are ignored.
+type legacyDiscovery struct {
+	impl Discovery
+}
+
+func (d *legacyDiscovery) Hello(_ context.Context, userAgent string, protocolVersion int) error {
+	return d.impl.Hello(userAgent, protocolVersion)
+}
+
+func (d *legacyDiscovery) StartSync(_ context.Context, eventCB SyncEventCallback, errorCB ErrorCallback) error {
+	return d.impl.StartSync(func(event string, port *Port) { _ = eventCB(event, port) }, errorCB)
+}
+
+func (d *legacyDiscovery) Stop(_ context.Context) error {
+	return d.impl.Stop()
+}
+
+func (d *legacyDiscovery) Quit(_ context.Context) {
+	d.impl.Quit()
+}
+
+// implementation returns the implementation of the Server, unwrapping the
+// Discovery adapted to the ContextDiscovery interface, to detect the
+// optional interfaces it implements.
+func (d *Server) implementation() any {
+	if legacy, ok := d.impl.(*legacyDiscovery); ok {
+		return legacy.impl
+	}
+	return d.impl
+}
+
+// beginSession creates the context of a new session.
+func (d *Server) beginSession() {
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	d.sessionCtx, d.cancelSession = context.WithCancel(context.Background())
+}
+
+// endSession cancels the contexts of the current session.
+func (d *Server) endSession() {
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	if d.cancelSession != nil {
+		d.cancelSession()
+	}
+}
+
+// sessionContext returns the context of the current session.
+func (d *Server) sessionContext() context.Context {
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	if d.sessionCtx == nil {
+		return context.Background()
+	}
+	return d.sessionCtx
+}
+
+// newSyncContext returns a new context for StartSync, cancelled on STOP or
+// at the end of the session.
+func (d *Server) newSyncContext() context.Context {
+	ctx, cancel := context.WithCancel(d.sessionContext())
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	if d.cancelSync != nil {
+		d.cancelSync()
+	}
+	d.cancelSync = cancel
+	return ctx
+}
+
+// cancelSyncContext cancels the context passed to StartSync.
+func (d *Server) cancelSyncContext() {
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	if d.cancelSync != nil {
+		d.cancelSync()
+		d.cancelSync = nil
+	}
+}
+
+// quit terminates the implementation. It's safe to call it more than once,
+// also concurrently: the implementation is terminated only the first time.
+func (d *Server) quit() {
+	d.cancelSyncContext()
+	d.quitOnce.Do(func() {
+		d.logger.Debugf("Quitting discovery")
+		d.impl.Quit(context.Background())
+	})
+}
@@ -0,0 +1,135 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testContextDiscovery records the contexts received by the methods.
+type testContextDiscovery struct {
+	helloCtx        context.Context
+	syncCtx         context.Context
+	eventCB         SyncEventCallback
+	syncDoneOnStop  bool
+	quitCalls       int
+	stopCtxCanceled bool
+}
+
+func (d *testContextDiscovery) Hello(ctx context.Context, userAgent string, protocolVersion int) error {
+	d.helloCtx = ctx
+	return nil
+}
+
+func (d *testContextDiscovery) StartSync(ctx context.Context, eventCB SyncEventCallback, errorCB ErrorCallback) error {
+	d.syncCtx = ctx
+	d.eventCB = eventCB
+	return nil
+}
+
+func (d *testContextDiscovery) Stop(ctx context.Context) error {
+	d.syncDoneOnStop = d.syncCtx.Err() != nil
+	d.stopCtxCanceled = ctx.Err() != nil
+	return nil
+}
+
+func (d *testContextDiscovery) Quit(ctx context.Context) {
+	d.quitCalls++
+}
+
+func TestContextServer(t *testing.T) {
+	impl := &testContextDiscovery{}
+	server := NewContextServer(impl)
+	in := strings.NewReader("HELLO 1 \"test\"\nSTART_SYNC\nSTOP\nSTART_SYNC\nQUIT\n")
+	require.NoError(t, server.Run(in, &bytes.Buffer{}))
+	// The StartSync context is cancelled before calling Stop
+	require.True(t, impl.syncDoneOnStop)
+	require.False(t, impl.stopCtxCanceled)
+	// The contexts are cancelled on QUIT
+	require.Error(t, impl.syncCtx.Err())
+	require.Error(t, impl.helloCtx.Err())
+	require.Equal(t, 1, impl.quitCalls)
+
+	// The contexts are cancelled when the input stream is closed
+	impl = &testContextDiscovery{}
+	server = NewContextServer(impl)
+	in = strings.NewReader("HELLO 1 \"test\"\nSTART_SYNC\n")
+	require.Error(t, server.Run(in, &bytes.Buffer{}))
+	require.ErrorIs(t, impl.syncCtx.Err(), context.Canceled)
+	require.Equal(t, 0, impl.quitCalls)
+}
+
+// breakableWriter fails all the writes once broken.
+type breakableWriter struct {
+	mutex  sync.Mutex
+	out    bytes.Buffer
+	broken bool
+}
+
+func (w *breakableWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.broken {
+		return 0, errors.New("broken pipe")
+	}
+	return w.out.Write(data)
+}
+
+func (w *breakableWriter) setBroken() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.broken = true
+}
+
+func TestContextServerEventNotDelivered(t *testing.T) {
+	impl := &testContextDiscovery{}
+	server := NewContextServer(impl)
+	in, inWriter := io.Pipe()
+	out := &breakableWriter{}
+	done := make(chan error)
+	go func() { done <- server.Run(in, out) }()
+	_, err := inWriter.Write([]byte("HELLO 1 \"test\"\nSTART_SYNC\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		out.mutex.Lock()
+		defer out.mutex.Unlock()
+		return strings.Contains(out.out.String(), `"start_sync"`)
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, impl.eventCB("add", &Port{Address: "1", Protocol: "test"}))
+	require.NoError(t, impl.syncCtx.Err())
+
+	// The client went away
+	out.setBroken()
+	err = impl.eventCB("add", &Port{Address: "2", Protocol: "test"})
+	require.ErrorIs(t, err, ErrEventNotDelivered)
+	require.ErrorIs(t, impl.syncCtx.Err(), context.Canceled)
+	require.ErrorIs(t, impl.eventCB("add", &Port{Address: "3", Protocol: "test"}), ErrEventNotDelivered)
+
+	inWriter.Close()
+	require.Error(t, <-done)
+}
@@ -18,52 +18,239 @@
 package discovery
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/arduino/go-paths-helper"
 	"github.com/stretchr/testify/require"
 )
 
-func TestDisc(t *testing.T) {
-	builder, err := paths.NewProcess(nil, "go", "build")
-	require.NoError(t, err)
-	builder.SetDir("dummy-discovery")
-	require.NoError(t, builder.Run())
+// testDiscovery is a minimal Discovery implementation used to test
+// the Server in-process.
+type testDiscovery struct {
+	done chan struct{}
+}
 
-	discovery, err := paths.NewProcess(nil, "./dummy-discovery")
-	require.NoError(t, err)
-	discovery.SetDir("dummy-discovery")
+func (d *testDiscovery) Hello(userAgent string, protocolVersion int) error { return nil }
+
+// StartSync emits a single "add" event from a goroutine, like a real
+// discovery would do.
+func (d *testDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	done := make(chan struct{})
+	d.done = done
+	go func() {
+		defer close(done)
+		eventCB("add", &Port{Address: "1", Protocol: "test"})
+	}()
+	return nil
+}
+
+// Stop waits for the emission of the events to complete.
+func (d *testDiscovery) Stop() error {
+	if d.done != nil {
+		<-d.done
+		d.done = nil
+	}
+	return nil
+}
+
+func (d *testDiscovery) Quit() {
+	_ = d.Stop()
+}
 
-	stdout, err := discovery.StdoutPipe()
+func TestServerStats(t *testing.T) {
+	server := NewServer(&testDiscovery{})
+	in := strings.NewReader("HELLO 1 \"test\"\nSTART_SYNC\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
+
+	stats := server.Stats()
+	require.Equal(t, uint64(3), stats.CommandsHandled)
+	require.Equal(t, uint64(1), stats.EventsEmitted)
+	require.Equal(t, uint64(out.Len()), stats.BytesWritten)
+	require.False(t, stats.LastClientActivity.IsZero())
+}
+
+func TestServerStatsCallback(t *testing.T) {
+	server := NewServer(&testDiscovery{})
+	statsCalled := make(chan ServerStats, 1)
+	server.SetStatsCallback(10*time.Millisecond, func(s ServerStats) {
+		select {
+		case statsCalled <- s:
+		default:
+		}
+	})
+	in, w := io.Pipe()
+	done := make(chan error)
+	go func() { done <- server.Run(in, io.Discard) }()
+
+	_, err := w.Write([]byte("HELLO 1 \"test\"\n"))
 	require.NoError(t, err)
-	stdin, err := discovery.StdinPipe()
+	require.Eventually(t, func() bool {
+		s := <-statsCalled
+		return s.CommandsHandled == 1
+	}, time.Second, time.Millisecond)
+
+	_, err = w.Write([]byte("QUIT\n"))
 	require.NoError(t, err)
+	require.NoError(t, <-done)
+}
+
+// eagerDiscovery emits an event from inside StartSync, before the server
+// has sent the START_SYNC response.
+type eagerDiscovery struct{ testDiscovery }
 
-	require.NoError(t, discovery.Start())
+func (d *eagerDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	eventCB("add", &Port{Address: "1", Protocol: "test"})
+	return nil
+}
 
-	{
-		// Check that discovery is able to handle an "hello" without parameters gracefully
-		// https://github.com/arduino/pluggable-discovery-protocol-handler/issues/32
-		inN, err := stdin.Write([]byte("hello\n"))
-		require.NoError(t, err)
-		require.Greater(t, inN, 0)
+func TestServerStartSyncOrdering(t *testing.T) {
+	in := strings.NewReader("HELLO 1 \"test\"\nSTART_SYNC\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, NewServer(&eagerDiscovery{}).Run(in, out))
 
-		output := [1024]byte{}
-		outN, err := stdout.Read(output[:])
-		require.Greater(t, outN, 0)
-		require.NoError(t, err)
-		require.Equal(t, "{\n  \"eventType\": \"hello\",\n  \"message\": \"Invalid HELLO command\",\n  \"error\": true\n}\n", string(output[:outN]))
+	decoder := json.NewDecoder(out)
+	events := []string{}
+	for decoder.More() {
+		var m message
+		require.NoError(t, decoder.Decode(&m))
+		events = append(events, m.EventType)
 	}
+	require.Equal(t, []string{"hello", "start_sync", "add", "quit"}, events)
+}
 
-	{
-		inN, err := stdin.Write([]byte("quit\n"))
-		require.NoError(t, err)
-		require.Greater(t, inN, 0)
+func TestServerAuthToken(t *testing.T) {
+	server := NewServer(&testDiscovery{})
+	server.SetAuthToken("secret")
+	in := strings.NewReader("HELLO 1 \"test\"\nHELLO 1 \"test\" \"wrong\"\nHELLO 1 \"test\" \"secret\"\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
 
-		output := [1024]byte{}
-		outN, err := stdout.Read(output[:])
-		require.Greater(t, outN, 0)
-		require.NoError(t, err)
-		require.Equal(t, "{\n  \"eventType\": \"quit\",\n  \"message\": \"OK\"\n}\n", string(output[:outN]))
+	decoder := json.NewDecoder(out)
+	for _, expected := range []string{"Invalid authentication token", "Invalid authentication token", "OK", "OK"} {
+		var m message
+		require.NoError(t, decoder.Decode(&m))
+		require.Equal(t, expected, m.Message)
 	}
+
+	// The token is ignored if not required
+	server = NewServer(&testDiscovery{})
+	in = strings.NewReader("HELLO 1 \"test\" \"secret\"\nQUIT\n")
+	out = &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
+	var m message
+	require.NoError(t, json.NewDecoder(out).Decode(&m))
+	require.Equal(t, "OK", m.Message)
+}
+
+func TestServerIdempotentStop(t *testing.T) {
+	server := NewServer(&testDiscovery{})
+	in := strings.NewReader("HELLO 1 \"test\"\nSTOP\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
+	decoder := json.NewDecoder(out)
+	var m message
+	require.NoError(t, decoder.Decode(&m))
+	require.Empty(t, m.Capabilities)
+	require.NoError(t, decoder.Decode(&m))
+	require.True(t, m.Error)
+	require.Equal(t, "Discovery already STOPped", m.Message)
+
+	server = NewServer(&testDiscovery{})
+	server.SetIdempotentStop(true)
+	in = strings.NewReader("HELLO 1 \"test\"\nSTOP\nSTART_SYNC\nSTOP\nSTOP\nQUIT\n")
+	out = &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
+	decoder = json.NewDecoder(out)
+	require.NoError(t, decoder.Decode(&m))
+	require.Equal(t, []string{CapabilityIdempotentStop}, m.Capabilities)
+	for decoder.More() {
+		m = message{}
+		require.NoError(t, decoder.Decode(&m))
+		if m.EventType == "stop" {
+			require.False(t, m.Error)
+			require.Equal(t, "OK", m.Message)
+		}
+	}
+}
+
+func TestServerHelloInvalidProtocolVersion(t *testing.T) {
+	server := NewServer(&testDiscovery{})
+	in := strings.NewReader("HELLO 99999999999999999999 \"test\"\nHELLO 1 \"test\"\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
+	decoder := json.NewDecoder(out)
+	var m message
+	require.NoError(t, decoder.Decode(&m))
+	require.True(t, m.Error)
+	require.Equal(t, "Invalid protocol version: 99999999999999999999", m.Message)
+	require.NoError(t, decoder.Decode(&m))
+	require.Equal(t, "OK", m.Message)
+}
+
+// manyPortsDiscovery reports a bunch of ports from inside StartSync.
+type manyPortsDiscovery struct{ testDiscovery }
+
+func (d *manyPortsDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	for _, address := range []string{"3", "1", "4", "5", "2"} {
+		eventCB("add", &Port{Address: address, Protocol: "test"})
+		eventCB("add", &Port{Address: address, Protocol: "other"})
+	}
+	return nil
+}
+
+func TestServerListOrder(t *testing.T) {
+	in := strings.NewReader("HELLO 1 \"test\"\nSTART\nLIST\nLIST\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, NewServer(&manyPortsDiscovery{}).Run(in, out))
+
+	decoder := json.NewDecoder(out)
+	var m message
+	require.NoError(t, decoder.Decode(&m))
+	require.NoError(t, decoder.Decode(&m))
+	for i := 0; i < 2; i++ {
+		m = message{}
+		require.NoError(t, decoder.Decode(&m))
+		res := []string{}
+		for _, port := range m.Ports {
+			res = append(res, port.Protocol+"://"+port.Address)
+		}
+		require.Equal(t, []string{
+			"other://1", "other://2", "other://3", "other://4", "other://5",
+			"test://1", "test://2", "test://3", "test://4", "test://5",
+		}, res)
+	}
+}
+
+func TestServerChunkedList(t *testing.T) {
+	server := NewServer(&manyPortsDiscovery{})
+	server.SetListChunkSize(4)
+	in := strings.NewReader("HELLO 1 \"test\"\nSTART\nLIST CHUNKED\nLIST\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
+
+	decoder := json.NewDecoder(out)
+	var m message
+	require.NoError(t, decoder.Decode(&m))
+	require.Equal(t, []string{CapabilityChunkedList}, m.Capabilities)
+	require.NoError(t, decoder.Decode(&m))
+	sizes := []int{}
+	for _, more := range []bool{true, true, false} {
+		m = message{}
+		require.NoError(t, decoder.Decode(&m))
+		require.Equal(t, "list", m.EventType)
+		require.Equal(t, more, m.More)
+		sizes = append(sizes, len(m.Ports))
+	}
+	require.Equal(t, []int{4, 4, 2}, sizes)
+
+	// The plain LIST is never chunked
+	m = message{}
+	require.NoError(t, decoder.Decode(&m))
+	require.False(t, m.More)
+	require.Len(t, m.Ports, 10)
 }
@@ -0,0 +1,527 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discoverytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// Instance is a running instance of a discovery under test.
+type Instance struct {
+	// In is the input of the discovery.
+	In io.WriteCloser
+	// Out is the output of the discovery.
+	Out io.Reader
+	// Wait waits for the termination of the discovery, after its output
+	// has been read to the end, and returns an error if it crashed.
+	Wait func() error
+	// Kill terminates the discovery.
+	Kill func()
+}
+
+// Launcher starts a new instance of the discovery under test.
+type Launcher func() (*Instance, error)
+
+// crashRegexp matches the output of the Go runtime when a program panics
+// or dies of a fatal error.
+var crashRegexp = regexp.MustCompile(`(?m)^(panic: |fatal error: )`)
+
+// ExecutableLauncher returns a Launcher running the discovery executable
+// with the given arguments. The discovery is considered crashed if it's
+// terminated by a signal or if it prints a Go panic on the standard error,
+// a non-zero exit code is not a crash.
+func ExecutableLauncher(executable string, args ...string) Launcher {
+	return func() (*Instance, error) {
+		proc, err := paths.NewProcess(nil, append([]string{executable}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		stdin, err := proc.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := proc.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		stderr := &syncBuffer{}
+		proc.RedirectStderrTo(stderr)
+		if err := proc.Start(); err != nil {
+			return nil, err
+		}
+		return &Instance{
+			In:  stdin,
+			Out: stdout,
+			Wait: func() error {
+				err := proc.Wait()
+				if loc := crashRegexp.FindStringIndex(stderr.String()); loc != nil {
+					return fmt.Errorf("discovery crashed: %s", firstLines(stderr.String()[loc[0]:], 5))
+				}
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) && !exitErr.Exited() {
+					return fmt.Errorf("discovery terminated: %s", exitErr)
+				}
+				return nil
+			},
+			Kill: func() { _ = proc.Kill() },
+		}, nil
+	}
+}
+
+// ServerLauncher returns a Launcher running in-process the Server returned
+// by newServer. The discovery is considered crashed if Server.Run panics.
+func ServerLauncher(newServer func() *discovery.Server) Launcher {
+	return func() (*Instance, error) {
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			defer outW.Close()
+			defer func() {
+				if r := recover(); r != nil {
+					done <- fmt.Errorf("discovery crashed: panic: %v", r)
+				}
+			}()
+			_ = newServer().Run(inR, outW)
+			done <- nil
+		}()
+		return &Instance{
+			In:   inW,
+			Out:  outR,
+			Wait: func() error { return <-done },
+			Kill: func() {
+				_ = inR.CloseWithError(errors.New("discovery killed"))
+				_ = outR.CloseWithError(errors.New("discovery killed"))
+			},
+		}, nil
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// firstLines returns the first n lines of s.
+func firstLines(s string, n int) string {
+	lines := strings.SplitN(s, "\n", n+1)
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Chaos stresses a discovery with the inputs a well-behaved client never
+// sends, checking that the discovery never crashes, never hangs and never
+// emits malformed JSON: it doesn't check the correctness of the responses,
+// see Session for that. Each scenario runs on a new instance of the
+// discovery:
+//
+//   - "random-commands" sends a random sequence of valid, invalid and
+//     malformed commands
+//   - "start-stop-cycles" starts and stops the discovery in rapid cycles,
+//     in both modes
+//   - "quit-before-hello" sends QUIT as the first command
+//   - "quit-while-syncing" sends QUIT right after START_SYNC, without
+//     waiting for the responses
+//   - "stdin-closed-mid-command" closes the input in the middle of a
+//     command
+//   - "huge-user-agent" sends a HELLO with a huge user agent
+type Chaos struct {
+	launch        Launcher
+	seed          int64
+	commands      int
+	cycles        int
+	userAgentSize int
+	timeout       time.Duration
+}
+
+// ChaosResult is the outcome of a chaos scenario.
+type ChaosResult struct {
+	Scenario string
+	Failures []string
+}
+
+// Passed returns true if the discovery survived the scenario.
+func (r *ChaosResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// NewChaos returns a Chaos running the discovery started by launch. The
+// random seed is taken from the current time, see SetSeed.
+func NewChaos(launch Launcher) *Chaos {
+	return &Chaos{
+		launch:        launch,
+		seed:          time.Now().UnixNano(),
+		commands:      200,
+		cycles:        50,
+		userAgentSize: 1 << 20,
+		timeout:       DefaultTimeout,
+	}
+}
+
+// SetSeed sets the seed of the random sequences, to reproduce a failure.
+func (c *Chaos) SetSeed(seed int64) {
+	c.seed = seed
+}
+
+// Seed returns the seed of the random sequences.
+func (c *Chaos) Seed() int64 {
+	return c.seed
+}
+
+// SetCommands sets the number of commands sent in the "random-commands"
+// scenario, the default is 200.
+func (c *Chaos) SetCommands(commands int) {
+	c.commands = commands
+}
+
+// SetCycles sets the number of cycles of the "start-stop-cycles" scenario,
+// the default is 50.
+func (c *Chaos) SetCycles(cycles int) {
+	c.cycles = cycles
+}
+
+// SetUserAgentSize sets the size of the user agent of the
+// "huge-user-agent" scenario, the default is 1 MiB.
+func (c *Chaos) SetUserAgentSize(size int) {
+	c.userAgentSize = size
+}
+
+// SetTimeout sets the time the discovery has to respond to a command or to
+// terminate, the default is DefaultTimeout.
+func (c *Chaos) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// chaosScenarios are the scenarios run by Chaos, in order.
+var chaosScenarios = []struct {
+	name string
+	run  func(c *Chaos, r *chaosRun)
+}{
+	{"random-commands", (*Chaos).randomCommands},
+	{"start-stop-cycles", (*Chaos).startStopCycles},
+	{"quit-before-hello", (*Chaos).quitBeforeHello},
+	{"quit-while-syncing", (*Chaos).quitWhileSyncing},
+	{"stdin-closed-mid-command", (*Chaos).stdinClosedMidCommand},
+	{"huge-user-agent", (*Chaos).hugeUserAgent},
+}
+
+// Run runs all the scenarios and returns their results.
+func (c *Chaos) Run() []ChaosResult {
+	res := []ChaosResult{}
+	for _, scenario := range chaosScenarios {
+		res = append(res, c.runScenario(scenario.name, scenario.run))
+	}
+	return res
+}
+
+// Test runs all the scenarios as subtests of t, failing them if the
+// discovery doesn't survive. The seed is logged on failure.
+func (c *Chaos) Test(t *testing.T) {
+	t.Helper()
+	for _, scenario := range chaosScenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			res := c.runScenario(scenario.name, scenario.run)
+			for _, failure := range res.Failures {
+				t.Error(failure)
+			}
+		})
+	}
+	if t.Failed() {
+		t.Logf("chaos seed: %d", c.seed)
+	}
+}
+
+func (c *Chaos) runScenario(name string, run func(c *Chaos, r *chaosRun)) ChaosResult {
+	res := ChaosResult{Scenario: name, Failures: []string{}}
+	instance, err := c.launch()
+	if err != nil {
+		res.Failures = append(res.Failures, fmt.Sprintf("launching discovery: %s", err))
+		return res
+	}
+	r := &chaosRun{
+		instance: instance,
+		timeout:  c.timeout,
+		events:   make(chan *Event, 100),
+		readDone: make(chan struct{}),
+	}
+	go r.readLoop()
+	run(c, r)
+	r.finish()
+	res.Failures = append(res.Failures, r.failures()...)
+	return res
+}
+
+func (c *Chaos) randomCommands(r *chaosRun) {
+	rnd := rand.New(rand.NewSource(c.seed))
+	commands := []string{
+		`HELLO 1 "chaos"`, "START", "STOP", "START_SYNC", "LIST", "SELFTEST",
+		`HELLO 99 "chaos"`, `HELLO x "chaos"`, "HELLO", "START START", "start_sync",
+		"", "FOO", "LIST CHUNKED NOW", `"`, "\x00\x01\x02", strings.Repeat("START", 1000),
+	}
+	for i := 0; i < c.commands; i++ {
+		cmd := commands[rnd.Intn(len(commands))]
+		if rnd.Intn(10) == 0 {
+			cmd = randomLine(rnd)
+		}
+		if !r.command(cmd) {
+			return
+		}
+	}
+	r.command("QUIT")
+}
+
+// randomLine returns a line of random bytes, without the line terminator.
+func randomLine(rnd *rand.Rand) string {
+	line := make([]byte, rnd.Intn(100))
+	for i := range line {
+		line[i] = byte(rnd.Intn(256))
+		if line[i] == '\n' {
+			line[i] = ' '
+		}
+	}
+	return string(line)
+}
+
+func (c *Chaos) startStopCycles(r *chaosRun) {
+	if !r.command(`HELLO 1 "chaos"`) {
+		return
+	}
+	for i := 0; i < c.cycles; i++ {
+		for _, cmd := range []string{"START", "STOP", "START_SYNC", "STOP"} {
+			if !r.command(cmd) {
+				return
+			}
+		}
+	}
+	r.command("QUIT")
+}
+
+func (c *Chaos) quitBeforeHello(r *chaosRun) {
+	r.command("QUIT")
+}
+
+func (c *Chaos) quitWhileSyncing(r *chaosRun) {
+	r.send("HELLO 1 \"chaos\"\nSTART_SYNC\nQUIT\n")
+}
+
+func (c *Chaos) stdinClosedMidCommand(r *chaosRun) {
+	if r.command(`HELLO 1 "chaos"`) && r.command("START_SYNC") {
+		r.send("LIS")
+	}
+}
+
+func (c *Chaos) hugeUserAgent(r *chaosRun) {
+	if r.command(fmt.Sprintf("HELLO 1 %q", strings.Repeat("a", c.userAgentSize))) && r.command("LIST") {
+		r.command("QUIT")
+	}
+}
+
+// chaosRun is the run of a scenario on an instance of the discovery.
+type chaosRun struct {
+	instance *Instance
+	timeout  time.Duration
+	events   chan *Event
+	readDone chan struct{}
+	// pending are the events received while sending a command
+	pending []*Event
+
+	mutex  sync.Mutex
+	errors []string
+}
+
+func (r *chaosRun) fail(format string, args ...any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *chaosRun) failures() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.errors
+}
+
+// readLoop decodes the output of the discovery, flagging the malformed
+// messages. The rest of the output is discarded after a malformed message,
+// since the decoding can't be resumed.
+func (r *chaosRun) readLoop() {
+	defer close(r.readDone)
+	defer close(r.events)
+	decoder := json.NewDecoder(r.instance.Out)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			r.fail("malformed JSON in the output: %s", err)
+			_, _ = io.Copy(io.Discard, r.instance.Out)
+			return
+		}
+		event := &Event{Raw: raw}
+		if err := json.Unmarshal(raw, event); err != nil {
+			r.fail("invalid message %s: %s", shorten(string(raw)), err)
+			continue
+		}
+		if event.EventType == "" {
+			r.fail("message without eventType: %s", shorten(string(raw)))
+			continue
+		}
+		r.events <- event
+	}
+}
+
+// send writes the data to the input of the discovery, it returns false if
+// the discovery doesn't accept it. The events are received in the meantime,
+// the discovery may be blocked writing them.
+func (r *chaosRun) send(data string) bool {
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(r.instance.In, data)
+		written <- err
+	}()
+	deadline := time.After(r.timeout)
+	events := r.events
+	for {
+		select {
+		case err := <-written:
+			if err != nil {
+				r.fail("sending %q: %s", shorten(data), err)
+				return false
+			}
+			return true
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			r.pending = append(r.pending, event)
+		case <-deadline:
+			r.fail("the discovery is not reading its input, sending %q", shorten(data))
+			return false
+		}
+	}
+}
+
+// next returns the next event, nil if the output is closed. expired is
+// true if the deadline expires first.
+func (r *chaosRun) next(deadline <-chan time.Time) (event *Event, expired bool) {
+	if len(r.pending) > 0 {
+		event, r.pending = r.pending[0], r.pending[1:]
+		return event, false
+	}
+	select {
+	case event := <-r.events:
+		return event, false
+	case <-deadline:
+		return nil, true
+	}
+}
+
+// command sends the command and waits for its response, any response is
+// accepted. It returns false if the scenario can't go on.
+func (r *chaosRun) command(cmd string) bool {
+	if !r.send(cmd + "\n") {
+		return false
+	}
+	responseType := strings.ToLower(strings.SplitN(strings.TrimSpace(cmd), " ", 2)[0])
+	deadline := time.After(r.timeout)
+	for {
+		event, expired := r.next(deadline)
+		if expired {
+			r.fail("no response to %q in %s", shorten(cmd), r.timeout)
+			return false
+		}
+		if event == nil {
+			r.fail("the discovery output closed while waiting the response to %q", shorten(cmd))
+			return false
+		}
+		if event.EventType == responseType || event.EventType == "command_error" {
+			return true
+		}
+	}
+}
+
+// finish closes the input of the discovery, then waits for the output to
+// be closed and for the termination of the discovery, killing it after the
+// timeout.
+func (r *chaosRun) finish() {
+	_ = r.instance.In.Close()
+	go func() {
+		for range r.events {
+		}
+	}()
+	select {
+	case <-r.readDone:
+	case <-time.After(r.timeout):
+		r.fail("the discovery didn't terminate in %s after closing its input", r.timeout)
+		r.instance.Kill()
+		select {
+		case <-r.readDone:
+		case <-time.After(r.timeout):
+		}
+		return
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- r.instance.Wait() }()
+	select {
+	case err := <-waited:
+		if err != nil {
+			r.fail("%s", err)
+		}
+	case <-time.After(r.timeout):
+		r.fail("the discovery didn't terminate in %s after closing its output", r.timeout)
+		r.instance.Kill()
+	}
+}
+
+// shorten truncates the long commands and messages in the failures.
+func shorten(s string) string {
+	if len(s) > 60 {
+		return s[:60] + "..."
+	}
+	return s
+}
@@ -0,0 +1,126 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discoverytest
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// fragileDiscovery panics when the user agent is too long.
+type fragileDiscovery struct {
+	testDiscovery
+}
+
+func (d *fragileDiscovery) Hello(userAgent string, protocolVersion int) error {
+	if len(userAgent) > 1000 {
+		panic("user agent too long")
+	}
+	return nil
+}
+
+// newChaos returns a Chaos with a small workload, for a fast test.
+func newChaos(launch Launcher) *Chaos {
+	chaos := NewChaos(launch)
+	chaos.SetSeed(1)
+	chaos.SetCommands(50)
+	chaos.SetCycles(5)
+	chaos.SetTimeout(2 * time.Second)
+	return chaos
+}
+
+func TestChaos(t *testing.T) {
+	newChaos(ServerLauncher(func() *discovery.Server {
+		return discovery.NewServer(&testDiscovery{})
+	})).Test(t)
+}
+
+func TestChaosCrash(t *testing.T) {
+	chaos := newChaos(ServerLauncher(func() *discovery.Server {
+		return discovery.NewServer(&fragileDiscovery{})
+	}))
+	for _, res := range chaos.Run() {
+		if res.Scenario != "huge-user-agent" {
+			require.True(t, res.Passed(), "%s: %v", res.Scenario, res.Failures)
+			continue
+		}
+		require.False(t, res.Passed())
+		require.Contains(t, strings.Join(res.Failures, "\n"), "discovery crashed: panic: user agent too long")
+	}
+}
+
+func TestChaosMalformedOutput(t *testing.T) {
+	chaos := newChaos(func() (*Instance, error) {
+		inR, inW := io.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, inR) }()
+		return &Instance{
+			In:   inW,
+			Out:  strings.NewReader(`{ "eventType": "hello", "message": "OK" }{ "message": "OK" }{ "eventType": `),
+			Wait: func() error { return nil },
+			Kill: func() { inR.CloseWithError(errors.New("killed")) },
+		}, nil
+	})
+	res := chaos.Run()[0]
+	require.Equal(t, "random-commands", res.Scenario)
+	require.Contains(t, strings.Join(res.Failures, "\n"), `message without eventType: { "message": "OK" }`)
+	require.Contains(t, strings.Join(res.Failures, "\n"), "malformed JSON in the output")
+}
+
+func TestChaosHang(t *testing.T) {
+	chaos := newChaos(func() (*Instance, error) {
+		killed := make(chan struct{})
+		inR, inW := io.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, inR) }()
+		outR, outW := io.Pipe()
+		go func() {
+			<-killed
+			outW.Close()
+		}()
+		return &Instance{
+			In:   inW,
+			Out:  outR,
+			Wait: func() error { return nil },
+			Kill: func() { close(killed) },
+		}, nil
+	})
+	chaos.SetTimeout(50 * time.Millisecond)
+	res := chaos.Run()[1]
+	require.Equal(t, "start-stop-cycles", res.Scenario)
+	require.Equal(t, []string{
+		`no response to "HELLO 1 \"chaos\"" in 50ms`,
+		"the discovery didn't terminate in 50ms after closing its input",
+	}, res.Failures)
+}
+
+func TestChaosExecutable(t *testing.T) {
+	executable := filepath.Join(t.TempDir(), "dummy-discovery")
+	builder, err := paths.NewProcess(nil, "go", "build", "-o", executable)
+	require.NoError(t, err)
+	builder.SetDir("../dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	newChaos(ExecutableLauncher(executable)).Test(t)
+}
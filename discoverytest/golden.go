@@ -0,0 +1,197 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discoverytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// UpdateGoldenEnv is the environment variable that, when set, makes
+// AssertGolden write the golden files instead of comparing them:
+//
+//	DISCOVERYTEST_UPDATE_GOLDEN=1 go test ./...
+const UpdateGoldenEnv = "DISCOVERYTEST_UPDATE_GOLDEN"
+
+// DefaultSettleTime is the time Transcript waits for further events after
+// the response to a command.
+const DefaultSettleTime = 200 * time.Millisecond
+
+// timestampRegexp matches the RFC 3339 timestamps.
+var timestampRegexp = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
+
+// scrubber replaces the variable parts of the string values of the events.
+type scrubber struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// SetSettleTime sets the time Transcript waits for further events after
+// the response to a command, the default is DefaultSettleTime.
+func (s *Session) SetSettleTime(settle time.Duration) {
+	s.settle = settle
+}
+
+// AddScrubber makes Transcript replace the matches of re, in the string
+// values of the events, with the replacement. The timestamps are always
+// replaced with "<timestamp>".
+func (s *Session) AddScrubber(re *regexp.Regexp, replacement string) {
+	s.scrubbers = append(s.scrubbers, scrubber{re: re, replacement: replacement})
+}
+
+// Transcript sends the commands of the script and returns a canonical
+// transcript of the conversation: each command, prefixed with "> ", is
+// followed by its response and by the events received until the discovery
+// is quiet for the settle time. The transcript is normalized to be stable
+// across runs: the events following a response are sorted, the ports of
+// the "list" responses are sorted by protocol and address, the JSON keys
+// are sorted and the timestamps are scrubbed.
+func (s *Session) Transcript(script ...string) string {
+	s.t.Helper()
+	var res strings.Builder
+	for _, cmd := range script {
+		fmt.Fprintf(&res, "> %s\n", cmd)
+		s.Send(cmd)
+		block := s.waitResponse(cmd)
+		block = append(block, s.drain()...)
+		for _, event := range block {
+			res.WriteString(event)
+			res.WriteString("\n")
+		}
+	}
+	return res.String()
+}
+
+// waitResponse waits for the response to the command and returns it as the
+// first element of the list of the normalized events received, the events
+// received before the response follow.
+func (s *Session) waitResponse(cmd string) []string {
+	s.t.Helper()
+	responseType := strings.ToLower(strings.SplitN(cmd, " ", 2)[0])
+	events := []string{}
+	for {
+		event := s.Next()
+		if event.EventType == responseType || event.EventType == "command_error" {
+			sort.Strings(events)
+			return append([]string{s.normalize(event)}, events...)
+		}
+		events = append(events, s.normalize(event))
+	}
+}
+
+// drain returns the sorted normalized events received until the discovery
+// is quiet for the settle time or its output is closed.
+func (s *Session) drain() []string {
+	events := []string{}
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				sort.Strings(events)
+				return events
+			}
+			events = append(events, s.normalize(event))
+		case <-time.After(s.settle):
+			sort.Strings(events)
+			return events
+		}
+	}
+}
+
+// normalize returns the canonical form of the event.
+func (s *Session) normalize(event *Event) string {
+	s.t.Helper()
+	var value map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(event.Raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		s.t.Fatalf("invalid event %s: %s", event, err)
+	}
+	if ports, ok := value["ports"].([]interface{}); ok {
+		sort.SliceStable(ports, func(i, j int) bool {
+			return portSortKey(ports[i]) < portSortKey(ports[j])
+		})
+	}
+	var res bytes.Buffer
+	encoder := json.NewEncoder(&res)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s.scrub(value)); err != nil {
+		s.t.Fatalf("encoding event %s: %s", event, err)
+	}
+	return strings.TrimSuffix(res.String(), "\n")
+}
+
+// scrub replaces the variable parts of the string values.
+func (s *Session) scrub(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		v = timestampRegexp.ReplaceAllString(v, "<timestamp>")
+		for _, scrubber := range s.scrubbers {
+			v = scrubber.re.ReplaceAllString(v, scrubber.replacement)
+		}
+		return v
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = s.scrub(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = s.scrub(item)
+		}
+	}
+	return value
+}
+
+func portSortKey(port interface{}) string {
+	p, _ := port.(map[string]interface{})
+	protocol, _ := p["protocol"].(string)
+	address, _ := p["address"].(string)
+	return protocol + "://" + address
+}
+
+// AssertGolden compares the transcript with the content of the golden file,
+// failing the test if they differ. If the UpdateGoldenEnv environment
+// variable is set, the golden file is written with the transcript instead.
+func AssertGolden(t testing.TB, goldenPath, transcript string) {
+	t.Helper()
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(goldenPath), 0755); err != nil {
+			t.Fatalf("creating golden file directory: %s", err)
+		}
+		if err := os.WriteFile(goldenPath, []byte(transcript), 0644); err != nil {
+			t.Fatalf("writing golden file: %s", err)
+		}
+		return
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("reading golden file (set %s=1 to create it): %s", UpdateGoldenEnv, err)
+	}
+	if expected := strings.ReplaceAll(string(golden), "\r\n", "\n"); expected != transcript {
+		t.Fatalf("transcript differs from the golden file %s\n--- expected:\n%s\n--- got:\n%s", goldenPath, expected, transcript)
+	}
+}
@@ -0,0 +1,55 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discoverytest
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscript(t *testing.T) {
+	s := newTestSession(t)
+	s.SetSettleTime(50 * time.Millisecond)
+	transcript := s.Transcript(`HELLO 1 "test"`, "START_SYNC", "LIST", "QUIT")
+	AssertGolden(t, "testdata/session.golden", transcript)
+}
+
+func TestTranscriptNormalize(t *testing.T) {
+	s := newTestSession(t)
+	s.AddScrubber(regexp.MustCompile(`session-\d+`), "session-N")
+	event := &Event{Raw: []byte(`{"ports":[{"protocol":"b","address":"1"},{"address":"2","protocol":"a"}],"eventType":"list","message":"at 2024-01-02T03:04:05.123Z in session-42","n":1}`)}
+	require.Equal(t, `{
+  "eventType": "list",
+  "message": "at <timestamp> in session-N",
+  "n": 1,
+  "ports": [
+    {
+      "address": "2",
+      "protocol": "a"
+    },
+    {
+      "address": "1",
+      "protocol": "b"
+    }
+  ]
+}`, s.normalize(event))
+	s.Send("QUIT")
+}
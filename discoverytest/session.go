@@ -0,0 +1,359 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package discoverytest provides the tools to write the integration tests of
+// a pluggable discovery: a Session drives a discovery, running as an external
+// binary or in-process, sending the commands and checking the events received.
+package discoverytest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// DefaultTimeout is the time a Session waits for an event before failing
+// the test.
+const DefaultTimeout = 5 * time.Second
+
+// Event is an event (or command response) received from the discovery.
+// Raw is the JSON message as received.
+type Event struct {
+	EventType       string            `json:"eventType"`
+	Message         string            `json:"message"`
+	Error           bool              `json:"error"`
+	Code            string            `json:"code"`
+	ProtocolVersion int               `json:"protocolVersion"`
+	Capabilities    []string          `json:"capabilities"`
+	Port            *discovery.Port   `json:"port"`
+	Ports           []*discovery.Port `json:"ports"`
+	Raw             json.RawMessage   `json:"-"`
+}
+
+// String returns the raw JSON of the event.
+func (e *Event) String() string {
+	return string(e.Raw)
+}
+
+// Session is a conversation with a discovery under test. The methods of
+// the Session fail the test, through the testing.TB given at creation, as
+// soon as the discovery misbehaves: they must be called from the goroutine
+// running the test.
+type Session struct {
+	t        testing.TB
+	in       io.WriteCloser
+	events   chan *Event
+	readErr  error
+	readDone chan struct{}
+	timeout  time.Duration
+	wait     func()
+
+	settle    time.Duration
+	scrubbers []scrubber
+}
+
+// Launch starts the discovery executable with the given arguments and
+// returns a Session connected to its stdin and stdout. The discovery is
+// killed at the end of the test if it didn't quit already.
+func Launch(t testing.TB, executable string, args ...string) *Session {
+	t.Helper()
+	proc, err := paths.NewProcess(nil, append([]string{executable}, args...)...)
+	if err != nil {
+		t.Fatalf("creating discovery process: %s", err)
+	}
+	stdin, err := proc.StdinPipe()
+	if err != nil {
+		t.Fatalf("creating discovery stdin: %s", err)
+	}
+	stdout, err := proc.StdoutPipe()
+	if err != nil {
+		t.Fatalf("creating discovery stdout: %s", err)
+	}
+	if err := proc.Start(); err != nil {
+		t.Fatalf("starting discovery: %s", err)
+	}
+	s := NewSession(t, stdin, stdout)
+	exited := make(chan struct{})
+	go func() {
+		// Wait closes the stdout pipe: all the output must be read before
+		<-s.readDone
+		_ = proc.Wait()
+		close(exited)
+	}()
+	s.wait = func() {
+		select {
+		case <-exited:
+		case <-time.After(s.timeout):
+			_ = proc.Kill()
+			// Unblock the read loop, if the events are not consumed
+			go func() {
+				for range s.events {
+				}
+			}()
+			<-exited
+		}
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// NewSession returns a Session sending the commands to in and reading the
+// events from out, for example the pipes connected to a Server running
+// in-process.
+func NewSession(t testing.TB, in io.WriteCloser, out io.Reader) *Session {
+	s := &Session{
+		t:        t,
+		in:       in,
+		events:   make(chan *Event, 100),
+		readDone: make(chan struct{}),
+		timeout:  DefaultTimeout,
+		settle:   DefaultSettleTime,
+	}
+	go s.readLoop(out)
+	return s
+}
+
+// SetTimeout sets the time the Session waits for an event before failing
+// the test, the default is DefaultTimeout.
+func (s *Session) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+func (s *Session) readLoop(out io.Reader) {
+	defer close(s.readDone)
+	defer close(s.events)
+	decoder := json.NewDecoder(out)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.readErr = err
+			}
+			return
+		}
+		event := &Event{Raw: raw}
+		if err := json.Unmarshal(raw, event); err != nil {
+			s.readErr = fmt.Errorf("invalid event %s: %w", raw, err)
+			return
+		}
+		s.events <- event
+	}
+}
+
+// Send sends a command to the discovery, the line terminator is added if
+// missing.
+func (s *Session) Send(cmd string) {
+	s.t.Helper()
+	if !strings.HasSuffix(cmd, "\n") {
+		cmd += "\n"
+	}
+	if _, err := io.WriteString(s.in, cmd); err != nil {
+		s.t.Fatalf("sending %q: %s", strings.TrimSpace(cmd), err)
+	}
+}
+
+// Next waits for the next event and returns it.
+func (s *Session) Next() *Event {
+	s.t.Helper()
+	select {
+	case event, ok := <-s.events:
+		if !ok {
+			if s.readErr != nil {
+				s.t.Fatalf("reading events: %s", s.readErr)
+			}
+			s.t.Fatalf("discovery output closed while waiting for an event")
+		}
+		return event
+	case <-time.After(s.timeout):
+		s.t.Fatalf("no event received in %s", s.timeout)
+	}
+	return nil
+}
+
+// ExpectEvent waits for the next event and checks that it has the given
+// type and satisfies all the matchers.
+func (s *Session) ExpectEvent(eventType string, matchers ...EventMatcher) *Event {
+	s.t.Helper()
+	event := s.Next()
+	if event.EventType != eventType {
+		s.t.Fatalf("expected %q event, got %s", eventType, event)
+	}
+	for _, match := range matchers {
+		if err := match(event); err != nil {
+			s.t.Fatalf("unexpected %q event: %s, got %s", eventType, err, event)
+		}
+	}
+	return event
+}
+
+// ExpectPortAdded waits for the next event and checks that it's an "add"
+// event of a port satisfying the matcher. The port is returned.
+func (s *Session) ExpectPortAdded(matcher PortMatcher) *discovery.Port {
+	s.t.Helper()
+	return s.expectPortEvent("add", matcher)
+}
+
+// ExpectPortRemoved waits for the next event and checks that it's a
+// "remove" event of a port satisfying the matcher. The port is returned.
+func (s *Session) ExpectPortRemoved(matcher PortMatcher) *discovery.Port {
+	s.t.Helper()
+	return s.expectPortEvent("remove", matcher)
+}
+
+func (s *Session) expectPortEvent(eventType string, matcher PortMatcher) *discovery.Port {
+	s.t.Helper()
+	event := s.ExpectEvent(eventType)
+	if event.Port == nil {
+		s.t.Fatalf("%q event without a port: %s", eventType, event)
+	}
+	if err := matcher(event.Port); err != nil {
+		s.t.Fatalf("unexpected port: %s, got %s", err, event)
+	}
+	return event.Port
+}
+
+// ExpectList waits for the next event and checks that it's a successful
+// "list" response. The ports listed are returned.
+func (s *Session) ExpectList() []*discovery.Port {
+	s.t.Helper()
+	event := s.ExpectEvent("list")
+	if event.Error {
+		s.t.Fatalf("LIST failed: %s", event)
+	}
+	return event.Ports
+}
+
+// ExpectNoEvent checks that no event is received for the given duration.
+func (s *Session) ExpectNoEvent(d time.Duration) {
+	s.t.Helper()
+	select {
+	case event, ok := <-s.events:
+		if ok {
+			s.t.Fatalf("unexpected event %s", event)
+		}
+	case <-time.After(d):
+	}
+}
+
+// Close closes the input of the discovery and, for a launched executable,
+// waits for it to exit, killing it after the Session timeout. The events
+// not yet received are discarded.
+func (s *Session) Close() {
+	_ = s.in.Close()
+	if s.wait != nil {
+		s.wait()
+	}
+}
+
+// EventMatcher checks a property of an event, returning a description of
+// the mismatch if the event doesn't satisfy it.
+type EventMatcher func(event *Event) error
+
+// WithOK matches the successful responses.
+func WithOK() EventMatcher {
+	return func(event *Event) error {
+		if event.Error || event.Message != "OK" {
+			return errors.New("expected an OK response")
+		}
+		return nil
+	}
+}
+
+// WithError matches the error responses having the given message, any
+// message is accepted if empty.
+func WithError(message string) EventMatcher {
+	return func(event *Event) error {
+		if !event.Error {
+			return errors.New("expected an error response")
+		}
+		if message != "" && event.Message != message {
+			return fmt.Errorf("expected error message %q", message)
+		}
+		return nil
+	}
+}
+
+// WithCode matches the error responses having the given error code.
+func WithCode(code discovery.ErrorCode) EventMatcher {
+	return func(event *Event) error {
+		if !event.Error || event.Code != string(code) {
+			return fmt.Errorf("expected an error response with code %q", code)
+		}
+		return nil
+	}
+}
+
+// WithProtocolVersion matches the "hello" responses negotiating the given
+// protocol version.
+func WithProtocolVersion(version int) EventMatcher {
+	return func(event *Event) error {
+		if event.ProtocolVersion != version {
+			return fmt.Errorf("expected protocol version %d", version)
+		}
+		return nil
+	}
+}
+
+// PortMatcher checks a property of a port, returning a description of
+// the mismatch if the port doesn't satisfy it.
+type PortMatcher func(port *discovery.Port) error
+
+// AnyPort matches any port.
+func AnyPort() PortMatcher {
+	return func(port *discovery.Port) error {
+		return nil
+	}
+}
+
+// PortWithAddress matches the ports with the given protocol and address.
+func PortWithAddress(protocol, address string) PortMatcher {
+	return func(port *discovery.Port) error {
+		if port.Protocol != protocol || port.Address != address {
+			return fmt.Errorf("expected port %s://%s", protocol, address)
+		}
+		return nil
+	}
+}
+
+// PortWithProperty matches the ports having the given property value.
+func PortWithProperty(key, value string) PortMatcher {
+	return func(port *discovery.Port) error {
+		if port.Properties == nil || port.Properties.Get(key) != value {
+			return fmt.Errorf("expected property %s=%s", key, value)
+		}
+		return nil
+	}
+}
+
+// AllOf matches the ports satisfying all the given matchers.
+func AllOf(matchers ...PortMatcher) PortMatcher {
+	return func(port *discovery.Port) error {
+		for _, match := range matchers {
+			if err := match(port); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
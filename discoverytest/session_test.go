@@ -0,0 +1,87 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discoverytest
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type testDiscovery struct{}
+
+func (d *testDiscovery) Hello(userAgent string, protocolVersion int) error { return nil }
+
+func (d *testDiscovery) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	go func() {
+		eventCB("add", &discovery.Port{Address: "1", Protocol: "test"})
+		eventCB("remove", &discovery.Port{Address: "1", Protocol: "test"})
+	}()
+	return nil
+}
+
+func (d *testDiscovery) Stop() error { return nil }
+
+func (d *testDiscovery) Quit() {}
+
+func newTestSession(t *testing.T) *Session {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go func() {
+		_ = discovery.NewServer(&testDiscovery{}).Run(inR, outW)
+		outW.Close()
+	}()
+	s := NewSession(t, inW, outR)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSession(t *testing.T) {
+	s := newTestSession(t)
+	s.Send("START")
+	s.ExpectEvent("command_error", WithError("First command must be HELLO, but got 'START'"), WithCode(discovery.ErrorCodeNotInitialized))
+	s.Send(`HELLO 1 "test"`)
+	s.ExpectEvent("hello", WithOK(), WithProtocolVersion(1))
+	s.Send("START_SYNC")
+	s.ExpectEvent("start_sync", WithOK())
+	port := s.ExpectPortAdded(PortWithAddress("test", "1"))
+	require.Equal(t, "1", port.Address)
+	s.ExpectPortRemoved(AnyPort())
+	s.ExpectNoEvent(10 * time.Millisecond)
+	s.Send("STOP")
+	s.ExpectEvent("stop", WithOK())
+	s.Send("QUIT")
+	s.ExpectEvent("quit", WithOK())
+}
+
+func TestMatchers(t *testing.T) {
+	port := &discovery.Port{Address: "1", Protocol: "test"}
+	require.NoError(t, PortWithAddress("test", "1")(port))
+	require.Error(t, PortWithAddress("serial", "1")(port))
+	require.Error(t, PortWithProperty("vid", "0x2341")(port))
+	require.Error(t, AllOf(AnyPort(), PortWithAddress("test", "2"))(port))
+
+	require.NoError(t, WithOK()(&Event{Message: "OK"}))
+	require.Error(t, WithOK()(&Event{Message: "OK", Error: true}))
+	require.NoError(t, WithError("")(&Event{Message: "failed", Error: true}))
+	require.Error(t, WithError("other")(&Event{Message: "failed", Error: true}))
+	require.Error(t, WithProtocolVersion(2)(&Event{ProtocolVersion: 1}))
+}
@@ -20,7 +20,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/arduino/go-properties-orderedmap"
@@ -39,11 +38,7 @@ type dummyDiscovery struct {
 
 func main() {
 	args.Parse()
-	dummy := &dummyDiscovery{}
-	server := discovery.NewServer(dummy)
-	if err := server.Run(os.Stdin, os.Stdout); err != nil {
-		os.Exit(1)
-	}
+	discovery.RunDiscovery(&dummyDiscovery{})
 }
 
 // Hello does nothing.
@@ -0,0 +1,54 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery_test
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/arduino/pluggable-discovery-protocol-handler/v2/discoverytest"
+	"github.com/stretchr/testify/require"
+)
+
+func buildDummyDiscovery(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+}
+
+func TestDisc(t *testing.T) {
+	buildDummyDiscovery(t)
+	s := discoverytest.Launch(t, "./dummy-discovery/dummy-discovery")
+
+	// Check that discovery is able to handle an "hello" without parameters gracefully
+	// https://github.com/arduino/pluggable-discovery-protocol-handler/issues/32
+	s.Send("hello")
+	s.ExpectEvent("hello", discoverytest.WithError("Invalid HELLO command"), discoverytest.WithCode(discovery.ErrorCodeInvalidCommand))
+
+	s.Send("quit")
+	s.ExpectEvent("quit", discoverytest.WithOK())
+}
+
+func TestDummyDiscoveryTranscript(t *testing.T) {
+	buildDummyDiscovery(t)
+	s := discoverytest.Launch(t, "./dummy-discovery/dummy-discovery")
+	transcript := s.Transcript(`HELLO 1 "test"`, "START_SYNC", "STOP", "QUIT")
+	discoverytest.AssertGolden(t, "testdata/dummy-discovery.golden", transcript)
+}
@@ -0,0 +1,104 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// ErrorCode is a machine-readable code sent along with the error messages of
+// the protocol, in the optional "code" field, so that the clients may
+// distinguish the kind of failures without parsing the messages.
+//
+// An ErrorCode is an error itself: a Discovery implementation may wrap it in
+// the errors it returns to report the code to the client, for example:
+//
+//	return fmt.Errorf("%w: cannot open %s", discovery.ErrorCodePermissionDenied, path)
+//
+// On the client side the errors returned by the commands can be matched with
+// errors.Is(err, discovery.ErrorCodePermissionDenied).
+type ErrorCode string
+
+// The standard error codes.
+const (
+	// ErrorCodeInvalidCommand is sent when a command is malformed or not supported.
+	ErrorCodeInvalidCommand ErrorCode = "invalid_command"
+	// ErrorCodeNotInitialized is sent when a command is received before HELLO.
+	ErrorCodeNotInitialized ErrorCode = "not_initialized"
+	// ErrorCodeNotStarted is sent when a command requires the discovery to be
+	// STARTed or START_SYNCed.
+	ErrorCodeNotStarted ErrorCode = "not_started"
+	// ErrorCodeInvalidState is sent when a command is not allowed in the
+	// current state of the discovery, for example a START when already started.
+	ErrorCodeInvalidState ErrorCode = "invalid_state"
+	// ErrorCodeUnauthorized is sent when the authentication token is not valid.
+	ErrorCodeUnauthorized ErrorCode = "unauthorized"
+	// ErrorCodeBusy is sent when the discovery is serving another client.
+	ErrorCodeBusy ErrorCode = "busy"
+	// ErrorCodePermissionDenied is sent when the discovery lacks the
+	// permissions to access the hardware or the system resources.
+	ErrorCodePermissionDenied ErrorCode = "permission_denied"
+	// ErrorCodeHardwareFailure is sent when the discovery can't communicate
+	// with the hardware.
+	ErrorCodeHardwareFailure ErrorCode = "hardware_failure"
+	// ErrorCodeInternal is sent when the discovery fails for any other reason.
+	ErrorCodeInternal ErrorCode = "internal_error"
+)
+
+func (c ErrorCode) Error() string {
+	return string(c)
+}
+
+// errorCode returns the ErrorCode to be sent for the given error returned by
+// the Discovery implementation.
+func errorCode(err error) ErrorCode {
+	var code ErrorCode
+	if errors.As(err, &code) {
+		return code
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return ErrorCodePermissionDenied
+	}
+	return ErrorCodeInternal
+}
+
+// CommandError is the error returned by the Client when the discovery
+// replies with an error to a command.
+type CommandError struct {
+	// Command is the command that failed, for example "START_SYNC".
+	Command string
+	// Code is the error code sent by the discovery, it may be empty if the
+	// discovery doesn't support error codes.
+	Code ErrorCode
+	// Message is the error message sent by the discovery.
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return "command failed: " + e.Message
+}
+
+// Unwrap returns the ErrorCode of the error, if any, so that the error can
+// be matched with errors.Is.
+func (e *CommandError) Unwrap() error {
+	if e.Code == "" {
+		return nil
+	}
+	return e.Code
+}
@@ -0,0 +1,41 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCode(t *testing.T) {
+	require.Equal(t, ErrorCodeHardwareFailure, errorCode(fmt.Errorf("%w: device not responding", ErrorCodeHardwareFailure)))
+	require.Equal(t, ErrorCodePermissionDenied, errorCode(&fs.PathError{Op: "open", Path: "/dev/ttyACM0", Err: fs.ErrPermission}))
+	require.Equal(t, ErrorCodeInternal, errorCode(errors.New("generic error")))
+
+	err := &CommandError{Command: "START_SYNC", Code: ErrorCodePermissionDenied, Message: "Cannot START_SYNC: permission denied"}
+	require.EqualError(t, err, "command failed: Cannot START_SYNC: permission denied")
+	require.ErrorIs(t, err, ErrorCodePermissionDenied)
+	require.NotErrorIs(t, err, ErrorCodeHardwareFailure)
+
+	// Errors from discoveries not supporting the error codes
+	require.NoError(t, (&CommandError{Message: "failure"}).Unwrap())
+}
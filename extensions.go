@@ -0,0 +1,202 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// The unknown fields of the ports and of the messages are kept as a JSON
+// object, the extensions, to be sent again when they are encoded. The
+// following helpers, working on the raw JSON objects, implement them.
+
+// appendJSONMembers appends the members of the extensions, whose key is
+// not in known, to the JSON object in data.
+func appendJSONMembers(data []byte, extensions json.RawMessage, known map[string]bool) ([]byte, error) {
+	if len(extensions) == 0 {
+		return data, nil
+	}
+	// Append the members before the closing brace
+	res := data[:len(data)-1]
+	empty := len(res) == 1
+	err := forEachJSONMember(extensions, func(key, value []byte) error {
+		if known[string(key)] {
+			// The known fields can't be overridden
+			return nil
+		}
+		if !empty {
+			res = append(res, ',')
+		}
+		empty = false
+		res = append(res, key...)
+		res = append(res, ':')
+		res = append(res, value...)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("invalid extensions: " + err.Error())
+	}
+	return append(res, '}'), nil
+}
+
+// unknownJSONMembers returns a JSON object with the members of the given
+// object whose key is not in known, or nil if there are none. The returned
+// object doesn't share memory with data.
+func unknownJSONMembers(data []byte, known map[string]bool) (json.RawMessage, error) {
+	var res []byte
+	err := forEachJSONMember(data, func(key, value []byte) error {
+		if known[string(key)] {
+			return nil
+		}
+		if res == nil {
+			res = append(res, '{')
+		} else {
+			res = append(res, ',')
+		}
+		res = append(res, key...)
+		res = append(res, ':')
+		res = append(res, value...)
+		return nil
+	})
+	if err != nil || res == nil {
+		return nil, err
+	}
+	return append(res, '}'), nil
+}
+
+// errJSONScan is returned by forEachJSONMember for the malformed objects.
+var errJSONScan = errors.New("malformed JSON object")
+
+// forEachJSONMember calls f with the quoted key and the value of each member
+// of the given JSON object, in order. It's a lightweight scanner: the values
+// are not validated, data must have been already validated.
+func forEachJSONMember(data []byte, f func(key, value []byte) error) error {
+	i := skipJSONSpaces(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return errJSONScan
+	}
+	i = skipJSONSpaces(data, i+1)
+	if i < len(data) && data[i] == '}' {
+		return nil
+	}
+	for {
+		if i >= len(data) || data[i] != '"' {
+			return errJSONScan
+		}
+		keyEnd := skipJSONValue(data, i)
+		key := data[i:keyEnd]
+		i = skipJSONSpaces(data, keyEnd)
+		if i >= len(data) || data[i] != ':' {
+			return errJSONScan
+		}
+		start := skipJSONSpaces(data, i+1)
+		end := skipJSONValue(data, start)
+		if end <= start {
+			return errJSONScan
+		}
+		if err := f(key, data[start:end]); err != nil {
+			return err
+		}
+		i = skipJSONSpaces(data, end)
+		if i >= len(data) {
+			return errJSONScan
+		}
+		switch data[i] {
+		case '}':
+			return nil
+		case ',':
+			i = skipJSONSpaces(data, i+1)
+		default:
+			return errJSONScan
+		}
+	}
+}
+
+func skipJSONSpaces(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipJSONValue returns the position after the JSON value starting at i.
+func skipJSONValue(data []byte, i int) int {
+	if i >= len(data) {
+		return i
+	}
+	switch data[i] {
+	case '"':
+		for i++; i < len(data); i++ {
+			switch data[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				i = skipJSONValue(data, i)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+	default:
+		// A number or a literal
+		for i < len(data) && !isJSONDelimiter(data[i]) {
+			i++
+		}
+		return i
+	}
+	return len(data)
+}
+
+func isJSONDelimiter(c byte) bool {
+	switch c {
+	case ',', ':', '}', ']', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return false
+}
+
+// unquoteJSONString decodes the given JSON string, without the overhead of
+// json.Unmarshal for the strings without escapes.
+func unquoteJSONString(data []byte) (string, error) {
+	if len(data) >= 2 && data[0] == '"' && data[len(data)-1] == '"' && bytes.IndexByte(data, '\\') < 0 {
+		return string(data[1 : len(data)-1]), nil
+	}
+	var res string
+	err := json.Unmarshal(data, &res)
+	return res, err
+}
@@ -0,0 +1,104 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func FuzzServerCommand(f *testing.F) {
+	for _, seed := range []string{
+		"HELLO 1 \"arduino-cli\"",
+		"HELLO 1 \"arduino-cli\" \"token\"",
+		"hello",
+		"HELLO ",
+		"HELLO 1",
+		"HELLO 1 \"",
+		"HELLO 1 \"x\"\"y\"",
+		"HELLO 1 \"ツール 🤖\"",
+		"HELLO 99999999999999999999 \"x\"",
+		"HELLO 1 \"x\"\nSTART\nLIST\nSTOP",
+		"HELLO 1 \"x\"\nSTART_SYNC\nSTOP\nSTART_SYNC",
+		"START",
+		"\xff\xfe",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		out := &bytes.Buffer{}
+		server := NewServer(&testDiscovery{})
+		if err := server.Run(strings.NewReader(input+"\nQUIT\n"), out); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The output must be a sequence of well-formed messages
+		decoder := json.NewDecoder(out)
+		for decoder.More() {
+			var msg message
+			if err := decoder.Decode(&msg); err != nil {
+				t.Fatalf("invalid output: %s", err)
+			}
+			if msg.EventType == "" {
+				t.Fatalf("message without eventType")
+			}
+		}
+	})
+}
+
+func FuzzClientMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"eventType":"hello","message":"OK","protocolVersion":1}`,
+		`{"eventType":"add","port":{"address":"1","protocol":"test","properties":{"a":"b"}}}`,
+		`{"eventType":"remove","port":{"address":"1"}}`,
+		`{"eventType":"add"}`,
+		`{"eventType":"list","ports":[{"address":"1"},null]}`,
+		`{"eventType":1}`,
+		`{"eventType":"add","port":{"hardwareIds":[1]}} garbage {"eventType":"quit"}`,
+		`{`,
+	} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	f.Fuzz(func(t *testing.T, input string, recovery bool) {
+		disc := NewClient("fuzz")
+		disc.SetDecodeRecovery(recovery)
+		disc.statusMutex.Lock()
+		events := disc.openEventChan(100)
+		disc.statusMutex.Unlock()
+		outChan := make(chan *message)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for msg := range outChan {
+				for _, port := range msg.Ports {
+					if port == nil {
+						t.Errorf("nil port in %q message", msg.EventType)
+					}
+				}
+			}
+		}()
+		go func() {
+			for range events {
+			}
+		}()
+		disc.jsonDecodeLoop(strings.NewReader(input), outChan, disc.session)
+		<-done
+	})
+}
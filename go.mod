@@ -8,10 +8,12 @@ require (
 	github.com/arduino/go-paths-helper v1.10.0
 	github.com/arduino/go-properties-orderedmap v1.8.0
 	github.com/stretchr/testify v1.8.4
+	go.uber.org/goleak v1.3.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
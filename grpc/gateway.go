@@ -0,0 +1,223 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package grpc provides a gRPC service exposing the ports detected by the
+// discoveries of a discovery.Manager, so that services written in other
+// languages can consume them through a well-typed API. The protobuf
+// definition of the service is in the rpc folder.
+package grpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	rpc "github.com/arduino/pluggable-discovery-protocol-handler/v2/grpc/rpc/cc/arduino/discovery/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// streamBacklog is the number of events that can be queued for a StartSync
+// stream, slower streams are terminated.
+const streamBacklog = 100
+
+// Gateway is the implementation of the DiscoveryService backed by a
+// discovery.Manager. It must be registered in a grpc.Server with
+// rpc.RegisterDiscoveryServiceServer.
+type Gateway struct {
+	rpc.UnimplementedDiscoveryServiceServer
+	manager *discovery.Manager
+
+	mutex   sync.Mutex
+	ports   *discovery.PortTracker
+	streams map[chan *rpc.StartSyncResponse]struct{}
+	running bool
+}
+
+// NewGateway creates a new Gateway for the given Manager. The Gateway must
+// be started with Start.
+func NewGateway(manager *discovery.Manager) *Gateway {
+	return &Gateway{
+		manager: manager,
+		ports:   discovery.NewPortTracker(),
+		streams: map[chan *rpc.StartSyncResponse]struct{}{},
+	}
+}
+
+// Start puts the discoveries of the Manager in "events" mode and starts
+// tracking the available ports. The discoveries that fail to start are
+// reported in the returned error.
+func (g *Gateway) Start() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.running {
+		return errors.New("gateway already started")
+	}
+	events, errs := g.manager.StartSync(streamBacklog)
+	g.running = true
+	go g.forwardEvents(events)
+	return errors.Join(errs...)
+}
+
+func (g *Gateway) forwardEvents(events <-chan *discovery.Event) {
+	for ev := range events {
+		g.mutex.Lock()
+		g.ports.Track(ev)
+		msg := eventToRPC(ev)
+		for stream := range g.streams {
+			g.sendLocked(stream, msg)
+		}
+		g.mutex.Unlock()
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.running = false
+	g.ports.Clear()
+	for stream := range g.streams {
+		delete(g.streams, stream)
+		close(stream)
+	}
+}
+
+// sendLocked queues the event for the given stream, if the stream is too
+// slow it's terminated. mutex must be held by the caller.
+func (g *Gateway) sendLocked(stream chan *rpc.StartSyncResponse, msg *rpc.StartSyncResponse) {
+	select {
+	case stream <- msg:
+	default:
+		delete(g.streams, stream)
+		close(stream)
+	}
+}
+
+// List returns the ports currently available.
+func (g *Gateway) List(ctx context.Context, req *rpc.ListRequest) (*rpc.ListResponse, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.running {
+		return nil, status.Error(codes.FailedPrecondition, "discovery not running")
+	}
+	res := &rpc.ListResponse{Ports: []*rpc.Port{}}
+	for _, discoveryID := range g.ports.DiscoveryIDs() {
+		for _, port := range g.ports.Ports(discoveryID) {
+			res.Ports = append(res.Ports, PortToRPC(port))
+		}
+	}
+	return res, nil
+}
+
+// StartSync streams the ports currently available, as "add" events,
+// followed by the events received from the discoveries. The stream is
+// terminated when the discoveries are stopped.
+func (g *Gateway) StartSync(req *rpc.StartSyncRequest, stream rpc.DiscoveryService_StartSyncServer) error {
+	events := make(chan *rpc.StartSyncResponse, streamBacklog)
+	g.mutex.Lock()
+	if !g.running {
+		g.mutex.Unlock()
+		return status.Error(codes.FailedPrecondition, "discovery not running")
+	}
+	initial := []*rpc.StartSyncResponse{}
+	for _, discoveryID := range g.ports.DiscoveryIDs() {
+		for _, port := range g.ports.Ports(discoveryID) {
+			initial = append(initial, &rpc.StartSyncResponse{
+				EventType:   "add",
+				DiscoveryId: discoveryID,
+				Port:        PortToRPC(port),
+			})
+		}
+	}
+	g.streams[events] = struct{}{}
+	g.mutex.Unlock()
+	defer g.unsubscribe(events)
+
+	for _, msg := range initial {
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// Stop stops the discoveries of the Manager, all the StartSync streams are
+// terminated.
+func (g *Gateway) Stop(ctx context.Context, req *rpc.StopRequest) (*rpc.StopResponse, error) {
+	if err := errors.Join(g.manager.Stop()...); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &rpc.StopResponse{}, nil
+}
+
+func (g *Gateway) unsubscribe(events chan *rpc.StartSyncResponse) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.streams[events]; ok {
+		delete(g.streams, events)
+		close(events)
+	}
+}
+
+// PortToRPC converts a discovery.Port to its protobuf representation.
+func PortToRPC(port *discovery.Port) *rpc.Port {
+	if port == nil {
+		return nil
+	}
+	res := &rpc.Port{
+		Address:       port.Address,
+		Label:         port.AddressLabel,
+		Protocol:      port.Protocol,
+		ProtocolLabel: port.ProtocolLabel,
+		HardwareId:    port.HardwareID,
+		HardwareIds:   port.HardwareIDs,
+		ContainerId:   port.ContainerID,
+	}
+	if port.Properties != nil {
+		res.Properties = port.Properties.AsMap()
+	}
+	return res
+}
+
+func eventToRPC(ev *discovery.Event) *rpc.StartSyncResponse {
+	res := &rpc.StartSyncResponse{
+		EventType:   ev.Type,
+		DiscoveryId: ev.DiscoveryID,
+		Port:        PortToRPC(ev.Port),
+		OldPort:     PortToRPC(ev.OldPort),
+		Seq:         ev.Seq,
+	}
+	for _, port := range ev.Ports {
+		res.Ports = append(res.Ports, PortToRPC(port))
+	}
+	if !ev.Timestamp.IsZero() {
+		res.Timestamp = timestamppb.New(ev.Timestamp)
+	}
+	return res
+}
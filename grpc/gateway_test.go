@@ -0,0 +1,165 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package grpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	rpc "github.com/arduino/pluggable-discovery-protocol-handler/v2/grpc/rpc/cc/arduino/discovery/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testDiscovery struct{}
+
+func (d *testDiscovery) Hello(userAgent string, protocolVersion int) error { return nil }
+func (d *testDiscovery) Stop() error                                       { return nil }
+func (d *testDiscovery) Quit()                                             {}
+func (d *testDiscovery) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	go eventCB("add", &discovery.Port{Address: "/dev/ttyACM0", Protocol: "serial"})
+	return nil
+}
+
+// newTestClient returns a discovery.Client connected to an in-process
+// discovery.Server.
+func newTestClient(id string) *discovery.Client {
+	return discovery.NewConnClient(id, func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go func() {
+			_ = discovery.NewServer(&testDiscovery{}).Run(server, server)
+			server.Close()
+		}()
+		return client, nil
+	})
+}
+
+func TestGateway(t *testing.T) {
+	manager := discovery.NewManager()
+	require.NoError(t, manager.Add(newTestClient("a")))
+	require.NoError(t, manager.Add(newTestClient("b")))
+	defer manager.Quit()
+	gateway := NewGateway(manager)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	rpc.RegisterDiscoveryServiceServer(server, gateway)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := rpc.NewDiscoveryServiceClient(conn)
+	ctx := context.Background()
+
+	_, err = client.List(ctx, &rpc.ListRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	require.NoError(t, gateway.Start())
+	require.Error(t, gateway.Start())
+
+	stream, err := client.StartSync(ctx, &rpc.StartSyncRequest{})
+	require.NoError(t, err)
+	received := map[string]string{}
+	for len(received) < 2 {
+		ev, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "add", ev.GetEventType())
+		received[ev.GetDiscoveryId()] = ev.GetPort().GetAddress()
+	}
+	require.Equal(t, map[string]string{"a": "/dev/ttyACM0", "b": "/dev/ttyACM0"}, received)
+
+	list, err := client.List(ctx, &rpc.ListRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetPorts(), 2)
+	require.Equal(t, "serial", list.GetPorts()[0].GetProtocol())
+
+	// A new stream receives the ports already available
+	stream2, err := client.StartSync(ctx, &rpc.StartSyncRequest{})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		ev, err := stream2.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "add", ev.GetEventType())
+	}
+
+	_, err = client.Stop(ctx, &rpc.StopRequest{})
+	require.NoError(t, err)
+	for _, s := range []rpc.DiscoveryService_StartSyncClient{stream, stream2} {
+		for {
+			ev, err := s.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.Equal(t, "stop", ev.GetEventType())
+		}
+	}
+}
+
+func TestGatewayTracking(t *testing.T) {
+	gateway := NewGateway(discovery.NewManager())
+	gateway.running = true
+	list := func() []string {
+		res, err := gateway.List(context.Background(), &rpc.ListRequest{})
+		require.NoError(t, err)
+		addresses := []string{}
+		for _, port := range res.GetPorts() {
+			addresses = append(addresses, port.GetAddress())
+		}
+		return addresses
+	}
+
+	acm0 := &discovery.Port{Address: "/dev/ttyACM0", Protocol: "serial"}
+	acm1 := &discovery.Port{Address: "/dev/ttyACM1", Protocol: "serial"}
+	gateway.ports.Track(&discovery.Event{Type: "add", DiscoveryID: "serial", Port: acm0})
+	require.Equal(t, []string{"/dev/ttyACM0"}, list())
+
+	moved := &discovery.Event{Type: "moved", DiscoveryID: "serial", Port: acm1, OldPort: acm0}
+	gateway.ports.Track(moved)
+	require.Equal(t, []string{"/dev/ttyACM1"}, list())
+	msg := eventToRPC(moved)
+	require.Equal(t, "/dev/ttyACM1", msg.GetPort().GetAddress())
+	require.Equal(t, "/dev/ttyACM0", msg.GetOldPort().GetAddress())
+
+	gateway.ports.Track(&discovery.Event{Type: "resynced", DiscoveryID: "serial"})
+	require.Empty(t, list())
+}
+
+func TestPortToRPC(t *testing.T) {
+	require.Nil(t, PortToRPC(nil))
+	port := &discovery.Port{
+		Address:     "/dev/ttyACM0",
+		Protocol:    "serial",
+		HardwareIDs: []string{"123", "456"},
+	}
+	res := PortToRPC(port)
+	require.Equal(t, "/dev/ttyACM0", res.GetAddress())
+	require.Equal(t, []string{"123", "456"}, res.GetHardwareIds())
+	require.Empty(t, res.GetProperties())
+}
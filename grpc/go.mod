@@ -0,0 +1,25 @@
+module github.com/arduino/pluggable-discovery-protocol-handler/v2/grpc
+
+go 1.21
+
+require (
+	github.com/arduino/pluggable-discovery-protocol-handler/v2 v2.2.0
+	github.com/stretchr/testify v1.8.4
+	google.golang.org/grpc v1.64.1
+	google.golang.org/protobuf v1.34.2
+)
+
+require (
+	github.com/arduino/go-paths-helper v1.10.0 // indirect
+	github.com/arduino/go-properties-orderedmap v1.8.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/arduino/pluggable-discovery-protocol-handler/v2 => ../
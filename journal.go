@@ -0,0 +1,181 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// Journal records the events of a Client or a Manager as newline-delimited
+// JSON, one record per line. A journal can be read back with ReplayJournal,
+// for post-mortem analysis or to build deterministic tests from real-world
+// captures.
+type Journal struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	closer   io.Closer
+	err      error
+	redactor *Redactor
+	index    *JournalIndex
+}
+
+// journalRecord is a line of the journal.
+type journalRecord struct {
+	Time        time.Time       `json:"time"`
+	DiscoveryID string          `json:"discoveryId"`
+	EventType   string          `json:"eventType"`
+	Seq         uint64          `json:"seq,omitempty"`
+	Port        *Port           `json:"port,omitempty"`
+	Ports       []*Port         `json:"ports,omitempty"`
+	OldPort     *Port           `json:"oldPort,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Extensions  json.RawMessage `json:"extensions,omitempty"`
+}
+
+// NewJournal creates a Journal that writes the records to the given writer.
+func NewJournal(out io.Writer) *Journal {
+	return &Journal{out: out}
+}
+
+// OpenJournal opens the journal file at the given path, creating it if
+// needed. The records are appended to the existing ones.
+func OpenJournal(path *paths.Path) (*Journal, error) {
+	f, err := os.OpenFile(path.String(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{out: f, closer: f}, nil
+}
+
+// SetRedactor sets the Redactor used to mask the sensitive data of the ports
+// before they are recorded.
+func (j *Journal) SetRedactor(redactor *Redactor) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.redactor = redactor
+}
+
+// SetIndex sets a JournalIndex where the recorded events are added, to
+// query them without reading back the journal.
+func (j *Journal) SetIndex(index *JournalIndex) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.index = index
+}
+
+// Record appends the given event to the journal. Once a write fails all the
+// following records are discarded and the error is returned by Err.
+func (j *Journal) Record(ev *Event) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.err != nil {
+		return
+	}
+	timestamp := ev.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	record := &journalRecord{
+		Time:        timestamp,
+		DiscoveryID: ev.DiscoveryID,
+		EventType:   ev.Type,
+		Seq:         ev.Seq,
+		Port:        j.redactor.Redact(ev.Port),
+		Ports:       j.redactor.RedactAll(ev.Ports),
+		OldPort:     j.redactor.Redact(ev.OldPort),
+		Error:       ev.Error,
+		Extensions:  ev.Extensions,
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		_, err = j.out.Write(append(data, '\n'))
+	}
+	j.err = err
+	if err == nil && j.index != nil {
+		j.index.Add(record.event())
+	}
+}
+
+// Err returns the first error occurred writing the journal, if any.
+func (j *Journal) Err() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.err
+}
+
+// Close closes the journal file, if opened with OpenJournal.
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.closer == nil {
+		return nil
+	}
+	return j.closer.Close()
+}
+
+// ReplayJournal reads the journal at the given path and delivers the
+// recorded events in the returned channel, that is closed at the end of
+// the journal. The malformed lines, like a truncated last line after a
+// crash, are skipped.
+func ReplayJournal(path *paths.Path) (<-chan *Event, error) {
+	f, err := path.Open()
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan *Event, 10)
+	go func() {
+		defer f.Close()
+		readJournal(f, events)
+	}()
+	return events, nil
+}
+
+func readJournal(in io.Reader, events chan<- *Event) {
+	defer close(events)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.EventType == "" {
+			continue
+		}
+		events <- record.event()
+	}
+}
+
+// event returns the Event recorded in the journal line.
+func (record *journalRecord) event() *Event {
+	return &Event{
+		Type:        record.EventType,
+		Port:        record.Port,
+		Ports:       record.Ports,
+		OldPort:     record.OldPort,
+		Error:       record.Error,
+		DiscoveryID: record.DiscoveryID,
+		Seq:         record.Seq,
+		Timestamp:   record.Time,
+		Extensions:  record.Extensions,
+	}
+}
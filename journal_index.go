@@ -0,0 +1,123 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// JournalIndex keeps the events of a journal indexed by time and by hardware
+// identifier, to answer the diagnostic queries (what changed since a given
+// time, when a board appeared or disappeared) without replaying the whole
+// journal. An index can be loaded from a journal file with LoadJournalIndex
+// or kept up to date with the live events using Journal.SetIndex.
+type JournalIndex struct {
+	mutex        sync.Mutex
+	events       []*Event
+	byHardwareID map[string][]*Event
+}
+
+// NewJournalIndex creates an empty JournalIndex.
+func NewJournalIndex() *JournalIndex {
+	return &JournalIndex{byHardwareID: map[string][]*Event{}}
+}
+
+// LoadJournalIndex reads the journal at the given path and returns the index
+// of the recorded events. The malformed lines are skipped as in ReplayJournal.
+func LoadJournalIndex(path *paths.Path) (*JournalIndex, error) {
+	events, err := ReplayJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	index := NewJournalIndex()
+	for ev := range events {
+		index.Add(ev)
+	}
+	return index, nil
+}
+
+// Add adds the given event to the index. The events are kept sorted by
+// Timestamp, the events with the same Timestamp in the order they are added.
+func (index *JournalIndex) Add(ev *Event) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.events = insertByTime(index.events, ev)
+	for _, id := range eventHardwareIDs(ev) {
+		index.byHardwareID[id] = insertByTime(index.byHardwareID[id], ev)
+	}
+}
+
+// Len returns the number of indexed events.
+func (index *JournalIndex) Len() int {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return len(index.events)
+}
+
+// EventsSince returns the events with a Timestamp equal to or after the given
+// time, in chronological order.
+func (index *JournalIndex) EventsSince(t time.Time) []*Event {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	i := sort.Search(len(index.events), func(i int) bool { return !index.events[i].Timestamp.Before(t) })
+	return append([]*Event{}, index.events[i:]...)
+}
+
+// HistoryForHardwareID returns, in chronological order, the events involving
+// a port with the given hardware identifier: the "add", "remove" and "moved"
+// events of the port (both the old and the new port are considered for the
+// "moved" events) and the "snapshot" events listing it.
+func (index *JournalIndex) HistoryForHardwareID(id string) []*Event {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return append([]*Event{}, index.byHardwareID[id]...)
+}
+
+// insertByTime inserts the event in the slice sorted by Timestamp, after the
+// events with the same Timestamp.
+func insertByTime(events []*Event, ev *Event) []*Event {
+	i := sort.Search(len(events), func(i int) bool { return events[i].Timestamp.After(ev.Timestamp) })
+	events = append(events, nil)
+	copy(events[i+1:], events[i:])
+	events[i] = ev
+	return events
+}
+
+// eventHardwareIDs returns the hardware identifiers of all the ports of the
+// event, without duplicates.
+func eventHardwareIDs(ev *Event) []string {
+	ports := append([]*Port{ev.Port, ev.OldPort}, ev.Ports...)
+	res := []string{}
+	seen := map[string]bool{}
+	for _, port := range ports {
+		if port == nil {
+			continue
+		}
+		for _, id := range port.AllHardwareIDs() {
+			if !seen[id] {
+				seen[id] = true
+				res = append(res, id)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,139 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+type failingWriter struct{}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestJournal(t *testing.T) {
+	out := &bytes.Buffer{}
+	journal := NewJournal(out)
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	journal.Record(&Event{Type: "add", DiscoveryID: "serial", Seq: 1, Timestamp: timestamp, Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial"}, Extensions: json.RawMessage(`{"priority":1}`)})
+	journal.Record(&Event{Type: "snapshot", DiscoveryID: "mdns", Ports: []*Port{{Address: "192.168.1.2", Protocol: "network"}}})
+	journal.Record(&Event{Type: "stop", DiscoveryID: "serial", Seq: 2, Timestamp: timestamp, Error: "EOF"})
+	require.NoError(t, journal.Err())
+	require.NoError(t, journal.Close())
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, `{"time":"2024-01-02T03:04:05Z","discoveryId":"serial","eventType":"add","seq":1,"port":{"address":"/dev/ttyACM0","protocol":"serial"},"extensions":{"priority":1}}`, lines[0])
+
+	// Malformed lines are skipped
+	path := paths.New(t.TempDir(), "journal.ndjson")
+	require.NoError(t, path.WriteFile([]byte(out.String()+"\n{}\n{\"time\":\"2024-01-02T03:04:05Z\",\"disc")))
+	events, err := ReplayJournal(path)
+	require.NoError(t, err)
+	ev := <-events
+	require.Equal(t, "add", ev.Type)
+	require.Equal(t, "serial", ev.DiscoveryID)
+	require.Equal(t, uint64(1), ev.Seq)
+	require.True(t, timestamp.Equal(ev.Timestamp))
+	require.Equal(t, "/dev/ttyACM0", ev.Port.Address)
+	require.Equal(t, `{"priority":1}`, string(ev.Extensions))
+	ev = <-events
+	require.Equal(t, "snapshot", ev.Type)
+	require.Len(t, ev.Ports, 1)
+	require.False(t, ev.Timestamp.IsZero())
+	ev = <-events
+	require.Equal(t, "stop", ev.Type)
+	require.Equal(t, "EOF", ev.Error)
+	_, ok := <-events
+	require.False(t, ok)
+
+	_, err = ReplayJournal(paths.New(t.TempDir(), "missing"))
+	require.Error(t, err)
+
+	// Ports are masked by the Redactor before being recorded
+	out.Reset()
+	journal = NewJournal(out)
+	journal.SetRedactor(NewRedactor().MaskAddress(nil))
+	journal.Record(&Event{Type: "add", DiscoveryID: "serial", Timestamp: timestamp, Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial"}})
+	require.Equal(t, `{"time":"2024-01-02T03:04:05Z","discoveryId":"serial","eventType":"add","port":{"address":"****","protocol":"serial"}}`, strings.TrimSpace(out.String()))
+
+	// Write errors are reported
+	journal = NewJournal(&failingWriter{})
+	journal.Record(&Event{Type: "add"})
+	require.EqualError(t, journal.Err(), "disk full")
+}
+
+func TestJournalIndex(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	board := &Port{Address: "/dev/ttyACM0", Protocol: "serial", HardwareID: "SN1"}
+	moved := &Port{Address: "/dev/ttyACM1", Protocol: "serial", HardwareID: "SN1", HardwareIDs: []string{"ALT1"}}
+	other := &Port{Address: "192.168.1.2", Protocol: "network", HardwareID: "SN2"}
+
+	out := &bytes.Buffer{}
+	journal := NewJournal(out)
+	live := NewJournalIndex()
+	journal.SetIndex(live)
+	journal.Record(&Event{Type: "add", DiscoveryID: "serial", Timestamp: t0, Port: board})
+	journal.Record(&Event{Type: "snapshot", DiscoveryID: "mdns", Timestamp: t0.Add(time.Second), Ports: []*Port{other}})
+	journal.Record(&Event{Type: "moved", DiscoveryID: "serial", Timestamp: t0.Add(3 * time.Second), Port: moved, OldPort: board})
+	// Out of order events are sorted by time
+	journal.Record(&Event{Type: "remove", DiscoveryID: "serial", Timestamp: t0.Add(2 * time.Second), Port: board})
+	journal.Record(&Event{Type: "stop", DiscoveryID: "serial", Timestamp: t0.Add(4 * time.Second)})
+	require.NoError(t, journal.Err())
+
+	path := paths.New(t.TempDir(), "journal.ndjson")
+	require.NoError(t, path.WriteFile(out.Bytes()))
+	loaded, err := LoadJournalIndex(path)
+	require.NoError(t, err)
+
+	types := func(events []*Event) []string {
+		res := []string{}
+		for _, ev := range events {
+			res = append(res, ev.Type)
+		}
+		return res
+	}
+	for _, index := range []*JournalIndex{live, loaded} {
+		require.Equal(t, 5, index.Len())
+		require.Equal(t, []string{"add", "snapshot", "remove", "moved", "stop"}, types(index.EventsSince(time.Time{})))
+		require.Equal(t, []string{"remove", "moved", "stop"}, types(index.EventsSince(t0.Add(2*time.Second))))
+		require.Empty(t, index.EventsSince(t0.Add(time.Hour)))
+		require.Equal(t, []string{"add", "remove", "moved"}, types(index.HistoryForHardwareID("SN1")))
+		require.Equal(t, []string{"moved"}, types(index.HistoryForHardwareID("ALT1")))
+		require.Equal(t, []string{"snapshot"}, types(index.HistoryForHardwareID("SN2")))
+		require.Empty(t, index.HistoryForHardwareID("SN3"))
+	}
+	history := loaded.HistoryForHardwareID("SN1")
+	require.True(t, t0.Add(2*time.Second).Equal(history[1].Timestamp))
+	require.Equal(t, "/dev/ttyACM0", history[2].OldPort.Address)
+
+	// The returned slices are copies
+	history[0] = nil
+	require.NotNil(t, loaded.HistoryForHardwareID("SN1")[0])
+
+	_, err = LoadJournalIndex(paths.New(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
@@ -0,0 +1,156 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"strings"
+)
+
+// SetLocale sets the locale sent to the discovery in the HELLO command, a
+// BCP 47 language tag like "it" or "pt-BR" (the POSIX form "pt_BR" is
+// accepted too), so that the discovery can send the AddressLabel and the
+// ProtocolLabel of the ports in the language of the user. The discoveries
+// not supporting the locale reject it, the HELLO is then sent again
+// without the locale. The malformed tags are ignored.
+func (disc *Client) SetLocale(locale string) {
+	disc.locale, _ = normalizeLocale(locale)
+}
+
+type localeKey struct{}
+
+// LocaleFromContext returns the locale requested by the client in the HELLO
+// command, normalized as a BCP 47 language tag (for example "pt-BR"). The
+// contexts passed to the methods of a ContextDiscovery, starting from
+// Hello, hold the locale of the session. ok is false if the client didn't
+// request a locale.
+func LocaleFromContext(ctx context.Context) (locale string, ok bool) {
+	locale, _ = ctx.Value(localeKey{}).(string)
+	return locale, locale != ""
+}
+
+// Locale returns the locale requested by the client in the HELLO command of
+// the current session, see LocaleFromContext. It's empty if the client
+// didn't request a locale.
+func (d *Server) Locale() string {
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	return d.locale
+}
+
+// setLocale sets the locale of the session and returns the session context
+// holding it.
+func (d *Server) setLocale(locale string) context.Context {
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	d.locale = locale
+	if d.sessionCtx == nil {
+		d.sessionCtx = context.Background()
+	}
+	if locale != "" {
+		d.sessionCtx = context.WithValue(d.sessionCtx, localeKey{}, locale)
+	}
+	return d.sessionCtx
+}
+
+// normalizeLocale checks that locale is a well formed BCP 47 language tag
+// and returns it with the canonical case: "pt_br" becomes "pt-BR" and
+// "zh-hant-tw" becomes "zh-Hant-TW". ok is false if the tag is malformed.
+func normalizeLocale(locale string) (string, bool) {
+	subtags := strings.Split(strings.ReplaceAll(locale, "_", "-"), "-")
+	if len(locale) > 35 || len(subtags[0]) < 2 || len(subtags[0]) > 8 {
+		return "", false
+	}
+	for i, subtag := range subtags {
+		if subtag == "" || len(subtag) > 8 {
+			return "", false
+		}
+		for _, c := range subtag {
+			isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+			if !isLetter && (i == 0 || c < '0' || c > '9') {
+				return "", false
+			}
+		}
+		switch {
+		case i == 0:
+			subtags[i] = strings.ToLower(subtag)
+		case len(subtag) == 2:
+			subtags[i] = strings.ToUpper(subtag)
+		case len(subtag) == 4 && subtag[0] > '9':
+			subtags[i] = strings.ToUpper(subtag[:1]) + strings.ToLower(subtag[1:])
+		default:
+			subtags[i] = strings.ToLower(subtag)
+		}
+	}
+	return strings.Join(subtags, "-"), true
+}
+
+// MatchLocale returns the best match of the requested locale among the
+// available ones: the same tag, or the closest one removing the subtags
+// from the end of the requested tag ("pt-BR" matches "pt"), compared
+// ignoring the case. The available locales are returned as given, ok is
+// false if none matches.
+func MatchLocale(locale string, available []string) (match string, ok bool) {
+	requested, valid := normalizeLocale(locale)
+	if !valid {
+		return "", false
+	}
+	for {
+		for _, tag := range available {
+			if normalized, valid := normalizeLocale(tag); valid && normalized == requested {
+				return tag, true
+			}
+		}
+		i := strings.LastIndex(requested, "-")
+		if i < 0 {
+			return "", false
+		}
+		requested = requested[:i]
+	}
+}
+
+// LocalizedLabel is a label translated in many languages, by BCP 47 language
+// tag. The implementations can use it to send the AddressLabel and the
+// ProtocolLabel of the ports in the language requested by the client:
+//
+//	var serialLabel = discovery.LocalizedLabel{"": "Serial Port", "it": "Porta seriale"}
+//
+//	func (d *myDiscovery) Hello(ctx context.Context, userAgent string, protocolVersion int) error {
+//		d.locale, _ = discovery.LocaleFromContext(ctx)
+//		return nil
+//	}
+//
+//	port.ProtocolLabel = serialLabel.Get(d.locale)
+type LocalizedLabel map[string]string
+
+// Get returns the translation of the label that best matches the locale,
+// see MatchLocale. If there is none, the translation with the empty key is
+// returned, the default one, or the English one if there is no default.
+func (l LocalizedLabel) Get(locale string) string {
+	tags := make([]string, 0, len(l))
+	for tag := range l {
+		tags = append(tags, tag)
+	}
+	if tag, ok := MatchLocale(locale, tags); ok {
+		return l[tag]
+	}
+	if label, ok := l[""]; ok {
+		return label
+	}
+	return l["en"]
+}
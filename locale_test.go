@@ -0,0 +1,158 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeLocale(t *testing.T) {
+	valid := map[string]string{
+		"it": "it", "EN": "en", "pt_br": "pt-BR", "zh-hant-tw": "zh-Hant-TW", "es-419": "es-419", "de-CH-1996": "de-CH-1996",
+	}
+	for in, expected := range valid {
+		locale, ok := normalizeLocale(in)
+		require.True(t, ok, in)
+		require.Equal(t, expected, locale, in)
+	}
+	for _, in := range []string{"", "i", "1t", "it-", "it--IT", "it IT", "it\"", "it-abcdefghi", "ità"} {
+		_, ok := normalizeLocale(in)
+		require.False(t, ok, in)
+	}
+}
+
+func TestLocalizedLabel(t *testing.T) {
+	match, ok := MatchLocale("pt_BR", []string{"pt", "pt-br", "en"})
+	require.True(t, ok)
+	require.Equal(t, "pt-br", match)
+	match, ok = MatchLocale("zh-Hant-TW", []string{"zh", "en"})
+	require.True(t, ok)
+	require.Equal(t, "zh", match)
+	_, ok = MatchLocale("fr", []string{"it", "en"})
+	require.False(t, ok)
+	_, ok = MatchLocale("", []string{"it", "en"})
+	require.False(t, ok)
+
+	label := LocalizedLabel{"": "Serial Port", "it": "Porta seriale", "pt-BR": "Porta serial"}
+	require.Equal(t, "Porta seriale", label.Get("it-CH"))
+	require.Equal(t, "Porta serial", label.Get("pt_br"))
+	require.Equal(t, "Serial Port", label.Get("pt"))
+	require.Equal(t, "Serial Port", label.Get(""))
+	require.Equal(t, "Serial", LocalizedLabel{"en": "Serial", "it": "Seriale"}.Get("fr"))
+}
+
+type localeDiscovery struct {
+	testContextDiscovery
+	server      *Server
+	helloLocale string
+	syncLocale  string
+	hellos      chan string
+}
+
+func (d *localeDiscovery) Hello(ctx context.Context, userAgent string, protocolVersion int) error {
+	d.helloLocale, _ = LocaleFromContext(ctx)
+	if d.hellos != nil {
+		d.hellos <- d.helloLocale
+	}
+	return nil
+}
+
+func (d *localeDiscovery) StartSync(ctx context.Context, eventCB SyncEventCallback, errorCB ErrorCallback) error {
+	d.syncLocale, _ = LocaleFromContext(ctx)
+	if err := d.testContextDiscovery.StartSync(ctx, eventCB, errorCB); err != nil {
+		return err
+	}
+	label := LocalizedLabel{"": "Serial Port", "it": "Porta seriale"}
+	return eventCB("add", &Port{Address: "/dev/ttyACM0", Protocol: "serial", ProtocolLabel: label.Get(d.server.Locale())})
+}
+
+func TestServerLocale(t *testing.T) {
+	impl := &localeDiscovery{}
+	impl.server = NewContextServer(impl)
+	_, ok := LocaleFromContext(context.Background())
+	require.False(t, ok)
+
+	out := &bytes.Buffer{}
+	in := strings.NewReader("HELLO 1 \"test\" locale=it_IT\nSTART_SYNC\nSTOP\nQUIT\n")
+	require.NoError(t, impl.server.RunSession(in, out))
+	require.Equal(t, "it-IT", impl.helloLocale)
+	require.Equal(t, "it-IT", impl.syncLocale)
+	require.Contains(t, out.String(), `"protocolLabel": "Porta seriale"`)
+	require.Empty(t, impl.server.Locale())
+
+	// No locale requested
+	in = strings.NewReader("HELLO 1 \"test\"\nSTART_SYNC\nSTOP\nQUIT\n")
+	require.NoError(t, impl.server.RunSession(in, &bytes.Buffer{}))
+	require.Empty(t, impl.helloLocale)
+	require.Empty(t, impl.syncLocale)
+}
+
+func TestClientLocale(t *testing.T) {
+	impl := &localeDiscovery{hellos: make(chan string, 1)}
+	impl.server = NewContextServer(impl)
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		_ = impl.server.Run(serverConn, serverConn)
+	}()
+	disc := NewConnClient("test", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	disc.SetLocale("pt_BR")
+	require.NoError(t, disc.Run())
+	disc.Quit()
+	require.Equal(t, "pt-BR", <-impl.hellos)
+
+	// The discoveries not supporting the locale get the HELLO without it
+	clientConn, serverConn = net.Pipe()
+	hellos := make(chan string, 2)
+	go func() {
+		defer serverConn.Close()
+		reader := bufio.NewReader(serverConn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.Contains(line, "locale="):
+				hellos <- line
+				_, _ = io.WriteString(serverConn, `{"eventType": "hello", "error": true, "message": "Invalid HELLO command"}`)
+			case strings.HasPrefix(line, "HELLO"):
+				hellos <- line
+				_, _ = io.WriteString(serverConn, `{"eventType": "hello", "message": "OK", "protocolVersion": 1}`)
+			case strings.HasPrefix(line, "QUIT"):
+				_, _ = io.WriteString(serverConn, `{"eventType": "quit", "message": "OK"}`)
+				return
+			}
+		}
+	}()
+	disc = NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	disc.SetUserAgentProduct("ide", "1.0")
+	disc.SetLocale("it")
+	require.NoError(t, disc.Run())
+	disc.Quit()
+	require.Equal(t, "HELLO 1 \"ide/1.0\" locale=it\n", <-hellos)
+	require.Equal(t, "HELLO 1 \"ide/1.0\"\n", <-hellos)
+}
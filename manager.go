@@ -0,0 +1,554 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAlreadyAdded is returned by Manager.Add when a discovery with the same
+// ID has already been added.
+var ErrAlreadyAdded = errors.New("pluggable discovery already added")
+
+// Manager handles a set of pluggable discovery Clients together: the ports
+// and the events of all the discoveries are aggregated.
+type Manager struct {
+	mutex       sync.Mutex
+	discoveries map[string]*Client
+	metrics     Metrics
+	transformer PortTransformer
+	dedupe      bool
+	priorities  map[string]int
+	sync        *managerSync
+	journal     *Journal
+	portCache   *PortCache
+	enrich      func(*Port) *Port
+	moveWindow  time.Duration
+	listTimeout time.Duration
+	clock       Clock
+	startup     managerStartup
+	// owners are the IDs of the discoveries reporting each protocol
+	owners map[string]map[string]bool
+
+	restartAttempts int
+	restartDelay    time.Duration
+	restartBackoff  Backoff
+	health          managerHealth
+
+	sinks          []*Sink
+	sinkBufferSize int
+}
+
+// NewManager creates a new discovery Manager
+func NewManager() *Manager {
+	return &Manager{
+		discoveries: map[string]*Client{},
+		listTimeout: defaultListTimeout,
+		clock:       systemClock{},
+	}
+}
+
+// Add adds a discovery to the Manager. An error is returned if a discovery
+// with the same ID has already been added. If the Manager is in "events"
+// mode the discovery is started too: in this case if the start fails the
+// error is returned, but the discovery is added anyway.
+func (dm *Manager) Add(disc *Client) error {
+	dm.mutex.Lock()
+	if _, has := dm.discoveries[disc.GetID()]; has {
+		dm.mutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrAlreadyAdded, disc.GetID())
+	}
+	dm.setup(disc)
+	dm.discoveries[disc.GetID()] = disc
+	active := dm.isActive(disc.GetID())
+	dm.mutex.Unlock()
+
+	if !active {
+		return nil
+	}
+	if s := dm.acquireSync(); s != nil {
+		defer dm.detach(s)
+		return dm.startSyncDiscovery(s, disc)
+	}
+	return nil
+}
+
+// setup applies the Manager settings to the given discovery. The mutex must
+// be held by the caller.
+func (dm *Manager) setup(disc *Client) {
+	if dm.metrics != nil {
+		disc.SetMetrics(dm.metrics)
+	}
+	if dm.enrich != nil {
+		disc.SetPortEnricher(dm.enrich)
+	}
+}
+
+// Remove removes the discovery with the given ID from the Manager and
+// returns it, or nil if there is no such discovery. The discovery is not
+// terminated, the caller may Quit it.
+func (dm *Manager) Remove(id string) *Client {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	disc := dm.discoveries[id]
+	delete(dm.discoveries, id)
+	dm.forgetHealth(id)
+	return disc
+}
+
+// Discoveries returns the discoveries of the Manager sorted by ID.
+func (dm *Manager) Discoveries() []*Client {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	res := []*Client{}
+	for _, disc := range dm.discoveries {
+		res = append(res, disc)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].GetID() < res[j].GetID() })
+	return res
+}
+
+// SetMetrics sets the metrics collector to be used in all the discoveries
+// of the Manager, including the ones added later.
+func (dm *Manager) SetMetrics(metrics Metrics) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.metrics = metrics
+	for _, disc := range dm.discoveries {
+		disc.SetMetrics(metrics)
+	}
+}
+
+// Use adds the given transformers to the chain of PortTransformers applied to
+// the ports reported by the discoveries, both in List and in StartSync. The
+// "remove" events of the hidden ports are dropped as well.
+func (dm *Manager) Use(transformers ...PortTransformer) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dm.transformer != nil {
+		transformers = append([]PortTransformer{dm.transformer}, transformers...)
+	}
+	dm.transformer = ChainPortTransformers(transformers...)
+}
+
+func (dm *Manager) getTransformer() PortTransformer {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	return dm.transformer
+}
+
+// transformPorts applies the transformer to the given ports.
+func transformPorts(transformer PortTransformer, discoveryID string, ports []*Port) []*Port {
+	if transformer == nil {
+		return ports
+	}
+	res := []*Port{}
+	for _, port := range ports {
+		if port = transformer.TransformPort(discoveryID, port); port != nil {
+			res = append(res, port)
+		}
+	}
+	return res
+}
+
+// SetJournal sets a Journal where all the aggregated events delivered by
+// StartSync are recorded. The setting is applied on the next StartSync.
+func (dm *Manager) SetJournal(journal *Journal) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.journal = journal
+}
+
+func (dm *Manager) getJournal() *Journal {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	return dm.journal
+}
+
+// runIfNeeded starts the discovery process if it's not already running.
+func runIfNeeded(disc *Client) error {
+	if disc.Alive() {
+		return nil
+	}
+	return disc.Run()
+}
+
+// Start runs all the discoveries (if needed) and sends the START command.
+// The discoveries are started in order of startup priority, see
+// SetStartupPriority, the lazy ones are started by StartProtocols. The
+// discoveries that fail are reported in the returned errors.
+func (dm *Manager) Start() []error {
+	dm.mutex.Lock()
+	dm.startup.started = true
+	dm.mutex.Unlock()
+	return dm.startAll(dm.activeDiscoveries(), dm.startDiscovery)
+}
+
+// startDiscovery runs the discovery (if needed) and sends the START command.
+func (dm *Manager) startDiscovery(disc *Client) error {
+	dm.setHealth(disc.GetID(), HealthStarting, nil)
+	if err := runIfNeeded(disc); err != nil {
+		dm.setHealth(disc.GetID(), HealthCrashed, err)
+		return fmt.Errorf("discovery %s: %w", disc, err)
+	}
+	err := disc.Start()
+	dm.commandHealth(disc, err)
+	if err != nil {
+		return fmt.Errorf("discovery %s: %w", disc, err)
+	}
+	return nil
+}
+
+// List returns the ports of all the discoveries, that must be STARTed,
+// except the lazy discoveries not requested yet. The discoveries are queried
+// concurrently, see ListWithErrors. The discoveries that fail are reported
+// in the returned errors, sorted by discovery ID.
+func (dm *Manager) List() ([]*Port, []error) {
+	ports, failed := dm.ListWithErrors()
+	ids := make([]string, 0, len(failed))
+	for id := range failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var errs []error
+	for _, id := range ids {
+		errs = append(errs, fmt.Errorf("discovery %s: %w", id, failed[id]))
+	}
+	return ports, errs
+}
+
+// StartSync runs all the discoveries (if needed) and puts them in "events"
+// mode. The events of all the discoveries are delivered in the returned
+// channel, that is closed when the event channels of all the discoveries have
+// been closed. The discoveries that fail are reported in the returned errors.
+// The discoveries added while the Manager is in "events" mode are started
+// and their events are delivered in the same channel. The discoveries are
+// started in order of startup priority, the lazy ones by StartProtocols.
+func (dm *Manager) StartSync(size int) (<-chan *Event, []error) {
+	s := &managerSync{merged: make(chan *Event, size), size: size, stopped: make(chan struct{})}
+	dm.mutex.Lock()
+	dm.sync = s
+	// Hold the sync open while the discoveries are being started
+	s.active = 1
+	dm.mutex.Unlock()
+	errs := dm.startAll(dm.activeDiscoveries(), func(disc *Client) error { return dm.startSyncDiscovery(s, disc) })
+	dm.detach(s)
+
+	out := make(chan *Event, size)
+	go func() {
+		defer close(out)
+		p := newEventProcessor(dm.getTransformer())
+		var dedupe *deduplicator
+		if dm.deduplicationEnabled() {
+			dedupe = newDeduplicator(dm.getPriorities())
+		}
+		var moves *moveTracker
+		if window := dm.getMoveWindow(); window > 0 {
+			moves = newMoveTracker(window, dm.getClock())
+		}
+		journal := dm.getJournal()
+		portCache := dm.getPortCache()
+		send := func(ev *Event) {
+			if journal != nil {
+				journal.Record(ev)
+			}
+			if portCache != nil {
+				portCache.Record(ev)
+			}
+			dm.publish(ev)
+			out <- ev
+		}
+		deliver := func(ev *Event) {
+			send(ev)
+			if moves == nil {
+				return
+			}
+			if moved := moves.process(ev); moved != nil {
+				send(moved)
+			}
+		}
+		for ev := range s.merged {
+			if ev = p.process(ev); ev == nil {
+				continue
+			}
+			if dedupe == nil {
+				deliver(ev)
+				continue
+			}
+			for _, ev := range dedupe.process(ev) {
+				deliver(ev)
+			}
+		}
+	}()
+	return out, errs
+}
+
+// managerSync is the state of the Manager while in "events" mode. The merged
+// channel is closed when there are no more active event channels.
+type managerSync struct {
+	merged chan *Event
+	size   int
+	// stopped is closed when the "events" mode is stopped on request, to
+	// cancel the restarts of the crashed discoveries
+	stopped chan struct{}
+
+	// The following fields are guarded by the Manager mutex
+	active     int
+	forwarders map[*Client]*forwarder
+	stopping   bool
+	// restarts counts the restart attempts of each discovery
+	restarts map[*Client]int
+}
+
+// forwarder forwards the events of a discovery in the merged channel,
+// tracking the ports of the discovery.
+type forwarder struct {
+	// portsMutex guards the ports, read by FindPort
+	portsMutex sync.Mutex
+	ports      map[string]*Port
+	replaced   bool // guarded by the Manager mutex
+	done       chan struct{}
+}
+
+// startSyncDiscovery puts the given discovery in "events" mode and forwards
+// its events in the merged channel.
+func (dm *Manager) startSyncDiscovery(s *managerSync, disc *Client) error {
+	if dm.healthState(disc.GetID()) != HealthRestarting {
+		dm.setHealth(disc.GetID(), HealthStarting, nil)
+	}
+	if err := runIfNeeded(disc); err != nil {
+		dm.setHealth(disc.GetID(), HealthCrashed, err)
+		return fmt.Errorf("discovery %s: %w", disc, err)
+	}
+	ch, err := disc.StartSync(s.size)
+	dm.commandHealth(disc, err)
+	if err != nil {
+		return fmt.Errorf("discovery %s: %w", disc, err)
+	}
+	f := &forwarder{ports: map[string]*Port{}, done: make(chan struct{})}
+	dm.mutex.Lock()
+	s.active++
+	if s.forwarders == nil {
+		s.forwarders = map[*Client]*forwarder{}
+	}
+	s.forwarders[disc] = f
+	dm.mutex.Unlock()
+	go func() {
+		defer close(f.done)
+		defer dm.detach(s)
+		crashed := false
+		for ev := range ch {
+			if ev.Type == "stop" && dm.isReplaced(f) {
+				// The discovery is being replaced: its ports are removed,
+				// the new discovery will add them again.
+				for _, port := range f.ports {
+					removed := *ev
+					removed.Type = "remove"
+					removed.Port = &Port{Address: port.Address, Protocol: port.Protocol}
+					s.merged <- &removed
+				}
+				continue
+			}
+			f.track(ev)
+			if ev.Type == "add" {
+				dm.learnProtocols(disc.GetID(), ev.Port)
+			}
+			dm.eventHealth(disc, ev)
+			crashed = ev.Type == "stop" && ev.Error != ""
+			s.merged <- ev
+		}
+		dm.mutex.Lock()
+		delete(s.forwarders, disc)
+		dm.mutex.Unlock()
+		if crashed {
+			// The sync is held open by this forwarder while restarting
+			dm.restart(s, disc)
+		}
+	}()
+	return nil
+}
+
+// track updates the ports of the discovery with the given event.
+func (f *forwarder) track(ev *Event) {
+	f.portsMutex.Lock()
+	defer f.portsMutex.Unlock()
+	switch ev.Type {
+	case "add":
+		f.ports[eventPortKey("", ev.Port)] = ev.Port
+	case "remove":
+		delete(f.ports, eventPortKey("", ev.Port))
+	case "snapshot":
+		f.ports = map[string]*Port{}
+		for _, port := range ev.Ports {
+			f.ports[eventPortKey("", port)] = port
+		}
+	case "reconnected", "resynced":
+		f.ports = map[string]*Port{}
+	}
+}
+
+func (dm *Manager) isReplaced(f *forwarder) bool {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	return f.replaced
+}
+
+// detach releases an active event channel of the sync.
+func (dm *Manager) detach(s *managerSync) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	s.active--
+	if s.active == 0 {
+		close(s.merged)
+		if dm.sync == s {
+			dm.sync = nil
+		}
+	}
+}
+
+// acquireSync returns the current sync, if any, holding it open until
+// detach is called.
+func (dm *Manager) acquireSync() *managerSync {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dm.sync != nil {
+		dm.sync.active++
+	}
+	return dm.sync
+}
+
+// eventProcessor applies the Manager policies to the aggregated events.
+type eventProcessor struct {
+	transformer PortTransformer
+	// hidden are the ports hidden by the transformer, their "remove"
+	// events must be dropped too.
+	hidden map[string]bool
+}
+
+func newEventProcessor(transformer PortTransformer) *eventProcessor {
+	return &eventProcessor{
+		transformer: transformer,
+		hidden:      map[string]bool{},
+	}
+}
+
+func eventPortKey(discoveryID string, port *Port) string {
+	return discoveryID + "|" + port.Protocol + "|" + port.Address
+}
+
+// process returns the event to deliver in place of the given event, or nil
+// if the event must be dropped.
+func (p *eventProcessor) process(ev *Event) *Event {
+	if p.transformer == nil {
+		return ev
+	}
+	switch ev.Type {
+	case "add":
+		key := eventPortKey(ev.DiscoveryID, ev.Port)
+		port := p.transformer.TransformPort(ev.DiscoveryID, ev.Port)
+		if port == nil {
+			p.hidden[key] = true
+			return nil
+		}
+		delete(p.hidden, key)
+		res := *ev
+		res.Port = port
+		return &res
+	case "remove":
+		key := eventPortKey(ev.DiscoveryID, ev.Port)
+		if p.hidden[key] {
+			delete(p.hidden, key)
+			return nil
+		}
+	case "reconnected", "resynced":
+		// The discovery is going to report all its ports again
+		p.forget(ev.DiscoveryID)
+	case "snapshot":
+		p.forget(ev.DiscoveryID)
+		res := *ev
+		res.Ports = transformPorts(p.transformer, ev.DiscoveryID, ev.Ports)
+		for _, port := range ev.Ports {
+			p.hidden[eventPortKey(ev.DiscoveryID, port)] = true
+		}
+		for _, port := range res.Ports {
+			delete(p.hidden, eventPortKey(ev.DiscoveryID, port))
+		}
+		return &res
+	}
+	return ev
+}
+
+// forget drops the hidden ports of the given discovery.
+func (p *eventProcessor) forget(discoveryID string) {
+	for key := range p.hidden {
+		if strings.HasPrefix(key, discoveryID+"|") {
+			delete(p.hidden, key)
+		}
+	}
+}
+
+// Stop sends the STOP command to all the discoveries.
+func (dm *Manager) Stop() []error {
+	return dm.stop(false)
+}
+
+// stop sends the STOP command to all the discoveries, if quitOnError is
+// true the discoveries that fail to stop are terminated.
+func (dm *Manager) stop(quitOnError bool) []error {
+	dm.stopSync()
+	dm.mutex.Lock()
+	dm.startup.started = false
+	dm.mutex.Unlock()
+	var errs []error
+	for _, disc := range dm.activeDiscoveries() {
+		if err := disc.Stop(); err == nil {
+			dm.setHealth(disc.GetID(), HealthStopped, nil)
+		} else if quitOnError {
+			disc.Quit()
+			dm.setHealth(disc.GetID(), HealthStopped, nil)
+		} else {
+			dm.commandHealth(disc, err)
+			errs = append(errs, fmt.Errorf("discovery %s: %w", disc, err))
+		}
+	}
+	return errs
+}
+
+// Quit terminates all the discoveries.
+func (dm *Manager) Quit() {
+	dm.stopSync()
+	for _, disc := range dm.Discoveries() {
+		disc.Quit()
+		dm.setHealth(disc.GetID(), HealthStopped, nil)
+	}
+}
+
+// stopSync cancels the restarts of the current "events" mode, if any.
+func (dm *Manager) stopSync() {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if s := dm.sync; s != nil && !s.stopping {
+		s.stopping = true
+		close(s.stopped)
+	}
+}
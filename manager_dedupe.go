@@ -0,0 +1,307 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+// SetDeduplication enables or disables the deduplication of the ports in
+// the Manager. When enabled, the ports reported by different discoveries
+// with a matching hardware ID (see Port.MatchesHardwareID) are considered
+// the same physical board and only one canonical port is exposed: the
+// port of the discovery with the highest priority (see SetPriority) or, for
+// equal priorities, of the discovery that reported the board first. The
+// other ports are reported in the Alternates of the events. The properties and
+// the hardware IDs of the duplicates are merged in the canonical port,
+// without overriding its own values. The ports without hardware IDs are
+// never deduplicated. The setting is applied on the next StartSync.
+func (dm *Manager) SetDeduplication(enabled bool) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.dedupe = enabled
+}
+
+func (dm *Manager) deduplicationEnabled() bool {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	return dm.dedupe
+}
+
+// SetPriority sets the priority of the discovery with the given ID, the
+// default priority is 0. When deduplication is enabled, the port of the
+// discovery with the highest priority wins over the ports of the same
+// board reported by the other discoveries, and its protocol should be
+// preferred for upload. The setting is applied on the next StartSync or List.
+func (dm *Manager) SetPriority(discoveryID string, priority int) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dm.priorities == nil {
+		dm.priorities = map[string]int{}
+	}
+	dm.priorities[discoveryID] = priority
+}
+
+// getPriorities returns a copy of the priorities of the discoveries.
+func (dm *Manager) getPriorities() map[string]int {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	res := map[string]int{}
+	for id, priority := range dm.priorities {
+		res[id] = priority
+	}
+	return res
+}
+
+// dedupeMember is a port reported by a discovery.
+type dedupeMember struct {
+	discoveryID string
+	port        *Port
+}
+
+func (m *dedupeMember) is(discoveryID string, port *Port) bool {
+	return m.discoveryID == discoveryID && m.port.Equals(port)
+}
+
+// dedupeGroup is a set of ports belonging to the same physical board.
+type dedupeGroup struct {
+	members    []*dedupeMember
+	priorities map[string]int
+}
+
+// canonical returns the member exposed for the group: the one with the
+// highest priority, the first reported among the ones with equal priority.
+func (g *dedupeGroup) canonical() *dedupeMember {
+	res := g.members[0]
+	for _, m := range g.members[1:] {
+		if g.priorities[m.discoveryID] > g.priorities[res.discoveryID] {
+			res = m
+		}
+	}
+	return res
+}
+
+// alternates returns the ports of the group other than the canonical one.
+func (g *dedupeGroup) alternates() []*Port {
+	canonical := g.canonical()
+	var res []*Port
+	for _, m := range g.members {
+		if m != canonical {
+			res = append(res, m.port)
+		}
+	}
+	return res
+}
+
+// merged returns the canonical port with the properties and the hardware
+// IDs of the other members merged in.
+func (g *dedupeGroup) merged() *Port {
+	canonical := g.canonical()
+	res := canonical.port.Clone()
+	for _, m := range g.members {
+		if m == canonical {
+			continue
+		}
+		for _, id := range m.port.AllHardwareIDs() {
+			if !res.HasHardwareID(id) {
+				res.HardwareIDs = append(res.HardwareIDs, id)
+			}
+		}
+		if m.port.Properties == nil {
+			continue
+		}
+		for _, key := range m.port.Properties.Keys() {
+			if res.Properties == nil {
+				res.Properties = m.port.Properties.Clone()
+				break
+			}
+			if !res.Properties.ContainsKey(key) {
+				res.Properties.Set(key, m.port.Properties.Get(key))
+			}
+		}
+	}
+	return res
+}
+
+// deduplicator tracks the ports of the aggregated events to expose only one
+// port for each physical board.
+type deduplicator struct {
+	groups     []*dedupeGroup
+	priorities map[string]int
+}
+
+func newDeduplicator(priorities map[string]int) *deduplicator {
+	return &deduplicator{priorities: priorities}
+}
+
+// derive creates an event for the canonical port of the group, with the
+// metadata of the given event.
+func derive(ev *Event, eventType string, g *dedupeGroup) *Event {
+	res := *ev
+	res.Type = eventType
+	res.DiscoveryID = g.canonical().discoveryID
+	res.Port = g.merged()
+	res.Ports = nil
+	res.Alternates = g.alternates()
+	return &res
+}
+
+// deriveRemove creates a "remove" event for the given member, with the
+// metadata of the given event.
+func deriveRemove(ev *Event, m *dedupeMember) *Event {
+	res := *ev
+	res.Type = "remove"
+	res.DiscoveryID = m.discoveryID
+	res.Port = &Port{Address: m.port.Address, Protocol: m.port.Protocol}
+	res.Ports = nil
+	res.Alternates = nil
+	return &res
+}
+
+// find returns the group containing the given port and the index of the
+// port in the group.
+func (d *deduplicator) find(discoveryID string, port *Port) (*dedupeGroup, int) {
+	for _, g := range d.groups {
+		for i, m := range g.members {
+			if m.is(discoveryID, port) {
+				return g, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// process returns the events to deliver in place of the given event.
+func (d *deduplicator) process(ev *Event) []*Event {
+	switch ev.Type {
+	case "add":
+		return d.add(ev, ev.DiscoveryID, ev.Port)
+	case "remove":
+		return d.remove(ev, ev.DiscoveryID, ev.Port)
+	case "reconnected", "resynced", "stop":
+		// All the ports of the discovery are gone
+		return append(d.forget(ev, ev.DiscoveryID), ev)
+	case "snapshot":
+		res := d.forget(ev, ev.DiscoveryID)
+		snapshot := *ev
+		snapshot.Ports = []*Port{}
+		for _, port := range ev.Ports {
+			if len(port.AllHardwareIDs()) == 0 {
+				snapshot.Ports = append(snapshot.Ports, port)
+				continue
+			}
+			for _, derived := range d.add(ev, ev.DiscoveryID, port) {
+				if derived.Type == "add" && derived.DiscoveryID == ev.DiscoveryID && derived.Port.Equals(port) {
+					// The port is exposed by this discovery
+					snapshot.Ports = append(snapshot.Ports, derived.Port)
+				} else {
+					res = append(res, derived)
+				}
+			}
+		}
+		return append(res, &snapshot)
+	}
+	return []*Event{ev}
+}
+
+func (d *deduplicator) add(ev *Event, discoveryID string, port *Port) []*Event {
+	if len(port.AllHardwareIDs()) == 0 {
+		return []*Event{ev}
+	}
+	if g, _ := d.find(discoveryID, port); g != nil {
+		// The port has been updated
+		d.remove(ev, discoveryID, port)
+	}
+	member := &dedupeMember{discoveryID: discoveryID, port: port}
+	for _, g := range d.groups {
+		for _, m := range g.members {
+			if m.port.MatchesHardwareID(port) {
+				previous := g.canonical()
+				g.members = append(g.members, member)
+				if g.canonical() != previous {
+					// The new port wins over the previous one
+					return []*Event{deriveRemove(ev, previous), derive(ev, "add", g)}
+				}
+				// Update the canonical port with the merged data
+				return []*Event{derive(ev, "add", g)}
+			}
+		}
+	}
+	g := &dedupeGroup{members: []*dedupeMember{member}, priorities: d.priorities}
+	d.groups = append(d.groups, g)
+	return []*Event{derive(ev, "add", g)}
+}
+
+func (d *deduplicator) remove(ev *Event, discoveryID string, port *Port) []*Event {
+	g, i := d.find(discoveryID, port)
+	if g == nil {
+		return []*Event{ev}
+	}
+	var res []*Event
+	if g.members[i] == g.canonical() {
+		res = append(res, deriveRemove(ev, g.members[i]))
+	}
+	g.members = append(g.members[:i], g.members[i+1:]...)
+	if len(g.members) == 0 {
+		for j, other := range d.groups {
+			if other == g {
+				d.groups = append(d.groups[:j], d.groups[j+1:]...)
+				break
+			}
+		}
+		return res
+	}
+	// A new canonical port is exposed, or the merged data of the
+	// current one has changed
+	return append(res, derive(ev, "add", g))
+}
+
+// forget removes all the ports of the given discovery.
+func (d *deduplicator) forget(ev *Event, discoveryID string) []*Event {
+	var res []*Event
+	for _, g := range append([]*dedupeGroup{}, d.groups...) {
+		for _, m := range append([]*dedupeMember{}, g.members...) {
+			if m.discoveryID != discoveryID {
+				continue
+			}
+			for _, derived := range d.remove(ev, discoveryID, m.port) {
+				// The "remove" events of the discovery itself are
+				// implied by the event being processed
+				if derived.Type == "remove" && derived.DiscoveryID == discoveryID {
+					continue
+				}
+				res = append(res, derived)
+			}
+		}
+	}
+	return res
+}
+
+// dedupePorts returns the canonical ports for the given reported ports.
+func dedupePorts(reported []*dedupeMember, priorities map[string]int) []*Port {
+	d := newDeduplicator(priorities)
+	var plain []*Port
+	for _, m := range reported {
+		if len(m.port.AllHardwareIDs()) == 0 {
+			plain = append(plain, m.port)
+			continue
+		}
+		d.add(&Event{}, m.discoveryID, m.port)
+	}
+	res := []*Port{}
+	for _, g := range d.groups {
+		res = append(res, g.merged())
+	}
+	return append(res, plain...)
+}
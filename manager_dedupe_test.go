@@ -0,0 +1,136 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeduplicator(t *testing.T) {
+	serial := &Port{
+		Address:    "/dev/ttyACM0",
+		Protocol:   "serial",
+		HardwareID: "ABC",
+		Properties: properties.NewFromHashmap(map[string]string{"vid": "0x2341"}),
+	}
+	vendor := &Port{
+		Address:     "board-1",
+		Protocol:    "vendor",
+		HardwareIDs: []string{"XYZ", "ABC"},
+		Properties:  properties.NewFromHashmap(map[string]string{"vid": "0x0000", "fw": "1.2"}),
+	}
+	network := &Port{Address: "192.168.1.2", Protocol: "network"}
+	d := newDeduplicator(nil)
+
+	evs := d.process(&Event{Type: "add", DiscoveryID: "serial", Port: serial, Seq: 1})
+	require.Len(t, evs, 1)
+	require.Equal(t, "/dev/ttyACM0", evs[0].Port.Address)
+	require.Equal(t, uint64(1), evs[0].Seq)
+
+	// The duplicate updates the canonical port with the merged data
+	evs = d.process(&Event{Type: "add", DiscoveryID: "vendor", Port: vendor, Seq: 2})
+	require.Len(t, evs, 1)
+	require.Equal(t, "add", evs[0].Type)
+	require.Equal(t, "serial", evs[0].DiscoveryID)
+	require.Equal(t, "/dev/ttyACM0", evs[0].Port.Address)
+	require.Equal(t, "0x2341", evs[0].Port.Properties.Get("vid"))
+	require.Equal(t, "1.2", evs[0].Port.Properties.Get("fw"))
+	require.Equal(t, []string{"ABC", "XYZ"}, evs[0].Port.AllHardwareIDs())
+	require.Equal(t, uint64(2), evs[0].Seq)
+
+	// Ports without hardware IDs are not deduplicated
+	ev := &Event{Type: "add", DiscoveryID: "network", Port: network}
+	require.Equal(t, []*Event{ev}, d.process(ev))
+
+	// When the canonical port goes away the duplicate takes its place
+	evs = d.process(&Event{Type: "remove", DiscoveryID: "serial", Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial"}})
+	require.Len(t, evs, 2)
+	require.Equal(t, "remove", evs[0].Type)
+	require.Equal(t, "/dev/ttyACM0", evs[0].Port.Address)
+	require.Equal(t, "add", evs[1].Type)
+	require.Equal(t, "vendor", evs[1].DiscoveryID)
+	require.Equal(t, "board-1", evs[1].Port.Address)
+
+	evs = d.process(&Event{Type: "remove", DiscoveryID: "vendor", Port: &Port{Address: "board-1", Protocol: "vendor"}})
+	require.Len(t, evs, 1)
+	require.Equal(t, "remove", evs[0].Type)
+	require.Empty(t, d.groups)
+
+	// Stopping a discovery exposes the duplicates of the other discoveries
+	d.process(&Event{Type: "add", DiscoveryID: "serial", Port: serial})
+	d.process(&Event{Type: "add", DiscoveryID: "vendor", Port: vendor})
+	evs = d.process(&Event{Type: "stop", DiscoveryID: "serial"})
+	require.Len(t, evs, 2)
+	require.Equal(t, "add", evs[0].Type)
+	require.Equal(t, "board-1", evs[0].Port.Address)
+	require.Equal(t, "stop", evs[1].Type)
+
+	// The duplicates are dropped from the snapshots
+	evs = d.process(&Event{Type: "snapshot", DiscoveryID: "serial", Ports: []*Port{serial, network}})
+	require.Len(t, evs, 2)
+	require.Equal(t, "add", evs[0].Type)
+	require.Equal(t, "vendor", evs[0].DiscoveryID)
+	require.Equal(t, "snapshot", evs[1].Type)
+	require.Equal(t, []*Port{network}, evs[1].Ports)
+}
+
+func TestDedupePorts(t *testing.T) {
+	ports := dedupePorts([]*dedupeMember{
+		{"serial", &Port{Address: "/dev/ttyACM0", Protocol: "serial", HardwareID: "ABC"}},
+		{"serial", &Port{Address: "/dev/ttyACM1", Protocol: "serial"}},
+		{"vendor", &Port{Address: "board-1", Protocol: "vendor", HardwareID: "ABC"}},
+	}, nil)
+	require.Len(t, ports, 2)
+	require.Equal(t, "/dev/ttyACM0", ports[0].Address)
+	require.Equal(t, "/dev/ttyACM1", ports[1].Address)
+}
+
+func TestDeduplicatorPriorities(t *testing.T) {
+	serial := &Port{Address: "/dev/ttyACM0", Protocol: "serial", HardwareID: "ABC"}
+	vendor := &Port{Address: "board-1", Protocol: "vendor", HardwareID: "ABC"}
+	d := newDeduplicator(map[string]int{"vendor": 10})
+
+	evs := d.process(&Event{Type: "add", DiscoveryID: "serial", Port: serial})
+	require.Len(t, evs, 1)
+	require.Empty(t, evs[0].Alternates)
+
+	// The port of the discovery with higher priority wins
+	evs = d.process(&Event{Type: "add", DiscoveryID: "vendor", Port: vendor})
+	require.Len(t, evs, 2)
+	require.Equal(t, "remove", evs[0].Type)
+	require.Equal(t, "serial", evs[0].DiscoveryID)
+	require.Equal(t, "/dev/ttyACM0", evs[0].Port.Address)
+	require.Equal(t, "add", evs[1].Type)
+	require.Equal(t, "vendor", evs[1].DiscoveryID)
+	require.Equal(t, "board-1", evs[1].Port.Address)
+	require.Equal(t, []*Port{serial}, evs[1].Alternates)
+
+	// Removing the losing port only updates the alternates
+	evs = d.process(&Event{Type: "remove", DiscoveryID: "serial", Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial"}})
+	require.Len(t, evs, 1)
+	require.Equal(t, "add", evs[0].Type)
+	require.Equal(t, "board-1", evs[0].Port.Address)
+	require.Empty(t, evs[0].Alternates)
+
+	ports := dedupePorts([]*dedupeMember{{"serial", serial}, {"vendor", vendor}}, map[string]int{"vendor": 10})
+	require.Len(t, ports, 1)
+	require.Equal(t, "board-1", ports[0].Address)
+}
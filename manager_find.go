@@ -0,0 +1,115 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrPortNotFound is returned by Manager.FindPort when no discovery reports
+// the requested port.
+var ErrPortNotFound = errors.New("port not found")
+
+// learnProtocols records the protocols of the ports reported by the
+// discovery with the given ID, see FindPort.
+func (dm *Manager) learnProtocols(discoveryID string, ports ...*Port) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	for _, port := range ports {
+		if port == nil {
+			continue
+		}
+		if dm.owners == nil {
+			dm.owners = map[string]map[string]bool{}
+		}
+		if dm.owners[port.Protocol] == nil {
+			dm.owners[port.Protocol] = map[string]bool{}
+		}
+		dm.owners[port.Protocol][discoveryID] = true
+	}
+}
+
+// protocolOwners returns the discoveries that report the given protocol
+// (or that are lazily started for it, see SetLazyStart), sorted by ID. If
+// no discovery is known to report the protocol all the active discoveries
+// are returned.
+func (dm *Manager) protocolOwners(protocol string) []*Client {
+	dm.mutex.Lock()
+	res := []*Client{}
+	for id, disc := range dm.discoveries {
+		if dm.owners[protocol][id] || hasAnyProtocol(dm.startup.lazy[id], []string{protocol}) {
+			res = append(res, disc)
+		}
+	}
+	dm.mutex.Unlock()
+	if len(res) == 0 {
+		return dm.activeDiscoveries()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].GetID() < res[j].GetID() })
+	return res
+}
+
+// FindPort returns the port with the given protocol and address and the
+// discovery reporting it, for example to validate the port chosen for an
+// upload right before using it. Only the discoveries of the protocol are
+// queried: the ones that have already reported ports of the protocol and
+// the lazy ones started for it, that are started if needed (see
+// SetLazyStart). Without such discoveries all the discoveries are queried.
+// In "events" mode the ports are looked up in the ones reported by the
+// events, otherwise the discoveries must be STARTed and are refreshed with
+// a LIST. If the port is not found an error wrapping ErrPortNotFound is
+// returned, along with the errors of the discoveries that failed, if any.
+func (dm *Manager) FindPort(protocol, address string) (*Port, *Client, error) {
+	errs := dm.StartProtocols(protocol)
+	transformer := dm.getTransformer()
+	key := eventPortKey("", &Port{Protocol: protocol, Address: address})
+	for _, disc := range dm.protocolOwners(protocol) {
+		var ports []*Port
+		if s := dm.acquireSync(); s != nil {
+			dm.mutex.Lock()
+			f := s.forwarders[disc]
+			dm.mutex.Unlock()
+			dm.detach(s)
+			if f == nil {
+				continue
+			}
+			f.portsMutex.Lock()
+			if port := f.ports[key]; port != nil {
+				ports = append(ports, port)
+			}
+			f.portsMutex.Unlock()
+		} else {
+			list, err := disc.List()
+			dm.commandHealth(disc, err)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("discovery %s: %w", disc, err))
+				continue
+			}
+			dm.learnProtocols(disc.GetID(), list...)
+			ports = list
+		}
+		for _, port := range transformPorts(transformer, disc.GetID(), ports) {
+			if port.Protocol == protocol && port.Address == address {
+				return port, disc, nil
+			}
+		}
+	}
+	return nil, nil, errors.Join(append([]error{fmt.Errorf("%w: %s %s", ErrPortNotFound, protocol, address)}, errs...)...)
+}
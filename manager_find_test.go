@@ -0,0 +1,113 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// protocolDiscovery reports a single port of the given protocol.
+type protocolDiscovery struct {
+	testDiscovery
+	protocol string
+}
+
+func (d *protocolDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	eventCB("add", &Port{Address: "1", Protocol: d.protocol})
+	return nil
+}
+
+func TestManagerFindPort(t *testing.T) {
+	var mutex sync.Mutex
+	lists := map[string]int{}
+	client := func(protocol string) *Client {
+		return NewConnClient(protocol, func() (io.ReadWriteCloser, error) {
+			clientConn, serverConn := net.Pipe()
+			go func() {
+				defer serverConn.Close()
+				server := NewServer(&protocolDiscovery{protocol: protocol})
+				server.Use(func(cmd string, next func()) {
+					if strings.HasPrefix(cmd, "LIST") {
+						mutex.Lock()
+						lists[protocol]++
+						mutex.Unlock()
+					}
+					next()
+				})
+				_ = server.Run(serverConn, serverConn)
+			}()
+			return clientConn, nil
+		})
+	}
+	listed := func() map[string]int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		res := map[string]int{}
+		for protocol, count := range lists {
+			res[protocol] = count
+		}
+		return res
+	}
+
+	dm := NewManager()
+	dm.SetLazyStart("network", "network")
+	serial, network := client("serial"), client("network")
+	require.NoError(t, dm.Add(serial))
+	require.NoError(t, dm.Add(network))
+	require.Empty(t, dm.Start())
+	_, errs := dm.List()
+	require.Empty(t, errs)
+
+	// Only the discovery of the protocol is refreshed
+	port, disc, err := dm.FindPort("serial", "1")
+	require.NoError(t, err)
+	require.Equal(t, "serial", port.Protocol)
+	require.Same(t, serial, disc)
+	require.Equal(t, map[string]int{"serial": 2}, listed())
+
+	// The lazy discovery of the protocol is started
+	port, disc, err = dm.FindPort("network", "1")
+	require.NoError(t, err)
+	require.Equal(t, "network", port.Protocol)
+	require.Same(t, network, disc)
+	require.Equal(t, map[string]int{"serial": 2, "network": 1}, listed())
+
+	_, _, err = dm.FindPort("serial", "2")
+	require.ErrorIs(t, err, ErrPortNotFound)
+
+	// In "events" mode the ports reported by the events are used
+	require.Empty(t, dm.Stop())
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	<-ch
+	<-ch
+	port, disc, err = dm.FindPort("network", "1")
+	require.NoError(t, err)
+	require.Equal(t, "network", port.Protocol)
+	require.Same(t, network, disc)
+	require.Equal(t, map[string]int{"serial": 3, "network": 1}, listed())
+	dm.Quit()
+	for range ch {
+	}
+}
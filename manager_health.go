@@ -0,0 +1,264 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthState is the health of a discovery of a Manager.
+type HealthState string
+
+const (
+	// HealthStopped is the state of the discoveries not started yet, or
+	// stopped on request.
+	HealthStopped HealthState = "stopped"
+	// HealthStarting is the state of the discoveries being started.
+	HealthStarting HealthState = "starting"
+	// HealthRunning is the state of the discoveries working normally.
+	HealthRunning HealthState = "running"
+	// HealthDegraded is the state of the discoveries still running but
+	// misbehaving: the last command failed, or the discovery has just
+	// recovered from an error (after a "reconnected" or "resynced" event).
+	// The discovery is back to HealthRunning with the next successful
+	// command or port event.
+	HealthDegraded HealthState = "degraded"
+	// HealthCrashed is the state of the discoveries that could not be
+	// started or that terminated unexpectedly.
+	HealthCrashed HealthState = "crashed"
+	// HealthRestarting is the state of the crashed discoveries being
+	// restarted by the Manager, see Manager.SetRestartPolicy.
+	HealthRestarting HealthState = "restarting"
+)
+
+// DiscoveryStatus is a snapshot of the health of a discovery of a Manager.
+type DiscoveryStatus struct {
+	// ID is the ID of the discovery.
+	ID string
+	// State is the current health state.
+	State HealthState
+	// Since is the time of the last change of State.
+	Since time.Time
+	// Error is the error that caused the last transition to HealthDegraded
+	// or HealthCrashed, it's kept until the discovery is running again.
+	Error string
+	// Restarts is the number of attempts of the Manager to restart the
+	// discovery after a crash.
+	Restarts int
+}
+
+// maxRestartDelay is the maximum delay between the attempts to restart a
+// crashed discovery.
+const maxRestartDelay = time.Minute
+
+// managerHealth tracks the health of the discoveries of a Manager. It has
+// its own mutex to be updated from the event forwarders without interfering
+// with the Manager mutex.
+type managerHealth struct {
+	mutex    sync.Mutex
+	statuses map[string]*DiscoveryStatus
+	callback func(status DiscoveryStatus, previous HealthState)
+}
+
+// SetHealthCallback sets a callback called at each change of the health
+// state of a discovery, with the new status and the previous state. The
+// callback is called synchronously from the goroutine that detected the
+// change (possibly a different one for each discovery), so it must not
+// block.
+func (dm *Manager) SetHealthCallback(callback func(status DiscoveryStatus, previous HealthState)) {
+	dm.health.mutex.Lock()
+	defer dm.health.mutex.Unlock()
+	dm.health.callback = callback
+}
+
+// SetRestartPolicy enables the restart of the discoveries crashed while
+// the Manager is in "events" mode: the Manager tries to run the discovery
+// and start the "events" mode again, up to the given number of attempts
+// for each discovery (counted from the start of the "events" mode),
+// waiting delay before the first attempt and doubling it (up to a minute)
+// for each of the following. When the attempts are exhausted the
+// discovery is left in HealthCrashed. An attempts value of 0 disables the restarts (the
+// default). The delays can be customized with SetRestartBackoff.
+func (dm *Manager) SetRestartPolicy(attempts int, delay time.Duration) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.restartAttempts = attempts
+	dm.restartDelay = delay
+}
+
+// SetRestartBackoff sets the Backoff computing the delays before the
+// attempts to restart a crashed discovery, in place of the delay doubled at
+// each attempt given to SetRestartPolicy, that still sets the number of
+// attempts. A nil backoff restores the default.
+func (dm *Manager) SetRestartBackoff(backoff Backoff) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.restartBackoff = backoff
+}
+
+// Status returns the health of all the discoveries of the Manager, sorted
+// by ID.
+func (dm *Manager) Status() []DiscoveryStatus {
+	res := []DiscoveryStatus{}
+	dm.health.mutex.Lock()
+	defer dm.health.mutex.Unlock()
+	for _, disc := range dm.Discoveries() {
+		if status, ok := dm.health.statuses[disc.GetID()]; ok {
+			res = append(res, *status)
+		} else {
+			res = append(res, DiscoveryStatus{ID: disc.GetID(), State: HealthStopped})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// setHealth changes the health state of the discovery, the error is
+// recorded for the HealthDegraded and HealthCrashed states.
+func (dm *Manager) setHealth(id string, state HealthState, err error) {
+	now := dm.getClock().Now()
+	h := &dm.health
+	h.mutex.Lock()
+	if h.statuses == nil {
+		h.statuses = map[string]*DiscoveryStatus{}
+	}
+	status, ok := h.statuses[id]
+	if !ok {
+		status = &DiscoveryStatus{ID: id, State: HealthStopped}
+		h.statuses[id] = status
+	}
+	previous := status.State
+	switch state {
+	case HealthDegraded, HealthCrashed:
+		if err != nil {
+			status.Error = err.Error()
+		}
+	case HealthRunning:
+		status.Error = ""
+	}
+	if state == HealthRestarting {
+		status.Restarts++
+	}
+	if previous == state {
+		h.mutex.Unlock()
+		return
+	}
+	status.State = state
+	status.Since = now
+	snapshot := *status
+	callback := h.callback
+	h.mutex.Unlock()
+	if callback != nil {
+		callback(snapshot, previous)
+	}
+}
+
+// healthState returns the current health state of the discovery.
+func (dm *Manager) healthState(id string) HealthState {
+	dm.health.mutex.Lock()
+	defer dm.health.mutex.Unlock()
+	if status, ok := dm.health.statuses[id]; ok {
+		return status.State
+	}
+	return HealthStopped
+}
+
+// forgetHealth drops the health of a discovery removed from the Manager.
+func (dm *Manager) forgetHealth(id string) {
+	dm.health.mutex.Lock()
+	defer dm.health.mutex.Unlock()
+	delete(dm.health.statuses, id)
+}
+
+// commandHealth updates the health of the discovery after a command.
+func (dm *Manager) commandHealth(disc *Client, err error) {
+	switch {
+	case err == nil:
+		dm.setHealth(disc.GetID(), HealthRunning, nil)
+	case disc.Alive():
+		dm.setHealth(disc.GetID(), HealthDegraded, err)
+	default:
+		dm.setHealth(disc.GetID(), HealthCrashed, err)
+	}
+}
+
+// eventHealth updates the health of the discovery after an event of the
+// "events" mode.
+func (dm *Manager) eventHealth(disc *Client, ev *Event) {
+	switch ev.Type {
+	case "add", "remove", "snapshot":
+		if dm.healthState(disc.GetID()) == HealthDegraded {
+			dm.setHealth(disc.GetID(), HealthRunning, nil)
+		}
+	case "reconnected", "resynced":
+		dm.setHealth(disc.GetID(), HealthDegraded, errors.New("recovered from an error in events mode"))
+	case "stop":
+		if ev.Error != "" {
+			dm.setHealth(disc.GetID(), HealthCrashed, errors.New(ev.Error))
+		} else {
+			dm.setHealth(disc.GetID(), HealthStopped, nil)
+		}
+	}
+}
+
+// restart tries to restart the crashed discovery in "events" mode,
+// following the restart policy.
+func (dm *Manager) restart(s *managerSync, disc *Client) {
+	for {
+		dm.mutex.Lock()
+		if s.restarts == nil {
+			s.restarts = map[*Client]int{}
+		}
+		attempt := s.restarts[disc]
+		if attempt >= dm.restartAttempts {
+			dm.mutex.Unlock()
+			return
+		}
+		s.restarts[disc]++
+		backoff := dm.restartBackoff
+		if backoff == nil {
+			backoff = ExponentialBackoff(dm.restartDelay, maxRestartDelay, 0)
+		}
+		timer := dm.clock.NewTimer(backoff.Delay(attempt + 1))
+		dm.mutex.Unlock()
+		select {
+		case <-timer.C():
+		case <-s.stopped:
+			timer.Stop()
+			return
+		}
+		dm.mutex.Lock()
+		// The discovery may have been removed or replaced meanwhile
+		gone := s.stopping || dm.discoveries[disc.GetID()] != disc
+		dm.mutex.Unlock()
+		if gone {
+			return
+		}
+		dm.setHealth(disc.GetID(), HealthRestarting, nil)
+		if disc.Alive() {
+			// Terminate what is left of the crashed session
+			disc.Quit()
+		}
+		if err := dm.startSyncDiscovery(s, disc); err == nil {
+			return
+		}
+	}
+}
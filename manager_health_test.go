@@ -0,0 +1,142 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerHealth(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	var mutex sync.Mutex
+	transitions := map[string][]HealthState{}
+	dm := NewManager()
+	dm.SetHealthCallback(func(status DiscoveryStatus, previous HealthState) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(transitions[status.ID]) == 0 {
+			transitions[status.ID] = []HealthState{previous}
+		}
+		transitions[status.ID] = append(transitions[status.ID], status.State)
+	})
+	getTransitions := func(id string) []HealthState {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]HealthState(nil), transitions[id]...)
+	}
+	start := time.Now()
+	clock := NewManualClock(start)
+	dm.SetClock(clock)
+	dm.SetRestartPolicy(1, 10*time.Millisecond)
+	require.NoError(t, dm.Add(NewClient("crashing", "dummy-discovery/dummy-discovery", "-k")))
+	require.NoError(t, dm.Add(NewClient("missing", "dummy-discovery/not-existent")))
+	require.NoError(t, dm.Add(NewClient("ok", "dummy-discovery/dummy-discovery")))
+	for _, status := range dm.Status() {
+		require.Equal(t, HealthStopped, status.State)
+	}
+
+	ch, errs := dm.StartSync(10)
+	require.Len(t, errs, 1)
+	go func() {
+		for range ch {
+			// Drain the events until the Manager is quit
+		}
+	}()
+
+	// The crashing discovery is restarted once after the delay, then left
+	// crashed
+	clock.WaitForTimers(1)
+	require.Equal(t, HealthCrashed, dm.Status()[0].State)
+	clock.Advance(10 * time.Millisecond)
+	require.Eventually(t, func() bool {
+		return len(getTransitions("crashing")) == 7
+	}, 10*time.Second, 10*time.Millisecond)
+	// ...and not restarted again
+	clock.Advance(time.Hour)
+	require.Zero(t, clock.Timers())
+	require.Equal(t, []HealthState{
+		HealthStopped, HealthStarting, HealthRunning, HealthCrashed,
+		HealthRestarting, HealthRunning, HealthCrashed,
+	}, getTransitions("crashing"))
+	require.Equal(t, []HealthState{HealthStopped, HealthStarting, HealthCrashed}, getTransitions("missing"))
+
+	statuses := dm.Status()
+	require.Len(t, statuses, 3)
+	require.Equal(t, "crashing", statuses[0].ID)
+	require.Equal(t, HealthCrashed, statuses[0].State)
+	require.Equal(t, 1, statuses[0].Restarts)
+	require.NotEmpty(t, statuses[0].Error)
+	// Crashed again after the restart delay
+	require.Equal(t, start.Add(10*time.Millisecond), statuses[0].Since)
+	require.Equal(t, HealthCrashed, statuses[1].State)
+	require.Contains(t, statuses[1].Error, "not-existent")
+	require.Equal(t, "ok", statuses[2].ID)
+	require.Equal(t, HealthRunning, statuses[2].State)
+	require.Empty(t, statuses[2].Error)
+
+	dm.Quit()
+	for _, status := range dm.Status() {
+		require.Equal(t, HealthStopped, status.State)
+	}
+	dm.Remove("ok")
+	require.Len(t, dm.Status(), 2)
+}
+
+func TestManagerRestartBackoff(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	var mutex sync.Mutex
+	attempts := []int{}
+	dm := NewManager()
+	// The backoff replaces the delay given to SetRestartPolicy
+	dm.SetRestartPolicy(2, time.Hour)
+	dm.SetRestartBackoff(BackoffFunc(func(attempt int) time.Duration {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts = append(attempts, attempt)
+		return 0
+	}))
+	require.NoError(t, dm.Add(NewClient("crashing", "dummy-discovery/dummy-discovery", "-k")))
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	go func() {
+		for range ch {
+			// Drain the events until the Manager is quit
+		}
+	}()
+	require.Eventually(t, func() bool {
+		status := dm.Status()[0]
+		return status.Restarts == 2 && status.State == HealthCrashed
+	}, 10*time.Second, 10*time.Millisecond)
+	dm.Quit()
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, []int{1, 2}, attempts)
+}
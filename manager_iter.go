@@ -0,0 +1,74 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build go1.23
+
+package discovery
+
+import (
+	"context"
+	"iter"
+)
+
+// Events returns an iterator over the aggregated events of the discoveries
+// of the Manager. The Manager is put in "events" mode when the iteration
+// starts, and stopped when the loop exits or ctx is done. The discoveries
+// are not terminated (unless they fail to stop), Quit may be called after
+// the loop.
+//
+// The discoveries that fail to start are yielded first, as errors with a
+// nil event. The "stop" events of the discoveries are yielded only if they
+// report an error, together with the error: the iteration goes on with the
+// events of the other discoveries. The ctx error is yielded with a nil
+// event.
+func (dm *Manager) Events(ctx context.Context) iter.Seq2[*Event, error] {
+	return func(yield func(*Event, error) bool) {
+		ch, errs := dm.StartSync(eventsIteratorSize)
+		defer func() {
+			// The channel is closed only when all the discoveries are
+			// stopped: terminate the ones that can't be stopped
+			dm.stop(true)
+			for range ch {
+				// Drain the events until the channel is closed
+			}
+		}()
+		for _, err := range errs {
+			if !yield(nil, err) {
+				return
+			}
+		}
+		for {
+			// The events may be already buffered: ctx is checked first
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			select {
+			case <-ctx.Done():
+			case ev, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := eventError(ev); err != nil || ev.Type != "stop" {
+					if !yield(ev, err) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
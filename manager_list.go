@@ -0,0 +1,123 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrListTimeout is reported by Manager.List for the discoveries that
+// don't answer the LIST within the timeout set with SetListTimeout.
+var ErrListTimeout = errors.New("LIST timed out")
+
+// defaultListTimeout is the default timeout of the LIST of each discovery
+// of a Manager.
+const defaultListTimeout = 15 * time.Second
+
+// SetListTimeout sets how long Manager.List waits for each discovery, 15
+// seconds by default: a discovery that doesn't answer in time is reported
+// with ErrListTimeout, without delaying the ports of the others. A zero
+// timeout waits for all the discoveries, however long they take.
+func (dm *Manager) SetListTimeout(timeout time.Duration) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.listTimeout = max(timeout, 0)
+}
+
+// listResult is the result of the LIST of a discovery.
+type listResult struct {
+	ports []*Port
+	err   error
+}
+
+// ListWithErrors returns the ports of all the discoveries, that must be
+// STARTed, like List. The discoveries are queried concurrently, the ports
+// of the ones that answer are returned even if others fail or hang: the
+// errors are returned by discovery ID, the discoveries that don't answer
+// within the timeout set with SetListTimeout are reported with an error
+// wrapping ErrListTimeout.
+func (dm *Manager) ListWithErrors() ([]*Port, map[string]error) {
+	dm.mutex.Lock()
+	timeout := dm.listTimeout
+	clock := dm.clock
+	dm.mutex.Unlock()
+
+	discoveries := dm.activeDiscoveries()
+	results := make([]chan listResult, len(discoveries))
+	for i, disc := range discoveries {
+		// Buffered, the result of a discovery timed out is not received
+		results[i] = make(chan listResult, 1)
+		go func(disc *Client, result chan<- listResult) {
+			ports, err := disc.List()
+			dm.commandHealth(disc, err)
+			result <- listResult{ports: ports, err: err}
+		}(disc, results[i])
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := clock.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C()
+	}
+	var reported []*dedupeMember
+	errs := map[string]error{}
+	transformer := dm.getTransformer()
+	portCache := dm.getPortCache()
+	expired := false
+	for i, disc := range discoveries {
+		var res listResult
+		if !expired {
+			select {
+			case res = <-results[i]:
+			case <-deadline:
+				// The deadline is the same for all the discoveries
+				expired = true
+			}
+		}
+		if expired {
+			select {
+			case res = <-results[i]:
+			default:
+				res.err = fmt.Errorf("%w after %s", ErrListTimeout, timeout)
+			}
+		}
+		if res.err != nil {
+			errs[disc.GetID()] = res.err
+			continue
+		}
+		dm.learnProtocols(disc.GetID(), res.ports...)
+		ports := transformPorts(transformer, disc.GetID(), res.ports)
+		if portCache != nil {
+			portCache.replace(disc.GetID(), ports)
+		}
+		for _, port := range ports {
+			reported = append(reported, &dedupeMember{discoveryID: disc.GetID(), port: port})
+		}
+	}
+	if dm.deduplicationEnabled() {
+		return dedupePorts(reported, dm.getPriorities()), errs
+	}
+	res := []*Port{}
+	for _, m := range reported {
+		res = append(res, m.port)
+	}
+	return res, errs
+}
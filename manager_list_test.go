@@ -0,0 +1,101 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerListWithErrors(t *testing.T) {
+	// The LIST of the "hung" discovery is blocked until released
+	release := make(chan struct{})
+	pipeClient := func(id string, middleware CommandMiddleware) *Client {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			server := NewServer(&testDiscovery{})
+			if middleware != nil {
+				server.Use(middleware)
+			}
+			_ = server.Run(serverConn, serverConn)
+		}()
+		cl := NewConnClient(id, func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		require.NoError(t, cl.Run())
+		return cl
+	}
+	ok := pipeClient("ok", nil)
+	hung := pipeClient("hung", func(cmd string, next func()) {
+		if strings.HasPrefix(cmd, "LIST") {
+			<-release
+		}
+		next()
+	})
+	notStarted := pipeClient("not-started", nil)
+	require.NoError(t, ok.Start())
+	require.NoError(t, hung.Start())
+
+	dm := NewManager()
+	clock := NewManualClock(time.Now())
+	dm.SetClock(clock)
+	dm.SetListTimeout(100 * time.Millisecond)
+	for _, disc := range []*Client{ok, hung, notStarted} {
+		require.NoError(t, dm.Add(disc))
+	}
+	// The timeout of the hung discovery expires when the clock advances,
+	// after the other discoveries answered
+	answered := make(chan string, 2)
+	dm.SetHealthCallback(func(status DiscoveryStatus, previous HealthState) {
+		select {
+		case answered <- status.ID:
+		default:
+		}
+	})
+	go func() {
+		<-answered
+		<-answered
+		clock.WaitForTimers(1)
+		clock.Advance(100 * time.Millisecond)
+	}()
+	ports, errs := dm.ListWithErrors()
+	require.Len(t, ports, 1)
+	require.Equal(t, "1", ports[0].Address)
+	require.Len(t, errs, 2)
+	require.ErrorIs(t, errs["hung"], ErrListTimeout)
+	require.ErrorIs(t, errs["not-started"], ErrorCodeNotStarted)
+
+	// The same errors are reported by List, sorted by discovery ID
+	close(release)
+	dm.SetListTimeout(0)
+	require.NoError(t, notStarted.Start())
+	ports, listErrs := dm.List()
+	require.Len(t, ports, 3)
+	require.Empty(t, listErrs)
+
+	require.NoError(t, notStarted.Stop())
+	ports, listErrs = dm.List()
+	require.Len(t, ports, 2)
+	require.Len(t, listErrs, 1)
+	require.ErrorContains(t, listErrs[0], "discovery not-started:")
+	dm.Quit()
+}
@@ -0,0 +1,138 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"strings"
+	"time"
+)
+
+// SetMoveTracking enables the tracking of the boards that change address,
+// for example after a reset that makes a board come back as /dev/ttyACM1
+// instead of /dev/ttyACM0. When a "remove" event of a port is followed,
+// within the given window, by an "add" event of a port of the same
+// discovery and with a matching hardware ID (see Port.MatchesHardwareID),
+// a "moved" event is delivered right after the "add" event: its Port is
+// the new port and its OldPort is the removed one. The "remove" and "add"
+// events are delivered as usual. A zero window disables the tracking (the
+// default), the setting is applied on the next StartSync.
+func (dm *Manager) SetMoveTracking(window time.Duration) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.moveWindow = window
+}
+
+func (dm *Manager) getMoveWindow() time.Duration {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	return dm.moveWindow
+}
+
+// moveTracker correlates the removed ports with the ports added shortly
+// after with the same hardware ID.
+type moveTracker struct {
+	window time.Duration
+	now    func() time.Time
+	// ports are the ports currently available, with a hardware ID
+	ports map[string]*Port
+	// removed are the ports removed in the last window
+	removed []*removedPort
+}
+
+type removedPort struct {
+	discoveryID string
+	port        *Port
+	at          time.Time
+}
+
+func newMoveTracker(window time.Duration, clock Clock) *moveTracker {
+	return &moveTracker{
+		window: window,
+		now:    clock.Now,
+		ports:  map[string]*Port{},
+	}
+}
+
+// process updates the tracker with the given event and returns the "moved"
+// event to deliver after it, or nil.
+func (t *moveTracker) process(ev *Event) *Event {
+	now := t.now()
+	t.expire(now)
+	switch ev.Type {
+	case "add":
+		if len(ev.Port.AllHardwareIDs()) == 0 {
+			return nil
+		}
+		t.ports[eventPortKey(ev.DiscoveryID, ev.Port)] = ev.Port
+		for i, removed := range t.removed {
+			if removed.discoveryID != ev.DiscoveryID || !removed.port.MatchesHardwareID(ev.Port) {
+				continue
+			}
+			t.removed = append(t.removed[:i], t.removed[i+1:]...)
+			if removed.port.Equals(ev.Port) {
+				// Back at the same address
+				return nil
+			}
+			moved := *ev
+			moved.Type = "moved"
+			moved.OldPort = removed.port
+			return &moved
+		}
+	case "remove":
+		key := eventPortKey(ev.DiscoveryID, ev.Port)
+		if port, ok := t.ports[key]; ok {
+			delete(t.ports, key)
+			t.removed = append(t.removed, &removedPort{discoveryID: ev.DiscoveryID, port: port, at: now})
+		}
+	case "snapshot":
+		t.forget(ev.DiscoveryID)
+		for _, port := range ev.Ports {
+			if len(port.AllHardwareIDs()) > 0 {
+				t.ports[eventPortKey(ev.DiscoveryID, port)] = port
+			}
+		}
+	case "reconnected", "resynced", "stop":
+		t.forget(ev.DiscoveryID)
+	}
+	return nil
+}
+
+// expire drops the removed ports older than the window.
+func (t *moveTracker) expire(now time.Time) {
+	i := 0
+	for i < len(t.removed) && now.Sub(t.removed[i].at) > t.window {
+		i++
+	}
+	t.removed = t.removed[i:]
+}
+
+// forget drops the ports of the given discovery.
+func (t *moveTracker) forget(discoveryID string) {
+	for key := range t.ports {
+		if strings.HasPrefix(key, discoveryID+"|") {
+			delete(t.ports, key)
+		}
+	}
+	removed := t.removed[:0]
+	for _, r := range t.removed {
+		if r.discoveryID != discoveryID {
+			removed = append(removed, r)
+		}
+	}
+	t.removed = removed
+}
@@ -0,0 +1,70 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMoveTracker(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	tracker := newMoveTracker(time.Second, clock)
+	event := func(eventType, discoveryID, address, hardwareID string) *Event {
+		return &Event{Type: eventType, DiscoveryID: discoveryID, Port: &Port{Address: address, Protocol: "serial", HardwareID: hardwareID}}
+	}
+	removed := func(discoveryID, address string) *Event {
+		return &Event{Type: "remove", DiscoveryID: discoveryID, Port: &Port{Address: address, Protocol: "serial"}}
+	}
+
+	require.Nil(t, tracker.process(event("add", "serial", "COM7", "1234")))
+	require.Nil(t, tracker.process(event("add", "serial", "COM3", "")))
+	require.Nil(t, tracker.process(removed("serial", "COM7")))
+	clock.Advance(500 * time.Millisecond)
+	moved := tracker.process(event("add", "serial", "COM8", "1234"))
+	require.NotNil(t, moved)
+	require.Equal(t, "moved", moved.Type)
+	require.Equal(t, "COM8", moved.Port.Address)
+	require.Equal(t, "COM7", moved.OldPort.Address)
+
+	// A board coming back at the same address didn't move
+	require.Nil(t, tracker.process(removed("serial", "COM8")))
+	require.Nil(t, tracker.process(event("add", "serial", "COM8", "1234")))
+
+	// Too late
+	require.Nil(t, tracker.process(removed("serial", "COM8")))
+	clock.Advance(2 * time.Second)
+	require.Nil(t, tracker.process(event("add", "serial", "COM9", "1234")))
+
+	// Another discovery, or a port without hardware ID
+	require.Nil(t, tracker.process(removed("serial", "COM9")))
+	require.Nil(t, tracker.process(event("add", "other", "COM10", "1234")))
+	require.Nil(t, tracker.process(removed("serial", "COM3")))
+	require.Nil(t, tracker.process(event("add", "serial", "COM4", "")))
+
+	// The removes are forgotten on reconnection
+	require.Nil(t, tracker.process(&Event{Type: "reconnected", DiscoveryID: "serial"}))
+	require.Nil(t, tracker.process(event("add", "serial", "COM11", "1234")))
+
+	// And after the sync recovery
+	require.Nil(t, tracker.process(removed("serial", "COM11")))
+	require.Nil(t, tracker.process(&Event{Type: "resynced", DiscoveryID: "serial"}))
+	require.Nil(t, tracker.process(event("add", "serial", "COM12", "1234")))
+}
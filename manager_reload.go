@@ -0,0 +1,57 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+// Replace replaces the discovery with the same ID of the given one, for
+// example after the discovery executable has been updated. If there is no
+// such discovery, Replace is the same as Add. If the Manager is in "events"
+// mode the old discovery is terminated gracefully, with QUIT, and the new
+// one is started: the ports of the old discovery are reported as removed
+// (instead of the "stop" event) and the new discovery reports them again.
+func (dm *Manager) Replace(disc *Client) error {
+	dm.mutex.Lock()
+	old := dm.discoveries[disc.GetID()]
+	if old == nil {
+		dm.mutex.Unlock()
+		return dm.Add(disc)
+	}
+	dm.setup(disc)
+	dm.discoveries[disc.GetID()] = disc
+	s := dm.sync
+	var f *forwarder
+	if s != nil {
+		// Hold the sync open while the discovery is replaced
+		s.active++
+		if f = s.forwarders[old]; f != nil {
+			f.replaced = true
+		}
+	}
+	dm.mutex.Unlock()
+
+	old.Quit()
+	if s == nil {
+		return nil
+	}
+	defer dm.detach(s)
+	if f != nil {
+		// Wait for the "remove" events to be delivered before the new
+		// discovery reports its ports
+		<-f.done
+	}
+	return dm.startSyncDiscovery(s, disc)
+}
@@ -0,0 +1,171 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"sync"
+)
+
+// defaultSinkBufferSize is the default number of events buffered by each
+// sink, see Manager.SetSinkBufferSize.
+const defaultSinkBufferSize = 100
+
+// Sink is a subscriber of the aggregated events of a Manager, created with
+// Manager.AddSink. Each Sink has its own goroutine and buffer: a slow sink
+// drops the events exceeding its buffer, and a panicking sink is recovered,
+// without affecting the other sinks or the StartSync channel.
+type Sink struct {
+	dm      *Manager
+	publish func(*Event)
+	queue   chan *Event
+	done    chan struct{}
+
+	mutex   sync.Mutex
+	closed  bool
+	dropped int
+	err     error
+}
+
+// AddSink adds a sink that is called with all the aggregated events
+// delivered by StartSync, in the same order, including the events of the
+// following StartSync. The events are shared between the sinks and must not
+// be modified. The sink is called from a dedicated goroutine, it may block
+// (for example, forwarding the events on the network) at the cost of losing
+// the events exceeding its buffer. The sink is active until Close is called.
+func (dm *Manager) AddSink(sink func(*Event)) *Sink {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	size := dm.sinkBufferSize
+	if size <= 0 {
+		size = defaultSinkBufferSize
+	}
+	s := &Sink{
+		dm:      dm,
+		publish: sink,
+		queue:   make(chan *Event, size),
+		done:    make(chan struct{}),
+	}
+	// The list is copied on write: publish uses it without copying
+	sinks := make([]*Sink, 0, len(dm.sinks)+1)
+	dm.sinks = append(append(sinks, dm.sinks...), s)
+	go s.run()
+	return s
+}
+
+// SetSinkBufferSize sets the number of events buffered by each sink, the
+// setting is applied to the sinks added later. The default is 100.
+func (dm *Manager) SetSinkBufferSize(size int) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.sinkBufferSize = size
+}
+
+// ChannelSink returns a sink that sends the events in the given channel.
+// The channel is not closed by the sink.
+func ChannelSink(ch chan<- *Event) func(*Event) {
+	return func(ev *Event) {
+		ch <- ev
+	}
+}
+
+// JournalSink returns a sink that records the events in the given Journal.
+// Unlike Manager.SetJournal, a slow journal does not delay the delivery of
+// the events to StartSync. The write errors are reported by Journal.Err.
+func JournalSink(journal *Journal) func(*Event) {
+	return journal.Record
+}
+
+// Close removes the sink from the Manager and waits for the delivery of the
+// buffered events.
+func (s *Sink) Close() {
+	s.dm.mutex.Lock()
+	sinks := []*Sink{}
+	for _, sink := range s.dm.sinks {
+		if sink != s {
+			sinks = append(sinks, sink)
+		}
+	}
+	s.dm.sinks = sinks
+	s.dm.mutex.Unlock()
+
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mutex.Unlock()
+	<-s.done
+}
+
+// Dropped returns the number of events dropped because the buffer of the
+// sink was full.
+func (s *Sink) Dropped() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+// Err returns the last panic of the sink, if any.
+func (s *Sink) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// enqueue buffers the event for the sink, without blocking.
+func (s *Sink) enqueue(ev *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		s.dropped++
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	for ev := range s.queue {
+		s.call(ev)
+	}
+}
+
+func (s *Sink) call(ev *Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.mutex.Lock()
+			s.err = fmt.Errorf("sink panic: %v", r)
+			s.mutex.Unlock()
+		}
+	}()
+	s.publish(ev)
+}
+
+// publish delivers the event to all the sinks of the Manager.
+func (dm *Manager) publish(ev *Event) {
+	dm.mutex.Lock()
+	sinks := dm.sinks
+	dm.mutex.Unlock()
+	for _, s := range sinks {
+		s.enqueue(ev)
+	}
+}
@@ -0,0 +1,107 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerSinks(t *testing.T) {
+	dm := NewManager()
+	dm.SetSinkBufferSize(2)
+
+	// A blocked sink drops the events exceeding its buffer...
+	blocked := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	slowEvents := []*Event{}
+	slow := dm.AddSink(func(ev *Event) {
+		blocked <- struct{}{}
+		<-unblock
+		slowEvents = append(slowEvents, ev)
+	})
+	// ...a panicking sink is recovered...
+	panicking := dm.AddSink(func(ev *Event) {
+		if ev.Seq == 1 {
+			panic("sink failure")
+		}
+	})
+	// ...and they don't affect the other sinks
+	ch := make(chan *Event, 10)
+	fast := dm.AddSink(ChannelSink(ch))
+	journal := &bytes.Buffer{}
+	dm.SetSinkBufferSize(10)
+	journalSink := dm.AddSink(JournalSink(NewJournal(journal)))
+
+	for i := 1; i <= 5; i++ {
+		dm.publish(&Event{Type: "add", DiscoveryID: "a", Seq: uint64(i), Port: &Port{Address: "1", Protocol: "test"}})
+		require.Equal(t, uint64(i), (<-ch).Seq)
+		if i == 1 {
+			<-blocked
+		}
+	}
+	fast.Close()
+	panicking.Close()
+	require.EqualError(t, panicking.Err(), "sink panic: sink failure")
+	require.Zero(t, panicking.Dropped())
+	journalSink.Close()
+	require.Equal(t, 5, bytes.Count(journal.Bytes(), []byte("\n")))
+
+	close(unblock)
+	go func() {
+		for range blocked {
+		}
+	}()
+	slow.Close()
+	close(blocked)
+	require.NoError(t, slow.Err())
+	// The first event is being delivered, two are buffered
+	require.Equal(t, 2, slow.Dropped())
+	require.Len(t, slowEvents, 3)
+	require.Equal(t, uint64(1), slowEvents[0].Seq)
+
+	// The closed sinks are not called anymore
+	require.Empty(t, dm.sinks)
+	dm.publish(&Event{Type: "stop", DiscoveryID: "a"})
+	require.Len(t, slowEvents, 3)
+}
+
+func TestManagerSinksWithDiscovery(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	dm := NewManager()
+	require.NoError(t, dm.Add(NewClient("a", "dummy-discovery/dummy-discovery")))
+	events := make(chan *Event, 10)
+	sink := dm.AddSink(ChannelSink(events))
+	defer sink.Close()
+
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	ev := <-ch
+	require.Same(t, ev, <-events)
+	dm.Quit()
+	for ev := range ch {
+		require.Same(t, ev, <-events)
+	}
+}
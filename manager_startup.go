@@ -0,0 +1,196 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sort"
+	"sync"
+)
+
+// managerStartup is the startup configuration of the discoveries of a
+// Manager, guarded by the Manager mutex.
+type managerStartup struct {
+	priorities  map[string]int
+	concurrency int
+	// lazy are the protocols of the discoveries started lazily, by ID
+	lazy map[string][]string
+	// touched are the lazy discoveries already requested
+	touched map[string]bool
+	// started is true after Start, until Stop
+	started bool
+}
+
+// SetStartupPriority sets the startup priority of the discovery with the
+// given ID, the default priority is 0. Start and StartSync start the
+// discoveries with higher priority first: the discoveries with a lower
+// priority are started only when all the others have been started. The
+// discoveries with the same priority are started concurrently, see
+// SetStartupConcurrency.
+func (dm *Manager) SetStartupPriority(discoveryID string, priority int) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dm.startup.priorities == nil {
+		dm.startup.priorities = map[string]int{}
+	}
+	dm.startup.priorities[discoveryID] = priority
+}
+
+// SetStartupConcurrency sets how many discoveries, with the same startup
+// priority, Start and StartSync may start at the same time. The default is
+// 1: the discoveries are started one after the other.
+func (dm *Manager) SetStartupConcurrency(concurrency int) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.startup.concurrency = max(concurrency, 1)
+}
+
+// SetLazyStart makes the discovery with the given ID lazy: it's not started
+// by Start and StartSync, nor queried by List, until one of the given
+// protocols is requested with StartProtocols (or FindPort). This way the
+// host application doesn't pay the startup cost of the discoveries of the
+// protocols never used. Without protocols the discovery is started
+// eagerly again, the default.
+func (dm *Manager) SetLazyStart(discoveryID string, protocols ...string) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if len(protocols) == 0 {
+		delete(dm.startup.lazy, discoveryID)
+		return
+	}
+	if dm.startup.lazy == nil {
+		dm.startup.lazy = map[string][]string{}
+	}
+	dm.startup.lazy[discoveryID] = append([]string(nil), protocols...)
+}
+
+// StartProtocols starts the lazy discoveries of the given protocols, see
+// SetLazyStart, in the current mode of the Manager: in "events" mode their
+// events are delivered in the channel returned by StartSync, after Start
+// they are STARTed, otherwise they will be started by the next Start or
+// StartSync. The discoveries that fail are reported in the returned errors.
+func (dm *Manager) StartProtocols(protocols ...string) []error {
+	dm.mutex.Lock()
+	var requested []*Client
+	for id, lazyProtocols := range dm.startup.lazy {
+		disc := dm.discoveries[id]
+		if disc == nil || dm.startup.touched[id] || !hasAnyProtocol(lazyProtocols, protocols) {
+			continue
+		}
+		if dm.startup.touched == nil {
+			dm.startup.touched = map[string]bool{}
+		}
+		dm.startup.touched[id] = true
+		requested = append(requested, disc)
+	}
+	started := dm.startup.started
+	dm.mutex.Unlock()
+	sort.Slice(requested, func(i, j int) bool { return requested[i].GetID() < requested[j].GetID() })
+
+	if s := dm.acquireSync(); s != nil {
+		defer dm.detach(s)
+		return dm.startAll(requested, func(disc *Client) error { return dm.startSyncDiscovery(s, disc) })
+	}
+	if started {
+		return dm.startAll(requested, dm.startDiscovery)
+	}
+	return nil
+}
+
+// hasAnyProtocol returns true if one of the requested protocols is in the
+// given ones.
+func hasAnyProtocol(protocols, requested []string) bool {
+	for _, protocol := range requested {
+		for _, p := range protocols {
+			if p == protocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// activeDiscoveries returns the discoveries sorted by ID, excluding the lazy
+// discoveries not requested yet.
+func (dm *Manager) activeDiscoveries() []*Client {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	res := []*Client{}
+	for id, disc := range dm.discoveries {
+		if dm.isActive(id) {
+			res = append(res, disc)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].GetID() < res[j].GetID() })
+	return res
+}
+
+// isActive returns false for the lazy discoveries not requested yet. The
+// mutex must be held by the caller.
+func (dm *Manager) isActive(id string) bool {
+	_, lazy := dm.startup.lazy[id]
+	return !lazy || dm.startup.touched[id]
+}
+
+// startAll starts the given discoveries with the given function, in order
+// of startup priority, and returns the errors in the order of the
+// discoveries.
+func (dm *Manager) startAll(discoveries []*Client, start func(*Client) error) []error {
+	dm.mutex.Lock()
+	concurrency := max(dm.startup.concurrency, 1)
+	priority := map[*Client]int{}
+	for _, disc := range discoveries {
+		priority[disc] = dm.startup.priorities[disc.GetID()]
+	}
+	dm.mutex.Unlock()
+
+	ordered := append([]*Client(nil), discoveries...)
+	sort.SliceStable(ordered, func(i, j int) bool { return priority[ordered[i]] > priority[ordered[j]] })
+	results := map[*Client]error{}
+	var resultsMutex sync.Mutex
+	for len(ordered) > 0 {
+		// The discoveries with the same priority are started together
+		n := 1
+		for n < len(ordered) && priority[ordered[n]] == priority[ordered[0]] {
+			n++
+		}
+		group := ordered[:n]
+		ordered = ordered[n:]
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, concurrency)
+		for _, disc := range group {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(disc *Client) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				err := start(disc)
+				resultsMutex.Lock()
+				results[disc] = err
+				resultsMutex.Unlock()
+			}(disc)
+		}
+		wg.Wait()
+	}
+	var errs []error
+	for _, disc := range discoveries {
+		if err := results[disc]; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,153 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startupRecorder records the commands received by the discoveries.
+type startupRecorder struct {
+	mutex    sync.Mutex
+	commands []string
+}
+
+// client returns a Client connected, when run, to a new Server with the
+// given middleware.
+func (r *startupRecorder) client(id string, middleware CommandMiddleware) *Client {
+	return NewConnClient(id, func() (io.ReadWriteCloser, error) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			server := NewServer(&testDiscovery{})
+			server.Use(func(cmd string, next func()) {
+				r.mutex.Lock()
+				r.commands = append(r.commands, id+" "+strings.Fields(cmd)[0])
+				r.mutex.Unlock()
+				next()
+			})
+			if middleware != nil {
+				server.Use(middleware)
+			}
+			_ = server.Run(serverConn, serverConn)
+		}()
+		return clientConn, nil
+	})
+}
+
+func (r *startupRecorder) matching(suffix string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res := []string{}
+	for _, command := range r.commands {
+		if strings.HasSuffix(command, suffix) {
+			res = append(res, command)
+		}
+	}
+	return res
+}
+
+func TestManagerStartupPriority(t *testing.T) {
+	recorder := &startupRecorder{}
+	dm := NewManager()
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, dm.Add(recorder.client(id, nil)))
+	}
+	dm.SetStartupPriority("b", 10)
+	dm.SetStartupPriority("c", 5)
+	require.Empty(t, dm.Start())
+	require.Equal(t, []string{"b START", "c START", "a START"}, recorder.matching(" START"))
+	dm.Quit()
+
+	// The discoveries with the same priority are started concurrently: each
+	// one waits for the other to receive the START
+	arrived := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+	barrier := func(id, other string) CommandMiddleware {
+		return func(cmd string, next func()) {
+			if cmd == "START_SYNC" {
+				close(arrived[id])
+				select {
+				case <-arrived[other]:
+				case <-time.After(5 * time.Second):
+				}
+			}
+			next()
+		}
+	}
+	recorder = &startupRecorder{}
+	dm = NewManager()
+	dm.SetStartupConcurrency(2)
+	require.NoError(t, dm.Add(recorder.client("a", barrier("a", "b"))))
+	require.NoError(t, dm.Add(recorder.client("b", barrier("b", "a"))))
+	start := time.Now()
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	require.Less(t, time.Since(start), 5*time.Second)
+	dm.Quit()
+	for range ch {
+	}
+}
+
+func TestManagerLazyStart(t *testing.T) {
+	recorder := &startupRecorder{}
+	dm := NewManager()
+	require.NoError(t, dm.Add(recorder.client("serial", nil)))
+	dm.SetLazyStart("network", "network")
+	require.NoError(t, dm.Add(recorder.client("network", nil)))
+
+	require.Empty(t, dm.Start())
+	require.Equal(t, []string{"serial HELLO"}, recorder.matching(" HELLO"))
+	ports, errs := dm.List()
+	require.Empty(t, errs)
+	require.Len(t, ports, 1)
+	require.Empty(t, dm.StartProtocols("serial"))
+	require.Equal(t, []string{"serial HELLO"}, recorder.matching(" HELLO"))
+
+	// The lazy discovery is started on request, in the current mode
+	require.Empty(t, dm.StartProtocols("serial", "network"))
+	require.Equal(t, []string{"serial START", "network START"}, recorder.matching(" START"))
+	ports, errs = dm.List()
+	require.Empty(t, errs)
+	require.Len(t, ports, 2)
+	require.Empty(t, dm.StartProtocols("network"))
+	require.Len(t, recorder.matching(" START"), 2)
+	dm.Quit()
+
+	// In "events" mode the events of the lazy discovery are delivered in
+	// the same channel
+	recorder = &startupRecorder{}
+	dm = NewManager()
+	dm.SetLazyStart("network", "network")
+	require.NoError(t, dm.Add(recorder.client("serial", nil)))
+	require.NoError(t, dm.Add(recorder.client("network", nil)))
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	require.Equal(t, "serial", (<-ch).DiscoveryID)
+	require.Empty(t, dm.StartProtocols("network"))
+	require.Equal(t, "network", (<-ch).DiscoveryID)
+	dm.Quit()
+	for range ch {
+	}
+}
@@ -0,0 +1,165 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	metrics := &testMetrics{}
+	dm := NewManager()
+	dm.SetMetrics(metrics)
+	require.NoError(t, dm.Add(NewClient("a", "dummy-discovery/dummy-discovery")))
+	require.NoError(t, dm.Add(NewClient("b", "dummy-discovery/dummy-discovery")))
+	require.Error(t, dm.Add(NewClient("a", "dummy-discovery/dummy-discovery")))
+	require.Len(t, dm.Discoveries(), 2)
+
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	received := map[string]int{}
+	for i := 0; i < 4; i++ {
+		ev := <-ch
+		require.Equal(t, "add", ev.Type)
+		received[ev.DiscoveryID]++
+	}
+	require.Equal(t, map[string]int{"a": 2, "b": 2}, received)
+
+	// Metrics have been plumbed to all the discoveries
+	require.Equal(t, 1, metrics.count("a HELLO"))
+	require.Equal(t, 1, metrics.count("b START_SYNC"))
+	require.Equal(t, 2, metrics.count("a event add"))
+
+	dm.Quit()
+	for range ch {
+		// drain remaining events until all the discoveries are closed
+	}
+
+	// Transformers are applied to the aggregated events
+	dm = NewManager()
+	require.NoError(t, dm.Add(NewClient("a", "dummy-discovery/dummy-discovery")))
+	dm.Use(FilterPorts(func(discoveryID string, port *Port) bool { return port.Address != "1" }))
+	dm.Use(RenameLabels(func(discoveryID string, port *Port) string { return "Lab " + port.AddressLabel }))
+	ch, errs = dm.StartSync(10)
+	require.Empty(t, errs)
+	ev := <-ch
+	require.Equal(t, "2", ev.Port.Address)
+	require.Equal(t, "Lab Dummy upload port", ev.Port.AddressLabel)
+	dm.Quit()
+	for range ch {
+	}
+
+	// The port enricher is plumbed to the discoveries added later
+	dm = NewManager()
+	dm.SetPortEnricher(func(port *Port) *Port {
+		res := port.Clone()
+		res.HardwareID = "enriched"
+		return res
+	})
+	require.NoError(t, dm.Add(NewClient("a", "dummy-discovery/dummy-discovery")))
+	ch, errs = dm.StartSync(10)
+	require.Empty(t, errs)
+	ev = <-ch
+	require.Equal(t, "enriched", ev.Port.HardwareID)
+	dm.Quit()
+	for range ch {
+	}
+}
+
+func TestManagerAddWhileSyncing(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	dm := NewManager()
+	require.NoError(t, dm.Add(NewClient("a", "dummy-discovery/dummy-discovery")))
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	require.Equal(t, "a", (<-ch).DiscoveryID)
+	require.Equal(t, "a", (<-ch).DiscoveryID)
+
+	// The discovery added later is started and joins the event stream
+	require.NoError(t, dm.Add(NewClient("b", "dummy-discovery/dummy-discovery")))
+	ev := <-ch
+	require.Equal(t, "b", ev.DiscoveryID)
+	require.Equal(t, "add", ev.Type)
+
+	// The stream is closed when all the discoveries are terminated
+	dm.Quit()
+	for range ch {
+	}
+	require.Error(t, dm.Add(NewClient("b", "dummy-discovery/dummy-discovery")))
+	require.ErrorIs(t, dm.Add(NewClient("a", "dummy-discovery/dummy-discovery")), ErrAlreadyAdded)
+	require.NoError(t, dm.Add(NewClient("c", "dummy-discovery/dummy-discovery")))
+	require.False(t, dm.Discoveries()[2].Alive())
+}
+
+func TestManagerReplace(t *testing.T) {
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	dm := NewManager()
+	// Replace works as Add if the discovery is not in the Manager
+	require.NoError(t, dm.Replace(NewClient("a", "dummy-discovery/dummy-discovery")))
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	require.Equal(t, "add", (<-ch).Type)
+	require.Equal(t, "add", (<-ch).Type)
+
+	// The ports of the old discovery are removed and added again by the new one
+	newDisc := NewClient("a", "dummy-discovery/dummy-discovery")
+	require.NoError(t, dm.Replace(newDisc))
+	removed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		ev := <-ch
+		require.Equal(t, "remove", ev.Type)
+		removed[ev.Port.Address] = true
+	}
+	require.Equal(t, map[string]bool{"1": true, "2": true}, removed)
+	ev := <-ch
+	require.Equal(t, "add", ev.Type)
+	require.Equal(t, "1", ev.Port.Address)
+	require.Same(t, newDisc, dm.Discoveries()[0])
+
+	dm.Quit()
+	for range ch {
+	}
+}
+
+func TestForwarderTrack(t *testing.T) {
+	f := &forwarder{ports: map[string]*Port{}}
+	port := &Port{Address: "/dev/ttyACM0", Protocol: "serial"}
+	for _, eventType := range []string{"reconnected", "resynced"} {
+		f.track(&Event{Type: "add", Port: port})
+		require.Len(t, f.ports, 1)
+		// The discovery is going to report all its ports again
+		f.track(&Event{Type: eventType})
+		require.Empty(t, f.ports, eventType)
+	}
+}
@@ -0,0 +1,23 @@
+module github.com/arduino/pluggable-discovery-protocol-handler/v2/mdns-discovery
+
+go 1.21
+
+require (
+	github.com/arduino/go-properties-orderedmap v1.8.0
+	github.com/arduino/pluggable-discovery-protocol-handler/v2 v2.2.0
+	github.com/hashicorp/mdns v1.0.5
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
+	github.com/arduino/go-paths-helper v1.10.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/miekg/dns v1.1.41 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/net v0.0.0-20210410081132-afb366fc7cd1 // indirect
+	golang.org/x/sys v0.0.0-20210330210617-4fbd30eecc44 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/arduino/pluggable-discovery-protocol-handler/v2 => ../
@@ -0,0 +1,153 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// mdns-discovery is an example network discovery: it browses the Arduino
+// boards announced via mDNS as "_arduino._tcp" services and reports them as
+// "network" ports. It's a reference for the authors of network discoveries
+// based on periodic announcements, relying on the Server port TTL to detect
+// the boards that go away.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	properties "github.com/arduino/go-properties-orderedmap"
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/hashicorp/mdns"
+)
+
+// The mDNS service browsed by the discovery.
+const mdnsServiceName = "_arduino._tcp"
+
+// queryInterval is the interval between the mDNS queries, a board not
+// answering to three consecutive queries is considered gone.
+const queryInterval = 5 * time.Second
+
+func main() {
+	server := discovery.NewContextServer(&mdnsDiscovery{})
+	server.SetPortTTL(3 * queryInterval)
+	discovery.RunServer(server)
+}
+
+// mdnsDiscovery is a ContextDiscovery browsing the mDNS services.
+type mdnsDiscovery struct {
+	wg sync.WaitGroup
+}
+
+// Hello does nothing.
+func (d *mdnsDiscovery) Hello(ctx context.Context, userAgent string, protocolVersion int) error {
+	return nil
+}
+
+// StartSync starts a goroutine that queries the network periodically, until
+// the context is cancelled.
+func (d *mdnsDiscovery) StartSync(ctx context.Context, eventCB discovery.SyncEventCallback, errorCB discovery.ErrorCallback) error {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			if err := query(ctx, eventCB); errors.Is(err, discovery.ErrEventNotDelivered) {
+				// The client went away, wait for the next START_SYNC
+				return
+			} else if err != nil {
+				errorCB(err.Error())
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(queryInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop waits for the running query to complete, the context passed to
+// StartSync is already cancelled.
+func (d *mdnsDiscovery) Stop(ctx context.Context) error {
+	d.wg.Wait()
+	return nil
+}
+
+// Quit stops the discovery.
+func (d *mdnsDiscovery) Quit(ctx context.Context) {
+	d.wg.Wait()
+}
+
+// query runs a single mDNS query and reports the boards found.
+func query(ctx context.Context, eventCB discovery.SyncEventCallback) error {
+	entries := make(chan *mdns.ServiceEntry)
+	done := make(chan error, 1)
+	go func() {
+		params := mdns.DefaultParams(mdnsServiceName)
+		params.Entries = entries
+		params.Timeout = 2 * time.Second
+		// The IPv6 multicast is not available on all the networks
+		params.DisableIPv6 = true
+		done <- mdns.Query(params)
+		close(entries)
+	}()
+	var res error
+	for entry := range entries {
+		if res != nil || ctx.Err() != nil {
+			// Drain the entries until the query ends
+			continue
+		}
+		if port := newBoardPort(entry); port != nil {
+			res = eventCB("add", port)
+		}
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	return res
+}
+
+// newBoardPort creates the Port of a board announced via mDNS, with the
+// conventional properties: "hostname", "port" and the TXT records of the
+// service (for example "board" or "auth_upload"). It returns nil if the
+// announcement has no IPv4 address.
+func newBoardPort(entry *mdns.ServiceEntry) *discovery.Port {
+	ip := entry.AddrV4
+	if ip == nil {
+		return nil
+	}
+	name := strings.TrimSuffix(entry.Name, "."+mdnsServiceName+".local.")
+	props := properties.NewMap()
+	props.Set("hostname", strings.TrimSuffix(entry.Host, "."))
+	props.Set("port", strconv.Itoa(entry.Port))
+	for _, field := range entry.InfoFields {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			props.Set(key, value)
+		}
+	}
+	return &discovery.Port{
+		Address:       ip.String(),
+		AddressLabel:  fmt.Sprintf("%s at %s", name, ip),
+		Protocol:      "network",
+		ProtocolLabel: "Network Port",
+		Properties:    props,
+		HardwareID:    props.Get("serial_number"),
+	}
+}
@@ -0,0 +1,49 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/mdns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBoardPort(t *testing.T) {
+	port := newBoardPort(&mdns.ServiceEntry{
+		Name:       "UNO R4 WiFi._arduino._tcp.local.",
+		Host:       "uno-r4.local.",
+		AddrV4:     net.IPv4(192, 168, 1, 10),
+		Port:       65280,
+		InfoFields: []string{"board=unor4wifi", "auth_upload=yes", "malformed"},
+	})
+	require.Equal(t, "192.168.1.10", port.Address)
+	require.Equal(t, "UNO R4 WiFi at 192.168.1.10", port.AddressLabel)
+	require.Equal(t, "network", port.Protocol)
+	require.Equal(t, "Network Port", port.ProtocolLabel)
+	require.Equal(t, map[string]string{
+		"hostname":    "uno-r4.local",
+		"port":        "65280",
+		"board":       "unor4wifi",
+		"auth_upload": "yes",
+	}, port.Properties.AsMap())
+
+	// Only the IPv4 announcements are reported
+	require.Nil(t, newBoardPort(&mdns.ServiceEntry{Name: "board._arduino._tcp.local.", AddrV6: net.IPv6loopback}))
+}
@@ -17,13 +17,80 @@
 
 package discovery
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// message is a message of the protocol, sent by the discoveries in reply to
+// the commands or to report the port events. Extensions holds the unknown
+// fields of the message, as a JSON object, to be sent again when the
+// message is encoded.
 type message struct {
-	EventType       string   `json:"eventType"`
-	Message         string   `json:"message,omitempty"`
-	Error           bool     `json:"error,omitempty"`
-	ProtocolVersion int      `json:"protocolVersion,omitempty"`
-	Port            *Port    `json:"port,omitempty"`
-	Ports           *[]*Port `json:"ports,omitempty"`
+	EventType       string          `json:"eventType"`
+	Message         string          `json:"message,omitempty"`
+	Error           bool            `json:"error,omitempty"`
+	Code            string          `json:"code,omitempty"`            // Used in error messages
+	ProtocolVersion int             `json:"protocolVersion,omitempty"` // Used in HELLO command
+	Port            *Port           `json:"port,omitempty"`            // Used in add and remove events
+	Ports           []*Port         `json:"ports"`                     // Used in LIST command
+	Capabilities    []string        `json:"capabilities,omitempty"`    // Used in HELLO command
+	PropertySchema  PropertySchema  `json:"propertySchema,omitempty"`  // Used in HELLO command
+	More            bool            `json:"more,omitempty"`            // Used in chunked LIST responses
+	Checks          []SelfTestCheck `json:"checks,omitempty"`          // Used in SELFTEST command
+	Extensions      json.RawMessage `json:"-"`
+
+	// raw is the message as received, set for the responses to the
+	// commands if a protocol violation handler is set.
+	raw json.RawMessage
+}
+
+// messageJSONKeys are the quoted keys of the fields of message.
+var messageJSONKeys = map[string]bool{
+	`"eventType"`: true, `"message"`: true, `"error"`: true, `"code"`: true, `"protocolVersion"`: true,
+	`"port"`: true, `"ports"`: true, `"capabilities"`: true, `"propertySchema"`: true, `"more"`: true,
+	`"checks"`: true,
+}
+
+// MarshalJSON implements json.Marshaler. The "ports" field is sent only if
+// Ports is not nil, an empty list of ports is sent as an empty array. The
+// Extensions are sent after the known fields.
+func (msg message) MarshalJSON() ([]byte, error) {
+	type plainMessage message
+	var ports *[]*Port
+	if msg.Ports != nil {
+		ports = &msg.Ports
+	}
+	data, err := json.Marshal(&struct {
+		*plainMessage
+		Ports *[]*Port `json:"ports,omitempty"`
+		More  bool     `json:"more,omitempty"`
+	}{
+		plainMessage: (*plainMessage)(&msg),
+		Ports:        ports,
+		More:         msg.More,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return appendJSONMembers(data, msg.Extensions, messageJSONKeys)
+}
+
+func (msg message) String() string {
+	s := fmt.Sprintf("type: %s", msg.EventType)
+	if msg.Message != "" {
+		s += fmt.Sprintf(", message: %s", msg.Message)
+	}
+	if msg.ProtocolVersion != 0 {
+		s += fmt.Sprintf(", protocol version: %d", msg.ProtocolVersion)
+	}
+	if len(msg.Ports) > 0 {
+		s += fmt.Sprintf(", ports: %s", msg.Ports)
+	}
+	if msg.Port != nil {
+		s += fmt.Sprintf(", port: %s", msg.Port)
+	}
+	return s
 }
 
 func messageOk(event string) *message {
@@ -33,10 +100,11 @@ func messageOk(event string) *message {
 	}
 }
 
-func messageError(event, msg string) *message {
+func messageError(event string, code ErrorCode, msg string) *message {
 	return &message{
 		EventType: event,
 		Error:     true,
+		Code:      string(code),
 		Message:   msg,
 	}
 }
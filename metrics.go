@@ -0,0 +1,78 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics is the interface that must be implemented by a metrics collector
+// to be used in the discovery client (or in all the clients of a Manager,
+// using Manager.SetMetrics). An adapter for Prometheus is available
+// in the "prometheus" submodule.
+type Metrics interface {
+	// CommandLatency is called when a command round-trip is completed, with
+	// the time elapsed and the resulting error (nil if the command succeeded).
+	CommandLatency(discoveryID, command string, elapsed time.Duration, err error)
+
+	// EventReceived is called for each port event received from the discovery.
+	EventReceived(discoveryID, eventType string)
+
+	// EventsBacklog is called each time an event is queued in the event
+	// channel, with the number of events waiting to be consumed.
+	EventsBacklog(discoveryID string, backlog int)
+
+	// ProcessRestarted is called each time the discovery process is started
+	// again after the first run.
+	ProcessRestarted(discoveryID string)
+}
+
+type nullMetrics struct{}
+
+func (m *nullMetrics) CommandLatency(discoveryID, command string, elapsed time.Duration, err error) {}
+func (m *nullMetrics) EventReceived(discoveryID, eventType string)                                  {}
+func (m *nullMetrics) EventsBacklog(discoveryID string, backlog int)                                {}
+func (m *nullMetrics) ProcessRestarted(discoveryID string)                                          {}
+
+// SetMetrics sets the metrics collector to be used in the discovery
+func (disc *Client) SetMetrics(metrics Metrics) {
+	disc.metrics = metrics
+}
+
+// instrumentCommand notifies the tracer and the metrics collector that a
+// command is being sent. The returned function must be called when the
+// command round-trip is completed, the errors reported by the discovery are
+// recorded as the last error (see LastError). The commands are serialized:
+// the command can't be sent until the previous one is completed.
+func (disc *Client) instrumentCommand(command string) func(err error) {
+	disc.commandMutex.Lock()
+	start := disc.clock.Now()
+	endTrace := disc.tracer.StartCommand(disc.traceCtx, disc.id, command)
+	return func(err error) {
+		endTrace(err)
+		disc.metrics.CommandLatency(disc.id, command, disc.clock.Now().Sub(start), err)
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) {
+			disc.statusMutex.Lock()
+			disc.lastError = err
+			disc.statusMutex.Unlock()
+		}
+		disc.commandMutex.Unlock()
+	}
+}
@@ -0,0 +1,722 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/arduino/go-properties-orderedmap"
+)
+
+// CapabilityMsgpackFraming is the capability advertised in the HELLO
+// response by the servers that, after a "FRAMING MSGPACK" command, send the
+// messages encoded in MessagePack instead of JSON, see
+// Server.SetMsgpackFraming. Each message is preceded by its length, as a
+// 32 bits big-endian unsigned integer. The commands are still sent as text.
+const CapabilityMsgpackFraming = "msgpack_framing"
+
+// maxFrameSize is the maximum size of a MessagePack frame accepted by the
+// Client.
+const maxFrameSize = 16 * 1024 * 1024
+
+// The values of a MessagePack document are decoded as nil, bool, int64,
+// float64, string, []interface{} or mpMap.
+
+// mpMap is a MessagePack map, the order of the entries is preserved.
+type mpMap []mpEntry
+
+type mpEntry struct {
+	key   string
+	value interface{}
+}
+
+// get returns the value with the given key, or nil.
+func (m mpMap) get(key string) interface{} {
+	for _, e := range m {
+		if e.key == key {
+			return e.value
+		}
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, keeping the order of the entries.
+func (m mpMap) MarshalJSON() ([]byte, error) {
+	var res bytes.Buffer
+	res.WriteByte('{')
+	for i, e := range m {
+		if i > 0 {
+			res.WriteByte(',')
+		}
+		key, _ := json.Marshal(e.key)
+		value, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		res.Write(key)
+		res.WriteByte(':')
+		res.Write(value)
+	}
+	res.WriteByte('}')
+	return res.Bytes(), nil
+}
+
+// mpEncoder writes MessagePack values.
+type mpEncoder struct {
+	bytes.Buffer
+}
+
+func (e *mpEncoder) writeHeader(fix, fixMax byte, code16 byte, n int) {
+	switch {
+	case n <= int(fixMax):
+		e.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		e.WriteByte(code16)
+		_ = binary.Write(e, binary.BigEndian, uint16(n))
+	default:
+		e.WriteByte(code16 + 1)
+		_ = binary.Write(e, binary.BigEndian, uint32(n))
+	}
+}
+
+func (e *mpEncoder) writeString(s string) {
+	if len(s) < 32 || len(s) > math.MaxUint8 {
+		e.writeHeader(0xa0, 31, 0xda, len(s))
+	} else {
+		e.WriteByte(0xd9)
+		e.WriteByte(byte(len(s)))
+	}
+	e.WriteString(s)
+}
+
+func (e *mpEncoder) writeInt(v int64) {
+	if v >= -32 && v <= 127 {
+		e.WriteByte(byte(v))
+		return
+	}
+	e.WriteByte(0xd3)
+	_ = binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *mpEncoder) writeBool(v bool) {
+	if v {
+		e.WriteByte(0xc3)
+	} else {
+		e.WriteByte(0xc2)
+	}
+}
+
+func (e *mpEncoder) writeFloat(v float64) {
+	e.WriteByte(0xcb)
+	_ = binary.Write(e, binary.BigEndian, math.Float64bits(v))
+}
+
+func (e *mpEncoder) writeMapHeader(n int) {
+	e.writeHeader(0x80, 15, 0xde, n)
+}
+
+func (e *mpEncoder) writeArrayHeader(n int) {
+	e.writeHeader(0x90, 15, 0xdc, n)
+}
+
+func (e *mpEncoder) writeStrings(values []string) {
+	e.writeArrayHeader(len(values))
+	for _, v := range values {
+		e.writeString(v)
+	}
+}
+
+// writeJSON writes the given JSON value, keeping the order of the members
+// of the objects. The value must be valid JSON.
+func (e *mpEncoder) writeJSON(data json.RawMessage) {
+	switch data[skipJSONSpaces(data, 0)] {
+	case '{':
+		f := &mpFields{}
+		_ = forEachJSONMember(data, func(key, value []byte) error {
+			k, _ := unquoteJSONString(key)
+			f.add(k, func(e *mpEncoder) { e.writeJSON(value) })
+			return nil
+		})
+		f.write(e)
+	case '[':
+		var values []json.RawMessage
+		_ = json.Unmarshal(data, &values)
+		e.writeArrayHeader(len(values))
+		for _, v := range values {
+			e.writeJSON(v)
+		}
+	default:
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		_ = dec.Decode(&v)
+		switch v := v.(type) {
+		case nil:
+			e.WriteByte(0xc0)
+		case bool:
+			e.writeBool(v)
+		case string:
+			e.writeString(v)
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				e.writeInt(n)
+			} else {
+				f, _ := v.Float64()
+				e.writeFloat(f)
+			}
+		}
+	}
+}
+
+// mpFields collects the fields of a map before writing them, to know their
+// number in advance.
+type mpFields struct {
+	n      int
+	fields []func(e *mpEncoder)
+}
+
+func (f *mpFields) add(key string, write func(e *mpEncoder)) {
+	f.n++
+	f.fields = append(f.fields, func(e *mpEncoder) {
+		e.writeString(key)
+		write(e)
+	})
+}
+
+func (f *mpFields) addString(key, value string, omitEmpty bool) {
+	if omitEmpty && value == "" {
+		return
+	}
+	f.add(key, func(e *mpEncoder) { e.writeString(value) })
+}
+
+// addExtensions adds the members of the extensions whose key is not in
+// known. The invalid extensions are not sent.
+func (f *mpFields) addExtensions(extensions json.RawMessage, known map[string]bool) {
+	if len(extensions) == 0 || !json.Valid(extensions) {
+		return
+	}
+	_ = forEachJSONMember(extensions, func(key, value []byte) error {
+		if k, err := unquoteJSONString(key); err == nil && !known[string(key)] {
+			f.add(k, func(e *mpEncoder) { e.writeJSON(value) })
+		}
+		return nil
+	})
+}
+
+func (f *mpFields) write(e *mpEncoder) {
+	e.writeMapHeader(f.n)
+	for _, write := range f.fields {
+		write(e)
+	}
+}
+
+// writeMessage writes the message with the same fields of its JSON encoding.
+func (e *mpEncoder) writeMessage(msg *message) {
+	f := &mpFields{}
+	f.addString("eventType", msg.EventType, false)
+	f.addString("message", msg.Message, true)
+	if msg.Error {
+		f.add("error", func(e *mpEncoder) { e.writeBool(true) })
+	}
+	f.addString("code", msg.Code, true)
+	if msg.ProtocolVersion != 0 {
+		f.add("protocolVersion", func(e *mpEncoder) { e.writeInt(int64(msg.ProtocolVersion)) })
+	}
+	if msg.Port != nil {
+		f.add("port", func(e *mpEncoder) { e.writePort(msg.Port) })
+	}
+	if msg.Ports != nil {
+		f.add("ports", func(e *mpEncoder) {
+			e.writeArrayHeader(len(msg.Ports))
+			for _, port := range msg.Ports {
+				e.writePort(port)
+			}
+		})
+	}
+	if len(msg.Capabilities) > 0 {
+		f.add("capabilities", func(e *mpEncoder) { e.writeStrings(msg.Capabilities) })
+	}
+	if msg.More {
+		f.add("more", func(e *mpEncoder) { e.writeBool(true) })
+	}
+	if len(msg.Checks) > 0 {
+		if data, err := json.Marshal(msg.Checks); err == nil {
+			f.add("checks", func(e *mpEncoder) { e.writeJSON(data) })
+		}
+	}
+	f.addExtensions(msg.Extensions, messageJSONKeys)
+	f.write(e)
+}
+
+// writePort writes the port with the same fields of its JSON encoding.
+func (e *mpEncoder) writePort(port *Port) {
+	if port == nil {
+		e.WriteByte(0xc0)
+		return
+	}
+	f := &mpFields{}
+	f.addString("address", port.Address, false)
+	f.addString("label", port.AddressLabel, true)
+	f.addString("protocol", port.Protocol, true)
+	f.addString("protocolLabel", port.ProtocolLabel, true)
+	if port.Properties != nil && port.Properties.Size() > 0 {
+		f.add("properties", func(e *mpEncoder) {
+			e.writeMapHeader(port.Properties.Size())
+			for _, key := range port.Properties.Keys() {
+				e.writeString(key)
+				e.writeString(port.Properties.Get(key))
+			}
+		})
+	}
+	hardwareID := port.HardwareID
+	if ids := port.AllHardwareIDs(); hardwareID == "" && len(ids) > 0 {
+		hardwareID = ids[0]
+	}
+	f.addString("hardwareId", hardwareID, true)
+	if len(port.HardwareIDs) > 0 {
+		f.add("hardwareIds", func(e *mpEncoder) { e.writeStrings(port.HardwareIDs) })
+	}
+	f.addString("containerId", port.ContainerID, true)
+	f.addExtensions(port.Extensions, portJSONKeys)
+	f.write(e)
+}
+
+// msgpackCodec is the MessagePack encoding, each message is preceded by its
+// length as a 32 bits big-endian unsigned integer.
+type msgpackCodec struct{}
+
+// Encode returns the MessagePack frame of the message.
+func (msgpackCodec) Encode(msg *message) ([]byte, error) {
+	e := &mpEncoder{}
+	e.Write([]byte{0, 0, 0, 0})
+	e.writeMessage(msg)
+	data := e.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return data, nil
+}
+
+// NewDecoder returns a decoder of a stream of MessagePack frames.
+func (msgpackCodec) NewDecoder(r io.Reader) decoder {
+	return &msgpackDecoder{r: bufio.NewReader(r)}
+}
+
+// mpDecoder reads MessagePack values.
+type mpDecoder struct {
+	r *bytes.Reader
+}
+
+func (d *mpDecoder) readN(n uint64) ([]byte, error) {
+	if n > uint64(d.r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	res := make([]byte, n)
+	_, err := io.ReadFull(d.r, res)
+	return res, err
+}
+
+func (d *mpDecoder) readUint(size int) (uint64, error) {
+	data, err := d.readN(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var res uint64
+	for _, b := range data {
+		res = res<<8 | uint64(b)
+	}
+	return res, nil
+}
+
+func (d *mpDecoder) decode(depth int) (interface{}, error) {
+	if depth > 32 {
+		return nil, errors.New("too deeply nested")
+	}
+	code, err := d.r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		return d.decodeString(uint64(code & 0x1f))
+	case code&0xf0 == 0x90:
+		return d.decodeArray(uint64(code&0x0f), depth)
+	case code&0xf0 == 0x80:
+		return d.decodeMap(uint64(code&0x0f), depth)
+	}
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.readUint(1 << (code - 0xcc))
+		if v > math.MaxInt64 {
+			return float64(v), err
+		}
+		return int64(v), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		v, err := d.readUint(size)
+		// Sign extension
+		shift := 64 - 8*size
+		return int64(v<<shift) >> shift, err
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		size := map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4, 0xc4: 1, 0xc5: 2, 0xc6: 4}[code]
+		n, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	}
+	return nil, fmt.Errorf("unsupported type 0x%02x", code)
+}
+
+func (d *mpDecoder) decodeString(n uint64) (interface{}, error) {
+	data, err := d.readN(n)
+	return string(data), err
+}
+
+func (d *mpDecoder) decodeArray(n uint64, depth int) (interface{}, error) {
+	if n > uint64(d.r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	res := make([]interface{}, n)
+	for i := range res {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = v
+	}
+	return res, nil
+}
+
+func (d *mpDecoder) decodeMap(n uint64, depth int) (interface{}, error) {
+	if n > uint64(d.r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	res := make(mpMap, n)
+	for i := range res {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, errors.New("map key is not a string")
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = mpEntry{key: k, value: v}
+	}
+	return res, nil
+}
+
+// frameBufferPool recycles the buffers of the MessagePack frames among all
+// the decoders, the decoded values don't refer to them.
+var frameBufferPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// msgpackDecoder decodes a stream of MessagePack frames.
+type msgpackDecoder struct {
+	r       *bufio.Reader
+	started bool
+	tree    mpMap
+	peeked  bool
+}
+
+// Decode returns the next message. If the frame is malformed the error wraps
+// errMalformed, and the decoding can continue with the next frame.
+func (d *msgpackDecoder) Decode() (*message, error) {
+	if !d.peeked {
+		if err := d.read(); err != nil {
+			return nil, err
+		}
+	}
+	d.peeked = false
+	msg, err := messageFromMsgpack(d.tree)
+	if err != nil {
+		d.tree = nil
+		return nil, &malformedError{fmt.Errorf("malformed msgpack frame: %w", err)}
+	}
+	return msg, nil
+}
+
+// Peek reads the next frame and returns its event type, the message is
+// converted by the following Decode.
+func (d *msgpackDecoder) Peek() (string, error) {
+	d.peeked = false
+	if err := d.read(); err != nil {
+		return "", err
+	}
+	eventType, ok := d.tree.get("eventType").(string)
+	if !ok && d.tree.get("eventType") != nil {
+		d.tree = nil
+		return "", &malformedError{errors.New("malformed msgpack frame: invalid eventType")}
+	}
+	d.peeked = true
+	return eventType, nil
+}
+
+// read reads and decodes the next frame in tree.
+func (d *msgpackDecoder) read() error {
+	d.tree = nil
+	if !d.started {
+		// Skip the whitespace following the last JSON message, it can't be
+		// the beginning of a frame since it would be far too large
+		for {
+			b, err := d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+				_ = d.r.UnreadByte()
+				break
+			}
+		}
+		d.started = true
+	}
+	var size uint32
+	if err := binary.Read(d.r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxFrameSize {
+		return fmt.Errorf("msgpack frame too large: %d bytes", size)
+	}
+	buf := frameBufferPool.Get().(*[]byte)
+	defer frameBufferPool.Put(buf)
+	if cap(*buf) < int(size) {
+		*buf = make([]byte, size)
+	}
+	data := (*buf)[:size]
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	mp := &mpDecoder{r: bytes.NewReader(data)}
+	v, err := mp.decode(0)
+	if err == nil && mp.r.Len() > 0 {
+		err = errors.New("trailing data")
+	}
+	if err != nil {
+		return &malformedError{fmt.Errorf("malformed msgpack frame: %w", err)}
+	}
+	tree, ok := v.(mpMap)
+	if !ok {
+		return &malformedError{errors.New("malformed msgpack frame: message is not a map")}
+	}
+	d.tree = tree
+	return nil
+}
+
+// Raw returns the JSON form of the last message, with the fields in the
+// same order of the MessagePack map.
+func (d *msgpackDecoder) Raw() json.RawMessage {
+	if d.tree == nil {
+		return nil
+	}
+	raw, _ := json.Marshal(d.tree)
+	return raw
+}
+
+// Resync does nothing, the malformed frames are entirely consumed.
+func (d *msgpackDecoder) Resync() (string, error) {
+	return "", nil
+}
+
+func (d *msgpackDecoder) Buffered() io.Reader {
+	return d.r
+}
+
+// mpConverter converts the decoded values, recording the first type error.
+type mpConverter struct {
+	err error
+}
+
+func (c *mpConverter) fail(key string) {
+	if c.err == nil {
+		c.err = fmt.Errorf("invalid value for %q", key)
+	}
+}
+
+func (c *mpConverter) string(m mpMap, key string) string {
+	switch v := m.get(key).(type) {
+	case nil:
+	case string:
+		return v
+	default:
+		c.fail(key)
+	}
+	return ""
+}
+
+func (c *mpConverter) bool(m mpMap, key string) bool {
+	switch v := m.get(key).(type) {
+	case nil:
+	case bool:
+		return v
+	default:
+		c.fail(key)
+	}
+	return false
+}
+
+func (c *mpConverter) strings(m mpMap, key string) []string {
+	switch v := m.get(key).(type) {
+	case nil:
+	case []interface{}:
+		res := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				c.fail(key)
+			}
+			res[i] = s
+		}
+		return res
+	default:
+		c.fail(key)
+	}
+	return nil
+}
+
+func (c *mpConverter) port(v interface{}, key string) *Port {
+	switch v := v.(type) {
+	case nil:
+	case mpMap:
+		port := acquirePort()
+		*port = Port{
+			Address:       c.string(v, "address"),
+			AddressLabel:  c.string(v, "label"),
+			Protocol:      c.string(v, "protocol"),
+			ProtocolLabel: c.string(v, "protocolLabel"),
+			HardwareID:    c.string(v, "hardwareId"),
+			HardwareIDs:   c.strings(v, "hardwareIds"),
+			ContainerID:   c.string(v, "containerId"),
+		}
+		switch props := v.get("properties").(type) {
+		case nil:
+		case mpMap:
+			port.Properties = properties.NewMap()
+			for _, e := range props {
+				value, ok := e.value.(string)
+				if !ok {
+					c.fail("properties")
+				}
+				port.Properties.Set(e.key, value)
+			}
+		default:
+			c.fail("properties")
+		}
+		port.Extensions = mpExtensions(v, portJSONKeys)
+		return port
+	default:
+		c.fail(key)
+	}
+	return nil
+}
+
+// mpExtensions returns the entries of the map whose key is not in known, as
+// a JSON object, or nil if there are none.
+func mpExtensions(m mpMap, known map[string]bool) json.RawMessage {
+	var extensions mpMap
+	for _, e := range m {
+		if !known[`"`+e.key+`"`] {
+			extensions = append(extensions, e)
+		}
+	}
+	if extensions == nil {
+		return nil
+	}
+	res, _ := json.Marshal(extensions)
+	return res
+}
+
+// messageFromMsgpack converts a decoded MessagePack message.
+func messageFromMsgpack(m mpMap) (*message, error) {
+	c := &mpConverter{}
+	msg := &message{
+		EventType:    c.string(m, "eventType"),
+		Message:      c.string(m, "message"),
+		Error:        c.bool(m, "error"),
+		Code:         c.string(m, "code"),
+		Capabilities: c.strings(m, "capabilities"),
+		More:         c.bool(m, "more"),
+		Port:         c.port(m.get("port"), "port"),
+		Extensions:   mpExtensions(m, messageJSONKeys),
+	}
+	switch v := m.get("protocolVersion").(type) {
+	case nil:
+	case int64:
+		msg.ProtocolVersion = int(v)
+	default:
+		c.fail("protocolVersion")
+	}
+	switch v := m.get("ports").(type) {
+	case nil:
+	case []interface{}:
+		msg.Ports = make([]*Port, len(v))
+		for i, item := range v {
+			msg.Ports[i] = c.port(item, "ports")
+		}
+	default:
+		c.fail("ports")
+	}
+	if v := m.get("checks"); v != nil {
+		// The checks are converted through their JSON encoding
+		if data, err := json.Marshal(v); err != nil || json.Unmarshal(data, &msg.Checks) != nil {
+			c.fail("checks")
+		}
+	}
+	return msg, c.err
+}
@@ -0,0 +1,147 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgpackFrames(t *testing.T) {
+	props := properties.NewMap()
+	props.Set("vid", "0x2341")
+	props.Set("pid", "0x0043")
+	props.Set("long", strings.Repeat("x", 300))
+	ports := []*Port{}
+	for i := 0; i < 20; i++ {
+		ports = append(ports, &Port{Address: fmt.Sprint(i), Protocol: "test"})
+	}
+	messages := []*message{
+		{EventType: "hello", Message: "OK", ProtocolVersion: 1, Capabilities: []string{CapabilityMsgpackFraming}},
+		{EventType: "add", Port: &Port{
+			Address:     "/dev/ttyACM0",
+			Protocol:    "serial",
+			Properties:  props,
+			HardwareIDs: []string{"1234", "abcd"},
+			ContainerID: strings.Repeat("c", 40),
+			Extensions:  json.RawMessage(`{"future":{"n":1,"f":2.5,"list":["a",null,true,-100]}}`),
+		}},
+		{EventType: "list", Ports: ports, More: true, Extensions: json.RawMessage(`{"page":{"n":2,"of":3}}`)},
+		{EventType: "selftest", Message: "OK", Checks: []SelfTestCheck{
+			{Name: "drivers", Status: SelfTestOK},
+			{Name: "permissions", Status: SelfTestFailed, Message: "add the user to the dialout group"},
+		}},
+		messageError("start", ErrorCodeNotStarted, "failed"),
+	}
+	stream := &bytes.Buffer{}
+	for _, msg := range messages {
+		data, err := msgpackCodec{}.Encode(msg)
+		require.NoError(t, err)
+		stream.Write(data)
+	}
+
+	frames := msgpackCodec{}.NewDecoder(stream)
+	for _, msg := range messages {
+		// The decoded message must be the same decoded from JSON
+		data, err := json.Marshal(msg)
+		require.NoError(t, err)
+		decoded, err := frames.Decode()
+		require.NoError(t, err)
+		decodedJSON, err := json.Marshal(decoded)
+		require.NoError(t, err)
+		require.JSONEq(t, string(data), string(decodedJSON))
+		require.JSONEq(t, string(data), string(frames.Raw()))
+	}
+	// The order of the properties is preserved
+	data, err := msgpackCodec{}.Encode(messages[1])
+	require.NoError(t, err)
+	decoded, err := msgpackCodec{}.NewDecoder(bytes.NewReader(data)).Decode()
+	require.NoError(t, err)
+	require.Equal(t, []string{"vid", "pid", "long"}, decoded.Port.Properties.Keys())
+	_, err = frames.Decode()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestMsgpackMalformedFrames(t *testing.T) {
+	frame := func(payload ...byte) []byte {
+		res := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+		return append(res, payload...)
+	}
+	stream := &bytes.Buffer{}
+	stream.Write(frame(0x81, 0xa9))                                                    // truncated map
+	stream.Write(frame(0x92, 0x01, 0x02))                                              // not a map
+	stream.Write(frame(0x81, 0xa9, 'e', 'v', 'e', 'n', 't', 'T', 'y', 'p', 'e', 0x01)) // wrong type
+	stream.Write(frame(0x80, 0x80))                                                    // trailing data
+	stream.Write(frame(0x81, 0xa9, 'e', 'v', 'e', 'n', 't', 'T', 'y', 'p', 'e', 0xa4, 'q', 'u', 'i', 't'))
+	frames := msgpackCodec{}.NewDecoder(stream)
+	for i := 0; i < 4; i++ {
+		_, err := frames.Decode()
+		require.ErrorIs(t, err, errMalformed)
+		skipped, err := frames.Resync()
+		require.NoError(t, err)
+		require.Empty(t, skipped)
+	}
+	msg, err := frames.Decode()
+	require.NoError(t, err)
+	require.Equal(t, "quit", msg.EventType)
+
+	// The oversized and truncated frames are fatal
+	_, err = msgpackCodec{}.NewDecoder(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})).Decode()
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errMalformed)
+	_, err = msgpackCodec{}.NewDecoder(bytes.NewReader([]byte{0, 0, 0, 2, 0x80})).Decode()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestClientMsgpackFraming(t *testing.T) {
+	for _, serverFraming := range []bool{false, true} {
+		clientConn, serverConn := net.Pipe()
+		server := NewServer(&manyPortsDiscovery{})
+		server.SetMsgpackFraming(serverFraming)
+		go func() {
+			defer serverConn.Close()
+			_ = server.Run(serverConn, serverConn)
+		}()
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		cl.SetMsgpackFraming(true)
+		require.NoError(t, cl.Run())
+		require.Equal(t, serverFraming, cl.HasCapability(CapabilityMsgpackFraming))
+		ch, err := cl.StartSync(20)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			select {
+			case ev := <-ch:
+				require.Equal(t, "add", ev.Type)
+			case <-time.After(time.Second):
+				t.Fatal("missing event")
+			}
+		}
+		require.NoError(t, cl.Stop())
+		cl.Quit()
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/arduino/pluggable-discovery-protocol-handler/v2/namedpipe
+
+go 1.21
+
+require (
+	github.com/arduino/pluggable-discovery-protocol-handler/v2 v2.2.0
+	github.com/stretchr/testify v1.8.4
+	golang.org/x/sys v0.28.0
+)
+
+require (
+	github.com/arduino/go-paths-helper v1.10.0 // indirect
+	github.com/arduino/go-properties-orderedmap v1.8.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/arduino/pluggable-discovery-protocol-handler/v2 => ../
@@ -0,0 +1,72 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package namedpipe serves and dials the pluggable discovery protocol over
+// the Windows named pipes, the local IPC of Windows with per-user access
+// control: a discovery serves the protocol with Server.Serve on a Listen
+// listener and the clients connect with NewClient. On the other platforms
+// Listen and Dial return ErrNotSupported, the unix domain sockets (see
+// discovery.ListenUnix and discovery.NewUnixClient) are used instead.
+package namedpipe
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// ErrNotSupported is returned by Listen and Dial on the platforms other than
+// Windows.
+var ErrNotSupported = errors.New("named pipes are supported only on Windows")
+
+// pipePrefix is the prefix of the local named pipes.
+const pipePrefix = `\\.\pipe\`
+
+// dialTimeout is the time NewClient waits for a busy pipe.
+const dialTimeout = 10 * time.Second
+
+// Config is the configuration of a named pipe created by Listen.
+type Config struct {
+	// SecurityDescriptor is the security descriptor of the pipe, in SDDL
+	// format. If empty only the current user (and the local system) can
+	// connect to the pipe.
+	SecurityDescriptor string
+	// BufferSize is the size of the input and output buffers of the pipe,
+	// 64 KiB if not set.
+	BufferSize int
+}
+
+// PipePath returns the path of the named pipe: the names without the
+// `\\.\pipe\` prefix are in the local pipe namespace.
+func PipePath(name string) string {
+	if strings.HasPrefix(name, pipePrefix) {
+		return name
+	}
+	return pipePrefix + name
+}
+
+// NewClient creates a new pluggable discovery client that connects to a
+// local discovery, served on the given named pipe, instead of spawning a
+// discovery process.
+func NewClient(id, name string) *discovery.Client {
+	return discovery.NewConnClient(id, func() (io.ReadWriteCloser, error) {
+		return Dial(name, dialTimeout)
+	})
+}
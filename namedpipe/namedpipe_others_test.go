@@ -0,0 +1,34 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !windows
+
+package namedpipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotSupported(t *testing.T) {
+	_, err := Listen("serial-discovery", nil)
+	require.ErrorIs(t, err, ErrNotSupported)
+	_, err = Dial("serial-discovery", 0)
+	require.ErrorIs(t, err, ErrNotSupported)
+	require.Error(t, NewClient("pipe", "serial-discovery").Run())
+}
@@ -0,0 +1,327 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package namedpipe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// defaultBufferSize is the size of the pipe buffers if not configured.
+const defaultBufferSize = 64 * 1024
+
+// errDeadline is returned by the deadline methods of the connections.
+var errDeadline = errors.New("deadlines are not supported on named pipes")
+
+// Listen creates the named pipe and returns a listener accepting its
+// clients, that may be served with Server.Serve. The pipe rejects the
+// remote clients. An error is returned if the pipe is already in use.
+func Listen(name string, config *Config) (net.Listener, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	sddl := config.SecurityDescriptor
+	if sddl == "" {
+		user, err := windows.GetCurrentProcessToken().GetTokenUser()
+		if err != nil {
+			return nil, fmt.Errorf("getting the current user: %w", err)
+		}
+		// Full access to the local system and to the current user only
+		sddl = fmt.Sprintf("D:P(A;;GA;;;SY)(A;;GA;;;%s)", user.User.Sid.String())
+	}
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid security descriptor: %w", err)
+	}
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	l := &listener{
+		addr: pipeAddr(PipePath(name)),
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+		bufferSize: uint32(bufferSize),
+	}
+	// The first instance is created now, to fail if the pipe is in use
+	if l.next, err = l.createInstance(true); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Dial connects to the named pipe, waiting up to timeout if all the
+// instances of the pipe are busy.
+func Dial(name string, timeout time.Duration) (net.Conn, error) {
+	addr := pipeAddr(PipePath(name))
+	path, err := windows.UTF16PtrFromString(string(addr))
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		h, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+			windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			return &conn{handle: h, addr: addr}, nil
+		}
+		if !errors.Is(err, windows.ERROR_PIPE_BUSY) || time.Now().After(deadline) {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: addr, Err: err}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pipeAddr is the address of a named pipe.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+
+func (a pipeAddr) String() string { return string(a) }
+
+// listener accepts the clients of a named pipe: each client is connected
+// to a new instance of the pipe, created in advance so that the clients
+// never find the pipe missing between two Accept.
+type listener struct {
+	addr       pipeAddr
+	sa         *windows.SecurityAttributes
+	bufferSize uint32
+
+	acceptMutex sync.Mutex
+	mutex       sync.Mutex
+	next        windows.Handle // guarded by mutex
+	accepting   bool           // guarded by mutex
+	closed      bool           // guarded by mutex
+}
+
+// createInstance creates a new instance of the pipe.
+func (l *listener) createInstance(first bool) (windows.Handle, error) {
+	path, err := windows.UTF16PtrFromString(string(l.addr))
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+	h, err := windows.CreateNamedPipe(path, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, l.bufferSize, l.bufferSize, 0, l.sa)
+	if first && errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		return windows.InvalidHandle, fmt.Errorf("the named pipe %s is already in use", l.addr)
+	} else if err != nil {
+		return windows.InvalidHandle, fmt.Errorf("creating the named pipe %s: %w", l.addr, err)
+	}
+	return h, nil
+}
+
+// Accept waits for the next client of the pipe.
+func (l *listener) Accept() (net.Conn, error) {
+	l.acceptMutex.Lock()
+	defer l.acceptMutex.Unlock()
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil, net.ErrClosed
+	}
+	if l.next == windows.InvalidHandle {
+		h, err := l.createInstance(false)
+		if err != nil {
+			l.mutex.Unlock()
+			return nil, err
+		}
+		l.next = h
+	}
+	h := l.next
+	l.accepting = true
+	l.mutex.Unlock()
+
+	err := overlappedIO(h, func(o *windows.Overlapped) error {
+		return windows.ConnectNamedPipe(h, o)
+	}, nil)
+	if errors.Is(err, windows.ERROR_PIPE_CONNECTED) {
+		// The client connected before ConnectNamedPipe
+		err = nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.accepting = false
+	if l.closed {
+		l.next = windows.InvalidHandle
+		_ = windows.CloseHandle(h)
+		return nil, net.ErrClosed
+	}
+	if err != nil {
+		l.next = windows.InvalidHandle
+		_ = windows.CloseHandle(h)
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.addr, Err: err}
+	}
+	// The next instance is ready for the following clients, if it can't be
+	// created now it's retried by the next Accept
+	if l.next, err = l.createInstance(false); err != nil {
+		l.next = windows.InvalidHandle
+	}
+	return &conn{handle: h, addr: l.addr}, nil
+}
+
+// Close closes the pipe, the Accept in progress returns net.ErrClosed. The
+// connections already accepted are not closed.
+func (l *listener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.accepting {
+		// Accept closes the instance when ConnectNamedPipe is cancelled
+		_ = windows.CancelIoEx(l.next, nil)
+	} else if l.next != windows.InvalidHandle {
+		_ = windows.CloseHandle(l.next)
+		l.next = windows.InvalidHandle
+	}
+	return nil
+}
+
+// Addr returns the address of the pipe.
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// conn is a connection to a named pipe instance, with overlapped I/O to
+// allow concurrent reads and writes.
+type conn struct {
+	handle windows.Handle
+	addr   pipeAddr
+
+	mutex  sync.Mutex
+	closed bool // guarded by mutex
+	ops    sync.WaitGroup
+}
+
+// begin registers an I/O operation, the handle is not closed until the
+// operation ends.
+func (c *conn) begin() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.ops.Add(1)
+	return nil
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if err := c.begin(); err != nil {
+		return 0, err
+	}
+	defer c.ops.Done()
+	var n uint32
+	err := overlappedIO(c.handle, func(o *windows.Overlapped) error {
+		return windows.ReadFile(c.handle, b, &n, o)
+	}, &n)
+	switch {
+	case err == nil:
+		return int(n), nil
+	case errors.Is(err, windows.ERROR_BROKEN_PIPE), errors.Is(err, windows.ERROR_PIPE_NOT_CONNECTED):
+		return int(n), io.EOF
+	case errors.Is(err, windows.ERROR_OPERATION_ABORTED):
+		return int(n), net.ErrClosed
+	}
+	return int(n), &net.OpError{Op: "read", Net: "pipe", Addr: c.addr, Err: err}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.begin(); err != nil {
+		return 0, err
+	}
+	defer c.ops.Done()
+	written := 0
+	for written < len(b) {
+		var n uint32
+		err := overlappedIO(c.handle, func(o *windows.Overlapped) error {
+			return windows.WriteFile(c.handle, b[written:], &n, o)
+		}, &n)
+		written += int(n)
+		if errors.Is(err, windows.ERROR_OPERATION_ABORTED) {
+			return written, net.ErrClosed
+		} else if err != nil {
+			return written, &net.OpError{Op: "write", Net: "pipe", Addr: c.addr, Err: err}
+		}
+	}
+	return written, nil
+}
+
+// Close cancels the I/O operations in progress and closes the connection.
+// The data already written can still be read by the other end.
+func (c *conn) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mutex.Unlock()
+	_ = windows.CancelIoEx(c.handle, nil)
+	c.ops.Wait()
+	return windows.CloseHandle(c.handle)
+}
+
+func (c *conn) LocalAddr() net.Addr { return c.addr }
+
+func (c *conn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *conn) SetDeadline(t time.Time) error { return errDeadline }
+
+func (c *conn) SetReadDeadline(t time.Time) error { return errDeadline }
+
+func (c *conn) SetWriteDeadline(t time.Time) error { return errDeadline }
+
+// overlappedIO runs an overlapped operation on the handle and waits for its
+// completion. The number of bytes transferred is stored in n, if not nil.
+func overlappedIO(h windows.Handle, start func(o *windows.Overlapped) error, n *uint32) error {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(event)
+	o := &windows.Overlapped{HEvent: event}
+	err = start(o)
+	if !errors.Is(err, windows.ERROR_IO_PENDING) {
+		return err
+	}
+	var done uint32
+	err = windows.GetOverlappedResult(h, o, &done, true)
+	if n != nil {
+		*n = done
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package namedpipe
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// testDiscovery emits a single "add" event when started.
+type testDiscovery struct{}
+
+func (d *testDiscovery) Hello(userAgent string, protocolVersion int) error { return nil }
+
+func (d *testDiscovery) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	eventCB("add", &discovery.Port{Address: "1", Protocol: "test"})
+	return nil
+}
+
+func (d *testDiscovery) Stop() error { return nil }
+
+func (d *testDiscovery) Quit() {}
+
+func TestServeNamedPipe(t *testing.T) {
+	name := fmt.Sprintf("discovery-test-%d", os.Getpid())
+	l, err := Listen(name, nil)
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- discovery.NewServer(&testDiscovery{}).Serve(l) }()
+
+	// The pipe is in use
+	_, err = Listen(name, nil)
+	require.EqualError(t, err, `the named pipe \\.\pipe\`+name+` is already in use`)
+
+	// Two sessions in a row, on different instances of the pipe
+	for i := 0; i < 2; i++ {
+		cl := NewClient("pipe", name)
+		require.NoError(t, cl.Run())
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		require.Equal(t, "1", (<-events).Port.Address)
+		require.NoError(t, cl.Close())
+	}
+
+	require.NoError(t, l.Close())
+	require.Error(t, <-served)
+}
+
+func TestConnFullDuplex(t *testing.T) {
+	// A read in progress doesn't block the writes
+	name := fmt.Sprintf("discovery-test-conn-%d", os.Getpid())
+	l, err := Listen(name, nil)
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	client, err := Dial(name, 0)
+	require.NoError(t, err)
+	server := <-accepted
+
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		n, _ := io.ReadFull(client, buf)
+		read <- string(buf[:n])
+	}()
+	_, err = client.Write([]byte("HELLO"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(buf))
+	_, err = server.Write([]byte("WORLD"))
+	require.NoError(t, err)
+	require.Equal(t, "WORLD", <-read)
+
+	// Closing the server end is seen as EOF
+	require.NoError(t, server.Close())
+	_, err = client.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, client.Close())
+}
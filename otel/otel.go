@@ -0,0 +1,81 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package otel provides an adapter to trace the commands and count the
+// events of a pluggable discovery Client using OpenTelemetry.
+package otel
+
+import (
+	"context"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/arduino/pluggable-discovery-protocol-handler/v2/otel"
+
+// Tracer is a discovery.ClientTracer implementation that creates a span for
+// each command round-trip and counts the port events received.
+type Tracer struct {
+	tracer trace.Tracer
+	events metric.Int64Counter
+}
+
+var _ discovery.ClientTracer = (*Tracer)(nil)
+
+// NewTracer creates a new Tracer using the given providers. The command spans
+// are children of the span contained in the context set with
+// Client.SetTraceContext (if any).
+func NewTracer(tp trace.TracerProvider, mp metric.MeterProvider) (*Tracer, error) {
+	events, err := mp.Meter(instrumentationName).Int64Counter("discovery.events",
+		metric.WithDescription("Number of port events received from the pluggable discoveries."))
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{
+		tracer: tp.Tracer(instrumentationName),
+		events: events,
+	}, nil
+}
+
+// StartCommand implements discovery.ClientTracer
+func (t *Tracer) StartCommand(ctx context.Context, discoveryID, command string) func(err error) {
+	_, span := t.tracer.Start(ctx, "discovery "+command,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("discovery.id", discoveryID),
+			attribute.String("discovery.command", command),
+		))
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// Event implements discovery.ClientTracer
+func (t *Tracer) Event(discoveryID, eventType string) {
+	t.events.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("discovery.id", discoveryID),
+		attribute.String("discovery.event", eventType),
+	))
+}
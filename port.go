@@ -17,9 +17,23 @@
 
 package discovery
 
-import "github.com/arduino/go-properties-orderedmap"
+import (
+	"cmp"
+	"encoding/json"
 
-// Port is a descriptor for a board port
+	"github.com/arduino/go-properties-orderedmap"
+)
+
+// Port is a descriptor for a board port.
+// HardwareID is the primary hardware identifier of the board, boards exposing
+// more than one stable identifier (USB serial number, MAC address, chip ID...)
+// may report the additional ones in HardwareIDs. If HardwareID is empty, the
+// first element of HardwareIDs is sent as the primary identifier to keep
+// compatibility with protocol v1 clients.
+// Extensions holds the fields unknown to this version of the library, as a
+// JSON object: they are decoded from the JSON and MessagePack encodings and
+// sent again when the port is encoded, so that the ports forwarded by
+// proxies and recorders keep the extensions of newer discoveries.
 type Port struct {
 	Address       string          `json:"address"`
 	AddressLabel  string          `json:"label,omitempty"`
@@ -27,6 +41,9 @@ type Port struct {
 	ProtocolLabel string          `json:"protocolLabel,omitempty"`
 	Properties    *properties.Map `json:"properties,omitempty"`
 	HardwareID    string          `json:"hardwareId,omitempty"`
+	HardwareIDs   []string        `json:"hardwareIds,omitempty"`
+	ContainerID   string          `json:"containerId,omitempty"`
+	Extensions    json.RawMessage `json:"-"`
 }
 
 // Equals returns true if the given port has the same address and protocol
@@ -35,6 +52,63 @@ func (p *Port) Equals(o *Port) bool {
 	return p.Address == o.Address && p.Protocol == o.Protocol
 }
 
+// ComparePorts compares two ports by protocol and then by address, it
+// returns -1, 0 or +1 like cmp.Compare. It's the order of the ports in the
+// LIST responses, and can be used with slices.SortFunc to sort the ports in
+// the same way.
+func ComparePorts(a, b *Port) int {
+	if c := cmp.Compare(a.Protocol, b.Protocol); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Address, b.Address)
+}
+
+// IsSiblingOf returns true if the given port belongs to the same physical
+// device (container) of the current port.
+func (p *Port) IsSiblingOf(o *Port) bool {
+	return p.ContainerID != "" && p.ContainerID == o.ContainerID
+}
+
+// AllHardwareIDs returns the list of all the hardware identifiers of the port,
+// without duplicates. The primary HardwareID (if any) is always the first
+// element of the list.
+func (p *Port) AllHardwareIDs() []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, id := range append([]string{p.HardwareID}, p.HardwareIDs...) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// HasHardwareID returns true if the given identifier is one of the hardware
+// identifiers of the port.
+func (p *Port) HasHardwareID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, hwID := range p.AllHardwareIDs() {
+		if hwID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesHardwareID returns true if the given port shares at least one
+// hardware identifier with the current port.
+func (p *Port) MatchesHardwareID(o *Port) bool {
+	for _, id := range o.AllHardwareIDs() {
+		if p.HasHardwareID(id) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Port) String() string {
 	if p == nil {
 		return "none"
@@ -51,5 +125,34 @@ func (p *Port) Clone() *Port {
 	if p.Properties != nil {
 		res.Properties = p.Properties.Clone()
 	}
+	if p.HardwareIDs != nil {
+		res.HardwareIDs = append([]string{}, p.HardwareIDs...)
+	}
+	if p.Extensions != nil {
+		res.Extensions = append(json.RawMessage{}, p.Extensions...)
+	}
 	return &res
 }
+
+// GroupByContainer groups the given ports by their ContainerID, so that all
+// the ports exposed by the same physical device (for example the interfaces
+// of a USB composite device) are returned together. Ports without a
+// ContainerID are returned each in its own group. The order of the groups
+// follows the order of the first port of each group in the given list.
+func GroupByContainer(ports []*Port) [][]*Port {
+	res := [][]*Port{}
+	groupIndex := map[string]int{}
+	for _, port := range ports {
+		if port.ContainerID == "" {
+			res = append(res, []*Port{port})
+			continue
+		}
+		if i, ok := groupIndex[port.ContainerID]; ok {
+			res[i] = append(res[i], port)
+			continue
+		}
+		groupIndex[port.ContainerID] = len(res)
+		res = append(res, []*Port{port})
+	}
+	return res
+}
@@ -0,0 +1,110 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"slices"
+
+	"github.com/arduino/go-properties-orderedmap"
+)
+
+// NewPort creates a new Port with the given address and protocol. The other
+// fields can be set with the With* methods, for example:
+//
+//	port := discovery.NewPort("/dev/ttyACM0", "serial").
+//		WithLabel("/dev/ttyACM0").
+//		WithProtocolLabel("Serial Port (USB)").
+//		WithProperty("vid", "0x2341").
+//		WithProperty("pid", "0x0043")
+func NewPort(address, protocol string) *Port {
+	return &Port{Address: address, Protocol: protocol}
+}
+
+// NewPortWithProperties creates a new Port with the given address, protocol
+// and properties, see PropertiesFromMap.
+func NewPortWithProperties(address, protocol string, props map[string]string) *Port {
+	return NewPort(address, protocol).WithProperties(props)
+}
+
+// PropertiesFromMap creates the properties of a Port from a plain map. Since
+// the order of a map is not defined, the properties are sorted by key.
+func PropertiesFromMap(props map[string]string) *properties.Map {
+	res := properties.NewMap()
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		res.Set(key, props[key])
+	}
+	return res
+}
+
+// WithLabel sets the address label of the port and returns the port.
+func (p *Port) WithLabel(label string) *Port {
+	p.AddressLabel = label
+	return p
+}
+
+// WithProtocolLabel sets the protocol label of the port and returns the port.
+func (p *Port) WithProtocolLabel(label string) *Port {
+	p.ProtocolLabel = label
+	return p
+}
+
+// WithProperty sets a property of the port and returns the port. The
+// properties are kept in the order they are set.
+func (p *Port) WithProperty(key, value string) *Port {
+	if p.Properties == nil {
+		p.Properties = properties.NewMap()
+	}
+	p.Properties.Set(key, value)
+	return p
+}
+
+// WithProperties sets the given properties of the port, sorted by key, and
+// returns the port. The properties already set are kept.
+func (p *Port) WithProperties(props map[string]string) *Port {
+	if p.Properties == nil {
+		p.Properties = properties.NewMap()
+	}
+	p.Properties.Merge(PropertiesFromMap(props))
+	return p
+}
+
+// WithHardwareID sets the primary hardware identifier of the port and
+// returns the port.
+func (p *Port) WithHardwareID(id string) *Port {
+	p.HardwareID = id
+	return p
+}
+
+// WithHardwareIDs adds the given identifiers to the additional hardware
+// identifiers of the port and returns the port.
+func (p *Port) WithHardwareIDs(ids ...string) *Port {
+	p.HardwareIDs = append(p.HardwareIDs, ids...)
+	return p
+}
+
+// WithContainerID sets the container identifier of the port, shared by the
+// ports of the same physical device, and returns the port.
+func (p *Port) WithContainerID(id string) *Port {
+	p.ContainerID = id
+	return p
+}
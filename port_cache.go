@@ -0,0 +1,192 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// PortCache persists the last known ports of the discoveries of a Manager,
+// see Manager.SetPortCache, so that a GUI can show the ports seen in the
+// previous run right at startup, while the discoveries are warming up.
+type PortCache struct {
+	mutex   sync.Mutex
+	path    *paths.Path
+	entries map[string]*CachedPort
+	err     error
+}
+
+// CachedPort is a port of a PortCache.
+type CachedPort struct {
+	DiscoveryID string    `json:"discoveryId"`
+	Port        *Port     `json:"port"`
+	LastSeen    time.Time `json:"lastSeen"`
+	// Stale is true if the port has been loaded from the cache file and
+	// has not been confirmed yet by its discovery.
+	Stale bool `json:"-"`
+}
+
+// portCacheFile is the content of the cache file.
+type portCacheFile struct {
+	Ports []*CachedPort `json:"ports"`
+}
+
+// OpenPortCache opens the port cache at the given path, loading the ports
+// saved in the previous run, if any, as stale ports. The file is created at
+// the first change.
+func OpenPortCache(path *paths.Path) (*PortCache, error) {
+	c := &PortCache{path: path, entries: map[string]*CachedPort{}}
+	data, err := path.ReadFile()
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var file portCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for _, entry := range file.Ports {
+		if entry == nil || entry.Port == nil {
+			continue
+		}
+		entry.Stale = true
+		c.entries[eventPortKey(entry.DiscoveryID, entry.Port)] = entry
+	}
+	return c, nil
+}
+
+// Ports returns a copy of the cached ports, sorted by discovery ID,
+// protocol and address.
+func (c *PortCache) Ports() []*CachedPort {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := []*CachedPort{}
+	for _, entry := range c.entries {
+		cached := *entry
+		cached.Port = entry.Port.Clone()
+		res = append(res, &cached)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return eventPortKey(res[i].DiscoveryID, res[i].Port) < eventPortKey(res[j].DiscoveryID, res[j].Port)
+	})
+	return res
+}
+
+// Err returns the last error occurred saving the cache file, if any.
+func (c *PortCache) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// Record updates the cache with the given event of the Manager.
+func (c *PortCache) Record(ev *Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := ev.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	switch ev.Type {
+	case "add":
+		c.entries[eventPortKey(ev.DiscoveryID, ev.Port)] = &CachedPort{DiscoveryID: ev.DiscoveryID, Port: ev.Port.Clone(), LastSeen: now}
+	case "remove":
+		key := eventPortKey(ev.DiscoveryID, ev.Port)
+		if _, ok := c.entries[key]; !ok {
+			return
+		}
+		delete(c.entries, key)
+	case "snapshot":
+		c.replaceLocked(ev.DiscoveryID, ev.Ports, now)
+	case "stop", "reconnected":
+		// The ports are kept, until confirmed again
+		for _, entry := range c.entries {
+			if entry.DiscoveryID == ev.DiscoveryID {
+				entry.Stale = true
+			}
+		}
+		return
+	default:
+		return
+	}
+	c.saveLocked()
+}
+
+// replace replaces the ports of the given discovery with the given ones,
+// the result of a LIST.
+func (c *PortCache) replace(discoveryID string, ports []*Port) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.replaceLocked(discoveryID, ports, time.Now())
+	c.saveLocked()
+}
+
+func (c *PortCache) replaceLocked(discoveryID string, ports []*Port, now time.Time) {
+	for key, entry := range c.entries {
+		if entry.DiscoveryID == discoveryID {
+			delete(c.entries, key)
+		}
+	}
+	for _, port := range ports {
+		c.entries[eventPortKey(discoveryID, port)] = &CachedPort{DiscoveryID: discoveryID, Port: port.Clone(), LastSeen: now}
+	}
+}
+
+// saveLocked writes the cache file, replacing the previous one atomically.
+func (c *PortCache) saveLocked() {
+	file := portCacheFile{Ports: []*CachedPort{}}
+	for _, entry := range c.entries {
+		file.Ports = append(file.Ports, entry)
+	}
+	sort.Slice(file.Ports, func(i, j int) bool {
+		return eventPortKey(file.Ports[i].DiscoveryID, file.Ports[i].Port) < eventPortKey(file.Ports[j].DiscoveryID, file.Ports[j].Port)
+	})
+	data, err := json.MarshalIndent(&file, "", "  ")
+	if err == nil {
+		tmp := c.path.Parent().Join(c.path.Base() + ".tmp")
+		if err = tmp.WriteFile(data); err == nil {
+			err = tmp.Rename(c.path)
+		}
+	}
+	c.err = err
+}
+
+// SetPortCache sets the PortCache where the ports reported by the
+// discoveries, with the events delivered by StartSync and with List, are
+// saved. The ports of the cache are confirmed, and are no longer stale,
+// when reported again by their discovery. The setting is applied on the
+// next StartSync.
+func (dm *Manager) SetPortCache(cache *PortCache) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	dm.portCache = cache
+}
+
+func (dm *Manager) getPortCache() *PortCache {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	return dm.portCache
+}
@@ -0,0 +1,116 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortCache(t *testing.T) {
+	path := paths.New(t.TempDir()).Join("ports.json")
+	cache, err := OpenPortCache(path)
+	require.NoError(t, err)
+	require.Empty(t, cache.Ports())
+	require.False(t, path.Exist())
+
+	seen := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cache.Record(&Event{Type: "add", DiscoveryID: "serial", Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial"}, Timestamp: seen})
+	cache.Record(&Event{Type: "add", DiscoveryID: "serial", Port: &Port{Address: "/dev/ttyACM1", Protocol: "serial"}, Timestamp: seen})
+	cache.Record(&Event{Type: "add", DiscoveryID: "mdns", Port: &Port{Address: "10.0.0.1", Protocol: "network"}, Timestamp: seen})
+	cache.Record(&Event{Type: "remove", DiscoveryID: "serial", Port: &Port{Address: "/dev/ttyACM1", Protocol: "serial"}})
+	require.NoError(t, cache.Err())
+	require.Len(t, cache.Ports(), 2)
+
+	// The ports are loaded as stale at the next start
+	cache, err = OpenPortCache(path)
+	require.NoError(t, err)
+	ports := cache.Ports()
+	require.Len(t, ports, 2)
+	require.Equal(t, "mdns", ports[0].DiscoveryID)
+	require.Equal(t, "10.0.0.1", ports[0].Port.Address)
+	require.True(t, ports[0].LastSeen.Equal(seen))
+	require.True(t, ports[0].Stale)
+	require.Equal(t, "/dev/ttyACM0", ports[1].Port.Address)
+	require.True(t, ports[1].Stale)
+
+	// Until they are confirmed by their discovery
+	cache.Record(&Event{Type: "add", DiscoveryID: "serial", Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial"}})
+	ports = cache.Ports()
+	require.True(t, ports[0].Stale)
+	require.False(t, ports[1].Stale)
+	require.True(t, ports[1].LastSeen.After(seen))
+	cache.Record(&Event{Type: "snapshot", DiscoveryID: "mdns", Ports: []*Port{{Address: "10.0.0.2", Protocol: "network"}}})
+	ports = cache.Ports()
+	require.Equal(t, "10.0.0.2", ports[0].Port.Address)
+	require.False(t, ports[0].Stale)
+
+	// The ports of a stopped discovery are kept as stale
+	cache.Record(&Event{Type: "stop", DiscoveryID: "serial"})
+	require.True(t, cache.Ports()[1].Stale)
+
+	// A malformed cache file is reported
+	require.NoError(t, path.WriteFile([]byte("{")))
+	_, err = OpenPortCache(path)
+	require.Error(t, err)
+}
+
+func TestManagerPortCache(t *testing.T) {
+	client := func(id string) *Client {
+		return NewConnClient(id, func() (io.ReadWriteCloser, error) {
+			clientConn, serverConn := net.Pipe()
+			go func() {
+				defer serverConn.Close()
+				_ = NewServer(&testDiscovery{}).Run(serverConn, serverConn)
+			}()
+			return clientConn, nil
+		})
+	}
+	path := paths.New(t.TempDir()).Join("ports.json")
+	cache, err := OpenPortCache(path)
+	require.NoError(t, err)
+	dm := NewManager()
+	dm.SetPortCache(cache)
+	require.NoError(t, dm.Add(client("a")))
+	require.Empty(t, dm.Start())
+	_, errs := dm.List()
+	require.Empty(t, errs)
+	require.Len(t, cache.Ports(), 1)
+	require.Empty(t, dm.Stop())
+
+	// The events update the cache
+	require.NoError(t, dm.Add(client("b")))
+	ch, errs := dm.StartSync(10)
+	require.Empty(t, errs)
+	<-ch
+	<-ch
+	dm.Quit()
+	for range ch {
+	}
+	cache, err = OpenPortCache(path)
+	require.NoError(t, err)
+	ports := cache.Ports()
+	require.Len(t, ports, 2)
+	require.Equal(t, "a", ports[0].DiscoveryID)
+	require.Equal(t, "b", ports[1].DiscoveryID)
+}
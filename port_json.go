@@ -0,0 +1,141 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/arduino/go-properties-orderedmap"
+)
+
+// portJSON is the JSON encoding of a Port, the order of the fields is the
+// order of the keys in the encoded object.
+type portJSON struct {
+	Address       string          `json:"address"`
+	AddressLabel  string          `json:"label,omitempty"`
+	Protocol      string          `json:"protocol,omitempty"`
+	ProtocolLabel string          `json:"protocolLabel,omitempty"`
+	Properties    *jsonProperties `json:"properties,omitempty"`
+	HardwareID    string          `json:"hardwareId,omitempty"`
+	HardwareIDs   []string        `json:"hardwareIds,omitempty"`
+	ContainerID   string          `json:"containerId,omitempty"`
+}
+
+// portJSONKeys are the quoted keys of the fields of portJSON.
+var portJSONKeys = map[string]bool{
+	`"address"`: true, `"label"`: true, `"protocol"`: true, `"protocolLabel"`: true,
+	`"properties"`: true, `"hardwareId"`: true, `"hardwareIds"`: true, `"containerId"`: true,
+}
+
+// jsonProperties is the JSON encoding of the properties of a Port: the
+// properties are encoded in the order of the properties.Map, and decoded
+// in the order they appear in the JSON object, so that the order set by the
+// discovery is preserved.
+type jsonProperties struct {
+	*properties.Map
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p jsonProperties) MarshalJSON() ([]byte, error) {
+	keys := p.Keys()
+	var res bytes.Buffer
+	res.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			res.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(p.Get(key))
+		res.Write(k)
+		res.WriteByte(':')
+		res.Write(v)
+	}
+	res.WriteByte('}')
+	return res.Bytes(), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *jsonProperties) UnmarshalJSON(data []byte) error {
+	p.Map = properties.NewMap()
+	return forEachJSONMember(data, func(key, value []byte) error {
+		k, err := unquoteJSONString(key)
+		if err != nil {
+			return err
+		}
+		v, err := unquoteJSONString(value)
+		if err != nil {
+			return err
+		}
+		p.Set(k, v)
+		return nil
+	})
+}
+
+// MarshalJSON implements json.Marshaler. The fields are always encoded in
+// the same order, followed by the Extensions; the empty fields and the
+// empty Properties are omitted. If the primary HardwareID is not set the
+// first of the HardwareIDs is used in its place.
+func (p Port) MarshalJSON() ([]byte, error) {
+	res := portJSON{
+		Address:       p.Address,
+		AddressLabel:  p.AddressLabel,
+		Protocol:      p.Protocol,
+		ProtocolLabel: p.ProtocolLabel,
+		HardwareID:    p.HardwareID,
+		HardwareIDs:   p.HardwareIDs,
+		ContainerID:   p.ContainerID,
+	}
+	if p.Properties != nil && p.Properties.Size() > 0 {
+		res.Properties = &jsonProperties{p.Properties}
+	}
+	if res.HardwareID == "" {
+		if ids := p.AllHardwareIDs(); len(ids) > 0 {
+			res.HardwareID = ids[0]
+		}
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	return appendJSONMembers(data, p.Extensions, portJSONKeys)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The unknown fields are kept
+// in the Extensions, to be sent again when the port is encoded.
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var res portJSON
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	*p = Port{
+		Address:       res.Address,
+		AddressLabel:  res.AddressLabel,
+		Protocol:      res.Protocol,
+		ProtocolLabel: res.ProtocolLabel,
+		HardwareID:    res.HardwareID,
+		HardwareIDs:   res.HardwareIDs,
+		ContainerID:   res.ContainerID,
+	}
+	if res.Properties != nil {
+		p.Properties = res.Properties.Map
+	}
+	extensions, err := unknownJSONMembers(data, portJSONKeys)
+	p.Extensions = extensions
+	return err
+}
@@ -0,0 +1,159 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrPropertyNotFound is returned by the typed accessors of the Port
+// properties if the property is not set.
+var ErrPropertyNotFound = errors.New("property not found")
+
+// CapabilityPropertySchema is the capability advertised in the HELLO
+// response by the servers that declare the types of the port properties in
+// the "propertySchema" field of the response, see Server.SetPropertySchema.
+const CapabilityPropertySchema = "property_schema"
+
+// PropertyType is the type of the value of a port property. The values are
+// always sent as strings, the type tells how to interpret them.
+type PropertyType string
+
+const (
+	// PropertyString is a plain string, it's the type of the properties
+	// not declared in the schema.
+	PropertyString PropertyType = "string"
+	// PropertyInt is a decimal integer, or a hexadecimal integer with the
+	// "0x" prefix.
+	PropertyInt PropertyType = "int"
+	// PropertyHex is a hexadecimal integer, with or without the "0x"
+	// prefix, like the USB VID and PID.
+	PropertyHex PropertyType = "hex"
+	// PropertyBool is a boolean: "true", "false", "1" or "0".
+	PropertyBool PropertyType = "bool"
+)
+
+// PropertySchema declares the types of the port properties reported by a
+// discovery, by property key.
+type PropertySchema map[string]PropertyType
+
+// getProperty returns the value of the property key of the port.
+func (p *Port) getProperty(key string) (string, error) {
+	if p.Properties == nil {
+		return "", fmt.Errorf("%w: %s", ErrPropertyNotFound, key)
+	}
+	value, ok := p.Properties.GetOk(key)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrPropertyNotFound, key)
+	}
+	return value, nil
+}
+
+// GetHex returns the value of the property key parsed as an hexadecimal
+// integer, with or without the "0x" prefix (for example "0x2341").
+func (p *Port) GetHex(key string) (uint64, error) {
+	value, err := p.getProperty(key)
+	if err != nil {
+		return 0, err
+	}
+	digits := strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	res, err := strconv.ParseUint(digits, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hex value for property %s: %q", key, value)
+	}
+	return res, nil
+}
+
+// GetInt returns the value of the property key parsed as an integer, in
+// decimal or, with the "0x" prefix, hexadecimal notation.
+func (p *Port) GetInt(key string) (int64, error) {
+	value, err := p.getProperty(key)
+	if err != nil {
+		return 0, err
+	}
+	res, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid int value for property %s: %q", key, value)
+	}
+	return res, nil
+}
+
+// GetBool returns the value of the property key parsed as a boolean.
+func (p *Port) GetBool(key string) (bool, error) {
+	value, err := p.getProperty(key)
+	if err != nil {
+		return false, err
+	}
+	res, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid bool value for property %s: %q", key, value)
+	}
+	return res, nil
+}
+
+// Value returns the value of the property key of the port converted to the
+// type declared in the schema: string, int64, uint64 or bool for the
+// PropertyString, PropertyInt, PropertyHex and PropertyBool types
+// respectively. The properties not declared are returned as strings.
+func (s PropertySchema) Value(port *Port, key string) (interface{}, error) {
+	switch t := s[key]; t {
+	case "", PropertyString:
+		return port.getProperty(key)
+	case PropertyInt:
+		return port.GetInt(key)
+	case PropertyHex:
+		return port.GetHex(key)
+	case PropertyBool:
+		return port.GetBool(key)
+	default:
+		return nil, fmt.Errorf("unknown type %q of property %s", t, key)
+	}
+}
+
+// Validate checks that all the properties of the port declared in the
+// schema have a valid value. The missing properties are not reported.
+func (s PropertySchema) Validate(port *Port) error {
+	var errs []error
+	for key := range s {
+		if _, err := s.Value(port, key); err != nil && !errors.Is(err, ErrPropertyNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetPropertySchema declares the types of the port properties reported by
+// the discovery, sent to the clients in the HELLO response so that they can
+// validate and convert the values consistently (see Client.PropertySchema).
+// The capability is advertised to the clients in the HELLO response. This
+// method must be called before Run.
+func (d *Server) SetPropertySchema(schema PropertySchema) {
+	d.propertySchema = schema
+}
+
+// PropertySchema returns the types of the port properties declared by the
+// discovery in the HELLO response, or nil if the discovery doesn't declare
+// them.
+func (disc *Client) PropertySchema() PropertySchema {
+	disc.statusMutex.Lock()
+	defer disc.statusMutex.Unlock()
+	return disc.propertySchema
+}
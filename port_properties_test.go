@@ -0,0 +1,104 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortTypedProperties(t *testing.T) {
+	props := properties.NewMap()
+	props.Set("vid", "0x2341")
+	props.Set("pid", "804E")
+	props.Set("count", "12")
+	props.Set("debug", "true")
+	props.Set("name", "Arduino")
+	port := &Port{Address: "1", Protocol: "test", Properties: props}
+
+	vid, err := port.GetHex("vid")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x2341), vid)
+	pid, err := port.GetHex("pid")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x804e), pid)
+	count, err := port.GetInt("count")
+	require.NoError(t, err)
+	require.Equal(t, int64(12), count)
+	vidInt, err := port.GetInt("vid")
+	require.NoError(t, err)
+	require.Equal(t, int64(0x2341), vidInt)
+	debug, err := port.GetBool("debug")
+	require.NoError(t, err)
+	require.True(t, debug)
+
+	_, err = port.GetHex("name")
+	require.EqualError(t, err, `invalid hex value for property name: "Arduino"`)
+	_, err = port.GetBool("name")
+	require.Error(t, err)
+	_, err = port.GetInt("missing")
+	require.ErrorIs(t, err, ErrPropertyNotFound)
+	_, err = (&Port{}).GetBool("debug")
+	require.ErrorIs(t, err, ErrPropertyNotFound)
+}
+
+func TestPropertySchema(t *testing.T) {
+	schema := PropertySchema{"vid": PropertyHex, "count": PropertyInt, "debug": PropertyBool, "serial": PropertyString}
+	props := properties.NewMap()
+	props.Set("vid", "0x2341")
+	props.Set("debug", "1")
+	props.Set("name", "Arduino")
+	port := &Port{Address: "1", Properties: props}
+
+	v, err := schema.Value(port, "vid")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x2341), v)
+	v, err = schema.Value(port, "debug")
+	require.NoError(t, err)
+	require.Equal(t, true, v)
+	v, err = schema.Value(port, "name")
+	require.NoError(t, err)
+	require.Equal(t, "Arduino", v)
+	require.NoError(t, schema.Validate(port))
+
+	props.Set("count", "many")
+	require.EqualError(t, schema.Validate(port), `invalid int value for property count: "many"`)
+	_, err = PropertySchema{"vid": "float"}.Value(port, "vid")
+	require.EqualError(t, err, `unknown type "float" of property vid`)
+}
+
+func TestClientPropertySchema(t *testing.T) {
+	for _, schema := range []PropertySchema{nil, {"vid": PropertyHex, "pid": PropertyHex}} {
+		clientConn, serverConn := net.Pipe()
+		server := NewServer(&testDiscovery{})
+		server.SetPropertySchema(schema)
+		go func() {
+			defer serverConn.Close()
+			_ = server.Run(serverConn, serverConn)
+		}()
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		require.NoError(t, cl.Run())
+		require.Equal(t, schema != nil, cl.HasCapability(CapabilityPropertySchema))
+		require.Equal(t, schema, cl.PropertySchema())
+		cl.Quit()
+	}
+}
@@ -0,0 +1,184 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortContainerID(t *testing.T) {
+	a := &Port{Address: "/dev/ttyACM0", Protocol: "serial", ContainerID: "usb-1-2"}
+	b := &Port{Address: "/dev/ttyACM1", Protocol: "serial", ContainerID: "usb-1-2"}
+	c := &Port{Address: "/dev/ttyACM2", Protocol: "serial"}
+	d := &Port{Address: "/dev/ttyACM3", Protocol: "serial"}
+	require.True(t, a.IsSiblingOf(b))
+	require.False(t, a.IsSiblingOf(c))
+	require.False(t, c.IsSiblingOf(d))
+
+	groups := GroupByContainer([]*Port{c, a, d, b})
+	require.Equal(t, [][]*Port{{c}, {a, b}, {d}}, groups)
+
+	data, err := json.Marshal(a)
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"/dev/ttyACM0","protocol":"serial","containerId":"usb-1-2"}`, string(data))
+	data, err = json.Marshal(c)
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"/dev/ttyACM2","protocol":"serial"}`, string(data))
+}
+
+func TestPortHardwareIDs(t *testing.T) {
+	a := &Port{Address: "1", HardwareID: "SN1234", HardwareIDs: []string{"SN1234", "AA:BB:CC:DD:EE:FF", "chip-42"}}
+	b := &Port{Address: "2", HardwareID: "AA:BB:CC:DD:EE:FF"}
+	c := &Port{Address: "3", HardwareIDs: []string{"chip-43"}}
+	d := &Port{Address: "4"}
+	require.Equal(t, []string{"SN1234", "AA:BB:CC:DD:EE:FF", "chip-42"}, a.AllHardwareIDs())
+	require.Equal(t, []string{"chip-43"}, c.AllHardwareIDs())
+	require.Empty(t, d.AllHardwareIDs())
+	require.True(t, a.HasHardwareID("chip-42"))
+	require.False(t, a.HasHardwareID(""))
+	require.False(t, d.HasHardwareID(""))
+	require.True(t, a.MatchesHardwareID(b))
+	require.True(t, b.MatchesHardwareID(a))
+	require.False(t, a.MatchesHardwareID(c))
+	require.False(t, d.MatchesHardwareID(d))
+
+	clone := a.Clone()
+	clone.HardwareIDs[0] = "changed"
+	require.Equal(t, "SN1234", a.HardwareIDs[0])
+
+	// The primary hardware ID is always sent in the v1 "hardwareId" field
+	data, err := json.Marshal(a)
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"1","hardwareId":"SN1234","hardwareIds":["SN1234","AA:BB:CC:DD:EE:FF","chip-42"]}`, string(data))
+	// The first of the HardwareIDs is promoted to primary if HardwareID is empty
+	data, err = json.Marshal(&Port{Address: "5", HardwareIDs: []string{"", "chip-44", "chip-45"}})
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"5","hardwareId":"chip-44","hardwareIds":["","chip-44","chip-45"]}`, string(data))
+
+	// Duplicates inside HardwareIDs are removed
+	e := &Port{Address: "6", HardwareIDs: []string{"id1", "id2", "id1", "id2"}}
+	require.Equal(t, []string{"id1", "id2"}, e.AllHardwareIDs())
+
+	var decoded Port
+	require.NoError(t, json.Unmarshal([]byte(`{"address":"2","hardwareId":"SN1"}`), &decoded))
+	require.Equal(t, []string{"SN1"}, decoded.AllHardwareIDs())
+}
+
+func TestPortJSON(t *testing.T) {
+	props := properties.NewMap()
+	props.Set("vid", "0x2341")
+	props.Set("pid", "0x0043")
+	port := &Port{
+		ContainerID:   "usb-1",
+		HardwareID:    "SN1",
+		Properties:    props,
+		ProtocolLabel: "Serial Port (USB)",
+		Protocol:      "serial",
+		AddressLabel:  "ttyACM0",
+		Address:       "/dev/ttyACM0",
+	}
+	// The fields are always in the same order, the properties in the order
+	// they have been set
+	data, err := json.Marshal(port)
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"/dev/ttyACM0","label":"ttyACM0","protocol":"serial","protocolLabel":"Serial Port (USB)",`+
+		`"properties":{"vid":"0x2341","pid":"0x0043"},"hardwareId":"SN1","containerId":"usb-1"}`, string(data))
+
+	// The empty properties are omitted
+	data, err = json.Marshal(&Port{Address: "1", Properties: properties.NewMap(), HardwareIDs: []string{}})
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"1"}`, string(data))
+
+	// The unknown fields are preserved...
+	in := `{"address":"1","future":{"b":[1,2.5,"s",null,true],"a":{}},"protocol":"test","properties":{"z":"1","a\"b":"\u00e8"},"other":"o"}`
+	var decoded Port
+	require.NoError(t, json.Unmarshal([]byte(in), &decoded))
+	require.Equal(t, "test", decoded.Protocol)
+	require.Equal(t, []string{"z", `a"b`}, decoded.Properties.Keys())
+	require.Equal(t, "è", decoded.Properties.Get(`a"b`))
+	require.Equal(t, `{"future":{"b":[1,2.5,"s",null,true],"a":{}},"other":"o"}`, string(decoded.Extensions))
+	// ...and sent again, with the properties in the decoded order
+	data, err = json.Marshal(&decoded)
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"1","protocol":"test","properties":{"z":"1","a\"b":"è"},"future":{"b":[1,2.5,"s",null,true],"a":{}},"other":"o"}`, string(data))
+	clone := decoded.Clone()
+	clone.Extensions[2] = 'F'
+	require.Equal(t, byte('f'), decoded.Extensions[2])
+
+	// The known fields can't be overridden by the extensions
+	data, err = json.Marshal(&Port{Address: "1", Extensions: json.RawMessage(`{"address":"2","x":1}`)})
+	require.NoError(t, err)
+	require.Equal(t, `{"address":"1","x":1}`, string(data))
+	_, err = json.Marshal(&Port{Address: "1", Extensions: json.RawMessage(`[1]`)})
+	require.Error(t, err)
+
+	// Without unknown fields there are no extensions
+	require.NoError(t, json.Unmarshal([]byte(`{"address":"1","hardwareIds":["a"]}`), &decoded))
+	require.Equal(t, &Port{Address: "1", HardwareIDs: []string{"a"}}, &decoded)
+}
+
+func TestComparePorts(t *testing.T) {
+	ports := []*Port{
+		{Protocol: "serial", Address: "/dev/ttyACM1"},
+		{Protocol: "network", Address: "192.168.1.2"},
+		{Protocol: "serial", Address: "/dev/ttyACM0"},
+		{Protocol: "network", Address: "192.168.1.1"},
+	}
+	slices.SortFunc(ports, ComparePorts)
+	res := []string{}
+	for _, port := range ports {
+		res = append(res, port.Protocol+"://"+port.Address)
+	}
+	require.Equal(t, []string{"network://192.168.1.1", "network://192.168.1.2", "serial:///dev/ttyACM0", "serial:///dev/ttyACM1"}, res)
+	require.Zero(t, ComparePorts(ports[0], ports[0]))
+}
+
+func TestPortBuilder(t *testing.T) {
+	port := NewPort("/dev/ttyACM0", "serial").
+		WithLabel("ttyACM0").
+		WithProtocolLabel("Serial Port (USB)").
+		WithProperty("vid", "0x2341").
+		WithProperties(map[string]string{"serialNumber": "123", "pid": "0x0043"}).
+		WithHardwareID("123").
+		WithHardwareIDs("abc").
+		WithContainerID("usb-1")
+	data, err := json.Marshal(port)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"address": "/dev/ttyACM0",
+		"label": "ttyACM0",
+		"protocol": "serial",
+		"protocolLabel": "Serial Port (USB)",
+		"properties": {"vid": "0x2341", "pid": "0x0043", "serialNumber": "123"},
+		"hardwareId": "123",
+		"hardwareIds": ["abc"],
+		"containerId": "usb-1"
+	}`, string(data))
+	// The properties set with a map are sorted by key
+	require.Equal(t, []string{"vid", "pid", "serialNumber"}, port.Properties.Keys())
+
+	port = NewPortWithProperties("1", "test", map[string]string{"b": "2", "a": "1"})
+	require.Equal(t, []string{"a", "b"}, port.Properties.Keys())
+	require.Equal(t, "2", port.Properties.Get("b"))
+	require.Empty(t, PropertiesFromMap(nil).Keys())
+}
@@ -0,0 +1,139 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// PortTracker keeps the ports currently available for each discovery,
+// updated with the events of a Client or a Manager. It's meant for the
+// consumers that report the available ports to the clients connected after
+// the events, like the WebSocket bridge and the gRPC gateway. It's safe for
+// concurrent use.
+type PortTracker struct {
+	mutex sync.Mutex
+	ports map[string]map[trackedPortKey]*Port
+}
+
+// trackedPortKey identifies a port of a discovery in a PortTracker.
+type trackedPortKey struct{ protocol, address string }
+
+func portKeyOf(port *Port) trackedPortKey {
+	return trackedPortKey{port.Protocol, port.Address}
+}
+
+// NewPortTracker creates an empty PortTracker.
+func NewPortTracker() *PortTracker {
+	return &PortTracker{ports: map[string]map[trackedPortKey]*Port{}}
+}
+
+// Track updates the ports of the discovery of the given event:
+//   - "add" and "remove" add and remove the port
+//   - "moved" removes the OldPort and adds the Port
+//   - "snapshot" replaces all the ports of the discovery
+//   - "reconnected" and "resynced" drop all the ports of the discovery,
+//     since they are going to be reported again
+//   - "stop" drops all the ports of the discovery
+func (t *PortTracker) Track(ev *Event) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch ev.Type {
+	case "add":
+		t.discoveryPorts(ev.DiscoveryID)[portKeyOf(ev.Port)] = ev.Port
+	case "remove":
+		delete(t.ports[ev.DiscoveryID], portKeyOf(ev.Port))
+	case "moved":
+		ports := t.discoveryPorts(ev.DiscoveryID)
+		if ev.OldPort != nil {
+			delete(ports, portKeyOf(ev.OldPort))
+		}
+		ports[portKeyOf(ev.Port)] = ev.Port
+	case "snapshot":
+		ports := map[trackedPortKey]*Port{}
+		for _, port := range ev.Ports {
+			ports[portKeyOf(port)] = port
+		}
+		t.ports[ev.DiscoveryID] = ports
+	case "reconnected", "resynced", "stop":
+		delete(t.ports, ev.DiscoveryID)
+	}
+}
+
+// discoveryPorts returns the ports of the given discovery, creating the map
+// if needed. mutex must be held by the caller.
+func (t *PortTracker) discoveryPorts(discoveryID string) map[trackedPortKey]*Port {
+	ports := t.ports[discoveryID]
+	if ports == nil {
+		ports = map[trackedPortKey]*Port{}
+		t.ports[discoveryID] = ports
+	}
+	return ports
+}
+
+// DiscoveryIDs returns the sorted IDs of the discoveries with at least one
+// port.
+func (t *PortTracker) DiscoveryIDs() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res := []string{}
+	for id, ports := range t.ports {
+		if len(ports) > 0 {
+			res = append(res, id)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Ports returns the ports of the given discovery, sorted by protocol and
+// address (see ComparePorts).
+func (t *PortTracker) Ports(discoveryID string) []*Port {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res := []*Port{}
+	for _, port := range t.ports[discoveryID] {
+		res = append(res, port)
+	}
+	slices.SortFunc(res, ComparePorts)
+	return res
+}
+
+// AllPorts returns the ports of all the discoveries, sorted by protocol
+// and address (see ComparePorts).
+func (t *PortTracker) AllPorts() []*Port {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res := []*Port{}
+	for _, ports := range t.ports {
+		for _, port := range ports {
+			res = append(res, port)
+		}
+	}
+	slices.SortFunc(res, ComparePorts)
+	return res
+}
+
+// Clear drops all the ports.
+func (t *PortTracker) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	clear(t.ports)
+}
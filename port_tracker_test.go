@@ -0,0 +1,64 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortTracker(t *testing.T) {
+	acm0 := &Port{Address: "/dev/ttyACM0", Protocol: "serial"}
+	acm1 := &Port{Address: "/dev/ttyACM1", Protocol: "serial"}
+	network := &Port{Address: "192.168.1.2", Protocol: "network"}
+	addresses := func(ports []*Port) []string {
+		res := []string{}
+		for _, port := range ports {
+			res = append(res, port.Address)
+		}
+		return res
+	}
+
+	tracker := NewPortTracker()
+	tracker.Track(&Event{Type: "add", DiscoveryID: "serial", Port: acm1})
+	tracker.Track(&Event{Type: "add", DiscoveryID: "serial", Port: acm0})
+	tracker.Track(&Event{Type: "snapshot", DiscoveryID: "mdns", Ports: []*Port{network}})
+	require.Equal(t, []string{"mdns", "serial"}, tracker.DiscoveryIDs())
+	require.Equal(t, []string{"/dev/ttyACM0", "/dev/ttyACM1"}, addresses(tracker.Ports("serial")))
+	require.Equal(t, []string{"192.168.1.2", "/dev/ttyACM0", "/dev/ttyACM1"}, addresses(tracker.AllPorts()))
+
+	tracker.Track(&Event{Type: "remove", DiscoveryID: "serial", Port: acm1})
+	require.Equal(t, []string{"/dev/ttyACM0"}, addresses(tracker.Ports("serial")))
+
+	// The old port of a "moved" event is dropped
+	tracker.Track(&Event{Type: "moved", DiscoveryID: "serial", Port: acm1, OldPort: acm0})
+	require.Equal(t, []string{"/dev/ttyACM1"}, addresses(tracker.Ports("serial")))
+
+	// The ports are reported again after a "resynced" or "reconnected" event
+	for _, eventType := range []string{"resynced", "reconnected", "stop"} {
+		tracker.Track(&Event{Type: "add", DiscoveryID: "serial", Port: acm0})
+		tracker.Track(&Event{Type: eventType, DiscoveryID: "serial"})
+		require.Empty(t, tracker.Ports("serial"), eventType)
+		require.Equal(t, []string{"mdns"}, tracker.DiscoveryIDs(), eventType)
+	}
+
+	tracker.Clear()
+	require.Empty(t, tracker.DiscoveryIDs())
+	require.Empty(t, tracker.AllPorts())
+}
@@ -0,0 +1,108 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package prometheus provides an adapter to collect the metrics of a
+// pluggable discovery Client using Prometheus.
+package prometheus
+
+import (
+	"time"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is a discovery.Metrics implementation that exports the metrics
+// of the discovery clients as Prometheus collectors.
+type Metrics struct {
+	commandDuration *prometheus.HistogramVec
+	commandErrors   *prometheus.CounterVec
+	events          *prometheus.CounterVec
+	eventsBacklog   *prometheus.GaugeVec
+	processRestarts *prometheus.CounterVec
+}
+
+var _ discovery.Metrics = (*Metrics)(nil)
+
+// NewMetrics creates a new Metrics and registers its collectors in the
+// given registerer. All the metric names are prefixed with the given
+// namespace.
+func NewMetrics(namespace string, reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "discovery_command_duration_seconds",
+			Help:      "Duration of the commands sent to the pluggable discoveries.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"discovery", "command"}),
+		commandErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "discovery_command_errors_total",
+			Help:      "Number of commands sent to the pluggable discoveries that failed.",
+		}, []string{"discovery", "command"}),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "discovery_events_total",
+			Help:      "Number of port events received from the pluggable discoveries.",
+		}, []string{"discovery", "type"}),
+		eventsBacklog: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "discovery_events_backlog",
+			Help:      "Number of events waiting to be consumed.",
+		}, []string{"discovery"}),
+		processRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "discovery_process_restarts_total",
+			Help:      "Number of restarts of the pluggable discoveries processes.",
+		}, []string{"discovery"}),
+	}
+	registered := []prometheus.Collector{}
+	for _, c := range []prometheus.Collector{m.commandDuration, m.commandErrors, m.events, m.eventsBacklog, m.processRestarts} {
+		if err := reg.Register(c); err != nil {
+			// Leave the registerer as it was
+			for _, r := range registered {
+				reg.Unregister(r)
+			}
+			return nil, err
+		}
+		registered = append(registered, c)
+	}
+	return m, nil
+}
+
+// CommandLatency implements discovery.Metrics
+func (m *Metrics) CommandLatency(discoveryID, command string, elapsed time.Duration, err error) {
+	m.commandDuration.WithLabelValues(discoveryID, command).Observe(elapsed.Seconds())
+	if err != nil {
+		m.commandErrors.WithLabelValues(discoveryID, command).Inc()
+	}
+}
+
+// EventReceived implements discovery.Metrics
+func (m *Metrics) EventReceived(discoveryID, eventType string) {
+	m.events.WithLabelValues(discoveryID, eventType).Inc()
+}
+
+// EventsBacklog implements discovery.Metrics
+func (m *Metrics) EventsBacklog(discoveryID string, backlog int) {
+	m.eventsBacklog.WithLabelValues(discoveryID).Set(float64(backlog))
+}
+
+// ProcessRestarted implements discovery.Metrics
+func (m *Metrics) ProcessRestarted(discoveryID string) {
+	m.processRestarts.WithLabelValues(discoveryID).Inc()
+}
@@ -0,0 +1,74 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package prometheus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m, err := NewMetrics("test", reg)
+	require.NoError(t, err)
+
+	m.CommandLatency("serial", "LIST", 10*time.Millisecond, nil)
+	m.CommandLatency("serial", "LIST", 20*time.Millisecond, errors.New("failed"))
+	m.EventReceived("serial", "add")
+	m.EventReceived("serial", "add")
+	m.EventReceived("serial", "remove")
+	m.EventsBacklog("serial", 3)
+	m.ProcessRestarted("serial")
+
+	require.Equal(t, 1, testutil.CollectAndCount(m.commandDuration))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.commandErrors.WithLabelValues("serial", "LIST")))
+	require.Equal(t, 2.0, testutil.ToFloat64(m.events.WithLabelValues("serial", "add")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.events.WithLabelValues("serial", "remove")))
+	require.Equal(t, 3.0, testutil.ToFloat64(m.eventsBacklog.WithLabelValues("serial")))
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP test_discovery_process_restarts_total Number of restarts of the pluggable discoveries processes.
+# TYPE test_discovery_process_restarts_total counter
+test_discovery_process_restarts_total{discovery="serial"} 1
+`), "test_discovery_process_restarts_total"))
+}
+
+func TestNewMetricsRegistrationError(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// Register a conflicting collector
+	require.NoError(t, reg.Register(prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "test",
+		Name:      "discovery_events_backlog",
+		Help:      "Conflicting collector.",
+	})))
+	m, err := NewMetrics("test", reg)
+	require.Error(t, err)
+	require.Nil(t, m)
+
+	// The collectors registered before the failure have been removed
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	_, err = NewMetrics("other", reg)
+	require.NoError(t, err)
+}
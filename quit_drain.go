@@ -0,0 +1,83 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"io"
+	"time"
+)
+
+// CapabilityQuitDrain is the capability advertised in the HELLO response by
+// the servers draining the events on QUIT, see Server.SetQuitDrain: the
+// "quit" response is always the last message of the session. The servers
+// without it may send a few events after the "quit" response, that the
+// Client ignores.
+const CapabilityQuitDrain = "quit_drain"
+
+// SetQuitDrain enables the draining of the events on QUIT, for the clients
+// that must not receive anything after the "quit" response: first the
+// events emitted by the discovery are not delivered anymore (the callbacks
+// return ErrEventNotDelivered), then the events already queued (for example
+// delayed by the rate limit, see SetEventRateLimit) and the buffered output
+// are written, and finally the discovery is terminated and the "quit"
+// response is sent. The capability is advertised to the clients in the
+// HELLO response. This method must be called before Run.
+func (d *Server) SetQuitDrain(enabled bool) {
+	d.quitDrain = enabled
+}
+
+// drainEvents is the first step of the QUIT command: the events emitted
+// from now on are refused with ErrEventNotDelivered, while the events
+// queued by the rate limit and the buffered output are written, so that
+// the "quit" response follows all the events of the session.
+func (d *Server) drainEvents() {
+	var pending []*message
+	if d.limiter != nil {
+		pending = d.limiter.takePending()
+	}
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	d.eventsClosed = true
+	for _, msg := range pending {
+		if d.output == io.Discard {
+			break
+		}
+		d.stats.eventEmitted()
+		if err := d.writeLocked(msg); err != nil {
+			d.logger.Errorf("Sending %s event: %v", msg.EventType, err)
+			d.output = io.Discard
+		}
+	}
+	if err := d.flushLocked(); err != nil {
+		d.logger.Errorf("Flushing the events: %v", err)
+	}
+}
+
+// waitQuitResponse waits for the response to QUIT, skipping the responses
+// to the previous commands still in flight. It returns nil also if the
+// discovery closes the connection without responding.
+func (disc *Client) waitQuitResponse(timeout time.Duration) error {
+	deadline := disc.clock.Now().Add(timeout)
+	for {
+		msg, err := disc.waitMessage(deadline.Sub(disc.clock.Now()))
+		if err != nil || msg == nil || msg.EventType == "quit" {
+			return err
+		}
+		disc.logger.Debugf("Skipped '%s' message waiting for the QUIT response", msg.EventType)
+	}
+}
@@ -0,0 +1,214 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// floodDiscovery emits events until they are refused, ignoring the
+// contexts, and reports the error of the callback.
+type floodDiscovery struct {
+	emitted chan struct{}
+	refused chan error
+}
+
+func (d *floodDiscovery) Hello(ctx context.Context, userAgent string, protocolVersion int) error {
+	return nil
+}
+
+func (d *floodDiscovery) StartSync(ctx context.Context, eventCB SyncEventCallback, errorCB ErrorCallback) error {
+	go func() {
+		for i := 0; ; i++ {
+			if err := eventCB("add", &Port{Address: fmt.Sprint(i), Protocol: "test"}); err != nil {
+				d.refused <- err
+				return
+			}
+			if i == 10 {
+				close(d.emitted)
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *floodDiscovery) Stop(ctx context.Context) error { return nil }
+
+func (d *floodDiscovery) Quit(ctx context.Context) {}
+
+// decodeMessages decodes all the messages sent by a Server.
+func decodeMessages(t *testing.T, data []byte) []message {
+	msgs := []message{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); errors.Is(err, io.EOF) {
+			return msgs
+		} else {
+			require.NoError(t, err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestServerQuitDrain(t *testing.T) {
+	impl := &floodDiscovery{emitted: make(chan struct{}), refused: make(chan error, 1)}
+	server := NewContextServer(impl)
+	server.SetQuitDrain(true)
+	inR, inW := io.Pipe()
+	go func() {
+		_, _ = io.WriteString(inW, "HELLO 1 \"test\"\nSTART_SYNC\n")
+		<-impl.emitted
+		_, _ = io.WriteString(inW, "QUIT\n")
+	}()
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(inR, out))
+	// The discovery is told that the events are not delivered anymore
+	require.ErrorIs(t, <-impl.refused, ErrEventNotDelivered)
+
+	msgs := decodeMessages(t, out.Bytes())
+	require.Contains(t, msgs[0].Capabilities, CapabilityQuitDrain)
+	require.Equal(t, "start_sync", msgs[1].EventType)
+	require.Greater(t, len(msgs), 13)
+	for _, msg := range msgs[2 : len(msgs)-1] {
+		require.Equal(t, "add", msg.EventType)
+	}
+	require.Equal(t, "quit", msgs[len(msgs)-1].EventType)
+	require.Equal(t, "OK", msgs[len(msgs)-1].Message)
+}
+
+// burstDiscovery emits a burst of events when started.
+type burstDiscovery struct {
+	testDiscovery
+}
+
+func (d *burstDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	eventCB("add", &Port{Address: "1", Protocol: "test"})
+	eventCB("add", &Port{Address: "2", Protocol: "test"})
+	eventCB("add", &Port{Address: "3", Protocol: "test"})
+	eventCB("remove", &Port{Address: "3", Protocol: "test"})
+	return nil
+}
+
+func TestServerQuitDrainRateLimit(t *testing.T) {
+	// The events delayed by the rate limit are delivered before the QUIT
+	// response, the port never reported is skipped
+	server := NewServer(&burstDiscovery{})
+	server.SetEventRateLimit(0.001, 1, false)
+	server.SetQuitDrain(true)
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(strings.NewReader("HELLO 1 \"test\"\nSTART_SYNC\nQUIT\n"), out))
+	events := []string{}
+	for _, msg := range decodeMessages(t, out.Bytes()) {
+		if msg.Port != nil {
+			events = append(events, msg.EventType+" "+msg.Port.Address)
+		} else {
+			events = append(events, msg.EventType)
+		}
+	}
+	require.Equal(t, []string{"hello", "start_sync", "add 1", "add 2", "quit"}, events)
+
+	// Without the drain they are discarded
+	server = NewServer(&burstDiscovery{})
+	server.SetEventRateLimit(0.001, 1, false)
+	out.Reset()
+	require.NoError(t, server.Run(strings.NewReader("HELLO 1 \"test\"\nSTART_SYNC\nQUIT\n"), out))
+	msgs := decodeMessages(t, out.Bytes())
+	require.NotContains(t, msgs[0].Capabilities, CapabilityQuitDrain)
+	require.Len(t, msgs, 4)
+}
+
+func TestClientQuitTrailingEvents(t *testing.T) {
+	run := func(capabilities string) ([]string, []Violation) {
+		// A discovery still sending events after the QUIT response
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			reader := bufio.NewReader(serverConn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				switch cmd, _, _ := strings.Cut(strings.TrimSpace(line), " "); cmd {
+				case "HELLO":
+					fmt.Fprintf(serverConn, `{"eventType":"hello","message":"OK","protocolVersion":1,"capabilities":[%s]}`+"\n", capabilities)
+				case "START_SYNC":
+					fmt.Fprintln(serverConn, `{"eventType":"start_sync","message":"OK"}`)
+					fmt.Fprintln(serverConn, `{"eventType":"add","port":{"address":"1","protocol":"test"}}`)
+				case "QUIT":
+					fmt.Fprintln(serverConn, `{"eventType":"add","port":{"address":"late","protocol":"test"}}`)
+					// The trailing event is in the same write, to be received before
+					// the connection is closed by the client
+					fmt.Fprintln(serverConn, `{"eventType":"quit","message":"OK"}`+"\n"+
+						`{"eventType":"add","port":{"address":"trailing","protocol":"test"}}`)
+					return
+				}
+			}
+		}()
+
+		var mutex sync.Mutex
+		violations := []Violation{}
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		cl.SetStrictStateValidation(true)
+		cl.SetProtocolViolationHandler(func(v Violation) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			violations = append(violations, v)
+		})
+		require.NoError(t, cl.Run())
+		events, err := cl.StartSync(10)
+		require.NoError(t, err)
+		cl.Quit()
+		addresses := []string{}
+		for ev := range events {
+			if ev.Port != nil {
+				addresses = append(addresses, ev.Port.Address)
+			}
+		}
+		require.NoError(t, cl.Close())
+		mutex.Lock()
+		defer mutex.Unlock()
+		return addresses, violations
+	}
+
+	// The trailing events are ignored
+	addresses, violations := run("")
+	require.Equal(t, []string{"1", "late"}, addresses)
+	require.Empty(t, violations)
+
+	// They are a violation if the discovery advertises the drain
+	addresses, violations = run(`"quit_drain"`)
+	require.Equal(t, []string{"1", "late"}, addresses)
+	require.Len(t, violations, 1)
+	require.Equal(t, ViolationInvalidState, violations[0].Kind)
+	require.Contains(t, string(violations[0].Raw), "trailing")
+	require.EqualError(t, violations[0].Err, "'add' event received after the QUIT response")
+}
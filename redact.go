@@ -0,0 +1,113 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"strings"
+)
+
+// Redactor masks the sensitive data of the ports, like serial numbers or MAC
+// addresses, before they are written to the logs of a Client or recorded in a
+// Journal, so that they can be shared in bug reports without leaking device
+// identifiers. The ports delivered to the application are not affected.
+type Redactor struct {
+	properties map[string]func(string) string
+	address    func(string) string
+}
+
+// NewRedactor creates a Redactor that doesn't mask anything, use
+// MaskProperty and MaskAddress to configure it.
+func NewRedactor() *Redactor {
+	return &Redactor{properties: map[string]func(string) string{}}
+}
+
+// MaskProperty masks the value of the port property with the given key using
+// the given mask function, or MaskAll if mask is nil.
+func (r *Redactor) MaskProperty(key string, mask func(string) string) *Redactor {
+	if mask == nil {
+		mask = MaskAll
+	}
+	r.properties[key] = mask
+	return r
+}
+
+// MaskAddress masks the address of the ports using the given mask function,
+// or MaskAll if mask is nil.
+func (r *Redactor) MaskAddress(mask func(string) string) *Redactor {
+	if mask == nil {
+		mask = MaskAll
+	}
+	r.address = mask
+	return r
+}
+
+// MaskAll replaces the whole value with a fixed placeholder.
+func MaskAll(value string) string {
+	return "****"
+}
+
+// MaskKeepLast returns a mask function that replaces all but the last n
+// characters of the value with '*'.
+func MaskKeepLast(n int) func(string) string {
+	return func(value string) string {
+		if len(value) <= n {
+			return strings.Repeat("*", len(value))
+		}
+		return strings.Repeat("*", len(value)-n) + value[len(value)-n:]
+	}
+}
+
+// Redact returns a copy of the given port with the sensitive data masked, or
+// the port itself if there is nothing to mask. A nil Redactor returns the
+// port unchanged.
+func (r *Redactor) Redact(port *Port) *Port {
+	if r == nil || port == nil {
+		return port
+	}
+	redacted := port
+	if r.address != nil && port.Address != "" {
+		redacted = port.Clone()
+		redacted.Address = r.address(port.Address)
+	}
+	if port.Properties == nil {
+		return redacted
+	}
+	for key, mask := range r.properties {
+		value, ok := port.Properties.GetOk(key)
+		if !ok {
+			continue
+		}
+		if redacted == port {
+			redacted = port.Clone()
+		}
+		redacted.Properties.Set(key, mask(value))
+	}
+	return redacted
+}
+
+// RedactAll returns the given ports with the sensitive data masked.
+func (r *Redactor) RedactAll(ports []*Port) []*Port {
+	if r == nil || ports == nil {
+		return ports
+	}
+	res := make([]*Port, len(ports))
+	for i, port := range ports {
+		res[i] = r.Redact(port)
+	}
+	return res
+}
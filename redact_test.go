@@ -0,0 +1,56 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactor(t *testing.T) {
+	port := &Port{
+		Address:  "AA:BB:CC:DD:EE:FF",
+		Protocol: "network",
+		Properties: properties.NewFromHashmap(map[string]string{
+			"serialNumber": "1234567890",
+			"mac":          "AA:BB:CC:DD:EE:FF",
+			"board":        "uno",
+		}),
+	}
+	r := NewRedactor().
+		MaskAddress(MaskKeepLast(2)).
+		MaskProperty("serialNumber", MaskKeepLast(4)).
+		MaskProperty("mac", nil)
+	redacted := r.Redact(port)
+	require.Equal(t, "***************FF", redacted.Address)
+	require.Equal(t, "******7890", redacted.Properties.Get("serialNumber"))
+	require.Equal(t, "****", redacted.Properties.Get("mac"))
+	require.Equal(t, "uno", redacted.Properties.Get("board"))
+
+	// The original port is not modified
+	require.Equal(t, "AA:BB:CC:DD:EE:FF", port.Address)
+	require.Equal(t, "1234567890", port.Properties.Get("serialNumber"))
+
+	// Nothing to mask
+	require.Same(t, port, NewRedactor().MaskProperty("vid", nil).Redact(port))
+	var nilRedactor *Redactor
+	require.Same(t, port, nilRedactor.Redact(port))
+	require.Equal(t, "**", MaskKeepLast(4)("ab"))
+}
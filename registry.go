@@ -0,0 +1,351 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/arduino/go-paths-helper"
+)
+
+// RegistryManifestName is the name of the manifest files that describe a
+// discovery to a Registry.
+const RegistryManifestName = "discovery.json"
+
+// RegistryEntry is a discovery found by a Registry.
+type RegistryEntry struct {
+	// ID is the discovery ID.
+	ID string
+	// Command is the command line used to run the discovery.
+	Command []string
+	// Manifest is the manifest describing the discovery, or nil if the
+	// discovery executable has been found directly.
+	Manifest *paths.Path
+
+	exeInfo os.FileInfo
+}
+
+// registryManifest is the content of a manifest file.
+type registryManifest struct {
+	Name string   `json:"name"`
+	Exe  string   `json:"exe"`
+	Args []string `json:"args"`
+}
+
+// Registry scans a directory tree for pluggable discoveries and keeps the
+// discoveries of a Manager in sync with the filesystem. The discoveries are
+// found as:
+//
+//   - manifest files named discovery.json, containing the "name" of the
+//     discovery (used as ID), the "exe" path (relative to the manifest
+//     folder) and the optional "args", for example:
+//     { "name": "serial", "exe": "serial-discovery", "args": ["-v"] }
+//   - executables named "<name>-discovery" (with the ".exe" extension on
+//     Windows), outside the folders containing a manifest. The ID of the discovery is
+//     the executable name. If the same executable is found multiple times,
+//     for example in folders named after different versions like the tools
+//     in the arduino-cli packages folder, the one with the highest version
+//     is used.
+type Registry struct {
+	root    *paths.Path
+	manager *Manager
+	setup   func(*Client)
+
+	mutex   sync.Mutex
+	entries map[string]*RegistryEntry
+}
+
+// NewRegistry creates a new Registry that scans the given root folder and
+// handles the discoveries of the given Manager.
+func NewRegistry(root *paths.Path, manager *Manager) *Registry {
+	return &Registry{
+		root:    root,
+		manager: manager,
+		entries: map[string]*RegistryEntry{},
+	}
+}
+
+// SetClientSetup sets a function called on each Client created by the
+// Registry, before adding it to the Manager, for example to set the logger
+// or the user agent.
+func (r *Registry) SetClientSetup(setup func(*Client)) {
+	r.setup = setup
+}
+
+// Scan scans the root folder and returns the discoveries found, sorted by
+// ID. The manifests that can't be loaded are reported in the returned error,
+// together with the discoveries found.
+func (r *Registry) Scan() ([]*RegistryEntry, error) {
+	files, err := r.root.ReadDirRecursive()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	entries := map[string]*RegistryEntry{}
+	var manifestFolders paths.PathList
+	for _, file := range files {
+		if file.Base() != RegistryManifestName {
+			continue
+		}
+		entry, err := loadRegistryManifest(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("loading %s: %w", file, err))
+			continue
+		}
+		if other, has := entries[entry.ID]; has {
+			errs = append(errs, fmt.Errorf("discovery %s defined in both %s and %s", entry.ID, other.Manifest, file))
+			continue
+		}
+		entries[entry.ID] = entry
+		manifestFolders.Add(file.Parent())
+	}
+
+	found := map[string]*paths.Path{}
+	for _, file := range files {
+		id, ok := discoveryExecutableName(file)
+		if !ok || isInsideAny(file, manifestFolders) {
+			continue
+		}
+		if _, has := entries[id]; has {
+			// A manifest has precedence
+			continue
+		}
+		if other, has := found[id]; has && compareVersions(other.String(), file.String()) >= 0 {
+			continue
+		}
+		found[id] = file
+	}
+	for id, exe := range found {
+		entries[id] = &RegistryEntry{ID: id, Command: []string{exe.String()}}
+	}
+
+	res := []*RegistryEntry{}
+	for _, entry := range entries {
+		res = append(res, entry)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, errors.Join(errs...)
+}
+
+func isInsideAny(file *paths.Path, folders paths.PathList) bool {
+	for _, folder := range folders {
+		if inside, err := file.IsInsideDir(folder); err == nil && inside {
+			return true
+		}
+	}
+	return false
+}
+
+func loadRegistryManifest(file *paths.Path) (*RegistryEntry, error) {
+	data, err := file.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	var manifest registryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Name == "" {
+		return nil, errors.New("missing discovery name")
+	}
+	if manifest.Exe == "" {
+		return nil, errors.New("missing discovery executable")
+	}
+	exe := paths.New(manifest.Exe)
+	if !exe.IsAbs() {
+		exe = file.Parent().Join(manifest.Exe)
+	}
+	return &RegistryEntry{
+		ID:       manifest.Name,
+		Command:  append([]string{exe.String()}, manifest.Args...),
+		Manifest: file,
+	}, nil
+}
+
+// discoveryExecutableName returns the name of the discovery executable, if
+// the given file is one.
+func discoveryExecutableName(file *paths.Path) (string, bool) {
+	name := file.Base()
+	if runtime.GOOS == "windows" {
+		if !strings.HasSuffix(strings.ToLower(name), ".exe") {
+			return "", false
+		}
+		name = name[:len(name)-4]
+	}
+	if !strings.HasSuffix(name, "-discovery") {
+		return "", false
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		return "", false
+	}
+	return name, true
+}
+
+// compareVersions compares the given strings, comparing the numeric parts
+// by value, so that "1.10.0" comes after "1.9.0".
+func compareVersions(a, b string) int {
+	split := func(s string) []string {
+		var res []string
+		for len(s) > 0 {
+			digits := unicode.IsDigit(rune(s[0]))
+			i := 1
+			for i < len(s) && unicode.IsDigit(rune(s[i])) == digits {
+				i++
+			}
+			res = append(res, s[:i])
+			s = s[i:]
+		}
+		return res
+	}
+	as, bs := split(a), split(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aerr := strconv.ParseUint(as[i], 10, 64)
+		bn, berr := strconv.ParseUint(bs[i], 10, 64)
+		if aerr == nil && berr == nil {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(as[i], bs[i])
+	}
+	return len(as) - len(bs)
+}
+
+// Entries returns the discoveries currently handled by the Registry, sorted
+// by ID.
+func (r *Registry) Entries() []*RegistryEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res := []*RegistryEntry{}
+	for _, entry := range r.entries {
+		res = append(res, entry)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Sync scans the root folder and updates the discoveries of the Manager: the
+// new discoveries are added, the ones no longer found are removed from the
+// Manager and terminated, and the ones with a different command line, or
+// whose executable has changed on disk (for example after a tool update),
+// are replaced (see Manager.Replace). Only the discoveries added by the
+// Registry are handled, the other discoveries of the Manager are left
+// untouched.
+func (r *Registry) Sync() error {
+	found, scanErr := r.Scan()
+	if found == nil {
+		return scanErr
+	}
+	errs := []error{scanErr}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	current := map[string]*RegistryEntry{}
+	for _, entry := range found {
+		current[entry.ID] = entry
+	}
+	for id := range r.entries {
+		if _, has := current[id]; has {
+			continue
+		}
+		if disc := r.manager.Remove(id); disc != nil {
+			disc.Quit()
+		}
+		delete(r.entries, id)
+	}
+	for _, entry := range found {
+		entry.exeInfo, _ = paths.New(entry.Command[0]).Stat()
+		old, has := r.entries[entry.ID]
+		if has && !old.changed(entry) {
+			continue
+		}
+		disc := NewClient(entry.ID, entry.Command...)
+		if r.setup != nil {
+			r.setup(disc)
+		}
+		if has {
+			if err := r.manager.Replace(disc); err != nil {
+				errs = append(errs, err)
+			}
+			r.entries[entry.ID] = entry
+			continue
+		}
+		if err := r.manager.Add(disc); err != nil {
+			errs = append(errs, err)
+			if errors.Is(err, ErrAlreadyAdded) {
+				// Not handled by the Registry
+				continue
+			}
+		}
+		r.entries[entry.ID] = entry
+	}
+	return errors.Join(errs...)
+}
+
+// changed returns true if the discovery must be restarted to apply the
+// given entry.
+func (e *RegistryEntry) changed(newEntry *RegistryEntry) bool {
+	if !slices.Equal(e.Command, newEntry.Command) {
+		return true
+	}
+	if e.exeInfo == nil || newEntry.exeInfo == nil {
+		return e.exeInfo != newEntry.exeInfo
+	}
+	// The executable may be replaced by a new file or rewritten in place
+	return !os.SameFile(e.exeInfo, newEntry.exeInfo) ||
+		!e.exeInfo.ModTime().Equal(newEntry.exeInfo.ModTime()) ||
+		e.exeInfo.Size() != newEntry.exeInfo.Size()
+}
+
+// Watch calls Sync periodically, with the given interval, until the context
+// is canceled. The errors are reported to errorCB, if not nil.
+func (r *Registry) Watch(ctx context.Context, interval time.Duration, errorCB func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Sync(); err != nil && errorCB != nil {
+			errorCB(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test executables are shell scripts")
+	}
+	root, err := paths.MkTempDir("", "registry")
+	require.NoError(t, err)
+	defer root.RemoveAll()
+	writeExe := func(path string) *paths.Path {
+		exe := root.Join(path)
+		require.NoError(t, exe.Parent().MkdirAll())
+		require.NoError(t, exe.WriteFile([]byte("#!/bin/sh\n")))
+		require.NoError(t, os.Chmod(exe.String(), 0755))
+		return exe
+	}
+	serial19 := writeExe("packages/builtin/tools/serial-discovery/1.9.0/serial-discovery")
+	serial110 := writeExe("packages/builtin/tools/serial-discovery/1.10.0/serial-discovery")
+	mdns := writeExe("packages/builtin/tools/mdns-discovery/1.0.0/mdns-discovery")
+	require.NoError(t, root.Join("packages/builtin/tools/mdns-discovery/1.0.0/README").WriteFile([]byte("not a discovery")))
+	require.NoError(t, root.Join("packages/other").MkdirAll())
+	require.NoError(t, root.Join("packages/other/not-executable-discovery").WriteFile([]byte("")))
+	writeExe("packages/vendor/tools/vendor/bin/vendor-discovery")
+	require.NoError(t, root.Join("packages/vendor/tools/vendor/discovery.json").WriteFile([]byte(
+		`{ "name": "vendor", "exe": "bin/vendor-discovery", "args": ["-v"] }`)))
+
+	manager := NewManager()
+	registry := NewRegistry(root, manager)
+	entries, err := registry.Scan()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, "mdns-discovery", entries[0].ID)
+	require.Equal(t, []string{mdns.String()}, entries[0].Command)
+	require.Nil(t, entries[0].Manifest)
+	require.Equal(t, "serial-discovery", entries[1].ID)
+	require.Equal(t, []string{serial110.String()}, entries[1].Command)
+	require.Equal(t, "vendor", entries[2].ID)
+	require.Equal(t, []string{root.Join("packages/vendor/tools/vendor/bin/vendor-discovery").String(), "-v"}, entries[2].Command)
+	require.NotNil(t, entries[2].Manifest)
+
+	// A discovery not handled by the Registry is left untouched
+	require.NoError(t, manager.Add(NewClient("other", "other-discovery")))
+	setupCalled := 0
+	registry.SetClientSetup(func(c *Client) { setupCalled++ })
+	require.NoError(t, registry.Sync())
+	require.Equal(t, 3, setupCalled)
+	ids := []string{}
+	for _, disc := range manager.Discoveries() {
+		ids = append(ids, disc.GetID())
+	}
+	require.Equal(t, []string{"mdns-discovery", "other", "serial-discovery", "vendor"}, ids)
+	require.Len(t, registry.Entries(), 3)
+
+	// Changes on the filesystem are applied to the Manager
+	require.NoError(t, serial110.Parent().RemoveAll())
+	require.NoError(t, mdns.Remove())
+	require.NoError(t, registry.Sync())
+	require.Len(t, manager.Discoveries(), 3)
+	require.Nil(t, registry.manager.discoveries["mdns-discovery"])
+	require.Equal(t, []string{serial19.String()}, registry.Entries()[0].Command)
+	require.Equal(t, 4, setupCalled)
+
+	// Invalid manifests are reported
+	require.NoError(t, root.Join("packages/broken").MkdirAll())
+	require.NoError(t, root.Join("packages/broken/discovery.json").WriteFile([]byte(`{ "name": "broken" }`)))
+	require.ErrorContains(t, registry.Sync(), "missing discovery executable")
+	require.Len(t, registry.Entries(), 2)
+}
+
+func TestCompareVersions(t *testing.T) {
+	require.Negative(t, compareVersions("1.9.0", "1.10.0"))
+	require.Positive(t, compareVersions("tools/2.0.0/a", "tools/1.99.0/a"))
+	require.Zero(t, compareVersions("1.0.0", "1.0.0"))
+	require.Negative(t, compareVersions("1.0.0", "1.0.0-rc1"))
+	require.Negative(t, compareVersions("a", "b"))
+}
+
+func TestRegistryHotReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the executable can't be replaced while running")
+	}
+	builder, err := paths.NewProcess(nil, "go", "build")
+	require.NoError(t, err)
+	builder.SetDir("dummy-discovery")
+	require.NoError(t, builder.Run())
+
+	root, err := paths.MkTempDir("", "registry")
+	require.NoError(t, err)
+	defer root.RemoveAll()
+	exe := root.Join("dummy-discovery")
+	install := func() {
+		// Replace the executable with a new file, like a tool update would do
+		tmp := root.Join("tmp")
+		require.NoError(t, paths.New("dummy-discovery", "dummy-discovery").CopyTo(tmp))
+		require.NoError(t, os.Chmod(tmp.String(), 0755))
+		require.NoError(t, tmp.Rename(exe))
+	}
+	install()
+
+	manager := NewManager()
+	registry := NewRegistry(root, manager)
+	require.NoError(t, registry.Sync())
+	ch, errs := manager.StartSync(10)
+	require.Empty(t, errs)
+	require.Equal(t, "add", (<-ch).Type)
+	require.Equal(t, "add", (<-ch).Type)
+	old := manager.Discoveries()[0]
+
+	// Nothing changed
+	require.NoError(t, registry.Sync())
+	require.Same(t, old, manager.Discoveries()[0])
+
+	install()
+	require.NoError(t, registry.Sync())
+	require.NotSame(t, old, manager.Discoveries()[0])
+	require.False(t, old.Alive())
+	for _, expected := range []string{"remove", "remove", "add", "add"} {
+		require.Equal(t, expected, (<-ch).Type)
+	}
+
+	manager.Quit()
+	for range ch {
+	}
+}
@@ -0,0 +1,148 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CapabilitySelfTest is the capability advertised in the HELLO response by
+// the servers whose implementation supports the SELFTEST command, see
+// SelfTester.
+const CapabilitySelfTest = "selftest"
+
+// selfTestTimeout is the time the Client waits for the SELFTEST response:
+// the checks may involve slow operations, like probing the network.
+const selfTestTimeout = time.Second * 30
+
+// SelfTester may be implemented by a Discovery (or ContextDiscovery) to
+// verify its prerequisites (the drivers installed, the permissions to
+// access the devices, the network reachable...) when the client sends the
+// SELFTEST command, so that the IDEs can help the users to diagnose why the
+// boards are not detected. The capability is advertised to the clients in
+// the HELLO response.
+type SelfTester interface {
+	// SelfTest runs the checks and returns their results. It may be called
+	// at any time after Hello, with the discovery started or not; the
+	// context is cancelled when the session ends.
+	SelfTest(ctx context.Context) SelfTestReport
+}
+
+// SelfTestStatus is the outcome of a self-test check.
+type SelfTestStatus string
+
+const (
+	// SelfTestOK is the status of a passed check.
+	SelfTestOK SelfTestStatus = "ok"
+	// SelfTestWarning is the status of a check revealing a problem that
+	// may prevent the detection of some boards.
+	SelfTestWarning SelfTestStatus = "warning"
+	// SelfTestFailed is the status of a check revealing a problem that
+	// prevents the discovery from working.
+	SelfTestFailed SelfTestStatus = "failed"
+)
+
+// SelfTestCheck is the result of a single self-test check.
+type SelfTestCheck struct {
+	// Name identifies the check, for example "serial-permissions".
+	Name string `json:"name"`
+	// Status is the outcome of the check.
+	Status SelfTestStatus `json:"status"`
+	// Message describes the outcome of the check in a human readable form,
+	// with the suggested fix if the check didn't pass.
+	Message string `json:"message,omitempty"`
+}
+
+// SelfTestReport is the result of the SELFTEST command.
+type SelfTestReport struct {
+	Checks []SelfTestCheck
+}
+
+// Passed returns true if none of the checks failed. The warnings don't
+// count as failures.
+func (r *SelfTestReport) Passed() bool {
+	for _, check := range r.Checks {
+		if check.Status == SelfTestFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Problems returns the checks that didn't pass, warnings included.
+func (r *SelfTestReport) Problems() []SelfTestCheck {
+	var res []SelfTestCheck
+	for _, check := range r.Checks {
+		if check.Status != SelfTestOK {
+			res = append(res, check)
+		}
+	}
+	return res
+}
+
+// selfTester returns the implementation as a SelfTester, if it implements
+// the interface.
+func (d *Server) selfTester() (SelfTester, bool) {
+	tester, ok := d.implementation().(SelfTester)
+	return tester, ok
+}
+
+func (d *Server) selfTest() {
+	tester, ok := d.selfTester()
+	if !ok {
+		d.send(messageError("selftest", ErrorCodeInvalidCommand, "Command SELFTEST not supported"))
+		return
+	}
+	report := tester.SelfTest(d.sessionContext())
+	d.send(&message{
+		EventType: "selftest",
+		Message:   "OK",
+		Checks:    report.Checks,
+	})
+}
+
+// SelfTest asks the discovery to verify its prerequisites and returns the
+// results of the checks, see SelfTester. It returns an error if the
+// discovery doesn't support the SELFTEST command (the CapabilitySelfTest
+// capability is not advertised): the failed checks are not errors, see
+// SelfTestReport.Passed.
+func (disc *Client) SelfTest() (report *SelfTestReport, err error) {
+	endCommand := disc.instrumentCommand("SELFTEST")
+	defer func() { endCommand(err) }()
+
+	if err := disc.checkNotReconnecting(); err != nil {
+		return nil, err
+	}
+	if !disc.HasCapability(CapabilitySelfTest) {
+		return nil, fmt.Errorf("discovery %s doesn't support SELFTEST", disc.id)
+	}
+	if err := disc.sendCommand("SELFTEST\n"); err != nil {
+		return nil, err
+	}
+	if msg, err := disc.waitMessage(selfTestTimeout); err != nil {
+		return nil, fmt.Errorf("calling SELFTEST: %w", err)
+	} else if msg.EventType != "selftest" {
+		return nil, disc.outOfSync("selftest", msg)
+	} else if msg.Error {
+		return nil, newCommandError("SELFTEST", msg)
+	} else {
+		return &SelfTestReport{Checks: msg.Checks}, nil
+	}
+}
@@ -0,0 +1,112 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// selfTestDiscovery reports a fixed list of checks.
+type selfTestDiscovery struct {
+	testDiscovery
+	checks []SelfTestCheck
+}
+
+func (d *selfTestDiscovery) SelfTest(ctx context.Context) SelfTestReport {
+	return SelfTestReport{Checks: d.checks}
+}
+
+// selfTestMessages decodes the responses to HELLO, SELFTEST and QUIT.
+func selfTestMessages(t *testing.T, out *bytes.Buffer) []message {
+	msgs := make([]message, 3)
+	decoder := json.NewDecoder(out)
+	for i := range msgs {
+		require.NoError(t, decoder.Decode(&msgs[i]))
+	}
+	return msgs
+}
+
+func TestServerSelfTest(t *testing.T) {
+	checks := []SelfTestCheck{
+		{Name: "drivers", Status: SelfTestOK, Message: "CH340 driver installed"},
+		{Name: "permissions", Status: SelfTestFailed, Message: "add the user to the dialout group"},
+	}
+	out := &bytes.Buffer{}
+	server := NewServer(&selfTestDiscovery{checks: checks})
+	require.NoError(t, server.Run(strings.NewReader("HELLO 1 \"test\"\nSELFTEST\nQUIT\n"), out))
+	msgs := selfTestMessages(t, out)
+	require.Contains(t, msgs[0].Capabilities, CapabilitySelfTest)
+	require.Equal(t, "selftest", msgs[1].EventType)
+	require.False(t, msgs[1].Error)
+	require.Equal(t, checks, msgs[1].Checks)
+
+	// The implementations without the checks don't support the command
+	out.Reset()
+	server = NewServer(&testDiscovery{})
+	require.NoError(t, server.Run(strings.NewReader("HELLO 1 \"test\"\nSELFTEST\nQUIT\n"), out))
+	msgs = selfTestMessages(t, out)
+	require.NotContains(t, msgs[0].Capabilities, CapabilitySelfTest)
+	require.True(t, msgs[1].Error)
+	require.Equal(t, string(ErrorCodeInvalidCommand), msgs[1].Code)
+}
+
+func TestClientSelfTest(t *testing.T) {
+	report := SelfTestReport{Checks: []SelfTestCheck{
+		{Name: "drivers", Status: SelfTestOK},
+		{Name: "network", Status: SelfTestWarning, Message: "multicast not available"},
+	}}
+	require.True(t, report.Passed())
+	require.Equal(t, report.Checks[1:], report.Problems())
+	report.Checks = append(report.Checks, SelfTestCheck{Name: "permissions", Status: SelfTestFailed})
+	require.False(t, report.Passed())
+	require.Equal(t, report.Checks[1:], report.Problems())
+
+	run := func(impl Discovery) *Client {
+		clientConn, serverConn := net.Pipe()
+		server := NewServer(impl)
+		server.SetMsgpackFraming(true)
+		go func() {
+			defer serverConn.Close()
+			_ = server.Run(serverConn, serverConn)
+		}()
+		cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+		cl.SetMsgpackFraming(true)
+		require.NoError(t, cl.Run())
+		return cl
+	}
+
+	cl := run(&selfTestDiscovery{checks: report.Checks})
+	require.True(t, cl.HasCapability(CapabilitySelfTest))
+	res, err := cl.SelfTest()
+	require.NoError(t, err)
+	require.Equal(t, &report, res)
+	cl.Quit()
+
+	cl = run(&testDiscovery{})
+	_, err = cl.SelfTest()
+	require.ErrorContains(t, err, "doesn't support SELFTEST")
+	cl.Quit()
+}
@@ -0,0 +1,87 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// PortInfo is the description of a serial port as reported by the OS.
+// VID and PID are the USB vendor and product IDs in hexadecimal notation,
+// without the "0x" prefix.
+type PortInfo struct {
+	Name         string
+	IsUSB        bool
+	VID          string
+	PID          string
+	SerialNumber string
+	Product      string
+}
+
+// Enumerator lists the serial ports currently available on the system.
+type Enumerator interface {
+	Enumerate() ([]*PortInfo, error)
+}
+
+// ErrEnumerationNotImplemented is returned by the OS enumerator on the
+// platforms where the enumeration is not implemented yet.
+var ErrEnumerationNotImplemented = errors.New("serial ports enumeration not implemented on " + runtime.GOOS)
+
+// osEnumerator is the stub of the Enumerator of the OS serial ports. A real
+// discovery should enumerate the ports with the platform API: the SetupAPI
+// on Windows, IOKit on macOS, and the /sys/class/tty tree on Linux, where the
+// USB attributes of a port are found in the parent USB device directory.
+type osEnumerator struct{}
+
+// Enumerate returns ErrEnumerationNotImplemented.
+func (osEnumerator) Enumerate() ([]*PortInfo, error) {
+	return nil, ErrEnumerationNotImplemented
+}
+
+// fakeEnumerator is an Enumerator simulating an Arduino board being
+// connected and disconnected every five enumerations, next to a serial port
+// always present. It's the default Enumerator of this example.
+type fakeEnumerator struct {
+	mutex sync.Mutex
+	count int
+}
+
+func newFakeEnumerator() *fakeEnumerator {
+	return &fakeEnumerator{}
+}
+
+// Enumerate returns the fake serial ports.
+func (e *fakeEnumerator) Enumerate() ([]*PortInfo, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.count++
+	res := []*PortInfo{{Name: "/dev/ttyS0"}}
+	if (e.count/5)%2 == 0 {
+		res = append(res, &PortInfo{
+			Name:         "/dev/ttyACM0",
+			IsUSB:        true,
+			VID:          "2341",
+			PID:          "0043",
+			SerialNumber: "85736323838351E0A0E1",
+			Product:      "Arduino Uno",
+		})
+	}
+	return res, nil
+}
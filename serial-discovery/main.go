@@ -0,0 +1,181 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// serial-discovery is the skeleton of a serial ports discovery: it polls the
+// serial ports of the system through an Enumerator and reports the ports
+// connected and disconnected since the previous poll. It's a reference for
+// the authors of discoveries based on the enumeration of the OS devices,
+// the enumeration itself is left to the platform specific Enumerator.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	properties "github.com/arduino/go-properties-orderedmap"
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+)
+
+// pollInterval is the interval between two enumerations of the serial ports.
+const pollInterval = time.Second
+
+func main() {
+	useOS := flag.Bool("os", false, "enumerate the serial ports of the OS instead of the fake ones")
+	flag.Parse()
+	var enumerator Enumerator = newFakeEnumerator()
+	if *useOS {
+		enumerator = osEnumerator{}
+	}
+	discovery.RunContextDiscovery(&serialDiscovery{
+		enumerator: enumerator,
+		interval:   pollInterval,
+	})
+}
+
+// serialDiscovery is a ContextDiscovery polling the serial ports.
+type serialDiscovery struct {
+	enumerator Enumerator
+	interval   time.Duration
+	wg         sync.WaitGroup
+}
+
+// Hello does nothing.
+func (d *serialDiscovery) Hello(ctx context.Context, userAgent string, protocolVersion int) error {
+	return nil
+}
+
+// StartSync enumerates the serial ports a first time, to report the ports
+// already connected and to fail early if the enumeration is not available,
+// then starts a goroutine that polls the ports until the context is cancelled.
+func (d *serialDiscovery) StartSync(ctx context.Context, eventCB discovery.SyncEventCallback, errorCB discovery.ErrorCallback) error {
+	p := &poller{enumerator: d.enumerator, eventCB: eventCB}
+	if err := p.poll(); err != nil {
+		return err
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(d.interval):
+			}
+			if err := p.poll(); errors.Is(err, discovery.ErrEventNotDelivered) {
+				// The client went away, wait for the next START_SYNC
+				return
+			} else if err != nil {
+				errorCB(err.Error())
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop waits for the polling goroutine to terminate, the context passed to
+// StartSync is already cancelled.
+func (d *serialDiscovery) Stop(ctx context.Context) error {
+	d.wg.Wait()
+	return nil
+}
+
+// Quit stops the discovery.
+func (d *serialDiscovery) Quit(ctx context.Context) {
+	d.wg.Wait()
+}
+
+// poller turns the snapshots taken by an Enumerator into "add" and "remove"
+// events, comparing each snapshot with the previous one.
+type poller struct {
+	enumerator Enumerator
+	eventCB    discovery.SyncEventCallback
+	ports      map[string]*discovery.Port
+}
+
+// poll enumerates the serial ports and sends the events for the ports
+// connected or disconnected since the previous call. A port whose details
+// changed (for example a board replaced on the same device name in between
+// two polls) is reported as removed and added again.
+func (p *poller) poll() error {
+	infos, err := p.enumerator.Enumerate()
+	if err != nil {
+		return fmt.Errorf("enumerating serial ports: %w", err)
+	}
+	current := map[string]*discovery.Port{}
+	for _, info := range infos {
+		current[info.Name] = newSerialPort(info)
+	}
+	for address, port := range p.ports {
+		if newPort, ok := current[address]; ok && newPort.HardwareID == port.HardwareID && newPort.Properties.Equals(port.Properties) {
+			continue
+		}
+		if err := p.eventCB("remove", &discovery.Port{Address: port.Address, Protocol: port.Protocol}); err != nil {
+			return err
+		}
+		delete(p.ports, address)
+	}
+	if p.ports == nil {
+		p.ports = map[string]*discovery.Port{}
+	}
+	// Report the new ports in the order given by the enumerator
+	for _, info := range infos {
+		if _, ok := p.ports[info.Name]; ok {
+			continue
+		}
+		port := current[info.Name]
+		if err := p.eventCB("add", port); err != nil {
+			return err
+		}
+		p.ports[info.Name] = port
+	}
+	return nil
+}
+
+// newSerialPort creates the Port of a serial port with the properties
+// recommended for the serial ports: "vid", "pid" and "serialNumber" for the
+// USB devices. The USB serial number, when available, is also the hardwareId
+// of the port: it allows the clients to recognize the board even if it's
+// connected to a different USB port.
+func newSerialPort(info *PortInfo) *discovery.Port {
+	props := properties.NewMap()
+	label := info.Name
+	protocolLabel := "Serial Port"
+	if info.IsUSB {
+		props.Set("vid", "0x"+info.VID)
+		props.Set("pid", "0x"+info.PID)
+		if info.SerialNumber != "" {
+			props.Set("serialNumber", info.SerialNumber)
+		}
+		if info.Product != "" {
+			label = fmt.Sprintf("%s (%s)", info.Name, info.Product)
+		}
+		protocolLabel = "Serial Port (USB)"
+	}
+	return &discovery.Port{
+		Address:       info.Name,
+		AddressLabel:  label,
+		Protocol:      "serial",
+		ProtocolLabel: protocolLabel,
+		Properties:    props,
+		HardwareID:    info.SerialNumber,
+	}
+}
@@ -0,0 +1,94 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package main
+
+import (
+	"testing"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type staticEnumerator struct {
+	ports []*PortInfo
+}
+
+func (e *staticEnumerator) Enumerate() ([]*PortInfo, error) {
+	return e.ports, nil
+}
+
+func TestPoller(t *testing.T) {
+	uno := &PortInfo{Name: "/dev/ttyACM0", IsUSB: true, VID: "2341", PID: "0043", SerialNumber: "1234", Product: "Arduino Uno"}
+	ttyS0 := &PortInfo{Name: "/dev/ttyS0"}
+	enumerator := &staticEnumerator{ports: []*PortInfo{ttyS0, uno}}
+	events := []string{}
+	p := &poller{
+		enumerator: enumerator,
+		eventCB: func(event string, port *discovery.Port) error {
+			events = append(events, event+" "+port.Address+" "+port.HardwareID)
+			return nil
+		},
+	}
+
+	require.NoError(t, p.poll())
+	require.Equal(t, []string{"add /dev/ttyS0 ", "add /dev/ttyACM0 1234"}, events)
+
+	// Nothing changed
+	events = events[:0]
+	require.NoError(t, p.poll())
+	require.Empty(t, events)
+
+	// Another board on the same device name
+	events = events[:0]
+	enumerator.ports = []*PortInfo{ttyS0, {Name: "/dev/ttyACM0", IsUSB: true, VID: "2341", PID: "0043", SerialNumber: "5678"}}
+	require.NoError(t, p.poll())
+	require.Equal(t, []string{"remove /dev/ttyACM0 ", "add /dev/ttyACM0 5678"}, events)
+
+	events = events[:0]
+	enumerator.ports = []*PortInfo{ttyS0}
+	require.NoError(t, p.poll())
+	require.Equal(t, []string{"remove /dev/ttyACM0 "}, events)
+
+	// A failed delivery is retried at the next poll
+	enumerator.ports = []*PortInfo{ttyS0, uno}
+	p.eventCB = func(event string, port *discovery.Port) error { return discovery.ErrEventNotDelivered }
+	require.ErrorIs(t, p.poll(), discovery.ErrEventNotDelivered)
+	events = events[:0]
+	p.eventCB = func(event string, port *discovery.Port) error {
+		events = append(events, event+" "+port.Address+" "+port.HardwareID)
+		return nil
+	}
+	require.NoError(t, p.poll())
+	require.Equal(t, []string{"add /dev/ttyACM0 1234"}, events)
+}
+
+func TestNewSerialPort(t *testing.T) {
+	port := newSerialPort(&PortInfo{Name: "/dev/ttyACM0", IsUSB: true, VID: "2341", PID: "0043", SerialNumber: "1234", Product: "Arduino Uno"})
+	require.Equal(t, "/dev/ttyACM0", port.Address)
+	require.Equal(t, "/dev/ttyACM0 (Arduino Uno)", port.AddressLabel)
+	require.Equal(t, "serial", port.Protocol)
+	require.Equal(t, "Serial Port (USB)", port.ProtocolLabel)
+	require.Equal(t, "1234", port.HardwareID)
+	require.Equal(t, map[string]string{"vid": "0x2341", "pid": "0x0043", "serialNumber": "1234"}, port.Properties.AsMap())
+
+	port = newSerialPort(&PortInfo{Name: "/dev/ttyS0"})
+	require.Equal(t, "/dev/ttyS0", port.AddressLabel)
+	require.Equal(t, "Serial Port", port.ProtocolLabel)
+	require.Empty(t, port.HardwareID)
+	require.Equal(t, 0, port.Properties.Size())
+}
@@ -0,0 +1,135 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// ActivationSocket returns the socket passed to the discovery by the
+// service manager that started it, if any:
+//   - with the systemd socket activation (the LISTEN_PID and LISTEN_FDS
+//     environment variables) the first socket passed by systemd: a
+//     listener with Accept=no or a connection with Accept=yes
+//   - with inetd the connection in the standard input
+//
+// The listener and the connection are both nil if the discovery has not
+// been started with socket activation, and always on Windows. The LISTEN_*
+// environment variables are removed, so that they are not inherited by the
+// processes started by the discovery.
+func ActivationSocket() (net.Listener, net.Conn, error) {
+	f, err := activationFile()
+	if f == nil || err != nil {
+		return nil, nil, err
+	}
+	if f != os.Stdin {
+		// The socket is duplicated by the net package
+		defer f.Close()
+	}
+	return socketFromFile(f)
+}
+
+// parseListenFDs parses the LISTEN_* environment variables set by systemd,
+// it returns false if the sockets have not been passed to the process with
+// the given pid, and the name of the first socket.
+func parseListenFDs(listenPID, listenFDs, listenFDNames string, pid int) (string, bool, error) {
+	if listenPID == "" || listenPID != strconv.Itoa(pid) {
+		return "", false, nil
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 1 {
+		return "", false, fmt.Errorf("invalid LISTEN_FDS: %q", listenFDs)
+	}
+	name, _, _ := strings.Cut(listenFDNames, ":")
+	if name == "" {
+		name = "LISTEN_FD_" + strconv.Itoa(listenFDsStart)
+	}
+	return name, true, nil
+}
+
+// socketFromFile returns the listener or the connection of the socket f.
+func socketFromFile(f *os.File) (net.Listener, net.Conn, error) {
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("activation socket: %w", err)
+	}
+	if conn.RemoteAddr() != nil {
+		return nil, conn, nil
+	}
+	// Not connected, it must be a listener
+	conn.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("activation socket: %w", err)
+	}
+	return l, nil, nil
+}
+
+// RunActivatedServer is the same as RunServer, but if the discovery has
+// been started with socket activation (see ActivationSocket) the Server
+// runs over the socket instead of the standard input and output. On a
+// connection (with inetd or with the systemd Accept=yes) a single session
+// is served, exactly like on the standard input. On a listener (with the
+// systemd Accept=no) the sessions are served with Serve, one at a time,
+// until the program receives a SIGINT or SIGTERM signal. This allows to
+// manage the discoveries of a remote lab with systemd units:
+//
+//	func main() {
+//		discovery.RunActivatedServer(discovery.NewServer(&myDiscovery{}))
+//	}
+func RunActivatedServer(server *Server) {
+	l, conn, err := ActivationSocket()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(ExitCodeIOError)
+	}
+	switch {
+	case l != nil:
+		os.Exit(serveActivated(server, l, notifyTermination()))
+	case conn != nil:
+		os.Exit(runDiscovery(server, conn, conn, notifyTermination()))
+	default:
+		RunServer(server)
+	}
+}
+
+// serveActivated serves the sessions on the listener until a signal is
+// received, and returns the exit code.
+func serveActivated(server *Server, l net.Listener, signals <-chan os.Signal) int {
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(l) }()
+	select {
+	case <-signals:
+		l.Close()
+		<-done
+		server.quit()
+		return ExitCodeOK
+	case <-done:
+		server.quit()
+		return ExitCodeIOError
+	}
+}
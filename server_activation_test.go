@@ -0,0 +1,124 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build unix && !discovery_nonet
+
+package discovery
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenFDs(t *testing.T) {
+	name, ok, err := parseListenFDs("", "", "", 42)
+	require.NoError(t, err)
+	require.False(t, ok)
+	// Meant for another process
+	_, ok, err = parseListenFDs("41", "1", "", 42)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	name, ok, err = parseListenFDs("42", "1", "", 42)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "LISTEN_FD_3", name)
+	name, ok, err = parseListenFDs("42", "2", "discovery:other", 42)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "discovery", name)
+
+	_, _, err = parseListenFDs("42", "0", "", 42)
+	require.EqualError(t, err, `invalid LISTEN_FDS: "0"`)
+}
+
+func TestSocketFromFile(t *testing.T) {
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer tcp.Close()
+	unix, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "discovery.sock"), Net: "unix"})
+	require.NoError(t, err)
+	defer unix.Close()
+
+	for _, listener := range []interface {
+		net.Listener
+		File() (*os.File, error)
+	}{tcp, unix} {
+		f, err := listener.File()
+		require.NoError(t, err)
+		l, conn, err := socketFromFile(f)
+		f.Close()
+		require.NoError(t, err)
+		require.Nil(t, conn)
+		require.Equal(t, listener.Addr().String(), l.Addr().String())
+		l.Close()
+	}
+
+	client, err := net.DialTCP("tcp", nil, tcp.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer client.Close()
+	f, err := client.File()
+	require.NoError(t, err)
+	l, conn, err := socketFromFile(f)
+	f.Close()
+	require.NoError(t, err)
+	require.Nil(t, l)
+	require.Equal(t, tcp.Addr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	// Not a socket
+	f, err = os.Open(os.DevNull)
+	require.NoError(t, err)
+	defer f.Close()
+	_, _, err = socketFromFile(f)
+	require.Error(t, err)
+}
+
+func TestServeActivated(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	impl := &quitCountingDiscovery{}
+	signals := make(chan os.Signal, 1)
+	code := make(chan int, 1)
+	go func() { code <- serveActivated(NewServer(impl), l, signals) }()
+
+	// Two sessions, one after the other
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("HELLO 1 \"test\"\nQUIT\n"))
+		require.NoError(t, err)
+		r := bufio.NewScanner(conn)
+		for r.Scan() {
+			if r.Text() == `  "eventType": "quit",` {
+				break
+			}
+		}
+		conn.Close()
+	}
+	require.Zero(t, impl.quits.Load())
+
+	signals <- syscall.SIGTERM
+	require.Equal(t, ExitCodeOK, <-code)
+	require.Equal(t, int32(1), impl.quits.Load())
+}
@@ -0,0 +1,44 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build unix && !discovery_nonet
+
+package discovery
+
+import (
+	"os"
+	"syscall"
+)
+
+// activationFile returns the socket passed by systemd or inetd, if any.
+func activationFile() (*os.File, error) {
+	if _, ok := os.LookupEnv("LISTEN_PID"); ok {
+		name, ok, err := parseListenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		if !ok || err != nil {
+			return nil, err
+		}
+		syscall.CloseOnExec(listenFDsStart)
+		return os.NewFile(listenFDsStart, name), nil
+	}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeSocket != 0 {
+		return os.Stdin, nil
+	}
+	return nil, nil
+}
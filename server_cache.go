@@ -0,0 +1,114 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import "slices"
+
+// CachedPorts returns a copy of the ports that the Server believes are
+// currently present: the ports added, and not removed, by the
+// implementation since the last START or START_SYNC, the same ones sent in
+// reply to a LIST. The ports are sorted with ComparePorts. The list is empty
+// when the discovery is stopped. It's safe to call CachedPorts from any
+// goroutine, for example from the implementation itself to answer a
+// SELFTEST.
+func (d *Server) CachedPorts() []*Port {
+	d.cacheMutex.Lock()
+	defer d.cacheMutex.Unlock()
+	res := make([]*Port, 0, len(d.cachedPorts))
+	for _, port := range d.cachedPorts {
+		res = append(res, port.Clone())
+	}
+	slices.SortFunc(res, ComparePorts)
+	return res
+}
+
+// SetCacheCallback sets a callback notified of the changes of the ports
+// cached by the Server (see CachedPorts), in START mode as well as in
+// "events" mode: event is "add" when a port is added or updated and
+// "remove" when a port is removed, the port is a copy. This way the
+// embedding program (for example a discovery with its own local UI) can
+// follow the ports even when the client only polls with LIST. When the
+// discovery is stopped a "remove" is notified for each cached port. The
+// notifications are delivered in order, from the goroutine of the
+// implementation sending the event, so the callback must not block; it may
+// call CachedPorts. This method must be called before Run.
+func (d *Server) SetCacheCallback(callback func(event string, port *Port)) {
+	d.cacheCallback = callback
+}
+
+// updateCache updates the cached ports with an event of the implementation.
+func (d *Server) updateCache(event string, port *Port) {
+	if port == nil {
+		return
+	}
+	d.cacheMutex.Lock()
+	id := port.Address + "|" + port.Protocol
+	changed := false
+	switch event {
+	case "add":
+		d.cachedPorts[id] = port
+		changed = true
+	case "remove":
+		if _, changed = d.cachedPorts[id]; changed {
+			delete(d.cachedPorts, id)
+		}
+	}
+	if !changed {
+		d.cacheMutex.Unlock()
+		return
+	}
+	d.notifyCacheLocked([]string{event}, []*Port{port})
+}
+
+// clearCache discards the cached ports and the cached error.
+func (d *Server) clearCache() {
+	d.cacheMutex.Lock()
+	removed := make([]*Port, 0, len(d.cachedPorts))
+	for _, port := range d.cachedPorts {
+		removed = append(removed, port)
+	}
+	d.cachedPorts = map[string]*Port{}
+	d.cachedErr = ""
+	slices.SortFunc(removed, ComparePorts)
+	events := make([]string, len(removed))
+	for i := range events {
+		events[i] = "remove"
+	}
+	d.notifyCacheLocked(events, removed)
+}
+
+// notifyCacheLocked notifies the cache callback of the given changes and
+// releases the cacheMutex, that must be held by the caller. The
+// notifications are serialized by the notifyMutex, acquired before the
+// cacheMutex is released to preserve the order of the changes.
+func (d *Server) notifyCacheLocked(events []string, ports []*Port) {
+	if d.cacheCallback == nil || len(ports) == 0 {
+		d.cacheMutex.Unlock()
+		return
+	}
+	copies := make([]*Port, len(ports))
+	for i, port := range ports {
+		copies[i] = port.Clone()
+	}
+	d.cacheNotifyMutex.Lock()
+	defer d.cacheNotifyMutex.Unlock()
+	d.cacheMutex.Unlock()
+	for i, port := range copies {
+		d.cacheCallback(events[i], port)
+	}
+}
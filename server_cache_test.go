@@ -0,0 +1,87 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerCachedPorts(t *testing.T) {
+	impl := &testDiscovery{}
+	server := NewServer(impl)
+	require.Empty(t, server.CachedPorts())
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go func() { _ = server.Run(inR, outW) }()
+	out := bufio.NewReader(outR)
+	command := func(cmd string, responses int) {
+		_, err := io.WriteString(inW, cmd+"\n")
+		require.NoError(t, err)
+		for i := 0; i < responses; i++ {
+			line := ""
+			for !strings.HasPrefix(line, "}") {
+				line, err = out.ReadString('\n')
+				require.NoError(t, err)
+			}
+		}
+	}
+	command("HELLO 1 \"test\"", 1)
+
+	// In START mode
+	command("START", 1)
+	require.Eventually(t, func() bool { return len(server.CachedPorts()) == 1 }, time.Second, time.Millisecond)
+	ports := server.CachedPorts()
+	require.Equal(t, "1", ports[0].Address)
+	// The ports are copies
+	ports[0].Address = "changed"
+	require.Equal(t, "1", server.CachedPorts()[0].Address)
+	command("STOP", 1)
+	require.Empty(t, server.CachedPorts())
+
+	// In "events" mode
+	command("START_SYNC", 2)
+	require.Len(t, server.CachedPorts(), 1)
+	command("STOP", 1)
+	require.Empty(t, server.CachedPorts())
+	command("QUIT", 1)
+}
+
+func TestServerCacheCallback(t *testing.T) {
+	server := NewServer(&testDiscovery{})
+	changes := make(chan string, 10)
+	server.SetCacheCallback(func(event string, port *Port) {
+		// The callback may look at the cache
+		changes <- fmt.Sprintf("%s %s %d", event, port.Address, len(server.CachedPorts()))
+	})
+	in := strings.NewReader("HELLO 1 \"test\"\nSTART\nSTOP\nSTART_SYNC\nQUIT\n")
+	require.NoError(t, server.Run(in, io.Discard))
+	close(changes)
+	received := []string{}
+	for change := range changes {
+		received = append(received, change)
+	}
+	require.Equal(t, []string{"add 1 1", "remove 1 0", "add 1 1"}, received)
+}
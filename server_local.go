@@ -0,0 +1,65 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ListenUnix listens on the unix domain socket at path, to serve the
+// protocol to the local clients with Serve (see NewUnixClient for the
+// client side). The socket file is created with the given permissions, for
+// example 0600 to allow only the user running the discovery to connect. A
+// stale socket, left behind by a process that didn't terminate cleanly, is
+// replaced, while an error is returned if another process is serving on the
+// socket or if path is not a socket. The socket file is removed when the
+// listener is closed.
+// On Windows (from Windows 10 version 1803) the permissions are not
+// applied, the access is controlled by the ACL of the directory containing
+// the socket: the named pipes, provided by the namedpipe module, allow a
+// finer access control.
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("the socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The clients must have the write permission to connect: with the
+	// usual umask nobody else can connect before the permissions are set
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting the permissions of the socket: %w", err)
+	}
+	return l, nil
+}
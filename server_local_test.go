@@ -0,0 +1,75 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package discovery
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "discovery.sock")
+	l, err := ListenUnix(socket, 0600)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(socket)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	served := make(chan error, 1)
+	go func() { served <- NewServer(&testDiscovery{}).Serve(l) }()
+
+	cl := NewUnixClient("unix", socket)
+	require.NoError(t, cl.Run())
+	events, err := cl.StartSync(10)
+	require.NoError(t, err)
+	require.Equal(t, "1", (<-events).Port.Address)
+	require.NoError(t, cl.Close())
+
+	// The socket is in use
+	_, err = ListenUnix(socket, 0600)
+	require.EqualError(t, err, "the socket "+socket+" is already in use")
+
+	require.NoError(t, l.Close())
+	require.Error(t, <-served)
+	_, err = os.Lstat(socket)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "discovery.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	// Leave the socket file behind, like a crashed discovery
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+	l, err = ListenUnix(socket, 0600)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	require.NoError(t, os.WriteFile(socket, nil, 0600))
+	_, err = ListenUnix(socket, 0600)
+	require.EqualError(t, err, socket+" exists and is not a socket")
+}
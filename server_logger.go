@@ -0,0 +1,87 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ServerLogger is the logger of a Server, the Server side counterpart of
+// ClientLogger. Since the standard output carries the protocol messages,
+// the logger must write somewhere else, like a file or the standard error.
+type ServerLogger interface {
+	Debugf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type nullServerLogger struct{}
+
+func (l *nullServerLogger) Debugf(format string, args ...interface{}) {}
+func (l *nullServerLogger) Errorf(format string, args ...interface{}) {}
+
+// SetLogger sets the logger of the Server, by default nothing is logged.
+// The state transitions of the discovery (initialized, started, sync
+// started and stopped) are logged with Debugf, the failures of the
+// implementation and of the output with Errorf.
+// This method must be called before Run.
+func (d *Server) SetLogger(logger ServerLogger) {
+	if logger == nil {
+		logger = &nullServerLogger{}
+	}
+	d.logger = logger
+}
+
+// SetCommandEcho enables the logging, with the Debugf method of the
+// ServerLogger, of every command received and of every message sent, so
+// that the authors of the discoveries can follow the dialogue with the
+// client. The authentication token is masked. This method must be called
+// before Run.
+func (d *Server) SetCommandEcho(enabled bool) {
+	d.commandEcho = enabled
+}
+
+// echoCommand logs the command received, if the command echo is enabled.
+func (d *Server) echoCommand(command string) {
+	if !d.commandEcho {
+		return
+	}
+	d.logger.Debugf("Received command %s", d.maskCommand(command))
+}
+
+// maskCommand masks the authentication token in the given command.
+func (d *Server) maskCommand(command string) string {
+	if d.authToken == "" {
+		return command
+	}
+	return strings.ReplaceAll(command, d.authToken, MaskAll(d.authToken))
+}
+
+// echoMessage logs the message sent, if the command echo is enabled. The
+// message is logged as JSON whatever the framing.
+func (d *Server) echoMessage(msg *message) {
+	if !d.commandEcho {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		d.logger.Debugf("Sent message %s (%v)", msg.EventType, err)
+		return
+	}
+	d.logger.Debugf("Sent message %s", data)
+}
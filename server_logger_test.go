@@ -0,0 +1,118 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testServerLogger records the log lines.
+type testServerLogger struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *testServerLogger) Debugf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lines = append(l.lines, "DEBUG "+fmt.Sprintf(format, args...))
+}
+
+func (l *testServerLogger) Errorf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lines = append(l.lines, "ERROR "+fmt.Sprintf(format, args...))
+}
+
+// matching returns the lines with the given prefix.
+func (l *testServerLogger) matching(prefix string) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	res := []string{}
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+func TestServerCommandEcho(t *testing.T) {
+	logger := &testServerLogger{}
+	server := NewServer(&testDiscovery{})
+	server.SetLogger(logger)
+	server.SetAuthToken("secret")
+	require.NoError(t, server.Run(strings.NewReader("HELLO 1 \"test\" \"secret\"\nLIST\nQUIT\n"), &bytes.Buffer{}))
+	// Nothing is echoed by default
+	require.Empty(t, logger.matching("DEBUG Received"))
+
+	server = NewServer(&testDiscovery{})
+	server.SetLogger(logger)
+	server.SetAuthToken("secret")
+	server.SetCommandEcho(true)
+	require.NoError(t, server.Run(strings.NewReader("HELLO 1 \"test\" \"secret\"\nLIST\nQUIT\n"), &bytes.Buffer{}))
+	require.Equal(t, []string{
+		`DEBUG Received command HELLO 1 "test" "****"`,
+		`DEBUG Received command LIST`,
+		`DEBUG Received command QUIT`,
+	}, logger.matching("DEBUG Received"))
+	require.Equal(t, []string{
+		`DEBUG Sent message {"eventType":"hello","message":"OK","protocolVersion":1}`,
+		`DEBUG Sent message {"eventType":"list","message":"Discovery not STARTed","error":true,"code":"not_started"}`,
+		`DEBUG Sent message {"eventType":"quit","message":"OK"}`,
+	}, logger.matching("DEBUG Sent"))
+}
+
+// failingStartDiscovery fails to start.
+type failingStartDiscovery struct {
+	testDiscovery
+}
+
+func (d *failingStartDiscovery) StartSync(eventCB EventCallback, errorCB ErrorCallback) error {
+	return fmt.Errorf("no ports available")
+}
+
+func TestServerLogsStateTransitions(t *testing.T) {
+	logger := &testServerLogger{}
+	server := NewServer(&testDiscovery{})
+	server.SetLogger(logger)
+	in := strings.NewReader("HELLO 1 \"test\"\nSTART_SYNC\nSTOP\nQUIT\n")
+	require.NoError(t, server.Run(in, &bytes.Buffer{}))
+	require.Equal(t, []string{
+		`DEBUG Discovery initialized (protocol version 1, user agent "test")`,
+		`DEBUG Discovery sync started`,
+		`DEBUG Discovery sync stopped`,
+		`DEBUG Quitting discovery`,
+	}, logger.matching("DEBUG"))
+	require.Empty(t, logger.matching("ERROR"))
+
+	logger = &testServerLogger{}
+	server = NewServer(&failingStartDiscovery{})
+	server.SetLogger(logger)
+	in = strings.NewReader("HELLO 1 \"test\"\nSTART\nQUIT\n")
+	require.NoError(t, server.Run(in, &bytes.Buffer{}))
+	require.Equal(t, []string{
+		`ERROR StartSync failed: no ports available`,
+	}, logger.matching("ERROR"))
+}
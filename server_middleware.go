@@ -0,0 +1,84 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandMiddleware wraps the execution of the commands received by a
+// Server. cmd is the command line received, with the authentication token
+// of HELLO masked, and next executes it: the middleware can run code before
+// and after next (to measure the time taken by the command or to audit it)
+// or not call next at all, to reject the command (for example while the
+// discovery is busy flashing a firmware). A rejected command is answered
+// with an error with the ErrorCodeInvalidState code.
+type CommandMiddleware func(cmd string, next func())
+
+// Use adds the given middlewares to the Server. The middlewares are run in
+// the order they are added, the first one wraps all the others. Commands
+// rejected by a middleware are not passed to the following ones. This
+// method must be called before Run.
+func (d *Server) Use(middlewares ...CommandMiddleware) {
+	for _, middleware := range middlewares {
+		if middleware != nil {
+			d.middlewares = append(d.middlewares, middleware)
+		}
+	}
+}
+
+// runMiddlewares executes the command through the middlewares, it returns
+// true if the command ends the session.
+func (d *Server) runMiddlewares(fullCmd string, quitImpl bool) bool {
+	if len(d.middlewares) == 0 {
+		return d.runCommand(fullCmd, quitImpl)
+	}
+	executed := false
+	quit := false
+	next := func() {
+		// A command is never executed twice
+		if !executed {
+			executed = true
+			quit = d.runCommand(fullCmd, quitImpl)
+		}
+	}
+	cmd := d.maskCommand(fullCmd)
+	for i := len(d.middlewares) - 1; i >= 0; i-- {
+		middleware, inner := d.middlewares[i], next
+		next = func() { middleware(cmd, inner) }
+	}
+	next()
+	if !executed {
+		d.rejectCommand(fullCmd)
+	}
+	return quit
+}
+
+// rejectCommand answers a command rejected by a middleware.
+func (d *Server) rejectCommand(fullCmd string) {
+	name, _, _ := strings.Cut(fullCmd, " ")
+	name = strings.ToUpper(name)
+	eventType := "command_error"
+	switch name {
+	case "HELLO", "START", "LIST", "START_SYNC", "FRAMING", "STOP", "CONFIGURE", "SELFTEST", "QUIT":
+		eventType = strings.ToLower(name)
+	}
+	d.logger.Debugf("Command %s rejected", name)
+	d.send(messageError(eventType, ErrorCodeInvalidState, fmt.Sprintf("Command %s rejected", name)))
+}
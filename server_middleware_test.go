@@ -0,0 +1,96 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerMiddlewares(t *testing.T) {
+	server := NewServer(&testDiscovery{})
+	server.SetAuthToken("secret")
+	trace := []string{}
+	server.Use(
+		func(cmd string, next func()) {
+			trace = append(trace, "before1 "+cmd)
+			next()
+			trace = append(trace, "after1 "+cmd)
+		},
+		func(cmd string, next func()) {
+			trace = append(trace, "before2 "+cmd)
+			next()
+			trace = append(trace, "after2 "+cmd)
+		},
+	)
+	in := strings.NewReader("HELLO 1 \"test\" \"secret\"\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
+	require.Equal(t, []string{
+		`before1 HELLO 1 "test" "****"`,
+		`before2 HELLO 1 "test" "****"`,
+		`after2 HELLO 1 "test" "****"`,
+		`after1 HELLO 1 "test" "****"`,
+		`before1 QUIT`,
+		`before2 QUIT`,
+		`after2 QUIT`,
+		`after1 QUIT`,
+	}, trace)
+	require.Contains(t, out.String(), `"eventType": "quit"`)
+}
+
+func TestServerMiddlewareRejectsCommands(t *testing.T) {
+	server := NewServer(&testDiscovery{})
+	server.Use(func(cmd string, next func()) {
+		// The discovery is busy, it can not be started
+		if strings.HasPrefix(cmd, "START") {
+			return
+		}
+		next()
+		// Calling next again doesn't execute the command twice
+		next()
+	})
+	in := strings.NewReader("HELLO 1 \"test\"\nSTART\nSTART_SYNC\nQUIT\n")
+	out := &bytes.Buffer{}
+	require.NoError(t, server.Run(in, out))
+	require.Equal(t, `{
+  "eventType": "hello",
+  "message": "OK",
+  "protocolVersion": 1
+}
+{
+  "eventType": "start",
+  "message": "Command START rejected",
+  "error": true,
+  "code": "invalid_state"
+}
+{
+  "eventType": "start_sync",
+  "message": "Command START_SYNC rejected",
+  "error": true,
+  "code": "invalid_state"
+}
+{
+  "eventType": "quit",
+  "message": "OK"
+}
+`, out.String())
+}
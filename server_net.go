@@ -0,0 +1,42 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2021 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+// SetAuthToken sets a token that the clients must provide in the HELLO
+// command, after the user agent, to open a session:
+//
+//	HELLO 1 "arduino-cli 1.0.0" "my-secret-token"
+//
+// The HELLO commands without a valid token are rejected. This is meant to
+// protect the discoveries served over the network, see Serve.
+func (d *Server) SetAuthToken(token string) {
+	d.authToken = token
+}
+
+// resetSession clears the protocol state to accept a new session.
+func (d *Server) resetSession() {
+	d.ctxMutex.Lock()
+	d.userAgent = UserAgent{}
+	d.locale = ""
+	d.ctxMutex.Unlock()
+	d.reqProtocolVersion = 0
+	d.initialized = false
+	d.started = false
+	d.syncStarted = false
+	d.clearCache()
+}
@@ -0,0 +1,175 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// JSONIndent is the indentation of the JSON messages sent by the Server.
+type JSONIndent int
+
+const (
+	// IndentSpaces indents the messages with two spaces (the default).
+	IndentSpaces JSONIndent = iota
+	// IndentTabs indents the messages with tabs.
+	IndentTabs
+	// IndentNone sends each message on a single line.
+	IndentNone
+)
+
+// FlushMode is the policy of the Server to write the messages to the
+// output.
+type FlushMode int
+
+const (
+	// FlushPerMessage writes each message to the output as soon as it's
+	// sent (the default).
+	FlushPerMessage FlushMode = iota
+	// FlushPerBatch buffers the messages and writes them to the output in
+	// batches: the responses are written after handling each command, the
+	// events are written at most FlushDelay after being sent. It reduces the
+	// number of writes for the discoveries sending bursts of events.
+	FlushPerBatch
+)
+
+// defaultFlushDelay is the FlushDelay used if not set in the OutputFormat.
+const defaultFlushDelay = 10 * time.Millisecond
+
+// OutputFormat is the formatting of the messages sent by the Server. The
+// zero value is the default format: the messages are indented with two
+// spaces, followed by a newline, and written as soon as they are sent.
+// The clients of this package accept all the formats, some other clients
+// may accept only the default one.
+type OutputFormat struct {
+	// Indent is the indentation of the JSON messages.
+	Indent JSONIndent
+	// NoTrailingNewline removes the newline following each message, the
+	// messages are sent one after the other.
+	NoTrailingNewline bool
+	// Flush is the policy to write the messages to the output.
+	Flush FlushMode
+	// FlushDelay is the maximum delay of the events with FlushPerBatch, 10ms
+	// if not set.
+	FlushDelay time.Duration
+}
+
+// SetOutputFormat sets the formatting of the messages sent to the clients.
+// The MessagePack framing, if requested by the client, is not affected by
+// the indentation and the newline settings. This method must be called
+// before Run.
+func (d *Server) SetOutputFormat(format OutputFormat) {
+	d.outputFormat = format
+}
+
+// newJSONCodec returns the JSON codec for the output format.
+func (d *Server) newJSONCodec() codec {
+	return jsonCodec{indent: d.outputFormat.Indent, noNewline: d.outputFormat.NoTrailingNewline}
+}
+
+// encodeJSON encodes the message with the given indentation.
+func encodeJSON(msg *message, indent JSONIndent) ([]byte, error) {
+	switch indent {
+	case IndentTabs:
+		return json.MarshalIndent(msg, "", "\t")
+	case IndentNone:
+		return json.Marshal(msg)
+	default:
+		return json.MarshalIndent(msg, "", "  ")
+	}
+}
+
+// beginOutput sets the output of a new session, buffering it if the
+// messages are flushed in batches. session is true for the sessions run
+// with RunSession, where the write errors are not fatal.
+func (d *Server) beginOutput(out io.Writer, session bool) {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	d.codec = d.newJSONCodec()
+	d.output = out
+	d.sessionOutput = session
+	d.eventsClosed = false
+	d.batchOutput = nil
+	if d.outputFormat.Flush == FlushPerBatch {
+		d.batchOutput = bufio.NewWriter(out)
+		d.output = d.batchOutput
+	}
+}
+
+// endOutput writes the buffered messages at the end of a session, the
+// events sent afterwards are written directly to out.
+func (d *Server) endOutput(out io.Writer) {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	if d.batchOutput == nil {
+		return
+	}
+	_ = d.flushLocked()
+	if d.output == d.batchOutput {
+		d.output = out
+	}
+	d.batchOutput = nil
+}
+
+// flushOutput writes the buffered messages, if any.
+func (d *Server) flushOutput() error {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	return d.flushLocked()
+}
+
+// flushLocked writes the buffered messages, outputMutex must be held by
+// the caller.
+func (d *Server) flushLocked() error {
+	if d.flushTimer != nil {
+		d.flushTimer.Stop()
+		d.flushTimer = nil
+	}
+	if d.batchOutput == nil || d.output != d.batchOutput {
+		return nil
+	}
+	return d.batchOutput.Flush()
+}
+
+// scheduleFlushLocked schedules the writing of the buffered events,
+// outputMutex must be held by the caller.
+func (d *Server) scheduleFlushLocked() {
+	if d.batchOutput == nil || d.flushTimer != nil {
+		return
+	}
+	delay := d.outputFormat.FlushDelay
+	if delay <= 0 {
+		delay = defaultFlushDelay
+	}
+	d.flushTimer = time.AfterFunc(delay, func() {
+		d.outputMutex.Lock()
+		defer d.outputMutex.Unlock()
+		d.flushTimer = nil
+		if d.batchOutput == nil || d.output != d.batchOutput {
+			return
+		}
+		if err := d.batchOutput.Flush(); err != nil {
+			// Same as a failed write of an event, see sendEvent
+			d.output = io.Discard
+			d.cancelSyncContext()
+		}
+	})
+}
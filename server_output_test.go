@@ -0,0 +1,135 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingWriter counts the writes to the underlying writer.
+type countingWriter struct {
+	w      io.Writer
+	mutex  sync.Mutex
+	writes int
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	c.mutex.Lock()
+	c.writes++
+	c.mutex.Unlock()
+	return c.w.Write(data)
+}
+
+func (c *countingWriter) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writes
+}
+
+func TestServerOutputFormat(t *testing.T) {
+	for _, indent := range []JSONIndent{IndentSpaces, IndentTabs, IndentNone} {
+		for _, noNewline := range []bool{false, true} {
+			format := OutputFormat{Indent: indent, NoTrailingNewline: noNewline}
+			t.Run(fmt.Sprintf("%d/%v", indent, noNewline), func(t *testing.T) {
+				out := &bytes.Buffer{}
+				server := NewServer(&testDiscovery{})
+				server.SetOutputFormat(format)
+				require.NoError(t, server.Run(strings.NewReader("HELLO 1 \"test\"\nQUIT\n"), out))
+
+				var expected string
+				switch indent {
+				case IndentSpaces:
+					expected = "{\n  \"eventType\": \"hello\",\n  \"message\": \"OK\",\n  \"protocolVersion\": 1\n}"
+				case IndentTabs:
+					expected = "{\n\t\"eventType\": \"hello\",\n\t\"message\": \"OK\",\n\t\"protocolVersion\": 1\n}"
+				case IndentNone:
+					expected = `{"eventType":"hello","message":"OK","protocolVersion":1}`
+				}
+				if !noNewline {
+					expected += "\n"
+				}
+				require.True(t, strings.HasPrefix(out.String(), expected), out.String())
+				require.Equal(t, !noNewline, strings.HasSuffix(out.String(), "}\n"))
+			})
+		}
+	}
+}
+
+func TestServerOutputFormatWithClient(t *testing.T) {
+	for _, indent := range []JSONIndent{IndentSpaces, IndentTabs, IndentNone} {
+		for _, noNewline := range []bool{false, true} {
+			for _, flush := range []FlushMode{FlushPerMessage, FlushPerBatch} {
+				format := OutputFormat{Indent: indent, NoTrailingNewline: noNewline, Flush: flush, FlushDelay: 100 * time.Millisecond}
+				t.Run(fmt.Sprintf("%d/%v/%d", indent, noNewline, flush), func(t *testing.T) {
+					impl := newCallbackDiscovery(0)
+					clientConn, serverConn := net.Pipe()
+					out := &countingWriter{w: serverConn}
+					server := NewServer(impl)
+					server.SetOutputFormat(format)
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						defer serverConn.Close()
+						_ = server.Run(serverConn, out)
+					}()
+					cl := NewConnClient("pipe", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+					require.NoError(t, cl.Run())
+					events, err := cl.StartSync(10)
+					require.NoError(t, err)
+					eventCB := <-impl.eventCB
+
+					// A burst of events is written at once with FlushPerBatch
+					before := out.count()
+					for i := 0; i < 5; i++ {
+						eventCB("add", &Port{Address: fmt.Sprint(i), Protocol: "test"})
+					}
+					for i := 0; i < 5; i++ {
+						ev := nextEvent(t, events)
+						require.Equal(t, "add", ev.Type)
+						require.Equal(t, fmt.Sprint(i), ev.Port.Address)
+					}
+					if flush == FlushPerBatch {
+						require.Equal(t, before+1, out.count())
+					} else {
+						require.Equal(t, before+5, out.count())
+					}
+
+					require.NoError(t, cl.Stop())
+					require.Equal(t, "stop", nextEvent(t, events).Type)
+					cl.Quit()
+					<-done
+					// HELLO, START_SYNC, the events, STOP and QUIT
+					if flush == FlushPerBatch {
+						require.Equal(t, 5, out.count())
+					} else {
+						require.Equal(t, 9, out.count())
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// SetEventRateLimit limits the rate of the "add" and "remove" events sent to
+// the client, to prevent a misbehaving source of events (for example a USB
+// device rapidly connecting and disconnecting) from flooding the client. The
+// limit is a token bucket refilled with the given number of events per
+// second, up to burst events. If perPort is true each port has its own
+// bucket, otherwise the limit is global.
+// The events exceeding the limit are not dropped arbitrarily: they are
+// coalesced, for each port, into the latest one, that is sent as soon as the
+// limit allows it. A port added and removed while limited is not reported
+// at all. A zero rate (the default) disables the limit. This method must be
+// called before Run.
+func (d *Server) SetEventRateLimit(rate float64, burst int, perPort bool) {
+	if rate <= 0 {
+		d.limiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	d.limiter = &eventLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		perPort:   perPort,
+		send:      d.emitEvent,
+		buckets:   map[string]*tokenBucket{},
+		pending:   map[string]*message{},
+		delivered: map[string]bool{},
+	}
+}
+
+// resetLimiter discards the events delayed by the rate limit, if any.
+func (d *Server) resetLimiter() {
+	if d.limiter != nil {
+		d.limiter.reset()
+	}
+}
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// eventLimiter applies the rate limit to the port events.
+type eventLimiter struct {
+	rate    float64
+	burst   float64
+	perPort bool
+	send    func(*message) error
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	pending   map[string]*message // the latest limited event, by port
+	order     []string            // the ports with a pending event, in order of arrival
+	delivered map[string]bool     // the ports the client knows about
+	timer     *time.Timer
+}
+
+func (l *eventLimiter) bucket(portID string, now time.Time) *tokenBucket {
+	key := ""
+	if l.perPort {
+		key = portID
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, l.rate, l.burst)
+	return b
+}
+
+// submit sends the event if allowed by the limit, or puts it in the pending
+// events otherwise. The error is returned only if the event has been sent.
+func (l *eventLimiter) submit(portID string, msg *message) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.flushLocked(now)
+	if _, ok := l.pending[portID]; ok {
+		// Coalesce with the pending event of the same port
+		l.pending[portID] = msg
+		return nil
+	}
+	b := l.bucket(portID, now)
+	if b.tokens >= 1 && (l.perPort || len(l.order) == 0) {
+		b.tokens--
+		return l.deliverLocked(portID, msg)
+	}
+	l.pending[portID] = msg
+	l.order = append(l.order, portID)
+	l.scheduleLocked(now)
+	return nil
+}
+
+// deliverLocked sends the event to the client, skipping the removal of the
+// ports never reported.
+func (l *eventLimiter) deliverLocked(portID string, msg *message) error {
+	if msg.EventType == "remove" {
+		if !l.delivered[portID] {
+			return nil
+		}
+		delete(l.delivered, portID)
+	} else {
+		l.delivered[portID] = true
+	}
+	return l.send(msg)
+}
+
+// flushLocked sends the pending events allowed by the limit.
+func (l *eventLimiter) flushLocked(now time.Time) {
+	remaining := l.order[:0]
+	for _, portID := range l.order {
+		b := l.bucket(portID, now)
+		if b.tokens < 1 || (!l.perPort && len(remaining) > 0) {
+			remaining = append(remaining, portID)
+			continue
+		}
+		b.tokens--
+		_ = l.deliverLocked(portID, l.pending[portID])
+		delete(l.pending, portID)
+	}
+	l.order = remaining
+}
+
+// scheduleLocked starts a timer to flush the pending events as soon as a
+// token is available.
+func (l *eventLimiter) scheduleLocked(now time.Time) {
+	if l.timer != nil || len(l.order) == 0 {
+		return
+	}
+	wait := time.Duration(float64(time.Second) / l.rate)
+	if b := l.bucket(l.order[0], now); b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	l.timer = time.AfterFunc(wait, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.timer = nil
+		now := time.Now()
+		l.flushLocked(now)
+		l.scheduleLocked(now)
+	})
+}
+
+// reset discards the pending events, to be called when the sync is stopped.
+func (l *eventLimiter) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.pending = map[string]*message{}
+	l.order = nil
+	l.delivered = map[string]bool{}
+}
+
+// takePending removes the pending events and returns them in order,
+// skipping the removal of the ports never reported, to be delivered
+// regardless of the limit when the session ends.
+func (l *eventLimiter) takePending() []*message {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	res := []*message{}
+	for _, portID := range l.order {
+		msg := l.pending[portID]
+		if msg.EventType == "remove" {
+			if !l.delivered[portID] {
+				continue
+			}
+			delete(l.delivered, portID)
+		} else {
+			l.delivered[portID] = true
+		}
+		res = append(res, msg)
+	}
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	l.pending = map[string]*message{}
+	l.order = nil
+	return res
+}
@@ -0,0 +1,96 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerEventRateLimit(t *testing.T) {
+	// run starts a sync session and returns the event callback and a
+	// function to get the events sent to the client.
+	run := func(t *testing.T, rate float64, burst int, perPort bool) (SyncEventCallback, func() []string) {
+		impl := &testContextDiscovery{}
+		server := NewContextServer(impl)
+		server.SetEventRateLimit(rate, burst, perPort)
+		in, inWriter := io.Pipe()
+		out := &breakableWriter{}
+		go server.Run(in, out)
+		t.Cleanup(func() { inWriter.Close() })
+		_, err := inWriter.Write([]byte("HELLO 1 \"test\"\nSTART_SYNC\n"))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			out.mutex.Lock()
+			defer out.mutex.Unlock()
+			return strings.Contains(out.out.String(), `"start_sync"`)
+		}, time.Second, time.Millisecond)
+		events := func() []string {
+			out.mutex.Lock()
+			defer out.mutex.Unlock()
+			res := []string{}
+			decoder := json.NewDecoder(strings.NewReader(out.out.String()))
+			for decoder.More() {
+				var msg message
+				require.NoError(t, decoder.Decode(&msg))
+				if msg.Port != nil {
+					res = append(res, msg.EventType+" "+msg.Port.Address)
+				}
+			}
+			return res
+		}
+		return impl.eventCB, events
+	}
+	port := func(address string) *Port {
+		return &Port{Address: address, Protocol: "test"}
+	}
+
+	t.Run("Global", func(t *testing.T) {
+		eventCB, events := run(t, 20, 2, false)
+		require.NoError(t, eventCB("add", port("1")))
+		require.NoError(t, eventCB("add", port("2")))
+		// Limited: the port 3 is added and removed before being reported
+		require.NoError(t, eventCB("add", port("3")))
+		require.NoError(t, eventCB("add", port("4")))
+		require.NoError(t, eventCB("remove", port("3")))
+		require.NoError(t, eventCB("remove", port("1")))
+		require.Equal(t, []string{"add 1", "add 2"}, events())
+		require.Eventually(t, func() bool { return len(events()) == 4 }, time.Second, 10*time.Millisecond)
+		require.Equal(t, []string{"add 1", "add 2", "add 4", "remove 1"}, events())
+	})
+
+	t.Run("PerPort", func(t *testing.T) {
+		eventCB, events := run(t, 10, 1, true)
+		// A port rapidly cycling doesn't delay the other ports
+		for i := 0; i < 10; i++ {
+			require.NoError(t, eventCB("add", port("1")))
+			require.NoError(t, eventCB("remove", port("1")))
+		}
+		require.NoError(t, eventCB("add", port("1")))
+		require.NoError(t, eventCB("add", port("2")))
+		require.Equal(t, []string{"add 1", "add 2"}, events())
+		time.Sleep(300 * time.Millisecond)
+		// The cycles have been coalesced into the latest state
+		require.Equal(t, []string{"add 1", "add 2", "add 1"}, events())
+	})
+}
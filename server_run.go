@@ -0,0 +1,90 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// The exit codes used by RunDiscovery.
+const (
+	// ExitCodeOK is used when the discovery terminates normally: after a
+	// QUIT, when the standard input is closed or when terminated by SIGINT
+	// or SIGTERM.
+	ExitCodeOK = 0
+	// ExitCodeIOError is used when the communication with the client fails.
+	ExitCodeIOError = 1
+)
+
+// RunDiscovery runs the given Discovery, communicating through the standard
+// input and output, and terminates the program when done. The Quit method
+// of the Discovery is always called before exiting, also if the program
+// receives a SIGINT or SIGTERM signal or if the standard input is closed.
+// The program exits with ExitCodeOK, or ExitCodeIOError if the communication
+// fails. RunDiscovery is meant to be the whole main() of a discovery:
+//
+//	func main() {
+//		discovery.RunDiscovery(&myDiscovery{})
+//	}
+func RunDiscovery(impl Discovery) {
+	RunServer(NewServer(impl))
+}
+
+// RunContextDiscovery is the same as RunDiscovery for a ContextDiscovery.
+func RunContextDiscovery(impl ContextDiscovery) {
+	RunServer(NewContextServer(impl))
+}
+
+// RunServer is the same as RunDiscovery for an already configured Server.
+func RunServer(server *Server) {
+	os.Exit(runDiscovery(server, os.Stdin, os.Stdout, notifyTermination()))
+}
+
+// notifyTermination returns a channel receiving the SIGINT and SIGTERM
+// signals.
+func notifyTermination() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return signals
+}
+
+// runDiscovery runs the Server until the end of the session or until a
+// signal is received, and returns the exit code.
+func runDiscovery(server *Server, in io.Reader, out io.Writer, signals <-chan os.Signal) int {
+	done := make(chan error, 1)
+	go func() { done <- server.Run(in, out) }()
+	select {
+	case <-signals:
+		server.quit()
+		return ExitCodeOK
+	case err := <-done:
+		if err == nil {
+			// QUIT command received
+			return ExitCodeOK
+		}
+		server.quit()
+		if errors.Is(err, io.EOF) {
+			return ExitCodeOK
+		}
+		return ExitCodeIOError
+	}
+}
@@ -0,0 +1,75 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type quitCountingDiscovery struct {
+	testDiscovery
+	quits atomic.Int32
+}
+
+func (d *quitCountingDiscovery) Quit() {
+	d.quits.Add(1)
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(data []byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestRunDiscovery(t *testing.T) {
+	run := func(in io.Reader, signals <-chan os.Signal) (int, int32) {
+		impl := &quitCountingDiscovery{}
+		server := NewServer(impl)
+		code := runDiscovery(server, in, &bytes.Buffer{}, signals)
+		return code, impl.quits.Load()
+	}
+
+	code, quits := run(strings.NewReader("HELLO 1 \"test\"\nQUIT\n"), nil)
+	require.Equal(t, ExitCodeOK, code)
+	require.Equal(t, int32(1), quits)
+
+	// Standard input closed
+	code, quits = run(strings.NewReader("HELLO 1 \"test\"\n"), nil)
+	require.Equal(t, ExitCodeOK, code)
+	require.Equal(t, int32(1), quits)
+
+	code, quits = run(&failingReader{}, nil)
+	require.Equal(t, ExitCodeIOError, code)
+	require.Equal(t, int32(1), quits)
+
+	in, _ := io.Pipe()
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	code, quits = run(in, signals)
+	require.Equal(t, ExitCodeOK, code)
+	require.Equal(t, int32(1), quits)
+}
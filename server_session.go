@@ -0,0 +1,81 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"io"
+)
+
+// SessionResetter may be implemented by a Discovery (or ContextDiscovery)
+// to be notified when the Server is reset between two sessions, see
+// Server.Reset. The implementation can use it to clear the state bound to
+// the previous client (for example the user agent received with Hello).
+type SessionResetter interface {
+	// ResetSession is called after the discovery has been stopped and
+	// before the next session begins.
+	ResetSession()
+}
+
+// RunSession runs a single protocol session on the given input and output
+// streams, for the setups where the same Server serves many clients one
+// after the other (like inetd or a socket re-opened for each client). It's
+// the same as Run, but the QUIT command terminates only the session: the
+// Quit method of the implementation is not called. When the session ends,
+// after a QUIT or when the input stream is closed, the Server is Reset and
+// a new session can be started with RunSession, beginning with a new HELLO.
+func (d *Server) RunSession(in io.Reader, out io.Writer) error {
+	err := d.runSession(in, out, false)
+	_ = d.Reset()
+	return err
+}
+
+// Reset brings the Server back to its initial state, waiting for a HELLO:
+// if the discovery is started (with START or START_SYNC) it's stopped, the
+// cached ports and the negotiated protocol settings are cleared, and the
+// ResetSession method of the implementation is called if it implements
+// SessionResetter. The implementation is not re-created nor terminated,
+// the error returned is the one of its Stop method, if called. The events
+// sent by the implementation after the Reset are discarded until the next
+// session begins. Reset must not be called while a session is running.
+func (d *Server) Reset() error {
+	var err error
+	if d.started || d.syncStarted {
+		d.cancelSyncContext()
+		err = d.impl.Stop(context.Background())
+		if err != nil {
+			d.logger.Errorf("Stopping discovery on reset: %v", err)
+		}
+	}
+	d.logger.Debugf("Session reset")
+	d.resetTTL()
+	d.resetLimiter()
+	d.resetSession()
+
+	d.outputMutex.Lock()
+	d.output = io.Discard
+	d.codec = nil
+	d.syncAckPending = false
+	d.pendingEvents = nil
+	d.outputMutex.Unlock()
+
+	if resetter, ok := d.implementation().(SessionResetter); ok {
+		resetter.ResetSession()
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sessionDiscovery tracks the calls of the Server across the sessions.
+type sessionDiscovery struct {
+	testDiscovery
+	userAgent string
+	stops     int
+	resets    int
+	quits     int
+}
+
+func (d *sessionDiscovery) Hello(userAgent string, protocolVersion int) error {
+	d.userAgent = userAgent
+	return nil
+}
+
+func (d *sessionDiscovery) Stop() error {
+	d.stops++
+	return d.testDiscovery.Stop()
+}
+
+func (d *sessionDiscovery) Quit() {
+	d.quits++
+}
+
+func (d *sessionDiscovery) ResetSession() {
+	d.resets++
+	d.userAgent = ""
+}
+
+// sessionEvents returns the event types of the messages sent in a session.
+func sessionEvents(t *testing.T, out *bytes.Buffer) []string {
+	res := []string{}
+	dec := json.NewDecoder(out)
+	for {
+		var msg message
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return res
+		}
+		require.NoError(t, err)
+		res = append(res, msg.EventType)
+	}
+}
+
+func TestServerRunSession(t *testing.T) {
+	impl := &sessionDiscovery{}
+	server := NewServer(impl)
+
+	// The client goes away without STOP
+	out := &bytes.Buffer{}
+	err := server.RunSession(strings.NewReader("HELLO 1 \"first\"\nSTART_SYNC\n"), out)
+	require.ErrorIs(t, err, io.EOF)
+	// The event is sent asynchronously, before the Stop returns
+	require.ElementsMatch(t, []string{"hello", "start_sync", "add", "command_error"}, sessionEvents(t, out))
+	require.Equal(t, 1, impl.stops)
+	require.Equal(t, 1, impl.resets)
+	require.Empty(t, impl.userAgent)
+
+	// A new session must begin with HELLO, the ports of the previous one
+	// are forgotten
+	out.Reset()
+	in := strings.NewReader("LIST\nHELLO 1 \"second\"\nSTART\nLIST\nQUIT\n")
+	require.NoError(t, server.RunSession(in, out))
+	require.Equal(t, []string{"command_error", "hello", "start", "list", "quit"}, sessionEvents(t, out))
+	require.Equal(t, 2, impl.stops)
+	require.Equal(t, 2, impl.resets)
+	require.Zero(t, impl.quits)
+
+	// Reset without a running discovery doesn't stop it again
+	require.NoError(t, server.Reset())
+	require.Equal(t, 2, impl.stops)
+	require.Equal(t, 3, impl.resets)
+
+	// Run still terminates the implementation
+	out.Reset()
+	require.NoError(t, server.Run(strings.NewReader("HELLO 1 \"third\"\nQUIT\n"), out))
+	require.Equal(t, []string{"hello", "quit"}, sessionEvents(t, out))
+	require.Equal(t, "third", impl.userAgent)
+	require.Equal(t, 1, impl.quits)
+}
@@ -0,0 +1,101 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2021 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// ServerStats is a snapshot of the counters collected by a Server.
+type ServerStats struct {
+	// CommandsHandled is the number of commands received from the client.
+	CommandsHandled uint64
+	// EventsEmitted is the number of port events sent to the client.
+	EventsEmitted uint64
+	// BytesWritten is the number of bytes sent to the client.
+	BytesWritten uint64
+	// LastClientActivity is the time when the last command has been received.
+	LastClientActivity time.Time
+}
+
+type serverStats struct {
+	mutex sync.Mutex
+	stats ServerStats
+}
+
+func (s *serverStats) commandHandled() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.CommandsHandled++
+	s.stats.LastClientActivity = time.Now()
+}
+
+func (s *serverStats) eventEmitted() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.EventsEmitted++
+}
+
+func (s *serverStats) bytesWritten(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.BytesWritten += uint64(n)
+}
+
+func (s *serverStats) get() ServerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+// Stats returns a snapshot of the counters collected by the Server.
+func (d *Server) Stats() ServerStats {
+	return d.stats.get()
+}
+
+// SetStatsCallback sets a callback that is called periodically, with the
+// given interval, while the Server is running. The callback receives a
+// snapshot of the Server counters and may be used by the discovery to log
+// health information. This method must be called before Run.
+func (d *Server) SetStatsCallback(interval time.Duration, cb func(ServerStats)) {
+	d.statsInterval = interval
+	d.statsCallback = cb
+}
+
+// runStatsCallback calls the stats callback periodically until the
+// returned function is called.
+func (d *Server) runStatsCallback() (stop func()) {
+	if d.statsCallback == nil || d.statsInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(d.statsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.statsCallback(d.Stats())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
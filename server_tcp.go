@@ -0,0 +1,91 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package discovery
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync"
+)
+
+// Serve accepts incoming connections on the listener and runs the pluggable
+// discovery protocol over them, with the same state machine used by Run.
+// Concurrent clients are not supported: since the Discovery implementation
+// (and its state) is shared, only one session at a time is served and the
+// connections received while a session is in progress are rejected with an
+// error message.
+// The QUIT command terminates only the current session and, like closing
+// the connection without a STOP, stops the discovery if needed: the Quit
+// method of the implementation is never called. The function blocks until the
+// listener returns an error, that is returned after closing the connection
+// of the session in progress (if any) and waiting for its termination.
+func (d *Server) Serve(l net.Listener) error {
+	busy := make(chan net.Conn, 1)
+	var wg sync.WaitGroup
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case active := <-busy:
+				active.Close()
+			default:
+			}
+			wg.Wait()
+			return err
+		}
+		select {
+		case busy <- conn:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = d.ServeConn(conn)
+				// Free the slot, unless Serve is already closing the connection
+				select {
+				case <-busy:
+				default:
+				}
+			}()
+		default:
+			data, _ := json.MarshalIndent(messageError("command_error", ErrorCodeBusy, "Discovery busy serving another client"), "", "  ")
+			_, _ = conn.Write(append(data, '\n'))
+			conn.Close()
+		}
+	}
+}
+
+// ServeTLS is like Serve but the connections are secured with TLS using the
+// given configuration, that must contain at least one certificate.
+func (d *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	return d.Serve(tls.NewListener(l, config))
+}
+
+// ServeConn runs a single protocol session over the given connection, like
+// Serve does for each accepted connection, and closes the connection at the
+// end. As for RunSession the QUIT command terminates only the session, and
+// if the client goes away without a STOP the discovery is stopped by the
+// Reset at the end of the session. A failed write, because the client went
+// away, doesn't stop the Server: the events are not delivered anymore (see
+// ErrEventNotDelivered) and the session ends as soon as the connection
+// read fails.
+func (d *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	return d.RunSession(conn, conn)
+}
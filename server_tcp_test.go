@@ -0,0 +1,160 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+//go:build !discovery_nonet
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerServe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	server := NewServer(&testDiscovery{})
+	go server.Serve(listener)
+
+	expect := func(decoder *json.Decoder, eventType, msg string) {
+		var m message
+		require.NoError(t, decoder.Decode(&m))
+		require.Equal(t, eventType, m.EventType)
+		require.Equal(t, msg, m.Message)
+	}
+
+	// connect dials the server and sends the HELLO command, retrying while
+	// the server is still busy with the previous session.
+	connect := func() (net.Conn, *json.Decoder) {
+		var conn net.Conn
+		var decoder *json.Decoder
+		require.Eventually(t, func() bool {
+			c, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err)
+			_, err = c.Write([]byte("START\nHELLO 1 \"test\"\nSTART\n"))
+			require.NoError(t, err)
+			dec := json.NewDecoder(c)
+			var m message
+			require.NoError(t, dec.Decode(&m))
+			if m.Message == "Discovery busy serving another client" {
+				c.Close()
+				return false
+			}
+			require.Equal(t, "First command must be HELLO, but got 'START'", m.Message)
+			conn, decoder = c, dec
+			return true
+		}, time.Second, 10*time.Millisecond)
+		return conn, decoder
+	}
+
+	// Each connection is a new session that must start with HELLO
+	for i := 0; i < 2; i++ {
+		conn, decoder := connect()
+		expect(decoder, "hello", "OK")
+		expect(decoder, "start", "OK")
+
+		// A second client is rejected while the session is in progress
+		conn2, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		expect(json.NewDecoder(conn2), "command_error", "Discovery busy serving another client")
+		conn2.Close()
+
+		_, err = conn.Write([]byte("QUIT\n"))
+		require.NoError(t, err)
+		expect(decoder, "quit", "OK")
+		conn.Close()
+	}
+
+}
+
+func TestServerServeListenerClosed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error)
+	go func() { served <- NewServer(&testDiscovery{}).Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("HELLO 1 \"test\"\n"))
+	require.NoError(t, err)
+	decoder := json.NewDecoder(conn)
+	var m message
+	require.NoError(t, decoder.Decode(&m))
+	require.Equal(t, "hello", m.EventType)
+
+	// Closing the listener terminates the session in progress
+	require.NoError(t, listener.Close())
+	select {
+	case err := <-served:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+	require.Error(t, decoder.Decode(&m))
+}
+
+// breakableConn is a connection whose writes fail once broken, like the
+// connection of a client gone away while the read side is still open.
+type breakableConn struct {
+	net.Conn
+	broken atomic.Bool
+}
+
+func (c *breakableConn) Write(data []byte) (int, error) {
+	if c.broken.Load() {
+		return 0, errors.New("broken pipe")
+	}
+	return c.Conn.Write(data)
+}
+
+func TestServerServeConnWriteError(t *testing.T) {
+	impl := &testContextDiscovery{}
+	server := NewContextServer(impl)
+	clientConn, serverConn := net.Pipe()
+	conn := &breakableConn{Conn: serverConn}
+	done := make(chan error)
+	go func() { done <- server.ServeConn(conn) }()
+	_, err := clientConn.Write([]byte("HELLO 1 \"test\"\nSTART_SYNC\n"))
+	require.NoError(t, err)
+	decoder := json.NewDecoder(clientConn)
+	for _, expected := range []string{"hello", "start_sync"} {
+		var m message
+		require.NoError(t, decoder.Decode(&m))
+		require.Equal(t, expected, m.EventType)
+	}
+
+	// The write errors are reported to the implementation...
+	conn.broken.Store(true)
+	err = impl.eventCB("add", &Port{Address: "1", Protocol: "test"})
+	require.ErrorIs(t, err, ErrEventNotDelivered)
+	require.ErrorContains(t, err, "broken pipe")
+	require.ErrorIs(t, impl.syncCtx.Err(), context.Canceled)
+
+	// ...and the responses that cannot be written don't stop the Server
+	_, err = clientConn.Write([]byte("LIST\n"))
+	require.NoError(t, err)
+	clientConn.Close()
+	require.Error(t, <-done)
+}
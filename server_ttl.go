@@ -0,0 +1,101 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// SetPortTTL enables the expiration of the ports not refreshed within the
+// given time-to-live, meant for the discoveries based on periodic beacons
+// (like mDNS or BLE advertisements): each "add" event refreshes the port,
+// and if no "add" event is received for a port within the TTL the Server
+// removes it from the cached port list (in START mode) or sends a "remove"
+// event to the client (in START_SYNC mode), as if the discovery had reported
+// the removal. A zero TTL (the default) disables the expiration. This method
+// must be called before Run.
+func (d *Server) SetPortTTL(ttl time.Duration) {
+	d.ttl = &portTTL{ttl: ttl, timers: map[string]*time.Timer{}}
+	if ttl <= 0 {
+		d.ttl = nil
+	}
+}
+
+// portTTL tracks the expiration of the ports.
+type portTTL struct {
+	ttl    time.Duration
+	mutex  sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// wrap returns an event callback that tracks the expiration of the ports
+// and then calls the given callback. The expired ports are reported to the
+// given callback as "remove" events.
+func (t *portTTL) wrap(eventCB SyncEventCallback) SyncEventCallback {
+	return func(event string, port *Port) error {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		id := port.Address + "|" + port.Protocol
+		if timer, ok := t.timers[id]; ok {
+			timer.Stop()
+			delete(t.timers, id)
+		}
+		if event == "add" {
+			var timer *time.Timer
+			timer = time.AfterFunc(t.ttl, func() {
+				t.mutex.Lock()
+				defer t.mutex.Unlock()
+				// Ignore the port if refreshed or removed in the meantime
+				if t.timers[id] != timer {
+					return
+				}
+				delete(t.timers, id)
+				_ = eventCB("remove", &Port{Address: port.Address, Protocol: port.Protocol})
+			})
+			t.timers[id] = timer
+		}
+		return eventCB(event, port)
+	}
+}
+
+// reset stops tracking all the ports.
+func (t *portTTL) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, timer := range t.timers {
+		timer.Stop()
+	}
+	t.timers = map[string]*time.Timer{}
+}
+
+// withTTL wraps the event callback to apply the ports expiration, if enabled.
+func (d *Server) withTTL(eventCB SyncEventCallback) SyncEventCallback {
+	if d.ttl == nil {
+		return eventCB
+	}
+	d.ttl.reset()
+	return d.ttl.wrap(eventCB)
+}
+
+// resetTTL stops tracking the expiration of the ports, if enabled.
+func (d *Server) resetTTL() {
+	if d.ttl != nil {
+		d.ttl.reset()
+	}
+}
@@ -0,0 +1,81 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerPortTTL(t *testing.T) {
+	impl := &testContextDiscovery{}
+	server := NewContextServer(impl)
+	server.SetPortTTL(200 * time.Millisecond)
+	in, inWriter := io.Pipe()
+	defer inWriter.Close()
+	out := &breakableWriter{}
+	go server.Run(in, out)
+	output := func() string {
+		out.mutex.Lock()
+		defer out.mutex.Unlock()
+		return out.out.String()
+	}
+	send := func(cmd, response string) {
+		_, err := inWriter.Write([]byte(cmd + "\n"))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return strings.Contains(output(), response) }, time.Second, time.Millisecond)
+	}
+
+	// START mode: the expired ports are removed from the cache
+	send(`HELLO 1 "test"`, `"hello"`)
+	send("START", `"start"`)
+	require.NoError(t, impl.eventCB("add", &Port{Address: "1", Protocol: "test"}))
+	require.NoError(t, impl.eventCB("add", &Port{Address: "2", Protocol: "test"}))
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		// Port 1 is refreshed
+		require.NoError(t, impl.eventCB("add", &Port{Address: "1", Protocol: "test"}))
+	}
+	out.mutex.Lock()
+	out.out.Reset()
+	out.mutex.Unlock()
+	send("LIST", `"list"`)
+	var list message
+	require.NoError(t, json.NewDecoder(bytes.NewBufferString(output())).Decode(&list))
+	require.Len(t, list.Ports, 1)
+	require.Equal(t, "1", (list.Ports)[0].Address)
+	send("STOP", `"stop"`)
+
+	// START_SYNC mode: a "remove" event is sent for the expired ports
+	send("START_SYNC", `"start_sync"`)
+	require.NoError(t, impl.eventCB("add", &Port{Address: "3", Protocol: "test"}))
+	require.Eventually(t, func() bool { return strings.Contains(output(), `"remove"`) }, time.Second, 10*time.Millisecond)
+	decoder := json.NewDecoder(bytes.NewBufferString(output()))
+	var msg message
+	for decoder.More() {
+		require.NoError(t, decoder.Decode(&msg))
+	}
+	require.Equal(t, "remove", msg.EventType)
+	require.Equal(t, "3", msg.Port.Address)
+}
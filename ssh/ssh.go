@@ -0,0 +1,113 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package ssh provides a transport to run a pluggable discovery on a remote
+// host over SSH: the discovery executable is launched in an SSH session and
+// the protocol is spoken over the session's stdio.
+package ssh
+
+import (
+	"fmt"
+	"io"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// NewClient creates a discovery.Client that runs the given command line on
+// the remote host connected through client. A new SSH session is opened each
+// time the discovery is started (or reconnected, see discovery.WithReconnect).
+// The SSH client is not closed by the discovery.Client.
+func NewClient(id string, client *gossh.Client, command string, opts ...discovery.ClientOption) *discovery.Client {
+	dial := func() (io.ReadWriteCloser, error) {
+		return startSession(client, command, nil)
+	}
+	return discovery.NewConnClient(id, dial, opts...)
+}
+
+// NewClientWithConfig creates a discovery.Client that connects to the SSH
+// server at addr, using the given configuration, and runs the given command
+// line on the remote host. The SSH connection is established each time the
+// discovery is started (or reconnected, see discovery.WithReconnect) and is
+// closed together with the discovery session.
+func NewClientWithConfig(id, addr string, config *gossh.ClientConfig, command string, opts ...discovery.ClientOption) *discovery.Client {
+	dial := func() (io.ReadWriteCloser, error) {
+		client, err := gossh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := startSession(client, command, client)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return discovery.NewConnClient(id, dial, opts...)
+}
+
+// sessionConn is the stdio of a remote discovery running in an SSH session.
+type sessionConn struct {
+	io.Reader
+	io.WriteCloser
+	session *gossh.Session
+	client  io.Closer
+}
+
+func startSession(client *gossh.Client, command string, owned io.Closer) (*sessionConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("opening SSH session: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("starting remote discovery: %w", err)
+	}
+	return &sessionConn{
+		Reader:      stdout,
+		WriteCloser: stdin,
+		session:     session,
+		client:      owned,
+	}, nil
+}
+
+// Close closes the remote discovery stdin and terminates the SSH session
+// (and the SSH connection if owned).
+func (c *sessionConn) Close() error {
+	c.WriteCloser.Close()
+	err := c.session.Close()
+	if err == io.EOF {
+		// The session has already been closed by the remote side
+		err = nil
+	}
+	if c.client != nil {
+		if cerr := c.client.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
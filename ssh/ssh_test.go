@@ -0,0 +1,137 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type testDiscovery struct{}
+
+func (d *testDiscovery) Hello(userAgent string, protocolVersion int) error { return nil }
+func (d *testDiscovery) Stop() error                                       { return nil }
+func (d *testDiscovery) Quit()                                             {}
+func (d *testDiscovery) StartSync(eventCB discovery.EventCallback, errorCB discovery.ErrorCallback) error {
+	go eventCB("add", &discovery.Port{Address: "/dev/ttyACM0", Protocol: "serial"})
+	return nil
+}
+
+// startServer starts an SSH server that runs a discovery.Server on each
+// "exec" request and returns the commands executed.
+func startServer(t *testing.T) (string, <-chan string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := gossh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	config := &gossh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	commands := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config, commands)
+		}
+	}()
+	return l.Addr().String(), commands
+}
+
+func serveConn(conn net.Conn, config *gossh.ServerConfig, commands chan<- string) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				gossh.Unmarshal(req.Payload, &payload)
+				commands <- payload.Command
+				req.Reply(true, nil)
+				go func() {
+					err := discovery.NewServer(&testDiscovery{}).Run(channel, channel)
+					status := struct{ Status uint32 }{}
+					if err != nil {
+						status.Status = 1
+					}
+					channel.SendRequest("exit-status", false, gossh.Marshal(&status))
+					channel.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func TestSSHClient(t *testing.T) {
+	addr, commands := startServer(t)
+	config := &gossh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}
+
+	check := func(t *testing.T, cl *discovery.Client) {
+		require.NoError(t, cl.Run())
+		require.Equal(t, "discovery --verbose", <-commands)
+		ch, err := cl.StartSync(10)
+		require.NoError(t, err)
+		ev := <-ch
+		require.Equal(t, "add", ev.Type)
+		require.Equal(t, "/dev/ttyACM0", ev.Port.Address)
+		cl.Quit()
+		require.Equal(t, "stop", (<-ch).Type)
+		require.False(t, cl.Alive())
+	}
+
+	t.Run("WithConfig", func(t *testing.T) {
+		check(t, NewClientWithConfig("ssh", addr, config, "discovery --verbose"))
+	})
+
+	t.Run("WithClient", func(t *testing.T) {
+		client, err := gossh.Dial("tcp", addr, config)
+		require.NoError(t, err)
+		defer client.Close()
+		cl := NewClient("ssh", client, "discovery --verbose")
+		check(t, cl)
+
+		// The SSH client can be used to start the discovery again
+		check(t, cl)
+	})
+}
@@ -1,46 +0,0 @@
-// This file is part of pluggable-discovery-protocol-handler.
-//
-// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
-//
-// This software is released under the GNU General Public License version 3,
-// which covers the main part of arduino-cli.
-// The terms of this license can be found at:
-// https://www.gnu.org/licenses/gpl-3.0.en.html
-//
-// You can be released from the requirements of the above licenses by purchasing
-// a commercial license. Buying such a license is mandatory if you want to
-// modify or otherwise use the software for commercial activities involving the
-// Arduino software without disclosing the source code of your own applications.
-// To purchase a commercial license, send an email to license@arduino.cc.
-
-// Proxy stdin/stdout through a TCP socket.
-// This program is used for testing purposes, to make it available on all
-// OS a tool equivalent to UNIX "nc".
-package main
-
-import (
-	"io"
-	"net"
-	"os"
-)
-
-func main() {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", os.Args[1])
-	if err != nil {
-		println("ResolveTCPAddr failed:", err.Error())
-		os.Exit(1)
-	}
-
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		println("Dial failed:", err.Error())
-		os.Exit(1)
-	}
-
-	go func() {
-		io.Copy(os.Stdout, conn)
-		os.Exit(0)
-	}()
-	io.Copy(conn, os.Stdin)
-	os.Exit(0)
-}
@@ -0,0 +1,183 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"strings"
+
+	"github.com/arduino/go-properties-orderedmap"
+)
+
+// PortTransformer is a middleware that can filter or modify the ports
+// reported by the discoveries, for example to enforce a policy. The
+// transformers can be chained in a Manager, see Manager.Use.
+type PortTransformer interface {
+	// TransformPort returns the port to expose in place of the given port,
+	// reported by the discovery with the given ID, or nil to hide it. The
+	// given port must not be modified: a modified copy (see Port.Clone)
+	// must be returned instead. The address and the protocol of the port
+	// must not be changed, since they identify the port in the "remove"
+	// events.
+	TransformPort(discoveryID string, port *Port) *Port
+}
+
+// PortTransformerFunc is an adapter to use a function as a PortTransformer.
+type PortTransformerFunc func(discoveryID string, port *Port) *Port
+
+// TransformPort calls f(discoveryID, port).
+func (f PortTransformerFunc) TransformPort(discoveryID string, port *Port) *Port {
+	return f(discoveryID, port)
+}
+
+// ChainPortTransformers returns a PortTransformer that applies the given
+// transformers in order, until a transformer hides the port.
+func ChainPortTransformers(transformers ...PortTransformer) PortTransformer {
+	return PortTransformerFunc(func(discoveryID string, port *Port) *Port {
+		for _, t := range transformers {
+			if port = t.TransformPort(discoveryID, port); port == nil {
+				return nil
+			}
+		}
+		return port
+	})
+}
+
+// FilterPorts returns a PortTransformer that hides the ports for which keep
+// returns false.
+func FilterPorts(keep func(discoveryID string, port *Port) bool) PortTransformer {
+	return PortTransformerFunc(func(discoveryID string, port *Port) *Port {
+		if !keep(discoveryID, port) {
+			return nil
+		}
+		return port
+	})
+}
+
+// AllowVIDs returns a PortTransformer that hides the ports whose "vid"
+// property is not in the given list. The VIDs are compared
+// case-insensitively and the ports without a "vid" property are hidden too.
+func AllowVIDs(vids ...string) PortTransformer {
+	return FilterPorts(func(discoveryID string, port *Port) bool {
+		if port.Properties == nil {
+			return false
+		}
+		vid := port.Properties.Get("vid")
+		for _, allowed := range vids {
+			if vid != "" && strings.EqualFold(vid, allowed) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RenameLabels returns a PortTransformer that replaces the label of the
+// ports with the one returned by label.
+func RenameLabels(label func(discoveryID string, port *Port) string) PortTransformer {
+	return PortTransformerFunc(func(discoveryID string, port *Port) *Port {
+		newLabel := label(discoveryID, port)
+		if newLabel == port.AddressLabel {
+			return port
+		}
+		port = port.Clone()
+		port.AddressLabel = newLabel
+		return port
+	})
+}
+
+// InjectProperties returns a PortTransformer that adds the given properties
+// to the ports, replacing the existing ones with the same key.
+func InjectProperties(props map[string]string) PortTransformer {
+	return PortTransformerFunc(func(discoveryID string, port *Port) *Port {
+		port = port.Clone()
+		if port.Properties == nil {
+			port.Properties = properties.NewMap()
+		}
+		for key, value := range props {
+			port.Properties.Set(key, value)
+		}
+		return port
+	})
+}
+
+// RedactProperties returns a PortTransformer that removes the properties
+// with the given keys from the ports, for example "serialNumber" to avoid
+// leaking the serial numbers of the boards.
+func RedactProperties(keys ...string) PortTransformer {
+	return PortTransformerFunc(func(discoveryID string, port *Port) *Port {
+		if port.Properties == nil {
+			return port
+		}
+		redacted := port
+		for _, key := range keys {
+			if !redacted.Properties.ContainsKey(key) {
+				continue
+			}
+			if redacted == port {
+				redacted = port.Clone()
+			}
+			redacted.Properties.Remove(key)
+		}
+		return redacted
+	})
+}
+
+// HardwareIDStrategy synthesizes the hardware ID of a port that doesn't
+// report one, it returns an empty string if the port has no stable identity.
+type HardwareIDStrategy func(port *Port) string
+
+// HardwareIDFromProperties returns a HardwareIDStrategy that joins, with a
+// ":", the values of the given properties of the port, for example "vid",
+// "pid" and "serialNumber". No hardware ID is synthesized if any of the
+// properties is missing or empty.
+func HardwareIDFromProperties(keys ...string) HardwareIDStrategy {
+	return func(port *Port) string {
+		if port.Properties == nil || len(keys) == 0 {
+			return ""
+		}
+		values := make([]string, len(keys))
+		for i, key := range keys {
+			if values[i] = port.Properties.Get(key); values[i] == "" {
+				return ""
+			}
+		}
+		return strings.Join(values, ":")
+	}
+}
+
+// RequireHardwareID returns a PortTransformer that hides the ports without
+// a stable identity, that is the ports without a HardwareID (nor any of the
+// additional HardwareIDs). If synthesize is not nil, it's used to give a
+// HardwareID to the ports missing it before hiding them.
+func RequireHardwareID(synthesize HardwareIDStrategy) PortTransformer {
+	return PortTransformerFunc(func(discoveryID string, port *Port) *Port {
+		if len(port.AllHardwareIDs()) > 0 {
+			return port
+		}
+		if synthesize == nil {
+			return nil
+		}
+		id := synthesize(port)
+		if id == "" {
+			return nil
+		}
+		port = port.Clone()
+		port.HardwareID = id
+		return port
+	})
+}
@@ -0,0 +1,101 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/arduino/go-properties-orderedmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortTransformers(t *testing.T) {
+	newPort := func(vid string) *Port {
+		return &Port{
+			Address:      "/dev/ttyACM0",
+			AddressLabel: "ttyACM0",
+			Protocol:     "serial",
+			Properties: properties.NewFromHashmap(map[string]string{
+				"vid":          vid,
+				"serialNumber": "1234",
+			}),
+		}
+	}
+
+	allow := AllowVIDs("0x2341", "0x2A03")
+	require.Nil(t, allow.TransformPort("serial", newPort("0x1234")))
+	require.NotNil(t, allow.TransformPort("serial", newPort("0x2a03")))
+	require.Nil(t, allow.TransformPort("serial", &Port{Address: "1"}))
+
+	port := newPort("0x2341")
+	res := RedactProperties("serialNumber", "missing").TransformPort("serial", port)
+	require.False(t, res.Properties.ContainsKey("serialNumber"))
+	require.True(t, port.Properties.ContainsKey("serialNumber"), "the original port must not be modified")
+	require.Same(t, port, RedactProperties("missing").TransformPort("serial", port))
+
+	res = InjectProperties(map[string]string{"lab": "bench-1"}).TransformPort("serial", port)
+	require.Equal(t, "bench-1", res.Properties.Get("lab"))
+	require.False(t, port.Properties.ContainsKey("lab"))
+	res = InjectProperties(map[string]string{"lab": "bench-1"}).TransformPort("serial", &Port{Address: "1"})
+	require.Equal(t, "bench-1", res.Properties.Get("lab"))
+
+	rename := RenameLabels(func(discoveryID string, port *Port) string {
+		return discoveryID + ": " + port.AddressLabel
+	})
+	chain := ChainPortTransformers(allow, RedactProperties("serialNumber"), rename)
+	res = chain.TransformPort("serial", port)
+	require.Equal(t, "serial: ttyACM0", res.AddressLabel)
+	require.False(t, res.Properties.ContainsKey("serialNumber"))
+	require.Equal(t, "ttyACM0", port.AddressLabel)
+	require.Nil(t, chain.TransformPort("serial", newPort("0x1234")))
+
+	require.Nil(t, RequireHardwareID(nil).TransformPort("serial", port))
+	withID := &Port{Address: "1", HardwareIDs: []string{"abcd"}}
+	require.Same(t, withID, RequireHardwareID(nil).TransformPort("serial", withID))
+	synth := RequireHardwareID(HardwareIDFromProperties("vid", "serialNumber"))
+	res = synth.TransformPort("serial", port)
+	require.Equal(t, "0x2341:1234", res.HardwareID)
+	require.Empty(t, port.HardwareID, "the original port must not be modified")
+	require.Nil(t, synth.TransformPort("serial", &Port{Address: "1"}))
+	require.Nil(t, RequireHardwareID(HardwareIDFromProperties("vid", "pid")).TransformPort("serial", port))
+}
+
+func TestManagerEventProcessor(t *testing.T) {
+	hideACM0 := FilterPorts(func(discoveryID string, port *Port) bool {
+		return port.Address != "/dev/ttyACM0"
+	})
+	p := newEventProcessor(ChainPortTransformers(hideACM0, InjectProperties(map[string]string{"a": "b"})))
+	acm0 := &Port{Address: "/dev/ttyACM0", Protocol: "serial"}
+	acm1 := &Port{Address: "/dev/ttyACM1", Protocol: "serial"}
+
+	require.Nil(t, p.process(&Event{Type: "add", DiscoveryID: "serial", Port: acm0}))
+	ev := p.process(&Event{Type: "add", DiscoveryID: "serial", Port: acm1, Seq: 2})
+	require.Equal(t, "b", ev.Port.Properties.Get("a"))
+	require.Equal(t, uint64(2), ev.Seq)
+	require.Nil(t, p.process(&Event{Type: "remove", DiscoveryID: "serial", Port: &Port{Address: "/dev/ttyACM0", Protocol: "serial"}}))
+	require.NotNil(t, p.process(&Event{Type: "remove", DiscoveryID: "serial", Port: &Port{Address: "/dev/ttyACM1", Protocol: "serial"}}))
+
+	ev = p.process(&Event{Type: "snapshot", DiscoveryID: "serial", Ports: []*Port{acm0, acm1}})
+	require.Len(t, ev.Ports, 1)
+	require.Equal(t, "/dev/ttyACM1", ev.Ports[0].Address)
+	require.Nil(t, p.process(&Event{Type: "remove", DiscoveryID: "serial", Port: acm0}))
+
+	// Without transformers the events are delivered as they are
+	ev = &Event{Type: "add", DiscoveryID: "serial", Port: acm0}
+	require.Same(t, ev, newEventProcessor(nil).process(ev))
+}
@@ -0,0 +1,273 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// UserAgent is the user agent sent by the client in the HELLO command,
+// parsed following the conventions of the HTTP User-Agent header (RFC 9110):
+// a list of product tokens ("name/version"), each optionally followed by
+// comments in parentheses. The "name version" form, used by older
+// clients, is recognized too. For example "arduino-cli/1.0.0 (amd64; linux)
+// Commit:abc1234" has Product "arduino-cli", Version "1.0.0" and Extra
+// "(amd64; linux)" and "Commit:abc1234".
+type UserAgent struct {
+	// Product and Version are the first product of the user agent, Version
+	// may be empty.
+	Product string
+	Version string
+	// Extra are the following tokens, the other products and the comments
+	// (with the parentheses), in order.
+	Extra []string
+	// Raw is the user agent as sent by the client.
+	Raw string
+}
+
+// ParseUserAgent parses the given user agent. The parsing never fails:
+// an unusual user agent results in a partially filled UserAgent.
+func ParseUserAgent(userAgent string) UserAgent {
+	res := UserAgent{Raw: userAgent}
+	tokens := userAgentTokens(userAgent)
+	if len(tokens) == 0 {
+		return res
+	}
+	if name, version, ok := strings.Cut(tokens[0], "/"); ok {
+		res.Product, res.Version = name, version
+		tokens = tokens[1:]
+	} else if !strings.HasPrefix(tokens[0], "(") {
+		res.Product = tokens[0]
+		tokens = tokens[1:]
+		if len(tokens) > 0 && isVersion(tokens[0]) {
+			res.Version = tokens[0]
+			tokens = tokens[1:]
+		}
+	}
+	if len(tokens) > 0 {
+		res.Extra = tokens
+	}
+	return res
+}
+
+// userAgentTokens splits the user agent in tokens separated by spaces, the
+// comments, enclosed in (possibly nested) parentheses and possibly
+// containing escapes, are a single token.
+func userAgentTokens(userAgent string) []string {
+	tokens := []string{}
+	for s := strings.TrimSpace(userAgent); s != ""; s = strings.TrimSpace(s) {
+		end := strings.IndexAny(s, " \t(")
+		if end == 0 {
+			// A comment, up to the matching parenthesis
+			depth := 0
+			for end = 0; end < len(s); end++ {
+				if s[end] == '\\' {
+					end++
+				} else if s[end] == '(' {
+					depth++
+				} else if s[end] == ')' {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+			end = min(end+1, len(s))
+		} else if end < 0 {
+			end = len(s)
+		}
+		tokens = append(tokens, s[:end])
+		s = s[end:]
+	}
+	return tokens
+}
+
+// isVersion returns true if the token looks like a version number, like
+// "1.2.3" or "v1.2".
+func isVersion(token string) bool {
+	token = strings.TrimPrefix(token, "v")
+	return token != "" && token[0] >= '0' && token[0] <= '9'
+}
+
+// Is returns true if the product of the user agent is the given one, the
+// comparison is case-insensitive.
+func (ua UserAgent) Is(product string) bool {
+	return strings.EqualFold(ua.Product, product)
+}
+
+// OlderThan returns true if the user agent is the given product with a
+// version older than the given one, see CompareVersions. A user agent
+// without a version is not considered older. It's meant to enable the
+// workarounds for the old versions of a client, for example:
+//
+//	if ua.OlderThan("arduino-cli", "0.30.0") { ... }
+func (ua UserAgent) OlderThan(product, version string) bool {
+	return ua.Is(product) && isVersion(ua.Version) && CompareVersions(ua.Version, version) < 0
+}
+
+// String returns the user agent as sent by the client.
+func (ua UserAgent) String() string {
+	return ua.Raw
+}
+
+// CompareVersions compares two version numbers, following the semantic
+// versioning precedence, and returns -1, 0 or +1 like cmp.Compare. The
+// numbers may have a "v" prefix and any number of components (the missing
+// ones are 0), the pre-release versions ("1.0.0-rc.1") come before the
+// release, the build metadata ("+abc") is ignored.
+func CompareVersions(a, b string) int {
+	a, _, _ = strings.Cut(strings.TrimPrefix(a, "v"), "+")
+	b, _, _ = strings.Cut(strings.TrimPrefix(b, "v"), "+")
+	a, preA, hasPreA := strings.Cut(a, "-")
+	b, preB, hasPreB := strings.Cut(b, "-")
+	if c := compareIdentifiers(strings.Split(a, "."), strings.Split(b, "."), true); c != 0 {
+		return c
+	}
+	switch {
+	case hasPreA && hasPreB:
+		return compareIdentifiers(strings.Split(preA, "."), strings.Split(preB, "."), false)
+	case hasPreA:
+		return -1
+	case hasPreB:
+		return +1
+	}
+	return 0
+}
+
+// compareIdentifiers compares the dot-separated identifiers of two
+// versions: the numeric ones numerically, the other ones lexically. If pad
+// is true the missing identifiers are 0, otherwise the shorter list comes
+// first.
+func compareIdentifiers(a, b []string, pad bool) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y string
+		if i < len(a) {
+			x = a[i]
+		} else if pad {
+			x = "0"
+		} else {
+			return -1
+		}
+		if i < len(b) {
+			y = b[i]
+		} else if pad {
+			y = "0"
+		} else {
+			return +1
+		}
+		nx, errX := strconv.ParseUint(x, 10, 64)
+		ny, errY := strconv.ParseUint(y, 10, 64)
+		switch {
+		case errX == nil && errY == nil:
+			if nx != ny {
+				if nx < ny {
+					return -1
+				}
+				return +1
+			}
+		case errX == nil:
+			// Numeric identifiers come first
+			return -1
+		case errY == nil:
+			return +1
+		default:
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+// defaultUserAgent is the user agent sent by the Client if not set with
+// Client.SetUserAgent or Client.SetUserAgentProduct.
+const defaultUserAgent = "arduino-cli pluggable-discovery-protocol-handler"
+
+// formatUserAgent returns the user agent for the HELLO command with the
+// given product, version and extra tokens.
+func formatUserAgent(product, version string, extra []string) string {
+	product = userAgentToken(product)
+	if product == "" {
+		return defaultUserAgent
+	}
+	res := product
+	if version = userAgentToken(version); version != "" {
+		res += "/" + version
+	}
+	for _, token := range extra {
+		if token = strings.TrimSpace(userAgentText(token)); token != "" {
+			res += " " + token
+		}
+	}
+	return res
+}
+
+// userAgentText returns the given text with the quotes, that would
+// terminate the user agent, and the control characters, that would
+// terminate the command, replaced by spaces.
+func userAgentText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// userAgentToken returns the given product name or version with the
+// characters not allowed in a token (RFC 9110) replaced by "-".
+func userAgentToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r > ' ' && r != 0x7f && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return r
+		}
+		return '-'
+	}, strings.TrimSpace(s))
+}
+
+type userAgentKey struct{}
+
+// UserAgentFromContext returns the user agent of the client, parsed from the
+// HELLO command. The contexts passed to the methods of a ContextDiscovery,
+// starting from Hello, hold the user agent of the session.
+func UserAgentFromContext(ctx context.Context) (UserAgent, bool) {
+	ua, ok := ctx.Value(userAgentKey{}).(UserAgent)
+	return ua, ok
+}
+
+// UserAgent returns the user agent of the current session, parsed from the
+// HELLO command. It's empty before HELLO.
+func (d *Server) UserAgent() UserAgent {
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	return d.userAgent
+}
+
+// setUserAgent sets the user agent of the session and returns the session
+// context holding it.
+func (d *Server) setUserAgent(ua UserAgent) context.Context {
+	d.ctxMutex.Lock()
+	defer d.ctxMutex.Unlock()
+	d.userAgent = ua
+	if d.sessionCtx == nil {
+		d.sessionCtx = context.Background()
+	}
+	d.sessionCtx = context.WithValue(d.sessionCtx, userAgentKey{}, ua)
+	return d.sessionCtx
+}
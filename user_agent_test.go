@@ -0,0 +1,157 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		in      string
+		product string
+		version string
+		extra   []string
+	}{
+		{in: "arduino-cli/1.0.0 (amd64; linux; go1.21) Commit:abc1234", product: "arduino-cli", version: "1.0.0",
+			extra: []string{"(amd64; linux; go1.21)", "Commit:abc1234"}},
+		{in: "arduino-cli 0.35.3", product: "arduino-cli", version: "0.35.3"},
+		{in: "arduino-cli pluggable-discovery-protocol-handler", product: "arduino-cli",
+			extra: []string{"pluggable-discovery-protocol-handler"}},
+		{in: "arduino-ide/2.3.2 (nested (comment \\) here)) arduino-cli/1.0.0", product: "arduino-ide", version: "2.3.2",
+			extra: []string{"(nested (comment \\) here))", "arduino-cli/1.0.0"}},
+		{in: "  tool   v2 ", product: "tool", version: "v2"},
+		{in: "(only a comment) x", extra: []string{"(only a comment)", "x"}},
+		{in: "broken (comment", product: "broken", extra: []string{"(comment"}},
+		{in: "ツール/1.0(注釈)", product: "ツール", version: "1.0", extra: []string{"(注釈)"}},
+		{in: ""},
+	}
+	for _, test := range tests {
+		ua := ParseUserAgent(test.in)
+		require.Equal(t, test.product, ua.Product, test.in)
+		require.Equal(t, test.version, ua.Version, test.in)
+		require.Equal(t, test.extra, ua.Extra, test.in)
+		require.Equal(t, test.in, ua.String())
+	}
+
+	ua := ParseUserAgent("Arduino-CLI/0.29.0-rc.1")
+	require.True(t, ua.Is("arduino-cli"))
+	require.True(t, ua.OlderThan("arduino-cli", "0.29.0"))
+	require.False(t, ua.OlderThan("arduino-cli", "0.29.0-alpha"))
+	require.False(t, ua.OlderThan("arduino-ide", "3.0.0"))
+	require.False(t, ParseUserAgent("arduino-cli dev").OlderThan("arduino-cli", "1.0.0"))
+}
+
+func TestCompareSemanticVersions(t *testing.T) {
+	ordered := []string{
+		"0.9", "v0.10.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.10",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			require.Equal(t, expected, CompareVersions(ordered[i], ordered[j]), "%s vs %s", ordered[i], ordered[j])
+		}
+	}
+	require.Zero(t, CompareVersions("1.0", "v1.0.0+build.5"))
+}
+
+// userAgentDiscovery records the user agents available in the methods.
+type userAgentDiscovery struct {
+	testContextDiscovery
+	server    *Server
+	helloUA   UserAgent
+	syncUA    UserAgent
+	serverUA  UserAgent
+	hasSyncUA bool
+	hellos    chan UserAgent
+}
+
+func (d *userAgentDiscovery) Hello(ctx context.Context, userAgent string, protocolVersion int) error {
+	d.helloUA, _ = UserAgentFromContext(ctx)
+	d.serverUA = d.server.UserAgent()
+	if d.hellos != nil {
+		d.hellos <- d.helloUA
+	}
+	return nil
+}
+
+func (d *userAgentDiscovery) StartSync(ctx context.Context, eventCB SyncEventCallback, errorCB ErrorCallback) error {
+	d.syncUA, d.hasSyncUA = UserAgentFromContext(ctx)
+	return d.testContextDiscovery.StartSync(ctx, eventCB, errorCB)
+}
+
+func TestServerUserAgent(t *testing.T) {
+	impl := &userAgentDiscovery{}
+	impl.server = NewContextServer(impl)
+	_, ok := UserAgentFromContext(context.Background())
+	require.False(t, ok)
+	require.Empty(t, impl.server.UserAgent())
+
+	in := strings.NewReader("HELLO 1 \"arduino-cli/1.0.0 (linux)\"\nSTART_SYNC\nSTOP\nQUIT\n")
+	require.NoError(t, impl.server.Run(in, &bytes.Buffer{}))
+	expected := UserAgent{Product: "arduino-cli", Version: "1.0.0", Extra: []string{"(linux)"}, Raw: "arduino-cli/1.0.0 (linux)"}
+	require.Equal(t, expected, impl.helloUA)
+	require.Equal(t, expected, impl.serverUA)
+	require.True(t, impl.hasSyncUA)
+	require.Equal(t, expected, impl.syncUA)
+}
+
+func TestClientUserAgent(t *testing.T) {
+	require.Equal(t, "arduino-ide/2.3.2 (linux; amd64)", formatUserAgent("arduino-ide", "2.3.2", []string{"(linux; amd64)"}))
+	require.Equal(t, "my-ide", formatUserAgent(" my ide ", "", nil))
+	require.Equal(t, `a-b-c/1.0-beta x  y`, formatUserAgent(`a"b/c`, "1.0 beta", []string{"\"\n", `  x "y" `}))
+	require.Equal(t, defaultUserAgent, formatUserAgent("", "1.0", nil))
+
+	impl := &userAgentDiscovery{hellos: make(chan UserAgent, 1)}
+	impl.server = NewContextServer(impl)
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		_ = impl.server.Run(serverConn, serverConn)
+	}()
+	disc := NewConnClient("test", func() (io.ReadWriteCloser, error) { return clientConn, nil })
+	disc.SetUserAgentProduct("my ide", "2.0", `(linux; "quoted")`, "line\nbreak")
+	require.NoError(t, disc.Run())
+	disc.Quit()
+	require.Equal(t, UserAgent{
+		Product: "my-ide",
+		Version: "2.0",
+		Extra:   []string{"(linux;  quoted )", "line", "break"},
+		Raw:     "my-ide/2.0 (linux;  quoted ) line break",
+	}, <-impl.hellos)
+	// The plain user agent is sent with the "arduino-cli" prefix
+	disc = NewClient("test")
+	require.Equal(t, "arduino-cli pluggable-discovery-protocol-handler", disc.userAgent)
+	disc.SetUserAgent("my-tool 1.0")
+	require.Equal(t, "arduino-cli my-tool 1.0", disc.userAgent)
+	disc.SetUserAgent("my \"tool\"\n1.0")
+	require.Equal(t, "arduino-cli my  tool  1.0", disc.userAgent)
+}
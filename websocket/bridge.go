@@ -0,0 +1,281 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+// Package websocket provides a bridge to expose the events of a pluggable
+// discovery Client (or Manager) to browser-based consumers, like web IDEs,
+// over a WebSocket connection.
+//
+// Each message sent by the bridge is a JSON object similar to the ones of
+// the pluggable discovery protocol, for example:
+//
+//	{ "eventType": "add", "discoveryId": "serial", "port": { ... } }
+//
+// Upon connection the bridge sends a "list" message with all the ports
+// currently available, followed by the "add" and "remove" events. The
+// "moved" events also carry the "oldPort" replaced by the "port". The
+// consumer may send a {"command": "LIST"} message to get the list again.
+package websocket
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// Source is a discovery that can be exposed by a Bridge. It is implemented
+// by discovery.Client, use ManagerSource to expose a discovery.Manager.
+type Source interface {
+	StartSync(size int) (<-chan *discovery.Event, error)
+	Stop() error
+}
+
+// ManagerSource returns a Source for the given discovery.Manager.
+func ManagerSource(m *discovery.Manager) Source {
+	return &managerSource{m}
+}
+
+type managerSource struct {
+	manager *discovery.Manager
+}
+
+func (s *managerSource) StartSync(size int) (<-chan *discovery.Event, error) {
+	events, errs := s.manager.StartSync(size)
+	return events, errors.Join(errs...)
+}
+
+func (s *managerSource) Stop() error {
+	return errors.Join(s.manager.Stop()...)
+}
+
+// message is a message sent to, or received from, the WebSocket consumer.
+type message struct {
+	EventType   string            `json:"eventType,omitempty"`
+	DiscoveryID string            `json:"discoveryId,omitempty"`
+	Port        *discovery.Port   `json:"port,omitempty"`
+	OldPort     *discovery.Port   `json:"oldPort,omitempty"`
+	Ports       []*discovery.Port `json:"ports,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Error       bool              `json:"error,omitempty"`
+	Command     string            `json:"command,omitempty"`
+}
+
+// subscriberBacklog is the number of messages that can be queued for a
+// consumer, slower consumers are disconnected.
+const subscriberBacklog = 100
+
+// Bridge exposes the events of a Source to WebSocket consumers. Bridge
+// implements http.Handler: each request is upgraded to a WebSocket
+// connection that receives the events.
+type Bridge struct {
+	source    Source
+	upgrader  gorilla.Upgrader
+	authToken string
+
+	mutex       sync.Mutex
+	ports       *discovery.PortTracker
+	subscribers map[chan *message]struct{}
+	running     bool
+}
+
+// NewBridge creates a new Bridge for the given Source. The Bridge must be
+// started with Start.
+func NewBridge(source Source) *Bridge {
+	return &Bridge{
+		source:      source,
+		ports:       discovery.NewPortTracker(),
+		subscribers: map[chan *message]struct{}{},
+	}
+}
+
+// SetCheckOrigin sets the function used to validate the Origin header of the
+// WebSocket requests, see gorilla/websocket Upgrader.CheckOrigin. By default
+// only same-origin requests are accepted.
+func (b *Bridge) SetCheckOrigin(checkOrigin func(r *http.Request) bool) {
+	b.upgrader.CheckOrigin = checkOrigin
+}
+
+// SetAuthToken sets a token that the consumers must provide to connect,
+// either as a bearer token in the Authorization header or, since browsers
+// can't set headers on WebSocket connections, in the "token" query
+// parameter. The requests without a valid token are rejected with
+// 401 Unauthorized. A Bridge exposed on the network should also be served
+// with TLS, for example using http.ListenAndServeTLS.
+func (b *Bridge) SetAuthToken(token string) {
+	b.authToken = token
+}
+
+// authorized checks the token provided in the request.
+func (b *Bridge) authorized(r *http.Request) bool {
+	if b.authToken == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.authToken)) == 1
+}
+
+// Start puts the Source in "events" mode and starts forwarding the events to
+// the consumers. When the events channel of the Source is closed all the
+// consumers are disconnected.
+func (b *Bridge) Start() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.running {
+		return errors.New("bridge already started")
+	}
+	events, err := b.source.StartSync(subscriberBacklog)
+	if events == nil {
+		return err
+	}
+	b.running = true
+	go b.forwardEvents(events)
+	return err
+}
+
+// Stop stops the Source, the consumers are disconnected.
+func (b *Bridge) Stop() error {
+	return b.source.Stop()
+}
+
+func (b *Bridge) forwardEvents(events <-chan *discovery.Event) {
+	for ev := range events {
+		b.mutex.Lock()
+		msg := b.handleEvent(ev)
+		for sub := range b.subscribers {
+			b.sendLocked(sub, msg)
+		}
+		b.mutex.Unlock()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.running = false
+	b.ports.Clear()
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub)
+	}
+}
+
+// handleEvent updates the ports list with the given event and returns the
+// message to send to the consumers. mutex must be held by the caller.
+func (b *Bridge) handleEvent(ev *discovery.Event) *message {
+	b.ports.Track(ev)
+	return &message{
+		EventType:   ev.Type,
+		DiscoveryID: ev.DiscoveryID,
+		Port:        ev.Port,
+		OldPort:     ev.OldPort,
+		Ports:       ev.Ports,
+	}
+}
+
+// list returns a "list" message with all the known ports. mutex must be
+// held by the caller.
+func (b *Bridge) list() *message {
+	return &message{EventType: "list", Ports: b.ports.AllPorts()}
+}
+
+// sendLocked queues the message for the given consumer, if the consumer is
+// too slow it's disconnected. mutex must be held by the caller.
+func (b *Bridge) sendLocked(sub chan *message, msg *message) {
+	select {
+	case sub <- msg:
+	default:
+		delete(b.subscribers, sub)
+		close(sub)
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and sends the
+// discovery events until the connection is closed.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !b.authorized(r) {
+		http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied with an HTTP error
+		return
+	}
+	defer conn.Close()
+
+	sub := make(chan *message, subscriberBacklog)
+	b.mutex.Lock()
+	if !b.running {
+		b.mutex.Unlock()
+		_ = conn.WriteJSON(&message{EventType: "error", Error: true, Message: "discovery not running"})
+		return
+	}
+	b.subscribers[sub] = struct{}{}
+	b.sendLocked(sub, b.list())
+	b.mutex.Unlock()
+
+	// Read the commands of the consumer
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var cmd message
+			if err := conn.ReadJSON(&cmd); err != nil {
+				return
+			}
+			b.mutex.Lock()
+			if _, ok := b.subscribers[sub]; ok {
+				if cmd.Command == "LIST" {
+					b.sendLocked(sub, b.list())
+				} else {
+					b.sendLocked(sub, &message{EventType: "command_error", Error: true, Message: "Command " + cmd.Command + " not supported"})
+				}
+			}
+			b.mutex.Unlock()
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-sub:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(msg); err != nil {
+				b.unsubscribe(sub)
+				return
+			}
+		case <-closed:
+			b.unsubscribe(sub)
+			return
+		}
+	}
+}
+
+func (b *Bridge) unsubscribe(sub chan *message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub)
+	}
+}
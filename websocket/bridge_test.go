@@ -0,0 +1,165 @@
+//
+// This file is part of pluggable-discovery-protocol-handler.
+//
+// Copyright 2024 ARDUINO SA (http://www.arduino.cc/)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-cli.
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to modify or
+// otherwise use the software for commercial activities involving the Arduino
+// software without disclosing the source code of your own applications. To purchase
+// a commercial license, send an email to license@arduino.cc.
+//
+
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	discovery "github.com/arduino/pluggable-discovery-protocol-handler/v2"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+type testSource struct {
+	events chan *discovery.Event
+}
+
+func (s *testSource) StartSync(size int) (<-chan *discovery.Event, error) {
+	s.events = make(chan *discovery.Event, size)
+	return s.events, nil
+}
+
+func (s *testSource) Stop() error {
+	close(s.events)
+	return nil
+}
+
+func TestBridge(t *testing.T) {
+	source := &testSource{}
+	bridge := NewBridge(source)
+	server := httptest.NewServer(bridge)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func() *gorilla.Conn {
+		conn, _, err := gorilla.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	read := func(conn *gorilla.Conn) *message {
+		var msg message
+		require.NoError(t, conn.ReadJSON(&msg))
+		return &msg
+	}
+
+	// Not started yet
+	msg := read(dial())
+	require.True(t, msg.Error)
+	require.Equal(t, "discovery not running", msg.Message)
+
+	require.NoError(t, bridge.Start())
+	require.Error(t, bridge.Start())
+	conn := dial()
+	msg = read(conn)
+	require.Equal(t, "list", msg.EventType)
+	require.Empty(t, msg.Ports)
+
+	port := &discovery.Port{Address: "/dev/ttyACM0", Protocol: "serial"}
+	source.events <- &discovery.Event{Type: "add", DiscoveryID: "serial", Port: port}
+	msg = read(conn)
+	require.Equal(t, "add", msg.EventType)
+	require.Equal(t, "serial", msg.DiscoveryID)
+	require.Equal(t, "/dev/ttyACM0", msg.Port.Address)
+
+	// A new consumer receives the ports already available
+	conn2 := dial()
+	msg = read(conn2)
+	require.Equal(t, "list", msg.EventType)
+	require.Len(t, msg.Ports, 1)
+
+	require.NoError(t, conn.WriteJSON(&message{Command: "LIST"}))
+	msg = read(conn)
+	require.Equal(t, "list", msg.EventType)
+	require.Len(t, msg.Ports, 1)
+	require.NoError(t, conn.WriteJSON(&message{Command: "START"}))
+	msg = read(conn)
+	require.Equal(t, "command_error", msg.EventType)
+	require.True(t, msg.Error)
+
+	source.events <- &discovery.Event{Type: "remove", DiscoveryID: "serial", Port: port}
+	require.Equal(t, "remove", read(conn).EventType)
+	require.Equal(t, "remove", read(conn2).EventType)
+	require.NoError(t, conn.WriteJSON(&message{Command: "LIST"}))
+	require.Empty(t, read(conn).Ports)
+
+	// A "moved" event replaces the old port, and "resynced" drops the ports
+	// that are going to be reported again
+	moved := &discovery.Port{Address: "/dev/ttyACM1", Protocol: "serial"}
+	source.events <- &discovery.Event{Type: "add", DiscoveryID: "serial", Port: port}
+	source.events <- &discovery.Event{Type: "moved", DiscoveryID: "serial", Port: moved, OldPort: port}
+	require.Equal(t, "add", read(conn).EventType)
+	msg = read(conn)
+	require.Equal(t, "moved", msg.EventType)
+	require.Equal(t, "/dev/ttyACM1", msg.Port.Address)
+	require.Equal(t, "/dev/ttyACM0", msg.OldPort.Address)
+	require.NoError(t, conn.WriteJSON(&message{Command: "LIST"}))
+	msg = read(conn)
+	require.Len(t, msg.Ports, 1)
+	require.Equal(t, "/dev/ttyACM1", msg.Ports[0].Address)
+	source.events <- &discovery.Event{Type: "resynced", DiscoveryID: "serial"}
+	require.Equal(t, "resynced", read(conn).EventType)
+	require.NoError(t, conn.WriteJSON(&message{Command: "LIST"}))
+	require.Empty(t, read(conn).Ports)
+	for i := 0; i < 3; i++ {
+		read(conn2)
+	}
+
+	// Stopping the source disconnects the consumers
+	require.NoError(t, bridge.Stop())
+	var m message
+	require.Error(t, conn.ReadJSON(&m))
+	require.Error(t, conn2.ReadJSON(&m))
+}
+
+func TestBridgeAuthToken(t *testing.T) {
+	source := &testSource{}
+	bridge := NewBridge(source)
+	bridge.SetAuthToken("secret")
+	require.NoError(t, bridge.Start())
+	defer bridge.Stop()
+	server := httptest.NewServer(bridge)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := gorilla.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	_, resp, err = gorilla.DefaultDialer.Dial(url+"?token=wrong", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	for _, dial := range []func() (*gorilla.Conn, *http.Response, error){
+		func() (*gorilla.Conn, *http.Response, error) {
+			return gorilla.DefaultDialer.Dial(url+"?token=secret", nil)
+		},
+		func() (*gorilla.Conn, *http.Response, error) {
+			return gorilla.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer secret"}})
+		},
+	} {
+		conn, _, err := dial()
+		require.NoError(t, err)
+		var msg message
+		require.NoError(t, conn.ReadJSON(&msg))
+		require.Equal(t, "list", msg.EventType)
+		conn.Close()
+	}
+}